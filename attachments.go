@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// attachmentImageTypes are the image attachments -render-attachments shows,
+// the formats every Chrome decodes
+var attachmentImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// pdfMIMEType is the content type of PDF attachments
+const pdfMIMEType = "application/pdf"
+
+// pdfAttachmentHeight is the height in CSS pixels a PDF attachment is shown
+// at: one US Letter page at 96 DPI, so the screenshot shows its first page
+const pdfAttachmentHeight = 1056
+
+// renderableAttachments returns the attachments of email that can be
+// screenshotted: images and PDFs
+func renderableAttachments(email Email) []BodyPart {
+	var parts []BodyPart
+	for _, part := range email.Attachments {
+		mimeType := strings.ToLower(part.Type)
+		if part.BlobID != "" && (attachmentImageTypes[mimeType] || mimeType == pdfMIMEType) {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// attachmentHTML returns the HTML showing an attachment's content: an image
+// inline, or a PDF's first page in Chrome's PDF viewer
+func attachmentHTML(part BodyPart, data []byte) string {
+	mimeType := strings.ToLower(part.Type)
+	dataURL := "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	if mimeType == pdfMIMEType {
+		return fmt.Sprintf(`<embed src="%s#page=1&toolbar=0" type="%s" style="display: block; width: 100%%; height: %dpx; border: 0;">`,
+			dataURL, pdfMIMEType, pdfAttachmentHeight)
+	}
+	return fmt.Sprintf(`<img src="%s" alt="%s">`, dataURL, html.EscapeString(part.Name))
+}
+
+// attachmentEmail returns email under the ID its nth (1-based) attachment's
+// screenshot is named after, so it lands next to the email's own
+func attachmentEmail(email Email, n int) Email {
+	email.ID = fmt.Sprintf("%s.attachment-%d", email.ID, n)
+	return email
+}
+
+// renderAttachments screenshots each image and PDF attachment of email as a
+// numbered file next to its screenshot, returning the paths written
+func (p *processor) renderAttachments(email Email, subdir string, output io.Writer) ([]string, error) {
+	var paths []string
+	for i, part := range renderableAttachments(email) {
+		name := part.Name
+		if name == "" {
+			name = part.Type
+		}
+		if part.Size > maxBlobBytes {
+			fmt.Fprintf(output, "  ↷ Attachment %q is %s, too large to render, skipping\n", name, formatBytes(part.Size))
+			continue
+		}
+
+		data, err := p.client.DownloadBlob(part.BlobID, part.Type, part.Name)
+		if err != nil {
+			return paths, fmt.Errorf("failed to download attachment %q: %w", name, err)
+		}
+
+		if err := p.tabs.Acquire(p.ctx); err != nil {
+			return paths, err
+		}
+		path, err := generateScreenshotWithRetry(p.ctx, p.generator, subdir, attachmentEmail(email, i+1), attachmentHTML(part, data), p.opts.ScreenshotRetries, output)
+		p.tabs.Release()
+		if err != nil {
+			return paths, fmt.Errorf("failed to render attachment %q: %w", name, err)
+		}
+		fmt.Fprintf(output, "  ✓ Attachment rendered: %s\n", path)
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
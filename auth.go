@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Auth modes for the -auth flag
+const (
+	AuthBearer = "bearer" // API token (Fastmail)
+	AuthBasic  = "basic"  // Username and password (e.g. self-hosted Stalwart or Cyrus)
+)
+
+// Authenticator adds credentials to an outgoing JMAP request. The same
+// Authenticator is used for session discovery and every API call.
+type Authenticator interface {
+	Authorize(req *http.Request)
+}
+
+// RefreshingAuthenticator is an Authenticator whose credentials can be
+// renewed, such as an OAuth token source. When the API rejects a request,
+// Refresh is called once and the request retried with the new credentials.
+// Concurrent requests may call Refresh at the same time.
+type RefreshingAuthenticator interface {
+	Authenticator
+	Refresh() error
+}
+
+// BearerAuth authenticates with an API token
+type BearerAuth struct {
+	Token string
+}
+
+// Authorize sets an "Authorization: Bearer" header
+func (a BearerAuth) Authorize(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+}
+
+// BasicAuth authenticates with HTTP Basic credentials
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authorize sets an "Authorization: Basic" header
+func (a BasicAuth) Authorize(req *http.Request) {
+	req.SetBasicAuth(a.Username, a.Password)
+}
+
+// authSchemes returns the auth schemes offered by a 401's WWW-Authenticate
+// headers, lowercased, in order. Each challenge starts with its scheme and
+// the parameters that follow contain "=", which is enough to tell them apart
+// short of a quoted parameter containing a comma.
+func authSchemes(challenges []string) []string {
+	var schemes []string
+	for _, challenge := range challenges {
+		for _, item := range strings.Split(challenge, ",") {
+			fields := strings.Fields(item)
+			if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+				schemes = append(schemes, strings.ToLower(fields[0]))
+			}
+		}
+	}
+	return schemes
+}
+
+// authHint explains a 401 from the WWW-Authenticate challenges: which scheme
+// the server expects, and the -auth mode to use when it isn't the one auth
+// sent. It is empty when the server names no scheme.
+func authHint(challenges []string, auth Authenticator) string {
+	schemes := authSchemes(challenges)
+	if len(schemes) == 0 {
+		return ""
+	}
+
+	var sent string
+	switch auth.(type) {
+	case BearerAuth:
+		sent = AuthBearer
+	case BasicAuth:
+		sent = AuthBasic
+	}
+	for _, scheme := range schemes {
+		if scheme == sent {
+			return fmt.Sprintf("server expects %s auth; check the credentials", authSchemeName(scheme))
+		}
+	}
+	for _, scheme := range schemes {
+		if scheme == AuthBearer || scheme == AuthBasic {
+			return fmt.Sprintf("server expects %s auth; pass -auth %s", authSchemeName(scheme), scheme)
+		}
+	}
+	return fmt.Sprintf("server expects %s auth, which isn't supported", authSchemeName(schemes[0]))
+}
+
+// authSchemeName returns a lowercased auth scheme as usually written
+func authSchemeName(scheme string) string {
+	return strings.ToUpper(scheme[:1]) + scheme[1:]
+}
+
+// newAuthenticator returns the Authenticator for an auth mode, checking the
+// credentials that mode needs are present
+func newAuthenticator(mode, apiKey, username, password string) (Authenticator, error) {
+	switch mode {
+	case AuthBearer:
+		if apiKey == "" {
+			return nil, fmt.Errorf("FASTMAIL_AAR_KEY environment variable is required")
+		}
+		return BearerAuth{Token: apiKey}, nil
+	case AuthBasic:
+		if username == "" || password == "" {
+			return nil, fmt.Errorf("-auth basic requires -username and -password (or AAR_USERNAME and AAR_PASSWORD)")
+		}
+		return BasicAuth{Username: username, Password: password}, nil
+	default:
+		return nil, fmt.Errorf("invalid -auth %q: expected %s or %s", mode, AuthBearer, AuthBasic)
+	}
+}
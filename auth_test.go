@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test basic auth credentials are sent for session discovery and API calls
+func TestBasicAuth_SessionAndAPI(t *testing.T) {
+	var checked []string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	requireBasic := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "alice" || pass != "s3cret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			checked = append(checked, r.URL.Path)
+			next(w, r)
+		}
+	}
+	mux.HandleFunc("/session", requireBasic(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"primaryAccounts":{"urn:ietf:params:jmap:mail":"acc1"},"apiUrl":"` + server.URL + `/api"}`))
+	}))
+	mux.HandleFunc("/api", requireBasic(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Email/query",{"ids":["M1"]},"0"]]}`))
+	}))
+
+	client := &JMAPClient{
+		auth:       BasicAuth{Username: "alice", Password: "s3cret"},
+		sessionURL: server.URL + "/session",
+		httpClient: server.Client(),
+	}
+	if err := client.authenticate(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, _, err := client.GetEmailsInMailbox("mb1", QueryOptions{}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(checked) != 2 || checked[0] != "/session" || checked[1] != "/api" {
+		t.Errorf("Expected basic auth on /session and /api, got %v", checked)
+	}
+
+	// Wrong credentials are rejected at session discovery
+	client.auth = BasicAuth{Username: "alice", Password: "wrong"}
+	if err := client.authenticate(); err == nil {
+		t.Error("Expected authentication failure with the wrong password")
+	}
+}
+
+// Test the auth mode selects the credentials it needs
+func TestNewAuthenticator(t *testing.T) {
+	auth, err := newAuthenticator(AuthBearer, "token", "", "")
+	if err != nil || auth != (BearerAuth{Token: "token"}) {
+		t.Errorf("Expected bearer auth, got %v, %v", auth, err)
+	}
+
+	auth, err = newAuthenticator(AuthBasic, "", "alice", "s3cret")
+	if err != nil || auth != (BasicAuth{Username: "alice", Password: "s3cret"}) {
+		t.Errorf("Expected basic auth, got %v, %v", auth, err)
+	}
+
+	for _, tc := range []struct{ mode, key, user, pass string }{
+		{AuthBearer, "", "", ""},
+		{AuthBasic, "", "alice", ""},
+		{"digest", "token", "", ""},
+	} {
+		if _, err := newAuthenticator(tc.mode, tc.key, tc.user, tc.pass); err == nil {
+			t.Errorf("Expected error for %+v", tc)
+		}
+	}
+}
+
+// Test a 401 names the auth scheme the server's WWW-Authenticate asks for
+func TestAuthenticate_WWWAuthenticateHint(t *testing.T) {
+	tests := []struct {
+		challenge string
+		auth      Authenticator
+		expected  string
+	}{
+		{`Basic realm="JMAP"`, BearerAuth{Token: "token"}, "server expects Basic auth; pass -auth basic"},
+		{`Bearer realm="JMAP", error="invalid_token"`, BasicAuth{Username: "alice", Password: "s3cret"}, "server expects Bearer auth; pass -auth bearer"},
+		{`Bearer, Basic realm="JMAP"`, BasicAuth{Username: "alice", Password: "wrong"}, "server expects Basic auth; check the credentials"},
+		{`Negotiate`, BearerAuth{Token: "token"}, "server expects Negotiate auth, which isn't supported"},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("WWW-Authenticate", tt.challenge)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}))
+		client := &JMAPClient{auth: tt.auth, sessionURL: server.URL, httpClient: server.Client()}
+
+		err := client.authenticate()
+		server.Close()
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.challenge, tt.expected, err)
+		}
+		if !IsAuthError(err) {
+			t.Errorf("%s: expected an auth error, got: %v", tt.challenge, err)
+		}
+	}
+}
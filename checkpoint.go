@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Checkpoint records how far through the source folder a -checkpoint run
+// got: every email listed up to and including EmailID was completed
+type Checkpoint struct {
+	Key       string `json:"key"`       // syncStateKey of the source folder
+	EmailID   string `json:"emailId"`   // Last email of the completed run of emails
+	Completed int    `json:"completed"` // Emails completed in the run that wrote it
+}
+
+// loadCheckpoint returns the last completed email recorded in the checkpoint
+// at path, or "" if there is no checkpoint yet. A checkpoint written for
+// another folder or account is an error rather than silently ignored.
+func loadCheckpoint(path, key string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return "", fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	if checkpoint.Key != key {
+		return "", fmt.Errorf("checkpoint %s is for another folder or account", path)
+	}
+	return checkpoint.EmailID, nil
+}
+
+// resumeAfter drops the emails up to and including emailID from emailIDs,
+// reporting what it skipped. If emailID isn't listed, which is usual once
+// completed emails have been moved out of the folder, nothing is dropped.
+func resumeAfter(emailIDs []string, emailID string, output io.Writer) []string {
+	if emailID == "" {
+		return emailIDs
+	}
+	for i, id := range emailIDs {
+		if id == emailID {
+			fmt.Fprintf(output, "Resuming from checkpoint: skipping %d email(s) up to %s\n", i+1, emailID)
+			return emailIDs[i+1:]
+		}
+	}
+	return emailIDs
+}
+
+// checkpointer advances a -checkpoint file as emails complete. Emails can
+// finish out of order, so it records the end of the unbroken run of
+// completed emails from the start of the list; a failed email holds it back.
+// It is used from the collecting goroutine only.
+type checkpointer struct {
+	path     string
+	key      string
+	emailIDs []string
+	done     []bool
+	next     int // Index of the first email not yet completed
+}
+
+// newCheckpointer returns a checkpointer for a run over emailIDs, or nil
+// when path is empty
+func newCheckpointer(path, key string, emailIDs []string) *checkpointer {
+	if path == "" {
+		return nil
+	}
+	return &checkpointer{path: path, key: key, emailIDs: emailIDs, done: make([]bool, len(emailIDs))}
+}
+
+// complete records r, saving the checkpoint if it moved forward. Failed
+// emails and emails left for a later run aren't complete.
+func (c *checkpointer) complete(r emailResult) error {
+	if c == nil || r.status == statusFailed || r.deferred {
+		return nil
+	}
+	c.done[r.index] = true
+
+	start := c.next
+	for c.next < len(c.done) && c.done[c.next] {
+		c.next++
+	}
+	if c.next == start {
+		return nil
+	}
+
+	checkpoint := Checkpoint{Key: c.key, EmailID: c.emailIDs[c.next-1], Completed: c.next}
+	return writeAtomic(c.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(checkpoint)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingOnScreenshotService fails the screenshot of one email
+type failingOnScreenshotService struct {
+	*MockScreenshotService
+	failOn string
+}
+
+func (f failingOnScreenshotService) GenerateScreenshot(subdir, timestamp, emailID, htmlContent string) (string, error) {
+	if emailID == f.failOn {
+		return "", &permanentError{errors.New("chrome crashed")}
+	}
+	return f.MockScreenshotService.GenerateScreenshot(subdir, timestamp, emailID, htmlContent)
+}
+
+// Test a run stopped part way resumes after the last completed email,
+// without redoing the emails before it
+func TestProcessEmails_CheckpointResume(t *testing.T) {
+	client := newSingleEmailClient()
+	for _, id := range []string{"email2", "email3", "email4"} {
+		addHTMLEmail(client, id, "<p>"+id+"</p>")
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	opts := ProcessOptions{Checkpoint: path, ArchiveMode: ArchiveNone, FailFast: true}
+
+	// The first run stops at email3
+	first := failingOnScreenshotService{NewMockScreenshotService(), "email3"}
+	var output bytes.Buffer
+	if _, err := processEmails(client, first, opts, &output); err == nil {
+		t.Fatal("Expected the first run to stop at email3")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected a checkpoint, got: %v", err)
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil || checkpoint.EmailID != "email2" || checkpoint.Completed != 2 {
+		t.Errorf("Expected a checkpoint at email2, got %+v, %v", checkpoint, err)
+	}
+
+	second := NewMockScreenshotService()
+	output.Reset()
+	result, err := processEmails(client, second, opts, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.TotalCount != 2 || result.ProcessedCount != 2 {
+		t.Errorf("Expected only email3 and email4 processed, got %+v", result)
+	}
+	for _, id := range []string{"email1", "email2"} {
+		if _, ok := second.rendered[id]; ok {
+			t.Errorf("Expected %s not to be redone", id)
+		}
+	}
+	if !strings.Contains(output.String(), "skipping 2 email(s) up to email2") {
+		t.Errorf("Expected the resumption noted, got:\n%s", output.String())
+	}
+	if emailID, _ := loadCheckpoint(path, checkpoint.Key); emailID != "email4" {
+		t.Errorf("Expected the checkpoint at email4, got %q", emailID)
+	}
+}
+
+// Test the checkpoint only moves past emails completed in list order
+func TestCheckpointer_OutOfOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	c := newCheckpointer(path, "acc:src", []string{"a", "b", "c", "d"})
+
+	steps := []struct {
+		result   emailResult
+		expected string
+	}{
+		{emailResult{index: 1, id: "b", status: statusProcessed}, ""},
+		{emailResult{index: 0, id: "a", status: statusSkipped}, "b"},
+		{emailResult{index: 3, id: "d", status: statusProcessed}, "b"},
+		{emailResult{index: 2, id: "c", status: statusFailed}, "b"},
+	}
+	for _, step := range steps {
+		if err := c.complete(step.result); err != nil {
+			t.Fatalf("Failed to save checkpoint: %v", err)
+		}
+		if emailID, _ := loadCheckpoint(path, "acc:src"); emailID != step.expected {
+			t.Errorf("After %s: expected checkpoint %q, got %q", step.result.id, step.expected, emailID)
+		}
+	}
+}
+
+// Test a checkpoint from another folder or account is refused
+func TestLoadCheckpoint_OtherFolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := os.WriteFile(path, []byte(`{"key": "acc:other", "emailId": "a"}`), 0644); err != nil {
+		t.Fatalf("Failed to write checkpoint: %v", err)
+	}
+	if _, err := loadCheckpoint(path, "acc:src"); err == nil {
+		t.Error("Expected error for another folder's checkpoint")
+	}
+}
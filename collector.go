@@ -0,0 +1,153 @@
+package main
+
+import "time"
+
+// emailResult is everything a worker reports about one finished email. Workers
+// only build results; the collector is the single place they are counted and
+// their output written.
+type emailResult struct {
+	index    int           // Position in the run's list of emails
+	id       string        // Email ID
+	status   emailStatus   // How the email ended up
+	path     string        // Screenshot written, if any
+	outputs  []string      // Every file written for it, with extra formats
+	err      error         // Why a failed email failed
+	duration time.Duration // Wall-clock processing time
+
+	known    bool   // Skipped because it already had a screenshot (Incremental)
+	deferred bool   // Left for a later run by MinAge
+	domain   string // Sender domain, with DomainStats
+
+	subject    string // Subject, sender and date received, once fetched
+	sender     string
+	receivedAt string
+
+	buf *emailBuffer // The email's buffered output
+}
+
+// resultCollector tallies emailResults as they arrive, in whatever order the
+// workers finish, writing each email's output as one block and updating the
+// progress line. It is used from a single goroutine.
+type resultCollector struct {
+	total    int
+	progress *progressReporter
+	results  []*emailResult // By index; nil for emails not handled
+	done     int
+
+	// With ordered, each email's output is held back until every email
+	// before it has been written, so blocks appear in list order
+	ordered bool
+	written int // Index of the first email whose output hasn't been written
+}
+
+// newResultCollector returns a collector for a run of total emails, writing
+// their output in list order when ordered is set and as they finish otherwise
+func newResultCollector(total int, progress *progressReporter, ordered bool) *resultCollector {
+	return &resultCollector{
+		total:    total,
+		progress: progress,
+		results:  make([]*emailResult, total),
+		ordered:  ordered,
+	}
+}
+
+// add records a finished email and writes its output, or with ordered, the
+// output of the emails it completes an unbroken run of from the start
+func (c *resultCollector) add(r emailResult) {
+	c.progress.clear()
+	c.results[r.index] = &r
+	if !c.ordered {
+		flushOutput(&r)
+	}
+	for c.ordered && c.written < c.total && c.results[c.written] != nil {
+		flushOutput(c.results[c.written])
+		c.written++
+	}
+
+	c.done++
+	c.progress.update(c.done)
+}
+
+// flush writes the output still held back, of emails collected after one
+// that never finished, such as when the run stopped early
+func (c *resultCollector) flush() {
+	c.progress.clear()
+	for _, r := range c.results {
+		if r != nil {
+			flushOutput(r)
+		}
+	}
+}
+
+// flushOutput writes r's buffered output, if any is left
+func flushOutput(r *emailResult) {
+	if r.buf != nil {
+		r.buf.Flush()
+	}
+}
+
+// fail marks an already collected email as failed, such as one whose batched
+// move was refused after it was otherwise processed
+func (c *resultCollector) fail(emailID string, err error) {
+	for _, r := range c.results {
+		if r != nil && r.id == emailID {
+			r.status = statusFailed
+			r.err = err
+			return
+		}
+	}
+}
+
+// handled returns the collected results in list order
+func (c *resultCollector) handled() []emailResult {
+	var results []emailResult
+	for _, r := range c.results {
+		if r != nil {
+			results = append(results, *r)
+		}
+	}
+	return results
+}
+
+// deferred returns how many emails were left for a later run
+func (c *resultCollector) deferred() int {
+	n := 0
+	for _, r := range c.results {
+		if r != nil && r.deferred {
+			n++
+		}
+	}
+	return n
+}
+
+// result builds the ProcessResult for the collected emails, with domain
+// counts when domainStats is set
+func (c *resultCollector) result(domainStats bool) *ProcessResult {
+	result := &ProcessResult{TotalCount: c.total, Emails: c.handled()}
+	if domainStats {
+		result.DomainCounts = make(map[string]int)
+	}
+	for _, r := range result.Emails {
+		switch r.status {
+		case statusProcessed:
+			result.ProcessedCount++
+			if domainStats {
+				result.DomainCounts[r.domain]++
+			}
+		case statusFailed:
+			result.FailedCount++
+		case statusSkipped:
+			result.SkippedCount++
+		case statusDuplicate:
+			result.DuplicateCount++
+		case statusArchivedWithoutScreenshot:
+			result.ArchivedWithoutScreenshot++
+		case statusQuarantined:
+			result.QuarantinedCount++
+		}
+		if r.known && r.status == statusSkipped {
+			result.KnownCount++
+		}
+	}
+	return result
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test ordered output holds back each email's block until the emails before
+// it are written, and writes what is left after a gap when flushed
+func TestResultCollector_Ordered(t *testing.T) {
+	var output bytes.Buffer
+	out := newSyncWriter(&output)
+	collector := newResultCollector(6, newProgressReporter(&output, 6, false), true)
+
+	arrivals := []struct {
+		index    int
+		expected string
+	}{
+		{2, ""},
+		{1, ""},
+		{0, "0\n1\n2\n"},
+		{5, "0\n1\n2\n"},
+		{3, "0\n1\n2\n3\n"},
+	}
+	for _, arrival := range arrivals {
+		r := emailResult{index: arrival.index, status: statusProcessed, buf: out.newEmailBuffer()}
+		fmt.Fprintf(r.buf, "%d\n", arrival.index)
+		collector.add(r)
+		if output.String() != arrival.expected {
+			t.Errorf("After %d: expected output %q, got %q", arrival.index, arrival.expected, output.String())
+		}
+	}
+
+	// Email 4 never finished, so 5 is only written by the final flush
+	collector.flush()
+	if output.String() != "0\n1\n2\n3\n5\n" {
+		t.Errorf("Expected the rest written by flush, got %q", output.String())
+	}
+}
+
+// Test results arriving out of order are counted once each, their output is
+// written as they arrive, and the result lists emails in their original order
+func TestResultCollector(t *testing.T) {
+	var output bytes.Buffer
+	out := newSyncWriter(&output)
+	collector := newResultCollector(4, newProgressReporter(&output, 4, false), false)
+
+	arrivals := []emailResult{
+		{index: 2, id: "c", status: statusFailed, err: errors.New("no HTML"), domain: "c.example"},
+		{index: 0, id: "a", status: statusProcessed, domain: "a.example"},
+		{index: 3, id: "d", status: statusSkipped, deferred: true},
+		{index: 1, id: "b", status: statusProcessed, domain: "a.example"},
+	}
+	for _, r := range arrivals {
+		r.buf = out.newEmailBuffer()
+		r.buf.WriteString(r.id + "\n")
+		collector.add(r)
+	}
+	collector.fail("b", errors.New("move refused"))
+
+	if output.String() != "c\na\nd\nb\n" {
+		t.Errorf("Expected output in arrival order, got %q", output.String())
+	}
+
+	result := collector.result(true)
+	if result.TotalCount != 4 || result.ProcessedCount != 1 || result.FailedCount != 2 || result.SkippedCount != 1 {
+		t.Errorf("Unexpected counts: %+v", result)
+	}
+	var ids []string
+	for _, r := range result.Emails {
+		ids = append(ids, r.id)
+	}
+	if strings.Join(ids, ",") != "a,b,c,d" {
+		t.Errorf("Expected emails in list order, got %v", ids)
+	}
+	if result.Emails[1].err == nil || result.Emails[1].status != statusFailed {
+		t.Errorf("Expected b to be failed by its move, got %+v", result.Emails[1])
+	}
+	if len(result.DomainCounts) != 1 || result.DomainCounts["a.example"] != 1 {
+		t.Errorf("Expected only processed emails counted by domain, got %v", result.DomainCounts)
+	}
+	if collector.deferred() != 1 {
+		t.Errorf("Expected 1 deferred email, got %d", collector.deferred())
+	}
+}
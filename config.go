@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadConfigFile reads a YAML (.yaml, .yml) or TOML (.toml) file of flag
+// settings and applies them to fs. Flags already set on the command line
+// keep their values; unknown keys are reported to warn and skipped.
+func loadConfigFile(fs *flag.FlagSet, filename string, warn io.Writer) error {
+	var separator string
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		separator = ":"
+	case ".toml":
+		separator = "="
+	default:
+		return fmt.Errorf("unsupported config file %q: expected .yaml, .yml or .toml", filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	settings, err := parseConfig(f, separator)
+	if err != nil {
+		return err
+	}
+	return applyConfig(fs, settings, warn)
+}
+
+// configSetting is one key from a config file with its values; list values
+// have one entry per element
+type configSetting struct {
+	line   int
+	key    string
+	values []string
+}
+
+// parseConfig parses flat "key<separator>value" lines, the subset of YAML
+// and TOML the flags need. Blank lines and # comments are ignored, values
+// may be quoted, and [a, b] lists set a repeatable flag once per element.
+func parseConfig(r io.Reader, separator string) ([]configSetting, error) {
+	var settings []configSetting
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, separator)
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t[") {
+			return nil, fmt.Errorf("invalid config on line %d: expected 'key%s value'", lineNum, separator)
+		}
+
+		values, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q on line %d: %w", key, lineNum, err)
+		}
+		settings = append(settings, configSetting{line: lineNum, key: key, values: values})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	return settings, nil
+}
+
+// parseConfigValue unquotes a scalar, or splits a [a, b] list into elements
+func parseConfigValue(value string) ([]string, error) {
+	if rest, ok := strings.CutPrefix(value, "["); ok {
+		end := strings.LastIndex(rest, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated list")
+		}
+		var values []string
+		for _, item := range strings.Split(rest[:end], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			scalar, err := parseConfigScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, scalar)
+		}
+		return values, nil
+	}
+
+	scalar, err := parseConfigScalar(value)
+	if err != nil {
+		return nil, err
+	}
+	return []string{scalar}, nil
+}
+
+// parseConfigScalar strips quotes from a value, or a trailing # comment
+// from an unquoted one
+func parseConfigScalar(value string) (string, error) {
+	if value != "" && (value[0] == '"' || value[0] == '\'') {
+		end := strings.IndexByte(value[1:], value[0])
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return value[1 : end+1], nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// applyConfig sets each flag named by a setting, unless it was given on the
+// command line. Keys may use underscores in place of dashes.
+func applyConfig(fs *flag.FlagSet, settings []configSetting, warn io.Writer) error {
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+
+	for _, setting := range settings {
+		name := strings.ReplaceAll(setting.key, "_", "-")
+		if fs.Lookup(name) == nil || name == "config" {
+			fmt.Fprintf(warn, "Warning: ignoring unknown config key %q on line %d\n", setting.key, setting.line)
+			continue
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		for _, value := range setting.values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid config value for %q on line %d: %w", setting.key, setting.line, err)
+			}
+		}
+	}
+
+	return nil
+}
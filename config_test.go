@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFlagSet returns a FlagSet with a few of the real flags' shapes
+func testFlagSet() (*flag.FlagSet, *int, *string, *bool, *stringList) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "")
+	archive := fs.String("archive", archiveFolder, "")
+	noMove := fs.Bool("no-move", false, "")
+	var capabilities stringList
+	fs.Var(&capabilities, "capability", "")
+	return fs, limit, archive, noMove, &capabilities
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+// Test a config file fills in flags, with command-line flags taking precedence
+func TestLoadConfigFile(t *testing.T) {
+	files := map[string]string{
+		"aar.yaml": `# nightly run
+limit: 10
+archive: "Done Mail"
+no_move: true # keep emails
+capability: [urn:a, "urn:b"]
+colour: blue
+`,
+		"aar.toml": `# nightly run
+limit = 10
+archive = 'Done Mail'
+no-move = true
+capability = ["urn:a", "urn:b"]
+colour = "blue"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			fs, limit, archive, noMove, capabilities := testFlagSet()
+			if err := fs.Parse([]string{"-limit", "3"}); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+
+			var warnings bytes.Buffer
+			if err := loadConfigFile(fs, writeConfig(t, name, content), &warnings); err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			if *limit != 3 {
+				t.Errorf("Expected command-line limit 3 to win, got %d", *limit)
+			}
+			if *archive != "Done Mail" || !*noMove {
+				t.Errorf("Expected archive and no-move from the file, got %q, %v", *archive, *noMove)
+			}
+			if capabilities.String() != "urn:a,urn:b" {
+				t.Errorf("Expected both capabilities, got %q", capabilities.String())
+			}
+			if !strings.Contains(warnings.String(), `"colour" on line 6`) {
+				t.Errorf("Expected unknown key warning, got: %q", warnings.String())
+			}
+		})
+	}
+}
+
+// Test invalid config files are rejected
+func TestLoadConfigFile_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"aar.ini":  "limit = 1\n",
+		"bad.toml": "limit\n",
+		"num.toml": "limit = many\n",
+		"str.yaml": "archive: \"Done\n",
+	}
+
+	for name, content := range tests {
+		fs, _, _, _, _ := testFlagSet()
+		if err := loadConfigFile(fs, writeConfig(t, name, content), &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errAborted is returned by processEmails when the run isn't confirmed
+var errAborted = errors.New("run aborted")
+
+// previewEmails lists the emails about to be processed, in order, with their
+// subject and sender
+func previewEmails(client EmailClient, emailIDs []string, output io.Writer) error {
+	result, err := client.GetEmails(emailIDs)
+	if err != nil {
+		return fmt.Errorf("failed to fetch emails to preview: %w", err)
+	}
+	byID := result.ByID()
+
+	fmt.Fprintf(output, "\nAbout to process %d email(s):\n", len(emailIDs))
+	for i, emailID := range emailIDs {
+		email, ok := byID[emailID]
+		if err := result.Failed[emailID]; err != nil {
+			fmt.Fprintf(output, "  %d. %s (could not be fetched: %v)\n", i+1, emailID, err)
+			continue
+		}
+		if !ok {
+			fmt.Fprintf(output, "  %d. %s (no longer available)\n", i+1, emailID)
+			continue
+		}
+		name, address := PrimarySender(email)
+		sender := name
+		if address != "" && address != name {
+			sender = fmt.Sprintf("%s <%s>", name, address)
+		}
+		fmt.Fprintf(output, "  %d. %s  %q from %s\n", i+1, emailID, email.Subject, sender)
+	}
+	return nil
+}
+
+// confirm asks question on output and reads the answer from input. Only
+// "y" or "yes" confirm; anything else, including no answer at all, doesn't.
+func confirm(question string, input io.Reader, output io.Writer) bool {
+	fmt.Fprintf(output, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(output)
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// confirmRun previews the emails and asks whether to process them,
+// returning errAborted unless the answer is yes
+func confirmRun(client EmailClient, emailIDs []string, input io.Reader, output io.Writer) error {
+	if err := previewEmails(client, emailIDs, output); err != nil {
+		return err
+	}
+	if !confirm(fmt.Sprintf("\nProcess these %d email(s)?", len(emailIDs)), input, output) {
+		fmt.Fprintln(output, "Aborted; no emails were processed")
+		return errAborted
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DiskEstimate is the projected screenshot disk usage for a run, extrapolated
+// from a few sample screenshots
+type DiskEstimate struct {
+	Samples      int   // Screenshots actually rendered and measured
+	AverageBytes int64 // Mean size of the samples
+	TotalBytes   int64 // AverageBytes times the number of emails
+}
+
+// estimateDiskUsage renders screenshots for up to samples of emailIDs,
+// measures them, deletes them again, and extrapolates to all of emailIDs.
+// Emails that already have a screenshot, by email ID or by content hash, are
+// not sampled so existing files are never overwritten or removed.
+func estimateDiskUsage(client EmailClient, generator ScreenshotService, emailIDs []string, samples int, htmlParts string, output io.Writer) (*DiskEstimate, error) {
+	var measured int
+	var totalSize int64
+	for _, emailID := range emailIDs {
+		if measured >= samples {
+			break
+		}
+		if generator.HasScreenshot(emailID) {
+			continue
+		}
+
+		getResult, err := client.GetEmails([]string{emailID})
+		if err != nil || len(getResult.List) == 0 {
+			continue
+		}
+		email := getResult.List[0]
+		htmlContent := extractHTMLContent(email, htmlParts)
+		if htmlContent == "" || hasScreenshotFor(generator, emailID, "", htmlContent) {
+			continue
+		}
+
+		path, err := generator.GenerateScreenshot("", email.ReceivedAt, email.ID, htmlContent)
+		if err != nil {
+			fmt.Fprintf(output, "  ⚠ Sample screenshot of %s failed: %v\n", emailID, err)
+			continue
+		}
+		size, err := sampleSize(path)
+		if err != nil {
+			return nil, err
+		}
+
+		measured++
+		totalSize += size
+	}
+
+	if measured == 0 {
+		return nil, errors.New("no emails could be sampled")
+	}
+
+	average := totalSize / int64(measured)
+	return &DiskEstimate{
+		Samples:      measured,
+		AverageBytes: average,
+		TotalBytes:   average * int64(len(emailIDs)),
+	}, nil
+}
+
+// sampleSize returns the combined size of a sample screenshot and the files
+// written alongside it (slices, thumbnail, saved HTML), removing them all
+func sampleSize(path string) (int64, error) {
+	files := []string{path, thumbnailPath(path), htmlPath(path)}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(slicePath(path, i)); err != nil {
+			break
+		}
+		files = append(files, slicePath(path, i))
+	}
+
+	var size int64
+	for _, p := range files {
+		info, err := os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) && p != path {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to measure sample screenshot: %w", err)
+		}
+		size += info.Size()
+		if err := os.Remove(p); err != nil {
+			return 0, fmt.Errorf("failed to remove sample screenshot: %w", err)
+		}
+	}
+	return size, nil
+}
+
+// formatBytes renders n as a human-readable size using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
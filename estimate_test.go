@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Test the estimate averages the samples and extrapolates to every email
+func TestEstimateDiskUsage(t *testing.T) {
+	client := newSingleEmailClient()
+	for _, id := range []string{"email2", "email3", "email4", "email5"} {
+		addHTMLEmail(client, id, "<p>"+id+"</p>")
+	}
+	generator := NewMockScreenshotService()
+	generator.outputDir = t.TempDir()
+	generator.fileSizes = []int{1000, 3000}
+
+	var output bytes.Buffer
+	estimate, err := estimateDiskUsage(client, generator, client.emails["src-123"], 2, HTMLPartsFirst, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if estimate.Samples != 2 || estimate.AverageBytes != 2000 || estimate.TotalBytes != 10000 {
+		t.Errorf("Expected 2 samples averaging 2000 for 10000 total, got %+v", estimate)
+	}
+
+	entries, _ := os.ReadDir(generator.outputDir)
+	if len(entries) != 0 {
+		t.Errorf("Expected sample screenshots to be removed, found %d file(s)", len(entries))
+	}
+}
+
+// Test emails that already have a screenshot are never sampled
+func TestEstimateDiskUsage_SkipsExisting(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	generator := NewMockScreenshotService()
+	generator.outputDir = t.TempDir()
+	generator.fileSizes = []int{500}
+	generator.existing["email1"] = true
+
+	var output bytes.Buffer
+	estimate, err := estimateDiskUsage(client, generator, client.emails["src-123"], 5, HTMLPartsFirst, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if _, ok := generator.generatedScreenshots["email1"]; ok {
+		t.Error("Expected email1 not to be re-rendered")
+	}
+	if estimate.Samples != 1 || estimate.TotalBytes != 1000 {
+		t.Errorf("Expected 1 sample extrapolated to 1000 bytes, got %+v", estimate)
+	}
+}
+
+// Test an email whose hash-named screenshot already exists isn't sampled, so
+// the estimate never removes a screenshot from an earlier run
+func TestEstimateDiskUsage_SkipsExistingHashName(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	generator := newTestGenerator(t, ScreenshotOptions{Width: 1280, Height: 800, Format: FormatPNG, NameByHash: true}, testPNG(t, 10, 10), nil)
+
+	existing, err := generator.hashedPath("", "<html><body>Test</body></html>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("earlier run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	estimate, err := estimateDiskUsage(client, generator, client.emails["src-123"], 5, HTMLPartsFirst, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if data, err := os.ReadFile(existing); err != nil || string(data) != "earlier run" {
+		t.Errorf("Expected the existing screenshot to be kept, got %q, %v", data, err)
+	}
+	if estimate.Samples != 1 {
+		t.Errorf("Expected only email2 to be sampled, got %+v", estimate)
+	}
+}
+
+// Test dry-run reports the estimate without archiving anything
+func TestProcessEmails_DryRunEstimate(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+	generator.outputDir = t.TempDir()
+	generator.fileSizes = []int{2048}
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, generator, ProcessOptions{DryRun: true, EstimateSamples: 3}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !strings.Contains(output.String(), "Estimated disk usage: 2.0 KB for 1 emails (average 2.0 KB over 1 sample(s))") {
+		t.Errorf("Expected estimate in output, got: %s", output.String())
+	}
+	if len(client.moves) != 0 {
+		t.Errorf("Expected no moves in dry-run, got %d", len(client.moves))
+	}
+}
+
+// Test byte counts are formatted with binary units
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		512:             "512 B",
+		2048:            "2.0 KB",
+		5 * 1024 * 1024: "5.0 MB",
+		3 << 30:         "3.0 GB",
+	}
+	for n, expected := range tests {
+		if got := formatBytes(n); got != expected {
+			t.Errorf("formatBytes(%d) = %q, expected %q", n, got, expected)
+		}
+	}
+}
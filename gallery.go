@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The -gallery files in the output directory: the page, and the entries it
+// was rendered from, which later runs add to
+const (
+	galleryPageName = "index.html"
+	galleryDataName = "gallery.json"
+)
+
+// GalleryEntry is one screenshot shown in the -gallery page. Paths are
+// relative to the output directory, with forward slashes.
+type GalleryEntry struct {
+	Screenshot string `json:"screenshot"`
+	Thumbnail  string `json:"thumbnail,omitempty"` // Shown in the grid instead, if written
+	Subject    string `json:"subject"`
+	Sender     string `json:"sender"`
+	ReceivedAt string `json:"receivedAt"` // RFC 3339, as the server sent it
+}
+
+// Date returns when the email was received, for its caption
+func (e GalleryEntry) Date() string {
+	received, err := time.Parse(time.RFC3339, e.ReceivedAt)
+	if err != nil {
+		return e.ReceivedAt
+	}
+	return received.Local().Format("2006-01-02 15:04")
+}
+
+// galleryTemplate is the -gallery page: a grid of screenshots, newest first,
+// each linking to the full image
+var galleryTemplate = template.Must(template.New(galleryPageName).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Email screenshots</title>
+<style>
+body { margin: 0; padding: 16px; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; background: #f4f4f5; color: #18181b; }
+h1 { font-size: 20px; margin: 0 0 16px; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(240px, 1fr)); gap: 16px; }
+figure { margin: 0; background: #fff; border-radius: 6px; overflow: hidden; box-shadow: 0 1px 3px rgba(0, 0, 0, 0.15); }
+figure a { display: block; }
+figure img { display: block; width: 100%; height: 320px; object-fit: cover; object-position: top; }
+figcaption { padding: 8px 10px; font-size: 13px; line-height: 1.4; }
+.subject { font-weight: 600; overflow-wrap: anywhere; }
+.meta { color: #71717a; }
+</style>
+</head>
+<body>
+<h1>Email screenshots ({{len .}})</h1>
+<div class="grid">
+{{- range .}}
+<figure>
+<a href="{{.Screenshot}}"><img src="{{if .Thumbnail}}{{.Thumbnail}}{{else}}{{.Screenshot}}{{end}}" alt="{{.Subject}}" loading="lazy"></a>
+<figcaption><div class="subject">{{.Subject}}</div><div class="meta">{{.Sender}} · {{.Date}}</div></figcaption>
+</figure>
+{{- end}}
+</div>
+</body>
+</html>
+`))
+
+// galleryEntries returns an entry for each email of result that has a
+// screenshot, with paths relative to dir, using its thumbnail if one was
+// written next to it
+func galleryEntries(result *ProcessResult, dir string) []GalleryEntry {
+	var entries []GalleryEntry
+	for _, r := range result.Emails {
+		if r.path == "" {
+			continue
+		}
+		entry := GalleryEntry{
+			Screenshot: galleryPath(dir, r.path),
+			Subject:    r.subject,
+			Sender:     r.sender,
+			ReceivedAt: r.receivedAt,
+		}
+		if thumbnail := thumbnailPath(r.path); fileExists(thumbnail) {
+			entry.Thumbnail = galleryPath(dir, thumbnail)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// galleryPath returns path relative to dir as a URL path, or path itself if
+// it is outside dir
+func galleryPath(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// fileExists reports whether there is a file at path
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// loadGallery reads the entries of an earlier -gallery run, or none if there
+// wasn't one
+func loadGallery(path string) ([]GalleryEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gallery: %w", err)
+	}
+
+	var entries []GalleryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid gallery %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// mergeGallery adds added to entries, replacing any entry for the same
+// screenshot and dropping those whose screenshot is no longer in dir. The
+// result is newest first.
+func mergeGallery(dir string, entries, added []GalleryEntry) []GalleryEntry {
+	byScreenshot := make(map[string]GalleryEntry, len(entries)+len(added))
+	for _, entry := range append(entries, added...) {
+		byScreenshot[entry.Screenshot] = entry
+	}
+
+	merged := make([]GalleryEntry, 0, len(byScreenshot))
+	for _, entry := range byScreenshot {
+		path := filepath.FromSlash(entry.Screenshot)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if !fileExists(path) {
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	slices.SortFunc(merged, func(a, b GalleryEntry) int {
+		if c := strings.Compare(b.ReceivedAt, a.ReceivedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Screenshot, b.Screenshot)
+	})
+	return merged
+}
+
+// writeGallery adds the screenshots of result to the gallery page in the
+// output directory, creating it on the first run
+func writeGallery(outputDir string, result *ProcessResult, output io.Writer) error {
+	dir, err := resolveOutputDir(outputDir)
+	if err != nil {
+		return err
+	}
+	dataPath := filepath.Join(dir, galleryDataName)
+	entries, err := loadGallery(dataPath)
+	if err != nil {
+		return err
+	}
+	entries = mergeGallery(dir, entries, galleryEntries(result, dir))
+
+	if err := writeAtomic(dataPath, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}); err != nil {
+		return err
+	}
+	pagePath := filepath.Join(dir, galleryPageName)
+	if err := writeAtomic(pagePath, func(w io.Writer) error {
+		return galleryTemplate.Execute(w, entries)
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Gallery updated: %s (%d screenshot(s))\n", pagePath, len(entries))
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test the gallery links each screenshot processed, with its thumbnail and
+// subject, and a later run adds to it rather than replacing it
+func TestWriteGallery(t *testing.T) {
+	generator := newTestGenerator(t, ScreenshotOptions{Width: 1280, Height: 800, Format: FormatPNG, ThumbnailWidth: 5}, testPNG(t, 10, 10), nil)
+	dir := generator.outputDir
+
+	first := newSingleEmailClient()
+	first.emailDetails["email1"] = withSubject(first.emailDetails["email1"], "Weekly digest")
+	result, err := processEmails(first, generator, ProcessOptions{}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := writeGallery(dir, result, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	firstPath := result.Emails[0].path
+
+	second := newSingleEmailClient()
+	second.emails["src-123"] = nil
+	addHTMLEmail(second, "email2", "<p>Two</p>")
+	email := withSubject(second.emailDetails["email2"], "Sale & offers")
+	email.ReceivedAt = "2025-10-25T09:00:00Z"
+	second.emailDetails["email2"] = email
+	addHTMLEmail(second, "email3", "")
+	second.emailDetails["email3"] = withSubject(second.emailDetails["email3"], "Broken")
+	result, err = processEmails(second, generator, ProcessOptions{}, io.Discard)
+	if err != nil && result == nil {
+		t.Fatalf("Expected a result, got: %v", err)
+	}
+	if err := writeGallery(dir, result, io.Discard); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	secondPath := result.Emails[0].path
+
+	data, err := os.ReadFile(filepath.Join(dir, galleryPageName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(data)
+	for _, path := range []string{firstPath, secondPath} {
+		name := filepath.Base(path)
+		for _, want := range []string{`href="` + name + `"`, `src="` + filepath.Base(thumbnailPath(path)) + `"`} {
+			if !strings.Contains(page, want) {
+				t.Errorf("Expected the gallery to contain %q", want)
+			}
+		}
+	}
+	for _, want := range []string{"Weekly digest", "Sale &amp; offers"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Expected the gallery to contain %q", want)
+		}
+	}
+	if strings.Contains(page, "Broken") {
+		t.Error("Expected emails without a screenshot to be left out")
+	}
+	if strings.Index(page, filepath.Base(secondPath)) > strings.Index(page, filepath.Base(firstPath)) {
+		t.Error("Expected the newest email first")
+	}
+}
+
+// withSubject returns email with its subject replaced
+func withSubject(email Email, subject string) Email {
+	email.Subject = subject
+	return email
+}
+
+// Test screenshots deleted since an earlier run are dropped from the gallery
+func TestMergeGallery_DropsMissingScreenshots(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "kept.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := mergeGallery(dir, []GalleryEntry{{Screenshot: "deleted.png"}, {Screenshot: "kept.png"}}, nil)
+	if len(merged) != 1 || merged[0].Screenshot != "kept.png" {
+		t.Errorf("Expected only kept.png, got %v", merged)
+	}
+}
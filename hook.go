@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ExecHook runs an external command after each successful screenshot
+type ExecHook struct {
+	args    []string
+	timeout time.Duration
+}
+
+// NewExecHook parses a command template. The template is split into
+// arguments on whitespace (single and double quotes group words) and the
+// placeholders {path}, {id} and {subject} are substituted within each
+// argument, so substituted values are never re-split or interpreted by a shell.
+func NewExecHook(template string, timeout time.Duration) (*ExecHook, error) {
+	args, err := splitArgs(template)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty exec command")
+	}
+	return &ExecHook{args: args, timeout: timeout}, nil
+}
+
+// Run executes the hook for a screenshot, returning an error that includes
+// the exit code and stderr when the command fails or times out
+func (h *ExecHook) Run(path string, email Email) error {
+	replacer := strings.NewReplacer(
+		"{path}", path,
+		"{id}", email.ID,
+		"{subject}", email.Subject,
+	)
+	args := make([]string, len(h.args))
+	for i, arg := range h.args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("command timed out after %s", h.timeout)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if msg != "" {
+				return fmt.Errorf("command exited with code %d: %s", exitErr.ExitCode(), msg)
+			}
+			return fmt.Errorf("command exited with code %d", exitErr.ExitCode())
+		}
+		return fmt.Errorf("failed to run command: %w", err)
+	}
+
+	return nil
+}
+
+// splitArgs splits a command line on whitespace, honoring single and double quotes
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in command")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the hook is invoked with placeholders substituted
+func TestExecHook_SubstitutesPlaceholders(t *testing.T) {
+	dir := t.TempDir()
+	screenshot := filepath.Join(dir, "shot with spaces.png")
+	out := filepath.Join(dir, "out.txt")
+
+	hook, err := NewExecHook(`sh -c 'echo "$1 $2 $3" > "$4"' hook {path} {id} {subject} `+out, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if err := hook.Run(screenshot, Email{ID: "M1", Subject: "Hello; rm -rf"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected hook output file: %v", err)
+	}
+	expected := screenshot + " M1 Hello; rm -rf\n"
+	if string(data) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(data))
+	}
+}
+
+// Test a non-zero exit is reported with its exit code and stderr
+func TestExecHook_NonZeroExit(t *testing.T) {
+	hook, err := NewExecHook(`sh -c 'echo upload failed >&2; exit 3'`, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	err = hook.Run("shot.png", Email{ID: "M1"})
+	if err == nil {
+		t.Fatal("Expected error for non-zero exit")
+	}
+	if !strings.Contains(err.Error(), "code 3") || !strings.Contains(err.Error(), "upload failed") {
+		t.Errorf("Expected exit code and stderr in error, got: %v", err)
+	}
+}
+
+// Test the hook is killed after its timeout
+func TestExecHook_Timeout(t *testing.T) {
+	hook, err := NewExecHook("sleep 5", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if err := hook.Run("shot.png", Email{}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected timeout error, got: %v", err)
+	}
+}
+
+// Test command line splitting
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`upload --dest "my bucket" 'a b' {path}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := []string{"upload", "--dest", "my bucket", "a b", "{path}"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %q, got %q", expected, args)
+	}
+
+	if _, err := splitArgs(`echo "unterminated`); err == nil {
+		t.Error("Expected error for unterminated quote")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultFontFamily is the wrapper font stack used when no font family is configured
+const defaultFontFamily = `-apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif`
+
+var (
+	hexColorPattern   = regexp.MustCompile(`^#([0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+	namedColorPattern = regexp.MustCompile(`^[a-zA-Z]+$`)
+	funcColorPattern  = regexp.MustCompile(`^(rgb|rgba|hsl|hsla)\([0-9.,%/\sa-z]*\)$`)
+	fontFamilyPattern = regexp.MustCompile(`^[a-zA-Z0-9 ,"'_-]+$`)
+)
+
+// WrapperStyle configures the page wrapped around email content
+type WrapperStyle struct {
+	BackgroundColor string // CSS color; empty leaves the browser default
+	FontFamily      string // CSS font-family; empty uses defaultFontFamily
+	Dark            bool   // Use the dark color scheme's default background and text
+}
+
+// contentHash returns a SHA-256 hash of HTML content with all whitespace removed,
+// so emails differing only in formatting hash identically
+func contentHash(htmlContent string) string {
+	normalized := strings.Join(strings.Fields(htmlContent), "")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateCSSColor checks that color is a single CSS color token such as
+// #fff, rebeccapurple, transparent or rgb(0, 0, 0)
+func validateCSSColor(color string) error {
+	color = strings.TrimSpace(color)
+	if hexColorPattern.MatchString(color) || namedColorPattern.MatchString(color) || funcColorPattern.MatchString(color) {
+		return nil
+	}
+	return fmt.Errorf("invalid CSS color %q", color)
+}
+
+// validateFontFamily checks that family is a plain font-family list that cannot escape the style block
+func validateFontFamily(family string) error {
+	if fontFamilyPattern.MatchString(family) {
+		return nil
+	}
+	return fmt.Errorf("invalid font family %q", family)
+}
+
+// wrapHTML embeds email content in a full HTML document with base styling
+func wrapHTML(content string, style WrapperStyle) string {
+	fontFamily := style.FontFamily
+	if fontFamily == "" {
+		fontFamily = defaultFontFamily
+	}
+
+	background := ""
+	if style.BackgroundColor != "" {
+		background = fmt.Sprintf(`
+        html, body {
+            background: %s;
+        }`, style.BackgroundColor)
+	}
+
+	// Chrome's dark canvas and text color show wherever the email doesn't
+	// set its own, as they would in a mail client's dark mode
+	if style.Dark {
+		background = `
+        :root {
+            color-scheme: dark;
+        }` + background
+	}
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <style>
+        body {
+            margin: 20px;
+            font-family: %s;
+            font-size: 14px;
+            line-height: 1.5;
+        }
+        img {
+            max-width: 100%%;
+            height: auto;
+        }%s
+    </style>
+</head>
+<body>
+%s
+</body>
+</html>`, fontFamily, background, content)
+}
+
+// renderBanner returns a header block showing the email's subject, sender and
+// received time, to be placed above the email body. All metadata is
+// HTML-escaped so it can't break the layout or inject markup.
+func renderBanner(email Email) string {
+	from, address := PrimarySender(email)
+	if address != "" && address != from {
+		from = fmt.Sprintf("%s <%s>", from, address)
+	}
+
+	return fmt.Sprintf(`<div class="aar-banner" style="margin: -20px -20px 20px; padding: 12px 20px; background: #f3f4f6; color: #111827; border-bottom: 1px solid #d1d5db; font: 13px/1.4 %s;">
+<div style="font-size: 16px; font-weight: 600;">%s</div>
+<div>From: %s</div>
+<div>Date: %s</div>
+</div>
+`, defaultFontFamily, html.EscapeString(email.Subject), html.EscapeString(from), html.EscapeString(bannerDate(email.ReceivedAt)))
+}
+
+// bannerDate formats an RFC 3339 timestamp in New York time, matching the
+// screenshot file names; unparseable timestamps are shown as-is
+func bannerDate(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	if ny, err := time.LoadLocation("America/New_York"); err == nil {
+		t = t.In(ny)
+	}
+	return t.Format("Mon, 2 Jan 2006 15:04 MST")
+}
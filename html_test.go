@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test the wrapper applies the configured background color and font family
+func TestWrapHTML_Style(t *testing.T) {
+	html := wrapHTML("<p>Hello</p>", WrapperStyle{
+		BackgroundColor: "#1e1e1e",
+		FontFamily:      `Georgia, "Times New Roman", serif`,
+	})
+
+	if !strings.Contains(html, "background: #1e1e1e;") {
+		t.Error("Expected wrapper to contain the background color")
+	}
+	if !strings.Contains(html, `font-family: Georgia, "Times New Roman", serif;`) {
+		t.Error("Expected wrapper to contain the font family")
+	}
+	if !strings.Contains(html, "<p>Hello</p>") {
+		t.Error("Expected wrapper to contain the email content")
+	}
+}
+
+// Test the wrapper defaults when no style is configured
+func TestWrapHTML_Defaults(t *testing.T) {
+	html := wrapHTML("<p>Hello</p>", WrapperStyle{})
+
+	if !strings.Contains(html, "font-family: "+defaultFontFamily+";") {
+		t.Error("Expected default font family")
+	}
+	if strings.Contains(html, "background:") {
+		t.Error("Expected no background rule by default")
+	}
+	if strings.Contains(html, "color-scheme") {
+		t.Error("Expected no color scheme by default")
+	}
+}
+
+// Test the dark scheme switches the page to dark defaults, which an explicit
+// background still overrides
+func TestWrapHTML_Dark(t *testing.T) {
+	html := wrapHTML("<p>Hello</p>", WrapperStyle{Dark: true, BackgroundColor: "#000"})
+
+	if !strings.Contains(html, "color-scheme: dark;") {
+		t.Error("Expected the dark color scheme")
+	}
+	if strings.Index(html, "color-scheme: dark;") > strings.Index(html, "background: #000;") {
+		t.Error("Expected the background color after the color scheme")
+	}
+}
+
+// Test CSS color validation
+func TestValidateCSSColor(t *testing.T) {
+	valid := []string{"#fff", "#1e1e1e", "#1e1e1e80", "white", "transparent", "rgb(30, 30, 30)", "rgba(0,0,0,0.5)", "hsl(120 50% 50%)"}
+	for _, color := range valid {
+		if err := validateCSSColor(color); err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", color, err)
+		}
+	}
+
+	invalid := []string{"", "#ggg", "red;", "red } body {", "url(x)", "#12345"}
+	for _, color := range invalid {
+		if err := validateCSSColor(color); err == nil {
+			t.Errorf("Expected %q to be invalid", color)
+		}
+	}
+}
+
+// Test the banner shows the email metadata and escapes markup in it
+func TestRenderBanner(t *testing.T) {
+	email := Email{
+		Subject:    `Big <script>alert("x")</script> & sale`,
+		From:       []EmailAddress{{Name: "News <Team>", Email: "news@example.com"}},
+		ReceivedAt: "2025-10-24T14:30:00Z",
+	}
+
+	banner := renderBanner(email)
+	if strings.Contains(banner, "<script>") {
+		t.Errorf("Expected script tag to be escaped, got: %s", banner)
+	}
+	expected := []string{
+		"Big &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; sale",
+		"From: News &lt;Team&gt; &lt;news@example.com&gt;",
+		"Date: Fri, 24 Oct 2025 10:30 EDT",
+	}
+	for _, s := range expected {
+		if !strings.Contains(banner, s) {
+			t.Errorf("Expected banner to contain %q, got: %s", s, banner)
+		}
+	}
+
+	if banner := renderBanner(Email{Subject: "No sender"}); !strings.Contains(banner, "From: unknown") {
+		t.Errorf("Expected unknown sender in banner, got: %s", banner)
+	}
+
+	wrapped := wrapHTML(banner+"<p>Body</p>", WrapperStyle{})
+	if !strings.Contains(wrapped, `class="aar-banner"`) || strings.Index(wrapped, "aar-banner") > strings.Index(wrapped, "<p>Body</p>") {
+		t.Error("Expected banner above the email body in the generated HTML")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stdinName is the name given to screenshots of HTML read from stdin
+const stdinName = "stdin"
+
+// runHTMLInput screenshots the HTML from -html-file or -stdin-html with the
+// rendering flags, without connecting to a JMAP server, and returns the exit
+// code
+func runHTMLInput(flags *cliFlags, stdin io.Reader, stdout io.Writer, logger *log.Logger) int {
+	if *flags.htmlFile != "" && *flags.stdinHTML {
+		logger.Print("-html-file and -stdin-html are mutually exclusive")
+		return exitConfig
+	}
+
+	input, name := stdin, stdinName
+	if *flags.htmlFile != "" {
+		f, err := os.Open(*flags.htmlFile)
+		if err != nil {
+			logger.Printf("Failed to open HTML file: %v", err)
+			return exitConfig
+		}
+		defer f.Close()
+		input = f
+		name = strings.TrimSuffix(filepath.Base(*flags.htmlFile), filepath.Ext(*flags.htmlFile))
+	}
+
+	generator, err := newScreenshotService(*flags.outDir, flags.screenshotOptions())
+	if err != nil {
+		logger.Printf("Failed to create screenshot generator: %v", err)
+		return exitConfig
+	}
+
+	path, err := screenshotHTML(generator, input, name, time.Now())
+	if err != nil {
+		logger.Printf("Failed to screenshot HTML: %v", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "✓ Screenshot generated: %s\n", path)
+	for _, extra := range outputPaths(generator, path)[1:] {
+		fmt.Fprintf(stdout, "✓ Also written: %s\n", extra)
+	}
+	return exitOK
+}
+
+// screenshotHTML renders the HTML document read from r through the same
+// wrapper and pipeline as an email body, naming the screenshot after name
+// and the time it was taken
+func screenshotHTML(generator ScreenshotService, r io.Reader, name string, now time.Time) (string, error) {
+	html, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read HTML: %w", err)
+	}
+	if strings.TrimSpace(string(html)) == "" {
+		return "", errors.New("no HTML to render")
+	}
+
+	return generator.GenerateScreenshot("", now.UTC().Format(time.RFC3339), name, string(html))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test HTML from a reader is wrapped, rendered and written as a screenshot
+// named after the input
+func TestScreenshotHTML(t *testing.T) {
+	var rendered string
+	generator := newTestGenerator(t, ScreenshotOptions{Width: 100, Height: 100, BackgroundColor: "navy"}, testPNG(t, 100, 100), &rendered)
+
+	now := time.Date(2025, 10, 24, 14, 30, 0, 0, time.UTC)
+	path, err := screenshotHTML(generator, strings.NewReader("<h1>Template</h1>"), "welcome", now)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if filepath.Base(path) != "2025-10-24-10-30-00-welcome.png" {
+		t.Errorf("Unexpected screenshot name %s", filepath.Base(path))
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the screenshot to be written: %v", err)
+	}
+	if !strings.Contains(rendered, "<h1>Template</h1>") || !strings.Contains(rendered, "navy") {
+		t.Errorf("Expected the HTML rendered in the styled wrapper, got:\n%s", rendered)
+	}
+
+	if _, err := screenshotHTML(generator, strings.NewReader("  \n"), "blank", now); err == nil {
+		t.Error("Expected error for empty input")
+	}
+}
+
+// Test -stdin-html renders piped HTML without credentials or a JMAP client
+func TestRun_StdinHTML(t *testing.T) {
+	var rendered string
+	oldClient, oldGenerator := newEmailClient, newScreenshotService
+	t.Cleanup(func() { newEmailClient, newScreenshotService = oldClient, oldGenerator })
+	newEmailClient = func(opts ClientOptions) (EmailClient, error) {
+		t.Error("Expected no JMAP client to be created")
+		return nil, errors.New("unexpected")
+	}
+	newScreenshotService = func(dir string, opts ScreenshotOptions) (ScreenshotService, error) {
+		if opts.Format != FormatPNG || opts.FontFamily != "serif" {
+			t.Errorf("Expected rendering flags to be honored, got %+v", opts)
+		}
+		return newTestGenerator(t, opts, testPNG(t, 10, 10), &rendered), nil
+	}
+
+	t.Setenv("FASTMAIL_AAR_KEY", "")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-stdin-html", "-font-family", "serif"}, strings.NewReader("<p>Piped</p>"), &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d\n%s", exitOK, code, stderr.String())
+	}
+	if !strings.Contains(rendered, "<p>Piped</p>") || !strings.Contains(stdout.String(), "-stdin.png") {
+		t.Errorf("Expected the piped HTML screenshotted, got:\n%s", stdout.String())
+	}
+
+	if code := run([]string{"-stdin-html", "-html-file", "x.html"}, nil, &stdout, &stderr); code != exitConfig {
+		t.Errorf("Expected exit code %d for both inputs, got %d", exitConfig, code)
+	}
+}
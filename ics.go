@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+// CalendarEvent is the part of an iCalendar VEVENT shown on an event card
+type CalendarEvent struct {
+	Summary  string
+	Location string
+	Start    time.Time
+	End      time.Time // Zero if the event has no DTEND
+	AllDay   bool      // Start and End are dates; End is exclusive
+	Floating bool      // Start and End have no time zone
+}
+
+// parseICS returns the first event of an iCalendar document. Only SUMMARY,
+// LOCATION, DTSTART and DTEND are read; properties of nested components such
+// as VALARM are ignored.
+func parseICS(data string) (*CalendarEvent, error) {
+	var event *CalendarEvent
+	depth := 0 // Components open inside the VEVENT
+	for _, line := range unfoldICS(data) {
+		name, params, value := splitICSProperty(line)
+		if event == nil {
+			if name == "BEGIN" && strings.EqualFold(value, "VEVENT") {
+				event = &CalendarEvent{}
+			}
+			continue
+		}
+
+		switch {
+		case name == "BEGIN":
+			depth++
+		case name == "END" && depth > 0:
+			depth--
+		case name == "END":
+			if event.Start.IsZero() {
+				return nil, errors.New("event has no start time")
+			}
+			return event, nil
+		case depth > 0:
+		case name == "SUMMARY":
+			event.Summary = unescapeICSText(value)
+		case name == "LOCATION":
+			event.Location = unescapeICSText(value)
+		case name == "DTSTART", name == "DTEND":
+			t, allDay, floating, err := parseICSTime(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			if name == "DTSTART" {
+				event.Start, event.AllDay, event.Floating = t, allDay, floating
+			} else {
+				event.End = t
+			}
+		}
+	}
+	if event == nil {
+		return nil, errors.New("no event found")
+	}
+	return nil, errors.New("event is not terminated")
+}
+
+// unfoldICS splits an iCalendar document into content lines, joining lines
+// folded onto continuation lines that start with a space or tab
+func unfoldICS(data string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// splitICSProperty splits a content line into its upper-cased name, its
+// parameters (upper-cased names, unquoted values) and its raw value
+func splitICSProperty(line string) (string, map[string]string, string) {
+	// The value starts at the first colon outside a quoted parameter value
+	quoted, colon := false, -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, ""
+	}
+
+	fields := strings.Split(line[:colon], ";")
+	params := make(map[string]string)
+	for _, param := range fields[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return strings.ToUpper(strings.TrimSpace(fields[0])), params, strings.TrimSpace(line[colon+1:])
+}
+
+// unescapeICSText decodes the backslash escapes of an iCalendar TEXT value
+func unescapeICSText(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+			switch value[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(value[i])
+			}
+			continue
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// parseICSTime parses a DATE or DATE-TIME value. UTC times and times with a
+// known TZID are zoned; the rest are floating and read as UTC.
+func parseICSTime(value string, params map[string]string) (t time.Time, allDay, floating bool, err error) {
+	if strings.EqualFold(params["VALUE"], "DATE") || len(value) == len("20060102") {
+		t, err = time.Parse("20060102", value)
+		return t, true, false, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, false, err
+	}
+	if tzid := params["TZID"]; tzid != "" {
+		if loc, err := time.LoadLocation(tzid); err == nil {
+			t, err = time.ParseInLocation("20060102T150405", value, loc)
+			return t, false, false, err
+		}
+	}
+	t, err = time.Parse("20060102T150405", value)
+	return t, false, true, err
+}
+
+// eventWhen describes when an event happens. Zoned times are shown in New
+// York time, like the banner; all-day events show their dates.
+func eventWhen(event *CalendarEvent) string {
+	if event.AllDay {
+		const dateLayout = "Mon, 2 Jan 2006"
+		when := event.Start.Format(dateLayout)
+		if last := event.End.AddDate(0, 0, -1); last.After(event.Start) {
+			when += " – " + last.Format(dateLayout)
+		}
+		return when + " (all day)"
+	}
+
+	start, end := event.Start, event.End
+	layout, timeLayout := "Mon, 2 Jan 2006 15:04", "15:04"
+	if !event.Floating {
+		if ny, err := time.LoadLocation("America/New_York"); err == nil {
+			start, end = start.In(ny), end.In(ny)
+		}
+		layout, timeLayout = layout+" MST", timeLayout+" MST"
+	}
+
+	when := start.Format(layout)
+	switch {
+	case event.End.IsZero():
+	case start.YearDay() == end.YearDay() && start.Year() == end.Year():
+		when = start.Format("Mon, 2 Jan 2006 15:04") + " – " + end.Format(timeLayout)
+	default:
+		when += " – " + end.Format(layout)
+	}
+	return when
+}
+
+// renderEventCard returns a block showing an event's title, time and place,
+// to be placed above the email body. Like the banner, every field is
+// HTML-escaped.
+func renderEventCard(event *CalendarEvent) string {
+	summary := event.Summary
+	if summary == "" {
+		summary = "(No title)"
+	}
+	var where string
+	if event.Location != "" {
+		where = fmt.Sprintf("<div>Where: %s</div>\n", html.EscapeString(event.Location))
+	}
+
+	return fmt.Sprintf(`<div class="aar-event" style="margin: 0 0 20px; padding: 16px 20px; background: #f9fafb; color: #111827; border: 1px solid #d1d5db; border-left: 4px solid #2563eb; border-radius: 6px; font: 14px/1.5 %s;">
+<div style="font-size: 12px; text-transform: uppercase; letter-spacing: 0.05em; color: #6b7280;">Calendar event</div>
+<div style="font-size: 18px; font-weight: 600;">%s</div>
+<div>When: %s</div>
+%s</div>
+`, defaultFontFamily, html.EscapeString(summary), html.EscapeString(eventWhen(event)), where)
+}
+
+// calendarCard returns the event card for an email's calendar part, or ""
+// when it has none or it can't be read, noting which in output
+func calendarCard(email Email, output io.Writer) string {
+	partID, ok := email.CalendarPart()
+	if !ok {
+		return ""
+	}
+	ics, fetched := email.BodyValues[partID]
+	if !fetched {
+		fmt.Fprintln(output, "  Calendar part found but the server didn't return its content; rendering the email as is")
+		return ""
+	}
+	event, err := parseICS(ics.Value)
+	if err != nil {
+		fmt.Fprintf(output, "  Calendar part could not be read (%v); rendering the email as is\n", err)
+		return ""
+	}
+	fmt.Fprintf(output, "  Calendar event: %s\n", event.Summary)
+	return renderEventCard(event)
+}
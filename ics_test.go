@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testInvite is a typical invite: folded and escaped text, a TZID and an
+// alarm whose properties must not leak into the event
+const testInvite = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:123@example.com\r\n" +
+	"SUMMARY:Quarterly planning\\, Q4 review with the whole\r\n" +
+	"  team\r\n" +
+	"DTSTART;TZID=America/New_York:20251024T103000\r\n" +
+	"DTEND;TZID=America/New_York:20251024T113000\r\n" +
+	"LOCATION;LANGUAGE=en:Room 4B\\; \"Main\" building\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"SUMMARY:Reminder\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+// Test an invite's summary, location and times are read, ignoring its alarm
+func TestParseICS(t *testing.T) {
+	event, err := parseICS(testInvite)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if event.Summary != "Quarterly planning, Q4 review with the whole team" {
+		t.Errorf("Unexpected summary %q", event.Summary)
+	}
+	if event.Location != `Room 4B; "Main" building` {
+		t.Errorf("Unexpected location %q", event.Location)
+	}
+	start := time.Date(2025, 10, 24, 14, 30, 0, 0, time.UTC)
+	if !event.Start.Equal(start) || !event.End.Equal(start.Add(time.Hour)) || event.AllDay || event.Floating {
+		t.Errorf("Unexpected times %+v", event)
+	}
+	if when := eventWhen(event); when != "Fri, 24 Oct 2025 10:30 – 11:30 EDT" {
+		t.Errorf("Unexpected when %q", when)
+	}
+}
+
+// Test how each kind of start and end time is shown
+func TestEventWhen(t *testing.T) {
+	tests := []struct {
+		name     string
+		ics      string
+		expected string
+	}{
+		{"UTC", "DTSTART:20251024T143000Z", "Fri, 24 Oct 2025 10:30 EDT"},
+		{"floating", "DTSTART:20251024T093000\nDTEND:20251025T170000", "Fri, 24 Oct 2025 09:30 – Sat, 25 Oct 2025 17:00"},
+		{"one day", "DTSTART;VALUE=DATE:20251024\nDTEND;VALUE=DATE:20251025", "Fri, 24 Oct 2025 (all day)"},
+		{"several days", "DTSTART;VALUE=DATE:20251024\nDTEND;VALUE=DATE:20251027", "Fri, 24 Oct 2025 – Sun, 26 Oct 2025 (all day)"},
+	}
+	for _, tt := range tests {
+		event, err := parseICS("BEGIN:VEVENT\n" + tt.ics + "\nEND:VEVENT\n")
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %v", tt.name, err)
+		}
+		if when := eventWhen(event); when != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, when)
+		}
+	}
+}
+
+// Test documents without a usable event are rejected
+func TestParseICS_Invalid(t *testing.T) {
+	for _, ics := range []string{
+		"BEGIN:VCALENDAR\nEND:VCALENDAR\n",
+		"BEGIN:VEVENT\nSUMMARY:No start\nEND:VEVENT\n",
+		"BEGIN:VEVENT\nDTSTART:tomorrow\nEND:VEVENT\n",
+		"BEGIN:VEVENT\nDTSTART:20251024T143000Z\n",
+	} {
+		if _, err := parseICS(ics); err == nil {
+			t.Errorf("Expected error for %q", ics)
+		}
+	}
+}
+
+// Test the event card escapes its fields
+func TestRenderEventCard(t *testing.T) {
+	card := renderEventCard(&CalendarEvent{
+		Summary: "<script>alert(1)</script>",
+		Start:   time.Date(2025, 10, 24, 14, 30, 0, 0, time.UTC),
+	})
+	if strings.Contains(card, "<script>") || !strings.Contains(card, "&lt;script&gt;") {
+		t.Errorf("Expected the summary escaped, got:\n%s", card)
+	}
+	if strings.Contains(card, "Where:") {
+		t.Errorf("Expected no location line, got:\n%s", card)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// thumbnailPath returns the thumbnail path for a screenshot, e.g. a.png -> a.thumb.png
+func thumbnailPath(screenshotPath string) string {
+	return trimExtension(screenshotPath) + ".thumb.png"
+}
+
+// writeThumbnail decodes a PNG screenshot and writes a copy scaled to width pixels wide
+func writeThumbnail(path string, pngData []byte, width int) error {
+	src, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		return fmt.Errorf("failed to decode screenshot: %w", err)
+	}
+
+	thumb := scaleToWidth(src, width)
+	return writeAtomic(path, func(w io.Writer) error {
+		return png.Encode(w, thumb)
+	})
+}
+
+// scaleToWidth downsamples src to width pixels wide, preserving the aspect
+// ratio, by averaging the source pixels covered by each destination pixel.
+// Images already narrower than width are copied at their original size.
+func scaleToWidth(src image.Image, width int) *image.RGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if width <= 0 || width > srcW {
+		width = srcW
+	}
+	height := srcH * width / srcW
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for dy := 0; dy < height; dy++ {
+		y0 := bounds.Min.Y + dy*srcH/height
+		y1 := bounds.Min.Y + (dy+1)*srcH/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < width; dx++ {
+			x0 := bounds.Min.X + dx*srcW/width
+			x1 := bounds.Min.X + (dx+1)*srcW/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := src.At(x, y).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(dx, dy, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// optimizePNG re-encodes a PNG at the best compression level, dropping any
+// metadata chunks. The original is returned if re-encoding doesn't shrink it.
+func optimizePNG(pngData []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode screenshot: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode screenshot: %w", err)
+	}
+	if buf.Len() >= len(pngData) {
+		return pngData, nil
+	}
+	return buf.Bytes(), nil
+}
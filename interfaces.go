@@ -2,13 +2,92 @@ package main
 
 // EmailClient defines the interface for JMAP email operations
 type EmailClient interface {
+	AccountID() string
 	FindMailboxByName(name string) (*Mailbox, error)
-	GetEmailsInMailbox(mailboxID string, limit int) ([]string, error)
-	GetEmails(emailIDs []string) ([]Email, error)
+	FindMailboxByRole(role string) (*Mailbox, error)
+	ListMailboxes() ([]Mailbox, error)
+	GetEmailsInMailbox(mailboxID string, query QueryOptions) (emailIDs []string, total int, err error)
+	GetEmails(emailIDs []string) (*EmailGetResult, error)
+	GetThread(threadID string) ([]string, error)
+	DownloadBlob(blobID, mimeType, name string) ([]byte, error)
 	MoveEmail(emailID, sourceMailboxID, targetMailboxID string) error
+	MoveEmailIfInState(emailID, sourceMailboxID, targetMailboxID, ifInState string) (newState string, err error)
+	MoveEmails(emailIDs []string, sourceMailboxID, targetMailboxID string) (moved []string, failed map[string]error)
+	CopyEmail(emailID, targetMailboxID string) error
+	GetEmailState() (string, error)
+	GetEmailChanges(sinceState string) (created, updated, destroyed []string, newState string, err error)
 }
 
-// ScreenshotService defines the interface for screenshot generation
+// ScreenshotService defines the interface for screenshot generation.
+// GenerateScreenshot returns a path along with an error when the screenshot
+// was written but some of its extra formats failed.
 type ScreenshotService interface {
-	GenerateScreenshot(timestamp, emailID, htmlContent string) (string, error)
+	GenerateScreenshot(subdir, timestamp, emailID, htmlContent string) (string, error)
+	HasScreenshot(emailID string) bool
+	RenderHTML(htmlContent string) string
+}
+
+// outputLister is implemented by screenshot services that can write more
+// than one file per screenshot, such as one per extra format
+type outputLister interface {
+	OutputPaths(screenshotPath string) []string
+}
+
+// unchangedCounter is implemented by screenshot services that can leave a
+// screenshot as it was when a new capture is identical
+type unchangedCounter interface {
+	UnchangedCount() int
+}
+
+// unchangedCount returns how many screenshots generator has left as they
+// were, which is none unless it says otherwise
+func unchangedCount(generator ScreenshotService) int {
+	if counter, ok := generator.(unchangedCounter); ok {
+		return counter.UnchangedCount()
+	}
+	return 0
+}
+
+// contentNamer is implemented by screenshot services that can name a
+// screenshot after its content, so one may already exist for some HTML
+// whatever email it came from
+type contentNamer interface {
+	ExistingScreenshot(subdir, htmlContent string) (string, bool)
+}
+
+// hasScreenshotFor reports whether generator already has a screenshot for
+// the email, by its ID or, when it names screenshots by content, its HTML
+func hasScreenshotFor(generator ScreenshotService, emailID, subdir, htmlContent string) bool {
+	if generator.HasScreenshot(emailID) {
+		return true
+	}
+	if namer, ok := generator.(contentNamer); ok {
+		_, exists := namer.ExistingScreenshot(subdir, htmlContent)
+		return exists
+	}
+	return false
+}
+
+// capabilityReporter is implemented by email clients that know the server's
+// limits
+type capabilityReporter interface {
+	Capabilities() CoreCapabilities
+}
+
+// clientCapabilities returns the server limits client knows, which are none
+// unless it says otherwise
+func clientCapabilities(client EmailClient) CoreCapabilities {
+	if reporter, ok := client.(capabilityReporter); ok {
+		return reporter.Capabilities()
+	}
+	return CoreCapabilities{}
+}
+
+// outputPaths returns every file generator wrote for the screenshot at
+// screenshotPath, which is just that one unless it says otherwise
+func outputPaths(generator ScreenshotService, screenshotPath string) []string {
+	if lister, ok := generator.(outputLister); ok {
+		return lister.OutputPaths(screenshotPath)
+	}
+	return []string{screenshotPath}
 }
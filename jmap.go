@@ -2,34 +2,131 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
 )
 
 const (
 	jmapServerURL = "https://api.fastmail.com/jmap/session"
 )
 
+// errRequestTooLarge marks a request the server would reject (or rejected)
+// for its size, which a smaller batch may fix
+var errRequestTooLarge = errors.New("request too large")
+
+// isRequestTooLarge reports whether err means the request should be split
+func isRequestTooLarge(err error) bool {
+	return errors.Is(err, errRequestTooLarge) || isJMAPError(err, "requestTooLarge")
+}
+
+// mailCapability is the capability URN of JMAP Mail, which an account must
+// have for this tool to use it
+const mailCapability = "urn:ietf:params:jmap:mail"
+
+// defaultUsing are the capabilities declared in every JMAP request
+var defaultUsing = []string{
+	"urn:ietf:params:jmap:core",
+	mailCapability,
+}
+
 // JMAPClient handles JMAP API interactions
 type JMAPClient struct {
-	apiKey     string
-	accountID  string
-	apiURL     string
-	httpClient *http.Client
+	auth               Authenticator
+	account            string // Account ID or name to use instead of the primary mail account
+	fetchAllBodyValues bool   // Also fetch the body values of AMP and calendar parts
+	exclusiveMoves     bool   // Moves replace mailboxIds instead of patching them
+	preserveKeywords   bool   // Moves that change keywords never remove any
+	accountID          string
+	sessionURL         string
+	apiURL             string
+	downloadURL        string // URI template for blob downloads
+	capabilities       CoreCapabilities
+	using              []string // Capability URNs declared in each request (default: defaultUsing)
+	httpClient         *http.Client
+	limiter            *rateLimiter
+	ctx                context.Context // Cancels requests when done; nil means never
+	tracer             *tracer
+	traceFile          *os.File
+	mailboxes          mailboxCache // Mailboxes already looked up
+	headers            []string     // Header fields fetched into Email.Headers
+}
+
+// ClientOptions configures a JMAPClient
+type ClientOptions struct {
+	APIKey            string
+	Auth              Authenticator // Credentials; defaults to bearer auth with APIKey
+	SessionURL        string        // JMAP session endpoint (default: Fastmail)
+	Capabilities      []string      // Extra capability URNs to declare in requests, e.g. vendor extensions
+	RequestsPerSecond float64       // Maximum JMAP API requests per second (0 = unlimited)
+	TraceFile         string        // Append raw JMAP requests/responses as JSON Lines to this file
+
+	// Context cancels the client's requests when it is done, including any
+	// waiting for the rate limiter (default: never)
+	Context context.Context
+
+	// CAFile adds the PEM certificates in this file to the trusted roots,
+	// for servers with a private CA. InsecureSkipVerify disables certificate
+	// verification entirely and is only meant for testing.
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// Account selects a mail account by ID or name instead of the session's
+	// primary mail account, for logins with access to several
+	Account string
+
+	// FetchAllBodyValues fetches the content of every text part, not just
+	// htmlBody, so AMP for Email and calendar parts can be rendered
+	FetchAllBodyValues bool
+
+	// ExclusiveMoves makes moves set an email's mailboxIds to just the
+	// target, removing it from every other mailbox it was also in, instead
+	// of only swapping the source for the target
+	ExclusiveMoves bool
+
+	// PreserveKeywords makes a move that changes keywords read each email's
+	// current keywords first and only ever add to them, so flags such as
+	// $flagged survive it. Moves that only change mailboxes are unaffected.
+	PreserveKeywords bool
+
+	// Headers names header fields, such as List-Unsubscribe, to fetch with
+	// each email into Email.Headers
+	Headers []string
 }
 
 // SessionResponse represents the JMAP session response
 type SessionResponse struct {
-	Accounts        map[string]Account `json:"accounts"`
-	PrimaryAccounts map[string]string  `json:"primaryAccounts"`
-	ApiURL          string             `json:"apiUrl"`
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+	Accounts        map[string]Account         `json:"accounts"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	ApiURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+}
+
+// CoreCapabilities are the server limits advertised under
+// urn:ietf:params:jmap:core in the session. Zero means no limit is known.
+type CoreCapabilities struct {
+	MaxSizeRequest    int64 `json:"maxSizeRequest"`
+	MaxCallsInRequest int   `json:"maxCallsInRequest"`
+	MaxObjectsInGet   int   `json:"maxObjectsInGet"`
+	MaxObjectsInSet   int   `json:"maxObjectsInSet"`
 }
 
 // Account represents a JMAP account
 type Account struct {
-	Name string `json:"name"`
+	Name                string                     `json:"name"`
+	AccountCapabilities map[string]json.RawMessage `json:"accountCapabilities"`
 }
 
 // MailboxQueryResponse represents the response to a Mailbox/query
@@ -49,9 +146,13 @@ type EmailGetResponse struct {
 
 // Mailbox represents a JMAP mailbox
 type Mailbox struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Role string `json:"role,omitempty"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Role     string `json:"role,omitempty"`
+	ParentID string `json:"parentId,omitempty"`
+
+	TotalEmails  int `json:"totalEmails"`
+	UnreadEmails int `json:"unreadEmails"`
 }
 
 // Email represents a JMAP email
@@ -63,6 +164,307 @@ type Email struct {
 	HTMLBody   []HTMLBodyPart       `json:"htmlBody"`
 	BodyValues map[string]BodyValue `json:"bodyValues"`
 	MailboxIds map[string]bool      `json:"mailboxIds"`
+	Preview    string               `json:"preview"` // Plain-text snippet; empty if the server doesn't provide one
+	ThreadID   string               `json:"threadId"`
+	Keywords   map[string]bool      `json:"keywords"` // Flags such as $seen and $flagged
+
+	// Headers holds the header fields requested with ClientOptions.Headers
+	// by the name they were requested as, decoded as text. Fields the email
+	// doesn't have are absent.
+	Headers map[string]string `json:"-"`
+
+	// BodyStructure is the full MIME tree, used to find parts such as AMP
+	// that htmlBody never includes
+	BodyStructure *BodyPart `json:"bodyStructure,omitempty"`
+
+	// Attachments are the parts a mail client would list as attachments
+	Attachments []BodyPart `json:"attachments,omitempty"`
+}
+
+// BodyPart is a node of an email's MIME structure, or one of its attachments
+type BodyPart struct {
+	PartID   string     `json:"partId"`
+	Type     string     `json:"type"`
+	SubParts []BodyPart `json:"subParts,omitempty"`
+
+	BlobID string `json:"blobId,omitempty"` // For downloading the part's content
+	Name   string `json:"name,omitempty"`   // File name, if the part has one
+	Size   int64  `json:"size,omitempty"`   // Decoded size in bytes
+
+	// CID is the part's Content-ID without angle brackets, and ContentType
+	// its raw Content-Type header, whose start parameter names the root
+	// part of a multipart/related
+	CID         string `json:"cid,omitempty"`
+	ContentType string `json:"header:Content-Type,omitempty"`
+}
+
+// bodyProperties are the properties Email/get returns for each body part:
+// JMAP's defaults plus the Content-Type header and subParts
+var bodyProperties = []string{
+	"partId", "blobId", "size", "name", "type", "charset", "disposition",
+	"cid", "language", "location", "subParts", "header:Content-Type",
+}
+
+// Content types of the alternative parts that can be rendered
+const (
+	ampMIMEType      = "text/x-amp-html"
+	calendarMIMEType = "text/calendar"
+)
+
+// AMPPart returns the ID of the email's AMP for Email part, if it has one
+func (e Email) AMPPart() (string, bool) {
+	return e.partOfType(ampMIMEType)
+}
+
+// CalendarPart returns the ID of the email's text/calendar (ICS) part, if it
+// has one
+func (e Email) CalendarPart() (string, bool) {
+	return e.partOfType(calendarMIMEType)
+}
+
+// TruncatedBody reports whether the server returned only the start of any of
+// the email's body values
+func (e Email) TruncatedBody() bool {
+	for _, value := range e.BodyValues {
+		if value.IsTruncated {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodingProblem reports whether the server couldn't decode any of the
+// email's body values
+func (e Email) EncodingProblem() bool {
+	for _, value := range e.BodyValues {
+		if value.IsEncodingProblem {
+			return true
+		}
+	}
+	return false
+}
+
+// partOfType returns the ID of the first part of the email's body structure
+// with the given content type, breadth first
+func (e Email) partOfType(mimeType string) (string, bool) {
+	if e.BodyStructure == nil {
+		return "", false
+	}
+	parts := []BodyPart{*e.BodyStructure}
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = append(parts[1:], part.SubParts...)
+		if strings.EqualFold(part.Type, mimeType) && part.PartID != "" {
+			return part.PartID, true
+		}
+	}
+	return "", false
+}
+
+// RootHTMLPart returns the ID of the HTML part at the root of the email's
+// body structure, the one a mail client shows as the body. Unlike the first
+// htmlBody part, this honors a multipart/related start parameter, so an
+// inline fragment listed before the real body isn't chosen.
+func (e Email) RootHTMLPart() (string, bool) {
+	if e.BodyStructure == nil {
+		return "", false
+	}
+	return rootHTMLPart(*e.BodyStructure)
+}
+
+// rootHTMLPart returns the ID of the root HTML part of part: the related
+// part named by start (else the first), the last HTML alternative, or the
+// first part of any other multipart
+func rootHTMLPart(part BodyPart) (string, bool) {
+	mediaType := strings.ToLower(part.Type)
+	switch {
+	case mediaType == "text/html":
+		return part.PartID, part.PartID != ""
+	case len(part.SubParts) == 0:
+		return "", false
+	case mediaType == "multipart/related":
+		return rootHTMLPart(relatedRoot(part))
+	case mediaType == "multipart/alternative":
+		for i := len(part.SubParts) - 1; i >= 0; i-- {
+			if id, ok := rootHTMLPart(part.SubParts[i]); ok {
+				return id, true
+			}
+		}
+		return "", false
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return rootHTMLPart(part.SubParts[0])
+	default:
+		return "", false
+	}
+}
+
+// relatedRoot returns the root of a multipart/related: the subpart whose
+// Content-ID is its start parameter, or the first subpart by default
+func relatedRoot(part BodyPart) BodyPart {
+	_, params, err := mime.ParseMediaType(strings.TrimSpace(part.ContentType))
+	if start := strings.Trim(params["start"], "<>"); err == nil && start != "" {
+		for _, sub := range part.SubParts {
+			if strings.Trim(sub.CID, "<>") == start {
+				return sub
+			}
+		}
+	}
+	return part.SubParts[0]
+}
+
+// PrimarySender returns the display name and address of an email's first
+// sender. A missing name falls back to the address, and an email without a
+// sender is named "unknown" with an empty address.
+func PrimarySender(e Email) (name, address string) {
+	if len(e.From) == 0 {
+		return "unknown", ""
+	}
+
+	name, address = strings.TrimSpace(e.From[0].Name), strings.TrimSpace(e.From[0].Email)
+	if name == "" {
+		name = address
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return name, address
+}
+
+// QueryOptions controls which emails an Email/query returns
+type QueryOptions struct {
+	Limit         int  // Maximum number of IDs to return (0 = server default)
+	NewestFirst   bool // Sort by receivedAt descending
+	UnreadOnly    bool // Only emails without the $seen keyword
+	HasAttachment bool // Only emails with an attachment
+}
+
+// EmailGetResult is the parsed result of an Email/get call
+type EmailGetResult struct {
+	List     []Email  `json:"list"`
+	NotFound []string `json:"notFound"`
+	State    string   `json:"state"`
+
+	// Failed holds why each email in a batch that failed as a whole wasn't
+	// fetched, when other batches of the same call succeeded
+	Failed map[string]error `json:"-"`
+}
+
+// ByID returns the emails returned by ID. Emails that weren't found, or
+// whose batch failed, have no entry.
+func (r *EmailGetResult) ByID() map[string]Email {
+	byID := make(map[string]Email, len(r.List))
+	for _, email := range r.List {
+		byID[email.ID] = email
+	}
+	return byID
+}
+
+// FailedErr returns an error for the emails in Failed, naming the first by
+// ID, or nil if there are none
+func (r *EmailGetResult) FailedErr() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	emailIDs := slices.Sorted(maps.Keys(r.Failed))
+	return fmt.Errorf("failed to fetch %d email(s), such as %s: %w", len(emailIDs), emailIDs[0], r.Failed[emailIDs[0]])
+}
+
+// IsNotFound reports whether the server listed emailID as not found
+func (r *EmailGetResult) IsNotFound(emailID string) bool {
+	for _, id := range r.NotFound {
+		if id == emailID {
+			return true
+		}
+	}
+	return false
+}
+
+// JMAPError is a method-level error returned by the server, such as
+// accountReadOnly or cannotCalculateChanges
+type JMAPError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *JMAPError) Error() string {
+	if e.Type == "accountReadOnly" {
+		return "API key has read-only permissions. Please create a new Fastmail API token with read-write permissions for Mail"
+	}
+	if e.Description == "" {
+		return fmt.Sprintf("JMAP error (%s)", e.Type)
+	}
+	return fmt.Sprintf("JMAP error (%s): %s", e.Type, e.Description)
+}
+
+// isJMAPError reports whether err is a JMAP method error of the given type
+func isJMAPError(err error, errorType string) bool {
+	var jmapErr *JMAPError
+	return errors.As(err, &jmapErr) && jmapErr.Type == errorType
+}
+
+// IsStateMismatch reports whether err is a guarded update rejected because
+// the server state changed since it was read
+func IsStateMismatch(err error) bool {
+	return isJMAPError(err, "stateMismatch")
+}
+
+// IsAuthError reports whether err means the credentials were rejected or
+// lack the permissions needed, as opposed to a transient or data problem
+func IsAuthError(err error) bool {
+	if errors.Is(err, ErrAuthExpired) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden
+	}
+	return isJMAPError(err, "accountReadOnly") || isJMAPError(err, "forbidden") || isJMAPError(err, "accountNotFound")
+}
+
+// ErrAuthExpired is returned when the API rejects credentials it accepted
+// before, such as an expired token, and they couldn't be refreshed. Every
+// later request would fail the same way, so it ends the run.
+var ErrAuthExpired = errors.New("authentication expired")
+
+// StatusError is an HTTP response from the JMAP server with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Body)
+}
+
+// MailboxNotFoundError is a mailbox lookup by name or role that matched nothing
+type MailboxNotFoundError struct {
+	Name string
+	Role string
+}
+
+func (e *MailboxNotFoundError) Error() string {
+	if e.Role != "" {
+		return fmt.Sprintf("mailbox with role '%s' not found", e.Role)
+	}
+	return fmt.Sprintf("mailbox '%s' not found", e.Name)
+}
+
+// methodError returns the error carried by a method response, or nil if it
+// is not an error response
+func methodError(methodResponse []interface{}) error {
+	if len(methodResponse) < 2 {
+		return nil
+	}
+	if methodName, ok := methodResponse[0].(string); !ok || methodName != "error" {
+		return nil
+	}
+
+	errorData, _ := json.Marshal(methodResponse[1])
+	var jmapErr JMAPError
+	if err := json.Unmarshal(errorData, &jmapErr); err != nil || jmapErr.Type == "" {
+		return fmt.Errorf("JMAP error: %s", string(errorData))
+	}
+	return &jmapErr
 }
 
 // EmailAddress represents an email address
@@ -79,33 +481,124 @@ type HTMLBodyPart struct {
 
 // BodyValue represents the body content
 type BodyValue struct {
-	Value  string `json:"value"`
-	IsHTML bool   `json:"isEncodingProblem"`
+	Value string `json:"value"`
+
+	// IsEncodingProblem is set when the server couldn't decode the part's
+	// bytes in its declared charset, so some characters were replaced
+	IsEncodingProblem bool `json:"isEncodingProblem"`
+
+	// IsTruncated is set when Value is only the start of the part, cut at
+	// maxBodyValueBytes
+	IsTruncated bool `json:"isTruncated"`
 }
 
 // NewJMAPClient creates a new JMAP client
-func NewJMAPClient(apiKey string) (*JMAPClient, error) {
+func NewJMAPClient(opts ClientOptions) (*JMAPClient, error) {
+	for _, name := range opts.Headers {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	httpClient, err := newHTTPClient(opts.CAFile, opts.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
 	client := &JMAPClient{
-		apiKey:     apiKey,
-		httpClient: &http.Client{},
+		auth:               opts.Auth,
+		account:            opts.Account,
+		fetchAllBodyValues: opts.FetchAllBodyValues,
+		exclusiveMoves:     opts.ExclusiveMoves,
+		preserveKeywords:   opts.PreserveKeywords,
+		headers:            opts.Headers,
+		sessionURL:         opts.SessionURL,
+		httpClient:         httpClient,
+		limiter:            newRateLimiter(opts.RequestsPerSecond),
+		ctx:                opts.Context,
+		using:              withCapabilities(defaultUsing, opts.Capabilities),
+	}
+	if client.auth == nil {
+		client.auth = BearerAuth{Token: opts.APIKey}
+	}
+	if client.sessionURL == "" {
+		client.sessionURL = jmapServerURL
+	}
+
+	if opts.TraceFile != "" {
+		f, err := os.OpenFile(opts.TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		client.traceFile = f
+		client.tracer = &tracer{w: f}
 	}
 
 	if err := client.authenticate(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("authentication failed: %w", err)
 	}
 
 	return client, nil
 }
 
+// newHTTPClient returns the HTTP client for JMAP requests. The default
+// transport is used unless a CA file or skipping verification calls for a
+// custom TLS configuration.
+func newHTTPClient(caFile string, insecure bool) (*http.Client, error) {
+	if caFile == "" && !insecure {
+		return &http.Client{}, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no PEM certificates found in CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// withCapabilities returns base followed by any extra URNs not already in it
+func withCapabilities(base, extra []string) []string {
+	using := append([]string(nil), base...)
+	for _, urn := range extra {
+		if !slices.Contains(using, urn) {
+			using = append(using, urn)
+		}
+	}
+	return using
+}
+
+// Close releases resources held by the client, such as the trace file
+func (c *JMAPClient) Close() error {
+	if c.traceFile != nil {
+		return c.traceFile.Close()
+	}
+	return nil
+}
+
 // authenticate establishes a session with the JMAP server
 func (c *JMAPClient) authenticate() error {
-	req, err := http.NewRequest("GET", jmapServerURL, nil)
+	req, err := http.NewRequestWithContext(c.requestContext(), "GET", c.sessionURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.auth.Authorize(req)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -115,7 +608,13 @@ func (c *JMAPClient) authenticate() error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("authentication failed with status %d: %s", resp.StatusCode, string(body))
+		err := &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+		if resp.StatusCode == http.StatusUnauthorized {
+			if hint := authHint(resp.Header.Values("WWW-Authenticate"), c.auth); hint != "" {
+				return fmt.Errorf("authentication failed with %w (%s)", err, hint)
+			}
+		}
+		return fmt.Errorf("authentication failed with %w", err)
 	}
 
 	var session SessionResponse
@@ -123,25 +622,95 @@ func (c *JMAPClient) authenticate() error {
 		return fmt.Errorf("failed to decode session response: %w", err)
 	}
 
-	// Get the primary account ID
-	accountID, ok := session.PrimaryAccounts["urn:ietf:params:jmap:mail"]
-	if !ok {
-		return fmt.Errorf("no primary mail account found")
+	accountID, err := selectAccount(session, c.account)
+	if err != nil {
+		return err
 	}
 
 	c.accountID = accountID
 	c.apiURL = session.ApiURL
+	c.downloadURL = session.DownloadURL
+
+	if core, ok := session.Capabilities["urn:ietf:params:jmap:core"]; ok {
+		if err := json.Unmarshal(core, &c.capabilities); err != nil {
+			return fmt.Errorf("failed to decode core capabilities: %w", err)
+		}
+	}
 
 	return nil
 }
 
+// selectAccount returns the ID of the mail account named by account, matched
+// against the session's account IDs and then names, or of the primary mail
+// account when account is empty
+func selectAccount(session SessionResponse, account string) (string, error) {
+	if account == "" {
+		accountID, ok := session.PrimaryAccounts[mailCapability]
+		if !ok {
+			return "", fmt.Errorf("no primary mail account found")
+		}
+		return accountID, nil
+	}
+
+	accountID := ""
+	if _, ok := session.Accounts[account]; ok {
+		accountID = account
+	} else {
+		for id, a := range session.Accounts {
+			if !strings.EqualFold(a.Name, account) {
+				continue
+			}
+			if accountID != "" {
+				return "", fmt.Errorf("account name '%s' is ambiguous; use an account ID", account)
+			}
+			accountID = id
+		}
+	}
+	if accountID == "" {
+		return "", &AccountNotFoundError{Account: account}
+	}
+	if _, ok := session.Accounts[accountID].AccountCapabilities[mailCapability]; !ok {
+		return "", fmt.Errorf("account '%s' does not support mail", account)
+	}
+	return accountID, nil
+}
+
+// AccountNotFoundError is an -account that matches no account in the session
+type AccountNotFoundError struct {
+	Account string
+}
+
+func (e *AccountNotFoundError) Error() string {
+	return fmt.Sprintf("account '%s' not found", e.Account)
+}
+
+// AccountID returns the mail account ID in use, the primary one unless
+// another was selected
+func (c *JMAPClient) AccountID() string {
+	return c.accountID
+}
+
+// Capabilities returns the core limits advertised by the server
+func (c *JMAPClient) Capabilities() CoreCapabilities {
+	return c.capabilities
+}
+
+// requestContext returns the context the client's requests are made with
+func (c *JMAPClient) requestContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 // makeRequest makes a JMAP API request
 func (c *JMAPClient) makeRequest(methodCalls []interface{}) ([]byte, error) {
+	using := c.using
+	if len(using) == 0 {
+		using = defaultUsing
+	}
 	requestBody := map[string]interface{}{
-		"using": []string{
-			"urn:ietf:params:jmap:core",
-			"urn:ietf:params:jmap:mail",
-		},
+		"using":       using,
 		"methodCalls": methodCalls,
 	}
 
@@ -149,31 +718,121 @@ func (c *JMAPClient) makeRequest(methodCalls []interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
+	if limit := c.capabilities.MaxSizeRequest; limit > 0 && int64(len(jsonData)) > limit {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the server's maxSizeRequest of %d", errRequestTooLarge, len(jsonData), limit)
+	}
 
-	req, err := http.NewRequest("POST", c.apiURL, bytes.NewBuffer(jsonData))
+	statusCode, body, err := c.sendRequest(jsonData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
+	}
+
+	// Credentials can expire during a long run. Refreshable ones get one
+	// retry; otherwise every later request would be rejected the same way.
+	if isRejected(statusCode) {
+		if refresher, ok := c.auth.(RefreshingAuthenticator); ok {
+			if err := refresher.Refresh(); err != nil {
+				return nil, fmt.Errorf("%w: failed to refresh credentials: %w", ErrAuthExpired, err)
+			}
+			statusCode, body, err = c.sendRequest(jsonData)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if isRejected(statusCode) {
+			return nil, fmt.Errorf("%w: request failed with %w", ErrAuthExpired, &StatusError{StatusCode: statusCode, Body: string(body)})
+		}
+	}
+
+	if statusCode != http.StatusOK {
+		if statusCode == http.StatusRequestEntityTooLarge {
+			return nil, fmt.Errorf("%w: status %d: %s", errRequestTooLarge, statusCode, string(body))
+		}
+		return nil, fmt.Errorf("request failed with %w", &StatusError{StatusCode: statusCode, Body: string(body)})
+	}
+	return body, nil
+}
+
+// sendRequest POSTs an encoded JMAP request to the API URL, returning the
+// response's status code and body
+func (c *JMAPClient) sendRequest(jsonData []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(c.requestContext(), "POST", c.apiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	c.auth.Authorize(req)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+
+	// Throttle outbound requests, blocking until the rate limit allows
+	if err := c.limiter.Wait(req.Context()); err != nil {
+		return 0, nil, fmt.Errorf("rate limiter: %w", err)
+	}
+
+	c.tracer.traceRequest(req, jsonData)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return 0, nil, fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+	body, err := io.ReadAll(resp.Body)
+	c.tracer.traceResponse(resp.StatusCode, body)
+
+	// An error response is reported with whatever of its body was read
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return 0, nil, fmt.Errorf("failed to read response: %w", err)
 	}
+	return resp.StatusCode, body, nil
+}
 
-	return io.ReadAll(resp.Body)
+// isRejected reports whether an API response status means the credentials
+// were rejected
+func isRejected(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
 }
 
-// FindMailboxByName finds a mailbox by name
+// callMethod makes a single JMAP method call and returns the raw response
+// arguments, converting a method-level error response into a *JMAPError
+func (c *JMAPClient) callMethod(method string, args map[string]interface{}) ([]byte, error) {
+	methodCalls := []interface{}{
+		[]interface{}{method, args, "0"},
+	}
+
+	responseData, err := c.makeRequest(methodCalls)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		MethodResponses [][]interface{} `json:"methodResponses"`
+	}
+
+	if err := json.Unmarshal(responseData, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(response.MethodResponses) == 0 || len(response.MethodResponses[0]) < 2 {
+		return nil, fmt.Errorf("unexpected response format")
+	}
+
+	if err := methodError(response.MethodResponses[0]); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(response.MethodResponses[0][1])
+}
+
+// FindMailboxByName finds a mailbox by name. Mailboxes already found or
+// listed are served from memory, email counts included, until
+// InvalidateMailboxCache.
 func (c *JMAPClient) FindMailboxByName(name string) (*Mailbox, error) {
+	if mailbox, ok := c.mailboxes.name(name); ok {
+		return mailbox, nil
+	}
+
 	methodCalls := []interface{}{
 		[]interface{}{
 			"Mailbox/query",
@@ -231,23 +890,251 @@ func (c *JMAPClient) FindMailboxByName(name string) (*Mailbox, error) {
 	}
 
 	if len(getResponse.List) == 0 {
-		return nil, fmt.Errorf("mailbox '%s' not found", name)
+		return nil, &MailboxNotFoundError{Name: name}
 	}
 
+	c.mailboxes.addNamed(name, getResponse.List[0])
 	return &getResponse.List[0], nil
 }
 
-// GetEmailsInMailbox retrieves emails from a specific mailbox
-func (c *JMAPClient) GetEmailsInMailbox(mailboxID string, limit int) ([]string, error) {
-	queryArgs := map[string]interface{}{
+// FindMailboxByRole finds a mailbox by its JMAP role (e.g. "archive",
+// "inbox"), from memory once the mailboxes have been listed
+func (c *JMAPClient) FindMailboxByRole(role string) (*Mailbox, error) {
+	if mailbox, ok := c.mailboxes.role(role); ok {
+		return mailbox, nil
+	}
+
+	mailboxes, err := c.getMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range mailboxes {
+		if strings.EqualFold(mailboxes[i].Role, role) {
+			return &mailboxes[i], nil
+		}
+	}
+
+	return nil, &MailboxNotFoundError{Role: role}
+}
+
+// FindMailboxesByPattern returns every mailbox whose name, or full path of
+// "/"-separated ancestor names (e.g. "_aar/2024"), matches the glob pattern.
+// As with path.Match, "*" does not match across "/".
+func (c *JMAPClient) FindMailboxesByPattern(pattern string) ([]*Mailbox, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid mailbox pattern %q: %w", pattern, err)
+	}
+
+	mailboxes, err := c.getMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*Mailbox, len(mailboxes))
+	for i := range mailboxes {
+		byID[mailboxes[i].ID] = &mailboxes[i]
+	}
+
+	var matches []*Mailbox
+	for i := range mailboxes {
+		mailbox := &mailboxes[i]
+		nameMatch, _ := path.Match(pattern, mailbox.Name)
+		pathMatch, _ := path.Match(pattern, mailboxPath(mailbox, byID))
+		if nameMatch || pathMatch {
+			matches = append(matches, mailbox)
+		}
+	}
+
+	return matches, nil
+}
+
+// mailboxPath returns the "/"-separated names from the top-level ancestor
+// down to mailbox, stopping at a missing parent or a cycle
+func mailboxPath(mailbox *Mailbox, byID map[string]*Mailbox) string {
+	names := []string{mailbox.Name}
+	seen := map[string]bool{mailbox.ID: true}
+	for parent := byID[mailbox.ParentID]; parent != nil && !seen[parent.ID]; parent = byID[parent.ParentID] {
+		seen[parent.ID] = true
+		names = append([]string{parent.Name}, names...)
+	}
+	return strings.Join(names, "/")
+}
+
+// ListMailboxes returns every mailbox in the account, always fetched afresh
+func (c *JMAPClient) ListMailboxes() ([]Mailbox, error) {
+	return c.getMailboxes()
+}
+
+// InvalidateMailboxCache forgets the mailboxes already looked up, so the
+// next lookups fetch them again, such as after mailboxes are created or
+// renamed
+func (c *JMAPClient) InvalidateMailboxCache() {
+	c.mailboxes.clear()
+}
+
+// GetThread returns the IDs of the emails in a thread, oldest first
+func (c *JMAPClient) GetThread(threadID string) ([]string, error) {
+	responseData, err := c.callMethod("Thread/get", map[string]interface{}{
 		"accountId": c.accountID,
-		"filter": map[string]interface{}{
-			"inMailbox": mailboxID,
-		},
+		"ids":       []string{threadID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		List []struct {
+			ID       string   `json:"id"`
+			EmailIDs []string `json:"emailIds"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(responseData, &response); err != nil {
+		return nil, fmt.Errorf("failed to decode thread response: %w", err)
+	}
+
+	for _, thread := range response.List {
+		if thread.ID == threadID {
+			return thread.EmailIDs, nil
+		}
+	}
+	return nil, fmt.Errorf("thread %s not found", threadID)
+}
+
+// maxBlobBytes is the largest blob DownloadBlob reads
+const maxBlobBytes = 25 << 20
+
+// DownloadBlob downloads the content of a blob, such as an attachment, from
+// the session's download URL
+func (c *JMAPClient) DownloadBlob(blobID, mimeType, name string) ([]byte, error) {
+	if c.downloadURL == "" {
+		return nil, errors.New("the server has no download URL")
+	}
+	downloadURL := expandURITemplate(c.downloadURL, map[string]string{
+		"accountId": c.accountID,
+		"blobId":    blobID,
+		"type":      mimeType,
+		"name":      name,
+	})
+
+	req, err := http.NewRequestWithContext(c.requestContext(), "GET", downloadURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	c.auth.Authorize(req)
+	req.Header.Set("User-Agent", userAgent())
+
+	if err := c.limiter.Wait(req.Context()); err != nil {
+		return nil, fmt.Errorf("rate limiter: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("blob download failed with %w", &StatusError{StatusCode: resp.StatusCode, Body: string(body)})
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlobBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+	if len(data) > maxBlobBytes {
+		return nil, fmt.Errorf("blob is larger than %s", formatBytes(maxBlobBytes))
+	}
+	return data, nil
+}
+
+// expandURITemplate fills in the {name} variables of a level 1 URI template
+// (RFC 6570), percent-encoding every byte outside the unreserved set
+func expandURITemplate(template string, values map[string]string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		end := strings.IndexByte(template[start+1:], '}')
+		if start < 0 || end < 0 {
+			b.WriteString(template)
+			return b.String()
+		}
+		end += start + 1
+		b.WriteString(template[:start])
+		for _, c := range []byte(values[template[start+1:end]]) {
+			if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		template = template[end+1:]
+	}
+}
+
+// getMailboxes retrieves all mailboxes in the account, remembering them for
+// later lookups
+func (c *JMAPClient) getMailboxes() ([]Mailbox, error) {
+	getResponseData, err := c.callMethod("Mailbox/get", map[string]interface{}{
+		"accountId": c.accountID,
+		"ids":       nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var getResponse struct {
+		List []Mailbox `json:"list"`
 	}
 
-	if limit > 0 {
-		queryArgs["limit"] = limit
+	if err := json.Unmarshal(getResponseData, &getResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode mailbox response: %w", err)
+	}
+
+	c.mailboxes.addAll(getResponse.List)
+	return getResponse.List, nil
+}
+
+// emailFilter builds the Email/query filter for mailboxID. Extra conditions
+// are combined with inMailbox under an AND operator.
+func emailFilter(mailboxID string, query QueryOptions) map[string]interface{} {
+	conditions := []map[string]interface{}{
+		{"inMailbox": mailboxID},
+	}
+	if query.UnreadOnly {
+		conditions = append(conditions, map[string]interface{}{"notKeyword": "$seen"})
+	}
+	if query.HasAttachment {
+		conditions = append(conditions, map[string]interface{}{"hasAttachment": true})
+	}
+
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+	return map[string]interface{}{
+		"operator":   "AND",
+		"conditions": conditions,
+	}
+}
+
+// GetEmailsInMailbox retrieves emails from a specific mailbox, along with
+// how many emails match the query in all, which can be more than the IDs
+// returned when a limit applies. The total is 0 if the server didn't say.
+func (c *JMAPClient) GetEmailsInMailbox(mailboxID string, query QueryOptions) ([]string, int, error) {
+	queryArgs := map[string]interface{}{
+		"accountId":      c.accountID,
+		"filter":         emailFilter(mailboxID, query),
+		"calculateTotal": true,
+	}
+
+	if query.Limit > 0 {
+		queryArgs["limit"] = query.Limit
+	}
+
+	if query.NewestFirst {
+		queryArgs["sort"] = []map[string]interface{}{
+			{"property": "receivedAt", "isAscending": false},
+		}
 	}
 
 	methodCalls := []interface{}{
@@ -260,7 +1147,7 @@ func (c *JMAPClient) GetEmailsInMailbox(mailboxID string, limit int) ([]string,
 
 	responseData, err := c.makeRequest(methodCalls)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	var response struct {
@@ -268,49 +1155,158 @@ func (c *JMAPClient) GetEmailsInMailbox(mailboxID string, limit int) ([]string,
 	}
 
 	if err := json.Unmarshal(responseData, &response); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+		return nil, 0, fmt.Errorf("failed to decode response: %w", err)
 	}
 
 	if len(response.MethodResponses) == 0 {
-		return nil, fmt.Errorf("unexpected response format")
+		return nil, 0, fmt.Errorf("unexpected response format")
 	}
 
 	// Parse the Email/query response
 	queryResponseData, err := json.Marshal(response.MethodResponses[0][1])
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	var queryResponse struct {
-		IDs []string `json:"ids"`
+		IDs   []string `json:"ids"`
+		Total int      `json:"total"` // With calculateTotal, if the server supports it
 	}
 
 	if err := json.Unmarshal(queryResponseData, &queryResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode query response: %w", err)
+		return nil, 0, fmt.Errorf("failed to decode query response: %w", err)
+	}
+
+	return queryResponse.IDs, queryResponse.Total, nil
+}
+
+// GetEmails retrieves email details along with any IDs the server reported as
+// not found, splitting the IDs into batches no larger than the server's
+// maxObjectsInGet
+func (c *JMAPClient) GetEmails(emailIDs []string) (*EmailGetResult, error) {
+	batchSize := c.capabilities.MaxObjectsInGet
+	if batchSize <= 0 || len(emailIDs) <= batchSize {
+		return c.getEmailBatch(emailIDs)
+	}
+
+	// A batch that fails fails only its own emails, unless they all do
+	result := &EmailGetResult{}
+	var firstErr error
+	fetched := false
+	for start := 0; start < len(emailIDs); start += batchSize {
+		end := min(start+batchSize, len(emailIDs))
+		batch, err := c.getEmailBatch(emailIDs[start:end])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			for _, emailID := range emailIDs[start:end] {
+				result.Failed[emailID] = err
+			}
+			continue
+		}
+		fetched = true
+		result.List = append(result.List, batch.List...)
+		result.NotFound = append(result.NotFound, batch.NotFound...)
+		result.State = batch.State
 	}
+	if !fetched {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// headerProperty returns the Email/get property fetching a header field
+// decoded as text
+func headerProperty(name string) string {
+	return "header:" + name + ":asText"
+}
+
+// validHeaderName reports whether name is a header field name: printable
+// ASCII other than a colon
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r < '!' || r > '~' || r == ':' {
+			return false
+		}
+	}
+	return true
+}
 
-	return queryResponse.IDs, nil
+// decodeHeaders fills in the Headers of emails, decoded from the same
+// Email/get response. A header the email doesn't have comes back null and is
+// left out.
+func (c *JMAPClient) decodeHeaders(getResponseData []byte, emails []Email) error {
+	var raw struct {
+		List []map[string]json.RawMessage `json:"list"`
+	}
+	if err := json.Unmarshal(getResponseData, &raw); err != nil {
+		return fmt.Errorf("failed to decode email headers: %w", err)
+	}
+
+	for i := range min(len(emails), len(raw.List)) {
+		for _, name := range c.headers {
+			var value *string
+			if err := json.Unmarshal(raw.List[i][headerProperty(name)], &value); err != nil || value == nil {
+				continue
+			}
+			if emails[i].Headers == nil {
+				emails[i].Headers = make(map[string]string, len(c.headers))
+			}
+			emails[i].Headers[name] = strings.TrimSpace(*value)
+		}
+	}
+	return nil
 }
 
-// GetEmails retrieves email details
-func (c *JMAPClient) GetEmails(emailIDs []string) ([]Email, error) {
+// maxBodyValueBytes caps each body value Email/get returns; longer values come
+// back cut short and marked isTruncated. Unset, the cap is up to the server,
+// so it is set well above the default -max-html-size to get whole bodies
+// while still bounding a pathological one.
+const maxBodyValueBytes = 64 << 20
+
+// getEmailBatch retrieves email details with a single Email/get call
+func (c *JMAPClient) getEmailBatch(emailIDs []string) (*EmailGetResult, error) {
+	properties := []string{
+		"id",
+		"subject",
+		"receivedAt",
+		"from",
+		"htmlBody",
+		"bodyValues",
+		"mailboxIds",
+		"keywords",
+		"preview",
+		"bodyStructure",
+		"threadId",
+		"attachments",
+	}
+	for _, name := range c.headers {
+		properties = append(properties, headerProperty(name))
+	}
+	getArgs := map[string]interface{}{
+		"accountId":           c.accountID,
+		"ids":                 emailIDs,
+		"properties":          properties,
+		"bodyProperties":      bodyProperties,
+		"fetchHTMLBodyValues": true,
+		"maxBodyValueBytes":   maxBodyValueBytes,
+	}
+	// AMP and calendar parts are never in htmlBody, so their values need
+	// every text part
+	if c.fetchAllBodyValues {
+		getArgs["fetchAllBodyValues"] = true
+	}
 	methodCalls := []interface{}{
 		[]interface{}{
 			"Email/get",
-			map[string]interface{}{
-				"accountId": c.accountID,
-				"ids":       emailIDs,
-				"properties": []string{
-					"id",
-					"subject",
-					"receivedAt",
-					"from",
-					"htmlBody",
-					"bodyValues",
-					"mailboxIds",
-				},
-				"fetchHTMLBodyValues": true,
-			},
+			getArgs,
 			"0",
 		},
 	}
@@ -338,89 +1334,305 @@ func (c *JMAPClient) GetEmails(emailIDs []string) ([]Email, error) {
 		return nil, err
 	}
 
-	var getResponse struct {
-		List []Email `json:"list"`
-	}
-
-	if err := json.Unmarshal(getResponseData, &getResponse); err != nil {
+	var getResult EmailGetResult
+	if err := json.Unmarshal(getResponseData, &getResult); err != nil {
 		return nil, fmt.Errorf("failed to decode email response: %w", err)
 	}
+	if len(c.headers) > 0 {
+		if err := c.decodeHeaders(getResponseData, getResult.List); err != nil {
+			return nil, err
+		}
+	}
 
-	return getResponse.List, nil
+	return &getResult, nil
 }
 
 // MoveEmail moves an email to a different mailbox
 func (c *JMAPClient) MoveEmail(emailID, sourceMailboxID, targetMailboxID string) error {
-	methodCalls := []interface{}{
-		[]interface{}{
-			"Email/set",
-			map[string]interface{}{
-				"accountId": c.accountID,
-				"update": map[string]interface{}{
-					emailID: map[string]interface{}{
-						"mailboxIds/" + sourceMailboxID: nil,
-						"mailboxIds/" + targetMailboxID: true,
-					},
-				},
-			},
-			"0",
-		},
+	_, err := c.MoveEmailIfInState(emailID, sourceMailboxID, targetMailboxID, "")
+	return err
+}
+
+// MoveEmailIfInState moves an email only if the account's Email state still
+// equals ifInState (no guard when empty), returning the new state. If the
+// state has changed since it was read, the error satisfies IsStateMismatch
+// and the caller should re-fetch the email before retrying.
+func (c *JMAPClient) MoveEmailIfInState(emailID, sourceMailboxID, targetMailboxID, ifInState string) (string, error) {
+	patch := c.movePatch(sourceMailboxID, targetMailboxID)
+	keywords, err := c.moveKeywords([]string{emailID}, patch)
+	if err != nil {
+		return "", fmt.Errorf("failed to move email: %w", err)
 	}
+	keepKeywords(patch, keywords[emailID])
+	newState, err := c.updateEmail(emailID, patch, ifInState)
+	if err != nil {
+		return "", fmt.Errorf("failed to move email: %w", err)
+	}
+	return newState, nil
+}
 
-	responseData, err := c.makeRequest(methodCalls)
+// movePatch returns the Email/set patch moving an email from source to
+// target: by default only those two memberships change, leaving any other
+// mailboxes the email is in; with exclusiveMoves the target replaces them all
+func (c *JMAPClient) movePatch(sourceMailboxID, targetMailboxID string) map[string]interface{} {
+	if c.exclusiveMoves {
+		return map[string]interface{}{
+			"mailboxIds": map[string]bool{targetMailboxID: true},
+		}
+	}
+	return map[string]interface{}{
+		"mailboxIds/" + sourceMailboxID: nil,
+		"mailboxIds/" + targetMailboxID: true,
+	}
+}
+
+// moveKeywords returns the current keywords of emailIDs when moves preserve
+// them and patch, their move, changes keywords. Otherwise it returns nil
+// without a request, since a move that leaves keywords alone can't lose any.
+func (c *JMAPClient) moveKeywords(emailIDs []string, patch map[string]interface{}) (map[string]map[string]bool, error) {
+	if !c.preserveKeywords || !changesKeywords(patch) {
+		return nil, nil
+	}
+
+	responseData, err := c.callMethod("Email/get", map[string]interface{}{
+		"accountId":  c.accountID,
+		"ids":        emailIDs,
+		"properties": []string{"id", "keywords"},
+	})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to read keywords: %w", err)
 	}
 
-	var response struct {
-		MethodResponses [][]interface{} `json:"methodResponses"`
+	var getResponse struct {
+		List []struct {
+			ID       string          `json:"id"`
+			Keywords map[string]bool `json:"keywords"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(responseData, &getResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode keywords: %w", err)
 	}
 
-	if err := json.Unmarshal(responseData, &response); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+	keywords := make(map[string]map[string]bool, len(getResponse.List))
+	for _, email := range getResponse.List {
+		keywords[email.ID] = email.Keywords
 	}
+	return keywords, nil
+}
 
-	if len(response.MethodResponses) == 0 {
-		return fmt.Errorf("unexpected response format")
+// changesKeywords reports whether patch sets or removes any keyword
+func changesKeywords(patch map[string]interface{}) bool {
+	for path := range patch {
+		if path == "keywords" || strings.HasPrefix(path, "keywords/") {
+			return true
+		}
 	}
+	return false
+}
 
-	// Check if the response is an error
-	if len(response.MethodResponses[0]) > 0 {
-		if methodName, ok := response.MethodResponses[0][0].(string); ok && methodName == "error" {
-			errorData, _ := json.Marshal(response.MethodResponses[0][1])
-			var errorResp struct {
-				Type        string `json:"type"`
-				Description string `json:"description"`
+// keepKeywords makes patch only ever add keywords to an email that has the
+// current ones: a replaced keywords object gets them all back, and one the
+// patch would remove stays set
+func keepKeywords(patch map[string]interface{}, current map[string]bool) {
+	if replaced, ok := patch["keywords"].(map[string]bool); ok {
+		merged := maps.Clone(replaced)
+		for keyword, set := range current {
+			if set {
+				merged[keyword] = true
 			}
-			if err := json.Unmarshal(errorData, &errorResp); err == nil {
-				if errorResp.Type == "accountReadOnly" {
-					return fmt.Errorf("API key has read-only permissions. Please create a new Fastmail API token with read-write permissions for Mail")
-				}
-				return fmt.Errorf("JMAP error (%s): %s", errorResp.Type, errorResp.Description)
-			}
-			return fmt.Errorf("JMAP error: %s", string(errorData))
 		}
+		patch["keywords"] = merged
+	}
+	for keyword, set := range current {
+		path := "keywords/" + escapePointer(keyword)
+		if _, ok := patch[path]; ok && set {
+			patch[path] = true
+		}
+	}
+}
+
+// escapePointer escapes a key for use in a JSON Pointer patch path, since
+// keywords may contain "/" and "~"
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// MoveEmails moves many emails from source to target with as few Email/set
+// calls as possible. Updates are batched by the server's maxObjectsInSet, and
+// a batch rejected as too large is halved and retried. Emails the server
+// refused are returned in failed with the reason.
+func (c *JMAPClient) MoveEmails(emailIDs []string, sourceMailboxID, targetMailboxID string) (moved []string, failed map[string]error) {
+	failed = make(map[string]error)
+	batchSize := c.capabilities.MaxObjectsInSet
+	if batchSize <= 0 {
+		batchSize = len(emailIDs)
+	}
+
+	for start := 0; start < len(emailIDs); start += batchSize {
+		end := min(start+batchSize, len(emailIDs))
+		moved = append(moved, c.moveBatch(emailIDs[start:end], sourceMailboxID, targetMailboxID, failed)...)
+	}
+	return moved, failed
+}
+
+// moveBatch moves emailIDs with a single Email/set, splitting the batch in
+// half while the server says it is too large
+func (c *JMAPClient) moveBatch(emailIDs []string, sourceMailboxID, targetMailboxID string, failed map[string]error) []string {
+	keywords, err := c.moveKeywords(emailIDs, c.movePatch(sourceMailboxID, targetMailboxID))
+	if err != nil {
+		for _, id := range emailIDs {
+			failed[id] = fmt.Errorf("failed to move email: %w", err)
+		}
+		return nil
 	}
 
-	// Parse successful response
-	setResponseData, err := json.Marshal(response.MethodResponses[0][1])
+	update := make(map[string]interface{}, len(emailIDs))
+	for _, id := range emailIDs {
+		patch := c.movePatch(sourceMailboxID, targetMailboxID)
+		keepKeywords(patch, keywords[id])
+		update[id] = patch
+	}
+
+	responseData, err := c.callMethod("Email/set", map[string]interface{}{
+		"accountId": c.accountID,
+		"update":    update,
+	})
+	if isRequestTooLarge(err) && len(emailIDs) > 1 {
+		half := len(emailIDs) / 2
+		moved := c.moveBatch(emailIDs[:half], sourceMailboxID, targetMailboxID, failed)
+		return append(moved, c.moveBatch(emailIDs[half:], sourceMailboxID, targetMailboxID, failed)...)
+	}
 	if err != nil {
-		return err
+		for _, id := range emailIDs {
+			failed[id] = fmt.Errorf("failed to move email: %w", err)
+		}
+		return nil
 	}
 
 	var setResponse struct {
+		Updated    map[string]interface{}     `json:"updated"`
+		NotUpdated map[string]json.RawMessage `json:"notUpdated"`
+	}
+	if err := json.Unmarshal(responseData, &setResponse); err != nil {
+		for _, id := range emailIDs {
+			failed[id] = fmt.Errorf("failed to decode set response: %w", err)
+		}
+		return nil
+	}
+
+	var moved []string
+	for _, id := range emailIDs {
+		if notUpdated, ok := setResponse.NotUpdated[id]; ok {
+			failed[id] = fmt.Errorf("failed to move email: not updated: %s", string(notUpdated))
+		} else if _, ok := setResponse.Updated[id]; ok {
+			moved = append(moved, id)
+		} else {
+			failed[id] = errors.New("failed to move email: missing from Email/set response")
+		}
+	}
+	return moved
+}
+
+// CopyEmail adds an email to another mailbox while leaving it in its current mailboxes
+func (c *JMAPClient) CopyEmail(emailID, targetMailboxID string) error {
+	patch := map[string]interface{}{
+		"mailboxIds/" + targetMailboxID: true,
+	}
+	if _, err := c.updateEmail(emailID, patch, ""); err != nil {
+		return fmt.Errorf("failed to copy email: %w", err)
+	}
+	return nil
+}
+
+// updateEmail applies a patch to a single email with Email/set
+func (c *JMAPClient) updateEmail(emailID string, patch map[string]interface{}, ifInState string) (string, error) {
+	args := map[string]interface{}{
+		"accountId": c.accountID,
+		"update": map[string]interface{}{
+			emailID: patch,
+		},
+	}
+	if ifInState != "" {
+		args["ifInState"] = ifInState
+	}
+
+	setResponseData, err := c.callMethod("Email/set", args)
+	if err != nil {
+		return "", err
+	}
+
+	var setResponse struct {
+		NewState   string                 `json:"newState"`
 		Updated    map[string]interface{} `json:"updated"`
 		NotUpdated map[string]interface{} `json:"notUpdated"`
 	}
 
 	if err := json.Unmarshal(setResponseData, &setResponse); err != nil {
-		return fmt.Errorf("failed to decode set response: %w", err)
+		return "", fmt.Errorf("failed to decode set response: %w", err)
 	}
 
 	if notUpdated, ok := setResponse.NotUpdated[emailID]; ok {
 		errData, _ := json.Marshal(notUpdated)
-		return fmt.Errorf("failed to move email: %s", string(errData))
+		return "", fmt.Errorf("not updated: %s", string(errData))
 	}
 
-	return nil
+	return setResponse.NewState, nil
+}
+
+// GetEmailState returns the current Email state string, used as the starting
+// point for a later GetEmailChanges call
+func (c *JMAPClient) GetEmailState() (string, error) {
+	responseData, err := c.callMethod("Email/get", map[string]interface{}{
+		"accountId": c.accountID,
+		"ids":       []string{},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var getResponse struct {
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(responseData, &getResponse); err != nil {
+		return "", fmt.Errorf("failed to decode email state: %w", err)
+	}
+
+	return getResponse.State, nil
+}
+
+// GetEmailChanges returns the IDs of emails created, updated and destroyed
+// since sinceState, following hasMoreChanges until the server is caught up.
+// If the server can no longer calculate changes from sinceState, the error
+// is a *JMAPError of type cannotCalculateChanges.
+func (c *JMAPClient) GetEmailChanges(sinceState string) (created, updated, destroyed []string, newState string, err error) {
+	for {
+		responseData, err := c.callMethod("Email/changes", map[string]interface{}{
+			"accountId":  c.accountID,
+			"sinceState": sinceState,
+		})
+		if err != nil {
+			return nil, nil, nil, "", err
+		}
+
+		var changes struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Created        []string `json:"created"`
+			Updated        []string `json:"updated"`
+			Destroyed      []string `json:"destroyed"`
+		}
+		if err := json.Unmarshal(responseData, &changes); err != nil {
+			return nil, nil, nil, "", fmt.Errorf("failed to decode changes response: %w", err)
+		}
+
+		created = append(created, changes.Created...)
+		updated = append(updated, changes.Updated...)
+		destroyed = append(destroyed, changes.Destroyed...)
+		newState = changes.NewState
+
+		if !changes.HasMoreChanges || changes.NewState == sinceState {
+			return created, updated, destroyed, newState, nil
+		}
+		sinceState = changes.NewState
+	}
 }
@@ -0,0 +1,1056 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestJMAPClient returns a JMAPClient whose API requests are served by handler
+func newTestJMAPClient(t *testing.T, handler http.HandlerFunc) *JMAPClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &JMAPClient{
+		auth:       BearerAuth{Token: "test-key"},
+		accountID:  "acc1",
+		apiURL:     server.URL,
+		httpClient: server.Client(),
+	}
+}
+
+// Test FindMailboxByRole filters Mailbox/get results on role
+func TestFindMailboxByRole(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Mailbox/get",{"list":[
+			{"id":"mb1","name":"Posteingang","role":"inbox"},
+			{"id":"mb2","name":"Archiv","role":"archive"},
+			{"id":"mb3","name":"_aar","role":null}
+		]},"0"]]}`))
+	})
+
+	mailbox, err := client.FindMailboxByRole("archive")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if mailbox.ID != "mb2" {
+		t.Errorf("Expected mailbox mb2, got %s", mailbox.ID)
+	}
+
+	if _, err := client.FindMailboxByRole("junk"); err == nil {
+		t.Error("Expected error for missing role")
+	}
+}
+
+// Test mailbox lookups are served from memory once a mailbox has been found
+// or listed, until the cache is invalidated
+func TestFindMailbox_Cache(t *testing.T) {
+	requests := 0
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "Mailbox/query") {
+			w.Write([]byte(`{"methodResponses":[["Mailbox/query",{"ids":["mb1"]},"0"],["Mailbox/get",{"list":[{"id":"mb1","name":"Receipts"}]},"1"]]}`))
+			return
+		}
+		w.Write([]byte(`{"methodResponses":[["Mailbox/get",{"list":[
+			{"id":"mb2","name":"Archive","role":"archive"},
+			{"id":"mb3","name":"Trash","role":"trash"}
+		]},"0"]]}`))
+	})
+
+	for range 2 {
+		if mailbox, err := client.FindMailboxByName("Receipts"); err != nil || mailbox.ID != "mb1" {
+			t.Fatalf("Expected mailbox mb1, got %v, %v", mailbox, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the second lookup by name from memory, got %d requests", requests)
+	}
+
+	// Listing the mailboxes serves later lookups by role and by name
+	if _, err := client.ListMailboxes(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	trash, err := client.FindMailboxByRole("Trash")
+	if err != nil || trash.ID != "mb3" {
+		t.Fatalf("Expected mailbox mb3, got %v, %v", trash, err)
+	}
+	if archive, err := client.FindMailboxByName("Archive"); err != nil || archive.ID != "mb2" {
+		t.Fatalf("Expected mailbox mb2, got %v, %v", archive, err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected lookups after listing from memory, got %d requests", requests)
+	}
+
+	client.InvalidateMailboxCache()
+	if _, err := client.FindMailboxByName("Receipts"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected a lookup after invalidating to fetch again, got %d requests", requests)
+	}
+}
+
+// Test the preview snippet is parsed from Email/get, and left empty when absent
+func TestGetEmails_Preview(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Email/get",{"list":[
+			{"id":"M1","subject":"Weekly","preview":"This week in review..."},
+			{"id":"M2","subject":"No preview"}
+		],"notFound":[]},"0"]]}`))
+	})
+
+	result, err := client.GetEmails([]string{"M1", "M2"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.List[0].Preview != "This week in review..." {
+		t.Errorf("Expected preview to be parsed, got %q", result.List[0].Preview)
+	}
+	if result.List[1].Preview != "" {
+		t.Errorf("Expected empty preview, got %q", result.List[1].Preview)
+	}
+}
+
+// Test requested header fields are fetched as text and parsed into Headers,
+// leaving out those the email doesn't have
+func TestGetEmails_Headers(t *testing.T) {
+	var properties []string
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var args struct {
+			Properties []string `json:"properties"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		properties = args.Properties
+
+		w.Write([]byte(`{"methodResponses":[["Email/get",{"list":[
+			{"id":"M1","header:List-Unsubscribe:asText":" <https://example.com/unsub>","header:Message-ID:asText":"<m1@example.com>"},
+			{"id":"M2","header:List-Unsubscribe:asText":null,"header:Message-ID:asText":"<m2@example.com>"}
+		],"notFound":[]},"0"]]}`))
+	})
+	client.headers = []string{"List-Unsubscribe", "Message-ID"}
+
+	result, err := client.GetEmails([]string{"M1", "M2"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !slices.Contains(properties, "header:List-Unsubscribe:asText") {
+		t.Errorf("Expected the header property to be requested, got %v", properties)
+	}
+
+	expected := map[string]string{"List-Unsubscribe": "<https://example.com/unsub>", "Message-ID": "<m1@example.com>"}
+	if !reflect.DeepEqual(result.List[0].Headers, expected) {
+		t.Errorf("Expected headers %v, got %v", expected, result.List[0].Headers)
+	}
+	if _, ok := result.List[1].Headers["List-Unsubscribe"]; ok {
+		t.Errorf("Expected an absent header to be left out, got %v", result.List[1].Headers)
+	}
+
+	if _, err := NewJMAPClient(ClientOptions{Headers: []string{"Bad:Name"}}); err == nil {
+		t.Error("Expected error for an invalid header name")
+	}
+}
+
+// Test FindMailboxesByPattern matches on name or on the full parent path
+func TestFindMailboxesByPattern(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Mailbox/get",{"list":[
+			{"id":"mb1","name":"_aar","parentId":null},
+			{"id":"mb2","name":"_aar-old","parentId":null},
+			{"id":"mb3","name":"2024","parentId":"mb1"},
+			{"id":"mb4","name":"2025","parentId":"mb1"},
+			{"id":"mb5","name":"Archive","role":"archive"},
+			{"id":"mb6","name":"2024","parentId":"mb5"}
+		]},"0"]]}`))
+	})
+
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"_aar*", []string{"mb1", "mb2"}},
+		{"_aar/*", []string{"mb3", "mb4"}},
+		{"_aar/2024", []string{"mb3"}},
+		{"2024", []string{"mb3", "mb6"}},
+		{"Inbox*", nil},
+	}
+	for _, tt := range tests {
+		mailboxes, err := client.FindMailboxesByPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %v", tt.pattern, err)
+		}
+		var ids []string
+		for _, mailbox := range mailboxes {
+			ids = append(ids, mailbox.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.pattern, tt.expected, ids)
+		}
+	}
+
+	if _, err := client.FindMailboxesByPattern("[unclosed"); err == nil {
+		t.Error("Expected error for malformed pattern")
+	}
+}
+
+// Test GetEmails surfaces notFound IDs and state from Email/get
+func TestGetEmails_NotFound(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Email/get",{
+			"state":"s42",
+			"list":[{"id":"M1","subject":"Hello"}],
+			"notFound":["M2"]
+		},"0"]]}`))
+	})
+
+	result, err := client.GetEmails([]string{"M1", "M2"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(result.List) != 1 || result.List[0].Subject != "Hello" {
+		t.Errorf("Expected one email with subject Hello, got %+v", result.List)
+	}
+	if !result.IsNotFound("M2") {
+		t.Errorf("Expected M2 to be reported as not found, got %v", result.NotFound)
+	}
+	if result.IsNotFound("M1") {
+		t.Error("Expected M1 not to be reported as not found")
+	}
+	if result.State != "s42" {
+		t.Errorf("Expected state s42, got %q", result.State)
+	}
+}
+
+// Test a failed Email/get batch fails only its own emails, while the other
+// batches' emails are returned or reported not found
+func TestGetEmails_PartialBatchFailure(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var args struct {
+			IDs []string `json:"ids"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+
+		switch args.IDs[0] {
+		case "M1":
+			w.Write([]byte(`{"methodResponses":[["Email/get",{"state":"s1","list":[{"id":"M1","subject":"Hello"}],"notFound":[]},"0"]]}`))
+		case "M2":
+			http.Error(w, "backend unavailable", http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"methodResponses":[["Email/get",{"state":"s1","list":[],"notFound":["` + args.IDs[0] + `"]},"0"]]}`))
+		}
+	})
+	client.capabilities.MaxObjectsInGet = 1
+
+	result, err := client.GetEmails([]string{"M1", "M2", "M3"})
+	if err != nil {
+		t.Fatalf("Expected a partial result, got: %v", err)
+	}
+	if _, ok := result.ByID()["M1"]; !ok || len(result.List) != 1 {
+		t.Errorf("Expected M1 returned, got %+v", result.List)
+	}
+	if !result.IsNotFound("M3") {
+		t.Errorf("Expected M3 not found, got %v", result.NotFound)
+	}
+	if len(result.Failed) != 1 || result.Failed["M2"] == nil {
+		t.Errorf("Expected only M2 failed, got %v", result.Failed)
+	}
+	if err := result.FailedErr(); err == nil || !strings.Contains(err.Error(), "such as M2") {
+		t.Errorf("Expected an error naming M2, got: %v", err)
+	}
+
+	// With every batch failing, there's nothing to return
+	if _, err := client.GetEmails([]string{"M2", "M2"}); err == nil {
+		t.Error("Expected an error when every batch fails")
+	}
+}
+
+// Test GetEmailsInMailbox asks the server to count matches and returns the
+// total, which can exceed the IDs returned
+func TestGetEmailsInMailbox_Total(t *testing.T) {
+	var requestBody []byte
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"methodResponses":[["Email/query",{"ids":["M1","M2"],"total":250},"0"]]}`))
+	})
+
+	ids, total, err := client.GetEmailsInMailbox("mb1", QueryOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(ids) != 2 || total != 250 {
+		t.Errorf("Expected 2 IDs of 250, got %d of %d", len(ids), total)
+	}
+	if !strings.Contains(string(requestBody), `"calculateTotal":true`) {
+		t.Errorf("Expected calculateTotal in the query, got: %s", requestBody)
+	}
+}
+
+// Test GetEmailsInMailbox sorts newest first when requested
+func TestGetEmailsInMailbox_NewestFirst(t *testing.T) {
+	var requestBody []byte
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"methodResponses":[["Email/query",{"ids":["M2","M1"]},"0"]]}`))
+	})
+
+	ids, _, err := client.GetEmailsInMailbox("mb1", QueryOptions{Limit: 10, NewestFirst: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("Expected 2 IDs, got %d", len(ids))
+	}
+
+	var request struct {
+		MethodCalls [][]json.RawMessage `json:"methodCalls"`
+	}
+	if err := json.Unmarshal(requestBody, &request); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	var args struct {
+		Limit int `json:"limit"`
+		Sort  []struct {
+			Property    string `json:"property"`
+			IsAscending bool   `json:"isAscending"`
+		} `json:"sort"`
+	}
+	if err := json.Unmarshal(request.MethodCalls[0][1], &args); err != nil {
+		t.Fatalf("Failed to decode query args: %v", err)
+	}
+
+	if args.Limit != 10 {
+		t.Errorf("Expected limit 10, got %d", args.Limit)
+	}
+	if len(args.Sort) != 1 || args.Sort[0].Property != "receivedAt" || args.Sort[0].IsAscending {
+		t.Errorf("Expected receivedAt descending sort, got %+v", args.Sort)
+	}
+}
+
+// captureSetPatch returns a test client that records the Email/set update patch for emailID
+func captureSetPatch(t *testing.T, emailID string, patch *map[string]interface{}) *JMAPClient {
+	t.Helper()
+	return newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		var args struct {
+			Update map[string]map[string]interface{} `json:"update"`
+		}
+		if err := json.Unmarshal(request.MethodCalls[0][1], &args); err != nil {
+			t.Errorf("Failed to decode set args: %v", err)
+		}
+		*patch = args.Update[emailID]
+		w.Write([]byte(`{"methodResponses":[["Email/set",{"updated":{"` + emailID + `":null}},"0"]]}`))
+	})
+}
+
+// Test MoveEmail removes the source mailbox and adds the target
+func TestMoveEmail_Payload(t *testing.T) {
+	var patch map[string]interface{}
+	client := captureSetPatch(t, "M1", &patch)
+
+	if err := client.MoveEmail("M1", "src", "dst"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{"mailboxIds/src": nil, "mailboxIds/dst": true}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Expected patch %v, got %v", expected, patch)
+	}
+}
+
+// Test an exclusive move replaces mailboxIds entirely, dropping any other
+// mailboxes the email was in
+func TestMoveEmail_Exclusive(t *testing.T) {
+	var patch map[string]interface{}
+	client := captureSetPatch(t, "M1", &patch)
+	client.exclusiveMoves = true
+
+	if err := client.MoveEmail("M1", "src", "dst"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{"mailboxIds": map[string]interface{}{"dst": true}}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Expected patch %v, got %v", expected, patch)
+	}
+}
+
+// Test -preserve-keywords leaves a move that only changes mailboxes as it is,
+// without reading keywords first, since it can't lose any
+func TestMoveEmail_PreserveKeywords(t *testing.T) {
+	var patch map[string]interface{}
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var method string
+		json.Unmarshal(request.MethodCalls[0][0], &method)
+		if method != "Email/set" {
+			t.Errorf("Expected only Email/set, got %s", method)
+		}
+
+		var args struct {
+			Update map[string]map[string]interface{} `json:"update"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		patch = args.Update["M1"]
+		w.Write([]byte(`{"methodResponses":[["Email/set",{"updated":{"M1":null}},"0"]]}`))
+	})
+	client.exclusiveMoves = true
+	client.preserveKeywords = true
+
+	if err := client.MoveEmail("M1", "src", "dst"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{"mailboxIds": map[string]interface{}{"dst": true}}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Expected patch %v, got %v", expected, patch)
+	}
+}
+
+// Test a mark-read move keeps $flagged, whether it replaces the keywords or
+// patches them one by one
+func TestKeepKeywords_MarkRead(t *testing.T) {
+	current := map[string]bool{"$flagged": true, "a/b": true}
+	for _, tc := range []struct {
+		patch    map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"mailboxIds/dst": true, "keywords": map[string]bool{"$seen": true}},
+			map[string]interface{}{"mailboxIds/dst": true, "keywords": map[string]bool{"$seen": true, "$flagged": true, "a/b": true}},
+		},
+		{
+			map[string]interface{}{"keywords/$seen": true, "keywords/$flagged": nil, "keywords/a~1b": nil},
+			map[string]interface{}{"keywords/$seen": true, "keywords/$flagged": true, "keywords/a~1b": true},
+		},
+	} {
+		if !changesKeywords(tc.patch) {
+			t.Errorf("Expected %v to change keywords", tc.patch)
+		}
+		keepKeywords(tc.patch, current)
+		if !reflect.DeepEqual(tc.patch, tc.expected) {
+			t.Errorf("Expected patch %v, got %v", tc.expected, tc.patch)
+		}
+	}
+}
+
+// Test CopyEmail only adds the target mailbox
+func TestCopyEmail_Payload(t *testing.T) {
+	var patch map[string]interface{}
+	client := captureSetPatch(t, "M1", &patch)
+
+	if err := client.CopyEmail("M1", "dst"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{"mailboxIds/dst": true}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Expected patch %v, got %v", expected, patch)
+	}
+}
+
+// Test GetEmailChanges follows hasMoreChanges and accumulates the results
+func TestGetEmailChanges_FollowsMoreChanges(t *testing.T) {
+	var sinceStates []string
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var args struct {
+			SinceState string `json:"sinceState"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		sinceStates = append(sinceStates, args.SinceState)
+
+		if args.SinceState == "s1" {
+			w.Write([]byte(`{"methodResponses":[["Email/changes",{"oldState":"s1","newState":"s2","hasMoreChanges":true,
+				"created":["M1"],"updated":[],"destroyed":[]},"0"]]}`))
+			return
+		}
+		w.Write([]byte(`{"methodResponses":[["Email/changes",{"oldState":"s2","newState":"s3","hasMoreChanges":false,
+			"created":["M2"],"updated":["M3"],"destroyed":["M4"]},"0"]]}`))
+	})
+
+	created, updated, destroyed, newState, err := client.GetEmailChanges("s1")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !reflect.DeepEqual(created, []string{"M1", "M2"}) {
+		t.Errorf("Expected created [M1 M2], got %v", created)
+	}
+	if !reflect.DeepEqual(updated, []string{"M3"}) {
+		t.Errorf("Expected updated [M3], got %v", updated)
+	}
+	if !reflect.DeepEqual(destroyed, []string{"M4"}) {
+		t.Errorf("Expected destroyed [M4], got %v", destroyed)
+	}
+	if newState != "s3" {
+		t.Errorf("Expected new state s3, got %s", newState)
+	}
+	if !reflect.DeepEqual(sinceStates, []string{"s1", "s2"}) {
+		t.Errorf("Expected requests since s1 then s2, got %v", sinceStates)
+	}
+}
+
+// Test a cannotCalculateChanges response surfaces as a typed JMAPError
+func TestGetEmailChanges_CannotCalculate(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["error",{"type":"cannotCalculateChanges"},"0"]]}`))
+	})
+
+	_, _, _, _, err := client.GetEmailChanges("old")
+	if !isJMAPError(err, "cannotCalculateChanges") {
+		t.Errorf("Expected cannotCalculateChanges error, got: %v", err)
+	}
+}
+
+// Test the session's core capabilities are parsed and size Email/get batches
+func TestAuthenticate_CapabilitiesLimitBatching(t *testing.T) {
+	var batches [][]string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"capabilities": {
+				"urn:ietf:params:jmap:core": {"maxSizeRequest": 10000, "maxCallsInRequest": 16, "maxObjectsInGet": 2, "maxObjectsInSet": 50},
+				"urn:ietf:params:jmap:mail": {}
+			},
+			"primaryAccounts": {"urn:ietf:params:jmap:mail": "acc1"},
+			"apiUrl": "` + server.URL + `/api"
+		}`))
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var args struct {
+			IDs []string `json:"ids"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		batches = append(batches, args.IDs)
+
+		var list []string
+		for _, id := range args.IDs {
+			list = append(list, `{"id":"`+id+`"}`)
+		}
+		w.Write([]byte(`{"methodResponses":[["Email/get",{"list":[` + strings.Join(list, ",") + `],"notFound":[]},"0"]]}`))
+	})
+
+	client := &JMAPClient{auth: BearerAuth{Token: "test-key"}, sessionURL: server.URL + "/session", httpClient: server.Client()}
+	if err := client.authenticate(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := CoreCapabilities{MaxSizeRequest: 10000, MaxCallsInRequest: 16, MaxObjectsInGet: 2, MaxObjectsInSet: 50}
+	if client.Capabilities() != expected {
+		t.Errorf("Expected capabilities %+v, got %+v", expected, client.Capabilities())
+	}
+
+	result, err := client.GetEmails([]string{"M1", "M2", "M3", "M4", "M5"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(result.List) != 5 {
+		t.Errorf("Expected 5 emails across batches, got %d", len(result.List))
+	}
+	if !reflect.DeepEqual(batches, [][]string{{"M1", "M2"}, {"M3", "M4"}, {"M5"}}) {
+		t.Errorf("Expected batches of at most 2, got %v", batches)
+	}
+
+	// Requests larger than maxSizeRequest are refused before sending
+	client.capabilities.MaxSizeRequest = 10
+	if _, err := client.GetEmails([]string{"M1"}); err == nil || !strings.Contains(err.Error(), "maxSizeRequest") {
+		t.Errorf("Expected maxSizeRequest error, got: %v", err)
+	}
+}
+
+// Test a guarded move sends ifInState and surfaces stateMismatch as a typed error
+func TestMoveEmailIfInState_StateMismatch(t *testing.T) {
+	var ifInState string
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var args struct {
+			IfInState string `json:"ifInState"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		ifInState = args.IfInState
+		w.Write([]byte(`{"methodResponses":[["error",{"type":"stateMismatch"},"0"]]}`))
+	})
+
+	_, err := client.MoveEmailIfInState("M1", "src", "dst", "s1")
+	if !IsStateMismatch(err) {
+		t.Errorf("Expected a stateMismatch error, got: %v", err)
+	}
+	if ifInState != "s1" {
+		t.Errorf("Expected ifInState s1, got %q", ifInState)
+	}
+}
+
+// Test a successful move returns the new state
+func TestMoveEmailIfInState_ReturnsNewState(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Email/set",{"oldState":"s1","newState":"s2","updated":{"M1":null}},"0"]]}`))
+	})
+
+	newState, err := client.MoveEmailIfInState("M1", "src", "dst", "s1")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if newState != "s2" {
+		t.Errorf("Expected new state s2, got %q", newState)
+	}
+}
+
+// Test extra capability URNs are declared after the defaults in every request
+func TestMakeRequest_ExtraCapabilities(t *testing.T) {
+	var using []string
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Using []string `json:"using"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		using = request.Using
+		w.Write([]byte(`{"methodResponses":[]}`))
+	})
+	client.using = withCapabilities(defaultUsing, []string{"https://www.fastmail.com/dev/maskedemail", "urn:ietf:params:jmap:mail"})
+
+	if _, err := client.makeRequest(nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := []string{"urn:ietf:params:jmap:core", "urn:ietf:params:jmap:mail", "https://www.fastmail.com/dev/maskedemail"}
+	if !reflect.DeepEqual(using, expected) {
+		t.Errorf("Expected using %v, got %v", expected, using)
+	}
+}
+
+// Test MoveEmails batches by maxObjectsInSet and aggregates per-ID failures
+func TestMoveEmails_Batching(t *testing.T) {
+	var batches [][]string
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var args struct {
+			Update map[string]map[string]interface{} `json:"update"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+
+		var ids, updated, notUpdated []string
+		for id := range args.Update {
+			ids = append(ids, id)
+			if id == "M4" {
+				notUpdated = append(notUpdated, `"M4":{"type":"notFound"}`)
+			} else {
+				updated = append(updated, `"`+id+`":null`)
+			}
+		}
+		batches = append(batches, ids)
+		w.Write([]byte(`{"methodResponses":[["Email/set",{"updated":{` + strings.Join(updated, ",") +
+			`},"notUpdated":{` + strings.Join(notUpdated, ",") + `}},"0"]]}`))
+	})
+	client.capabilities.MaxObjectsInSet = 2
+
+	moved, failed := client.MoveEmails([]string{"M1", "M2", "M3", "M4", "M5"}, "src", "dst")
+
+	if len(batches) != 3 {
+		t.Errorf("Expected 3 Email/set calls, got %d", len(batches))
+	}
+	for _, batch := range batches {
+		if len(batch) > 2 {
+			t.Errorf("Expected batches of at most 2, got %v", batch)
+		}
+	}
+	if !reflect.DeepEqual(moved, []string{"M1", "M2", "M3", "M5"}) {
+		t.Errorf("Expected M1 M2 M3 M5 moved, got %v", moved)
+	}
+	if len(failed) != 1 || failed["M4"] == nil || !strings.Contains(failed["M4"].Error(), "notFound") {
+		t.Errorf("Expected M4 to fail with notFound, got %v", failed)
+	}
+}
+
+// Test a batch rejected as too large is halved until it fits
+func TestMoveEmails_SplitsTooLargeBatch(t *testing.T) {
+	var sizes []int
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+		var args struct {
+			Update map[string]interface{} `json:"update"`
+		}
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		sizes = append(sizes, len(args.Update))
+
+		if len(args.Update) > 1 {
+			w.Write([]byte(`{"methodResponses":[["error",{"type":"requestTooLarge"},"0"]]}`))
+			return
+		}
+		for id := range args.Update {
+			w.Write([]byte(`{"methodResponses":[["Email/set",{"updated":{"` + id + `":null}},"0"]]}`))
+		}
+	})
+
+	moved, failed := client.MoveEmails([]string{"M1", "M2", "M3"}, "src", "dst")
+	if len(moved) != 3 || len(failed) != 0 {
+		t.Errorf("Expected all 3 moved after splitting, got moved %v failed %v", moved, failed)
+	}
+	if !reflect.DeepEqual(sizes, []int{3, 1, 2, 1, 1}) {
+		t.Errorf("Expected halving 3 -> 1+2 -> 1+1, got %v", sizes)
+	}
+}
+
+// Test the query filter is a plain inMailbox condition or an AND of conditions
+func TestEmailFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    QueryOptions
+		expected string
+	}{
+		{"mailbox only", QueryOptions{}, `{"inMailbox":"mb1"}`},
+		{"unread", QueryOptions{UnreadOnly: true},
+			`{"conditions":[{"inMailbox":"mb1"},{"notKeyword":"$seen"}],"operator":"AND"}`},
+		{"attachment", QueryOptions{HasAttachment: true},
+			`{"conditions":[{"inMailbox":"mb1"},{"hasAttachment":true}],"operator":"AND"}`},
+		{"both", QueryOptions{UnreadOnly: true, HasAttachment: true},
+			`{"conditions":[{"inMailbox":"mb1"},{"notKeyword":"$seen"},{"hasAttachment":true}],"operator":"AND"}`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(emailFilter("mb1", tt.query))
+		if err != nil {
+			t.Fatalf("%s: failed to marshal filter: %v", tt.name, err)
+		}
+		if string(data) != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, data)
+		}
+	}
+}
+
+// Test PrimarySender falls back sensibly for missing names, addresses and senders
+func TestPrimarySender(t *testing.T) {
+	tests := []struct {
+		name            string
+		from            []EmailAddress
+		expectedName    string
+		expectedAddress string
+	}{
+		{"empty", nil, "unknown", ""},
+		{"name and address", []EmailAddress{{Name: "News", Email: "news@example.com"}}, "News", "news@example.com"},
+		{"name only", []EmailAddress{{Name: "News"}}, "News", ""},
+		{"address only", []EmailAddress{{Email: "news@example.com"}}, "news@example.com", "news@example.com"},
+		{"blank", []EmailAddress{{Name: " ", Email: ""}}, "unknown", ""},
+		{"first of several", []EmailAddress{{Email: "a@example.com"}, {Email: "b@example.com"}}, "a@example.com", "a@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, address := PrimarySender(Email{From: tt.from})
+			if name != tt.expectedName || address != tt.expectedAddress {
+				t.Errorf("Expected (%q, %q), got (%q, %q)", tt.expectedName, tt.expectedAddress, name, address)
+			}
+		})
+	}
+}
+
+// Test a self-signed server is trusted with -ca-file and rejected without it
+func TestNewJMAPClient_CAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"apiUrl":"https://example.invalid/api","primaryAccounts":{"urn:ietf:params:jmap:mail":"acc1"}}`))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	client, err := NewJMAPClient(ClientOptions{APIKey: "test-key", SessionURL: server.URL, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("Expected the configured CA to be trusted, got: %v", err)
+	}
+	if client.AccountID() != "acc1" {
+		t.Errorf("Expected account acc1, got %q", client.AccountID())
+	}
+
+	if _, err := NewJMAPClient(ClientOptions{APIKey: "test-key", SessionURL: server.URL}); err == nil {
+		t.Error("Expected an unknown CA to be rejected by default")
+	}
+	if _, err := NewJMAPClient(ClientOptions{APIKey: "test-key", SessionURL: server.URL, InsecureSkipVerify: true}); err != nil {
+		t.Errorf("Expected verification to be skipped, got: %v", err)
+	}
+}
+
+// Test a CA file without certificates is an error
+func TestNewJMAPClient_InvalidCAFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, []byte("not a certificate"), 0644)
+
+	if _, err := NewJMAPClient(ClientOptions{APIKey: "test-key", CAFile: caFile}); err == nil || !strings.Contains(err.Error(), "no PEM certificates") {
+		t.Errorf("Expected invalid CA file error, got: %v", err)
+	}
+}
+
+// Test -account selects a mail account by ID or name instead of the primary
+func TestNewJMAPClient_Account(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"apiUrl": "https://example.invalid/api",
+			"primaryAccounts": {"urn:ietf:params:jmap:mail": "acc1"},
+			"accounts": {
+				"acc1": {"name": "me@example.com", "accountCapabilities": {"urn:ietf:params:jmap:mail": {}}},
+				"acc2": {"name": "shared@example.com", "accountCapabilities": {"urn:ietf:params:jmap:mail": {}}},
+				"acc3": {"name": "contacts", "accountCapabilities": {"urn:ietf:params:jmap:contacts": {}}}
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	tests := map[string]string{
+		"":                   "acc1",
+		"acc2":               "acc2",
+		"Shared@Example.com": "acc2",
+	}
+	for account, expected := range tests {
+		client, err := NewJMAPClient(ClientOptions{APIKey: "test-key", SessionURL: server.URL, Account: account})
+		if err != nil {
+			t.Errorf("%q: expected no error, got: %v", account, err)
+			continue
+		}
+		if client.AccountID() != expected {
+			t.Errorf("%q: expected account %s, got %s", account, expected, client.AccountID())
+		}
+	}
+
+	_, err := NewJMAPClient(ClientOptions{APIKey: "test-key", SessionURL: server.URL, Account: "work"})
+	var notFound *AccountNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("Expected AccountNotFoundError, got: %v", err)
+	}
+	if _, err := NewJMAPClient(ClientOptions{APIKey: "test-key", SessionURL: server.URL, Account: "contacts"}); err == nil || !strings.Contains(err.Error(), "does not support mail") {
+		t.Errorf("Expected a non-mail account to be rejected, got: %v", err)
+	}
+}
+
+// Test Email/get requests bodyStructure, and every body value only when the
+// client is asked to
+func TestGetEmails_FetchAllBodyValues(t *testing.T) {
+	for _, fetchAllBodyValues := range []bool{false, true} {
+		var args map[string]interface{}
+		client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+			var request struct {
+				MethodCalls [][]json.RawMessage `json:"methodCalls"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			json.Unmarshal(request.MethodCalls[0][1], &args)
+			w.Write([]byte(`{"methodResponses":[["Email/get",{"state":"s1","list":[{"id":"M1",
+				"bodyStructure":{"type":"multipart/alternative","subParts":[{"partId":"1","type":"text/html"},{"partId":"2","type":"text/x-amp-html"}]}
+			}]},"0"]]}`))
+		})
+		client.fetchAllBodyValues = fetchAllBodyValues
+
+		result, err := client.GetEmails([]string{"M1"})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if !slices.Contains(args["properties"].([]interface{}), interface{}("bodyStructure")) {
+			t.Errorf("Expected bodyStructure requested, got %v", args["properties"])
+		}
+		if _, ok := args["fetchAllBodyValues"]; ok != fetchAllBodyValues {
+			t.Errorf("fetchAllBodyValues %v: unexpected fetchAllBodyValues in %v", fetchAllBodyValues, args)
+		}
+		if partID, ok := result.List[0].AMPPart(); !ok || partID != "2" {
+			t.Errorf("Expected AMP part 2, got %q, %v", partID, ok)
+		}
+	}
+}
+
+// Test Email/get caps body values explicitly and reads the truncation and
+// encoding problem markers of each one
+func TestGetEmails_BodyValueFlags(t *testing.T) {
+	var args map[string]interface{}
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		json.Unmarshal(request.MethodCalls[0][1], &args)
+		w.Write([]byte(`{"methodResponses":[["Email/get",{"state":"s1","list":[{"id":"M1","bodyValues":{
+			"1":{"value":"<p>Whole</p>","isEncodingProblem":true,"isTruncated":false},
+			"2":{"value":"<p>Cut","isEncodingProblem":false,"isTruncated":true}
+		}}]},"0"]]}`))
+	})
+
+	result, err := client.GetEmails([]string{"M1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if args["maxBodyValueBytes"] != float64(maxBodyValueBytes) {
+		t.Errorf("Expected maxBodyValueBytes %d, got %v", maxBodyValueBytes, args["maxBodyValueBytes"])
+	}
+
+	email := result.List[0]
+	if !email.BodyValues["1"].IsEncodingProblem || email.BodyValues["1"].IsTruncated {
+		t.Errorf("Expected part 1 with an encoding problem only, got %+v", email.BodyValues["1"])
+	}
+	if email.BodyValues["2"].IsEncodingProblem || !email.BodyValues["2"].IsTruncated {
+		t.Errorf("Expected part 2 truncated only, got %+v", email.BodyValues["2"])
+	}
+	if !email.TruncatedBody() || !email.EncodingProblem() {
+		t.Errorf("Expected the email truncated with an encoding problem")
+	}
+}
+
+// Test DownloadBlob fills in the session's download URL template, encoding
+// each value
+func TestDownloadBlob(t *testing.T) {
+	var requestURI string
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+		w.Write([]byte("%PDF-1.4"))
+	})
+	client.downloadURL = client.apiURL + "/download/{accountId}/{blobId}/{name}?accept={type}"
+
+	data, err := client.DownloadBlob("B1", "application/pdf", "March invoice.pdf")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if string(data) != "%PDF-1.4" {
+		t.Errorf("Expected the blob content, got %q", data)
+	}
+	if want := "/download/acc1/B1/March%20invoice.pdf?accept=application%2Fpdf"; requestURI != want {
+		t.Errorf("Expected %s, got %s", want, requestURI)
+	}
+}
+
+// Test GetThread returns a thread's email IDs in order
+func TestGetThread(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Thread/get",{"list":[{"id":"T1","emailIds":["M1","M2"]}],"notFound":[]},"0"]]}`))
+	})
+
+	emailIDs, err := client.GetThread("T1")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(emailIDs, []string{"M1", "M2"}) {
+		t.Errorf("Expected [M1 M2], got %v", emailIDs)
+	}
+
+	if _, err := client.GetThread("T2"); err == nil {
+		t.Error("Expected error for an unknown thread")
+	}
+}
+
+// refreshingAuth is a bearer token that Refresh replaces with its next token
+type refreshingAuth struct {
+	token     string
+	next      string
+	refreshes int
+}
+
+func (a *refreshingAuth) Authorize(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+}
+
+func (a *refreshingAuth) Refresh() error {
+	a.refreshes++
+	a.token = a.next
+	return nil
+}
+
+// Test a request rejected with 401 is retried once after refreshing the token
+func TestMakeRequest_RefreshesRejectedCredentials(t *testing.T) {
+	requests := 0
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, "token expired", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"methodResponses":[["Mailbox/get",{"list":[{"id":"mb1","name":"Archive","role":"archive"}]},"0"]]}`))
+	})
+	auth := &refreshingAuth{token: "stale", next: "fresh"}
+	client.auth = auth
+
+	mailbox, err := client.FindMailboxByRole("archive")
+	if err != nil {
+		t.Fatalf("Expected no error after refreshing, got: %v", err)
+	}
+	if mailbox.ID != "mb1" {
+		t.Errorf("Expected mailbox mb1, got %+v", mailbox)
+	}
+	if auth.refreshes != 1 || requests != 2 {
+		t.Errorf("Expected 1 refresh and 2 requests, got %d and %d", auth.refreshes, requests)
+	}
+}
+
+// Test rejected credentials that can't be refreshed report ErrAuthExpired
+func TestMakeRequest_AuthExpired(t *testing.T) {
+	for _, auth := range []Authenticator{BearerAuth{Token: "stale"}, &refreshingAuth{token: "stale", next: "still-stale"}} {
+		requests := 0
+		client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			http.Error(w, "token expired", http.StatusUnauthorized)
+		})
+		client.auth = auth
+
+		_, err := client.FindMailboxByRole("archive")
+		if !errors.Is(err, ErrAuthExpired) || !IsAuthError(err) {
+			t.Errorf("Expected ErrAuthExpired, got: %v", err)
+		}
+		expected := 1 // Retried only after a refresh
+		if _, ok := auth.(*refreshingAuth); ok {
+			expected = 2
+		}
+		if requests != expected {
+			t.Errorf("Expected %d request(s) with %T, got %d", expected, auth, requests)
+		}
+	}
+}
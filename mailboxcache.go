@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// mailboxCache remembers the mailboxes a JMAPClient has looked up, by name
+// and by role, so looking one up again costs no request. Mailboxes that
+// weren't found aren't remembered. It is safe for concurrent use, and its
+// zero value is empty and ready to use.
+type mailboxCache struct {
+	mu     sync.Mutex
+	byName map[string]Mailbox
+	byRole map[string]Mailbox // Roles lowercased
+}
+
+// name returns the mailbox last found for name
+func (m *mailboxCache) name(name string) (*Mailbox, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mailbox, ok := m.byName[name]
+	return &mailbox, ok
+}
+
+// role returns the mailbox with role, if the account's mailboxes have been
+// listed and one has it
+func (m *mailboxCache) role(role string) (*Mailbox, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mailbox, ok := m.byRole[strings.ToLower(role)]
+	return &mailbox, ok
+}
+
+// addNamed records the mailbox a lookup by name found
+func (m *mailboxCache) addNamed(name string, mailbox Mailbox) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byName == nil {
+		m.byName = make(map[string]Mailbox)
+	}
+	m.byName[name] = mailbox
+}
+
+// addAll records every mailbox of the account. Where several share a name
+// or role, the first listed is kept, as a lookup would find it first.
+func (m *mailboxCache) addAll(mailboxes []Mailbox) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byName == nil {
+		m.byName = make(map[string]Mailbox)
+	}
+	m.byRole = make(map[string]Mailbox)
+	for _, mailbox := range mailboxes {
+		if _, ok := m.byName[mailbox.Name]; !ok {
+			m.byName[mailbox.Name] = mailbox
+		}
+		role := strings.ToLower(mailbox.Role)
+		if _, ok := m.byRole[role]; role != "" && !ok {
+			m.byRole[role] = mailbox
+		}
+	}
+}
+
+// clear forgets every mailbox
+func (m *mailboxCache) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byName, m.byRole = nil, nil
+}
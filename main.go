@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
 const (
@@ -14,59 +23,1247 @@ const (
 	screenshotDir    = "./screenshots"
 	screenshotWidth  = 1280
 	screenshotHeight = 800
-)
 
-var (
-	limit  = flag.Int("limit", 0, "Maximum emails to process (default: 0 = all)")
-	dryRun = flag.Bool("dry-run", false, "Preview operations without making changes")
+	// defaultMaxHTMLSize is generous for real email but keeps a malformed or
+	// malicious body from exhausting memory
+	defaultMaxHTMLSize = 10 << 20
 )
 
+// cliFlags holds the values of the command-line flags
+type cliFlags struct {
+	limit   *int
+	dryRun  *bool
+	archive *string
+	retries *int
+	rules   *string
+	outDir  *string
+	bgColor *string
+	font    *string
+	capture *string
+	thumbW  *int
+
+	execCmd        *string
+	execTimeout    *time.Duration
+	execIgnoreFail *bool
+
+	noMove   *bool
+	copyMode *bool
+
+	dedupe          *bool
+	dedupeNoArchive *bool
+
+	fromAllow       *string
+	fromDeny        *string
+	archiveFiltered *bool
+
+	htmlParts *string
+
+	rps       *float64
+	traceFile *string
+
+	incremental    *bool
+	knownThreshold *int
+
+	clipSelector *string
+	debugLog     *bool
+
+	estimate *int
+
+	sidecar    *bool
+	senderDirs *bool
+
+	maxHeight *int
+	split     *bool
+
+	saveHTML *bool
+
+	failFast    *bool
+	maxFailures *int
+
+	authMode   *string
+	authUser   *string
+	authPass   *string
+	sessionURL *string
+
+	autoWidth *bool
+	minWidth  *int
+	maxWidth  *int
+
+	metaViewport *bool
+
+	banner *bool
+
+	guardedMove *bool
+
+	emailID *string
+
+	capabilities *stringList
+
+	batchMoves *bool
+
+	printHTML *bool
+
+	unreadOnly    *bool
+	hasAttachment *bool
+
+	verifyMove *bool
+
+	minAge *time.Duration
+
+	listMailboxes *bool
+
+	caFile   *string
+	insecure *bool
+
+	optimize *bool
+
+	format  *string
+	quality *int
+
+	pdfPageSize  *string
+	pdfMargin    *float64
+	pdfLandscape *bool
+
+	concurrency *int
+	delay       *time.Duration
+	delayJitter *int
+	maxTabs     *int
+
+	configFile *string
+
+	showVersion *bool
+
+	stateFile  *string
+	resetState *bool
+
+	report      *string
+	retryReport *string
+
+	embedMetadata *bool
+
+	chromePath  *string
+	chromeFlags *stringList
+	imageProxy  *string
+
+	webhook   *string
+	webhookOn *string
+
+	checkpoint *string
+
+	exclusiveArchive *bool
+
+	stripTrackers *bool
+
+	nameByHash *bool
+
+	interactive *bool
+	yes         *bool
+
+	domainStats *bool
+
+	account *string
+
+	htmlFile  *string
+	stdinHTML *bool
+
+	preferAMP *bool
+
+	thread     *bool
+	threadMove *string
+
+	maxHTMLSize *int
+
+	trashOnFail *bool
+
+	renderICS *bool
+
+	failTruncated *bool
+
+	archiveUnscreenshotted *bool
+
+	renderAttachments *bool
+
+	colorScheme *string
+
+	matchBg *bool
+
+	pruneEmptyDirs *bool
+
+	timezone *string
+	locale   *string
+
+	onlyWithScreenshotDiff *bool
+	diffPixels             *bool
+
+	quarantine       *string
+	quarantineUnless *string
+
+	widths *intList
+
+	preserveKeywords *bool
+
+	gallery *bool
+
+	archiveOnScreenshotSkip *bool
+
+	orderedOutput *bool
+
+	headers *string
+}
+
+// newFlagSet defines every command-line flag on a new FlagSet
+func newFlagSet(name string) (*flag.FlagSet, *cliFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags := &cliFlags{
+		limit:   fs.Int("limit", 0, "Maximum emails to process (default: 0 = all)"),
+		dryRun:  fs.Bool("dry-run", false, "Preview operations without making changes"),
+		archive: fs.String("archive", archiveFolder, "Archive mailbox name, or role:<role> to match by role (e.g. role:archive)"),
+		retries: fs.Int("screenshot-retries", 0, "Number of times to retry a failed screenshot before marking the email failed"),
+		rules:   fs.String("rules", "", "File of sender rules mapping address/domain patterns to archive mailboxes"),
+		outDir:  fs.String("output-dir", screenshotDir, "Directory to save screenshots in (~ is expanded)"),
+		bgColor: fs.String("bg-color", "", "CSS background color for the render wrapper, or \"transparent\" (default: browser white)"),
+		font:    fs.String("font-family", defaultFontFamily, "CSS font-family for the render wrapper"),
+		capture: fs.String("capture", CaptureFull, "Screenshot area: full (entire page) or viewport (visible area only)"),
+		thumbW:  fs.Int("thumbnail-width", 0, "Also write a <name>.thumb.png scaled to this width (default: 0 = none)"),
+
+		execCmd:        fs.String("exec", "", "Command to run after each screenshot; {path}, {id} and {subject} are substituted"),
+		execTimeout:    fs.Duration("exec-timeout", 30*time.Second, "Maximum run time for the -exec command"),
+		execIgnoreFail: fs.Bool("exec-ignore-failure", false, "Don't count a failing -exec command as a processing failure"),
+
+		noMove:   fs.Bool("no-move", false, "Only take screenshots; leave emails in the source folder"),
+		copyMode: fs.Bool("copy", false, "Add emails to the archive folder without removing them from the source folder"),
+
+		dedupe:          fs.Bool("dedupe", false, "Skip screenshots for emails whose HTML duplicates one already processed this run"),
+		dedupeNoArchive: fs.Bool("dedupe-no-archive", false, "With -dedupe, leave duplicate emails in the source folder instead of archiving them"),
+
+		fromAllow:       fs.String("from-allow", "", "Comma-separated sender address/domain patterns to process (default: all)"),
+		fromDeny:        fs.String("from-deny", "", "Comma-separated sender address/domain patterns to skip"),
+		archiveFiltered: fs.Bool("archive-filtered", false, "Archive emails skipped by -from-allow/-from-deny (without a screenshot) instead of leaving them"),
+
+		htmlParts: fs.String("html-parts", HTMLPartsFirst, "How to combine multiple HTML body parts: first, concat, or largest"),
+
+		rps:       fs.Float64("rps", 0, "Maximum JMAP requests per second (default: 0 = unlimited)"),
+		traceFile: fs.String("trace-file", "", "Append raw JMAP requests and responses to this file as JSON Lines (credentials redacted)"),
+
+		incremental:    fs.Bool("incremental", false, "Process newest emails first and stop after a run of already-screenshotted emails"),
+		knownThreshold: fs.Int("known-threshold", 5, "Consecutive already-screenshotted emails that end an -incremental run"),
+
+		clipSelector: fs.String("clip-selector", "", "Capture only the bounding box of the first element matching this CSS selector (default: whole page)"),
+		debugLog:     fs.Bool("debug", false, "Log debugging details such as measured clip regions"),
+
+		estimate: fs.Int("estimate", 0, "With -dry-run, render this many sample screenshots to estimate total disk usage (starts Chrome)"),
+
+		sidecar:    fs.Bool("sidecar", false, "Write email metadata (subject, sender, date, preview) to a <name>.json file next to each screenshot"),
+		senderDirs: fs.Bool("sender-dirs", false, "Put each screenshot in a subdirectory of the output directory named after the sender's domain"),
+
+		maxHeight: fs.Int("max-height", 0, "Maximum screenshot height in pixels; taller emails are cut off (default: 0 = unlimited)"),
+		split:     fs.Bool("split", false, "With -max-height, split tall emails into numbered slices instead of cutting them off"),
+
+		saveHTML: fs.Bool("save-html", false, "Also save the exact HTML rendered for each screenshot as <name>.html"),
+
+		failFast:    fs.Bool("fail-fast", false, "Stop at the first email that fails instead of continuing with the rest"),
+		maxFailures: fs.Int("max-failures", 0, "Stop the run once this many emails have failed (default: 0 = never)"),
+
+		authMode:   fs.String("auth", AuthBearer, "Authentication: bearer (FASTMAIL_AAR_KEY token) or basic (username and password)"),
+		authUser:   fs.String("username", "", "Username for -auth basic (default: $AAR_USERNAME)"),
+		authPass:   fs.String("password", "", "Password for -auth basic (default: $AAR_PASSWORD)"),
+		sessionURL: fs.String("session-url", jmapServerURL, "JMAP session URL, for servers other than Fastmail"),
+
+		autoWidth: fs.Bool("auto-width", false, "Resize the viewport to fit the email's content width, between -min-width and -max-width"),
+		minWidth:  fs.Int("min-width", 480, "Narrowest viewport for -auto-width and -meta-viewport"),
+		maxWidth:  fs.Int("max-width", screenshotWidth, "Widest viewport for -auto-width and -meta-viewport"),
+
+		metaViewport: fs.Bool("meta-viewport", false, "Set each email's viewport to the width its <meta name=\"viewport\"> declares, between -min-width and -max-width"),
+
+		banner: fs.Bool("banner", false, "Render a header with the subject, sender and date above each email"),
+
+		guardedMove: fs.Bool("guarded-move", false, "Only move an email if the mailbox hasn't changed since it was read (safe for overlapping runs)"),
+
+		emailID: fs.String("email-id", "", "Process only the email with this ID (it must be in the source folder); ignores -limit"),
+
+		capabilities: new(stringList),
+
+		batchMoves: fs.Bool("batch-moves", false, "Move emails to the archive in batches at the end of the run instead of one at a time"),
+
+		printHTML: fs.Bool("print-html", false, "Print the HTML each email would be rendered from, without Chrome and without moving emails"),
+
+		unreadOnly:    fs.Bool("unread-only", false, "Only process unread emails in the source folder"),
+		hasAttachment: fs.Bool("has-attachment", false, "Only process emails with attachments in the source folder"),
+
+		format:  fs.String("format", FormatPNG, "Output format: png, webp (smaller, lossy, encoded by Chrome) or pdf (paginated for printing); a comma-separated list such as png,pdf writes each from one render"),
+		quality: fs.Int("quality", defaultWebPQuality, "Compression quality 1-100 for -format webp"),
+
+		pdfPageSize:  fs.String("pdf-page-size", defaultPDFPageSize, "Paper size for -format pdf: letter, legal, a4 or a3"),
+		pdfMargin:    fs.Float64("pdf-margin", defaultPDFMargin, "Margin on every side of -format pdf pages, in inches"),
+		pdfLandscape: fs.Bool("pdf-landscape", false, "Print -format pdf pages in landscape orientation"),
+
+		optimize: fs.Bool("optimize", false, "Re-encode screenshots with maximum PNG compression (smaller files, more CPU)"),
+
+		listMailboxes: fs.Bool("list-mailboxes", false, "Print every mailbox's name, role, ID and email counts, then exit"),
+
+		caFile:   fs.String("ca-file", "", "PEM file of extra CA certificates to trust, for self-hosted servers with a private CA"),
+		insecure: fs.Bool("insecure", false, "Skip TLS certificate verification (UNSAFE, for testing only)"),
+
+		minAge: fs.Duration("min-age", 0, "Leave emails received more recently than this (e.g. 10m) in the source folder for a later run (default: 0 = no minimum)"),
+
+		verifyMove: fs.Bool("verify-move", false, "After each move, re-fetch the email to confirm it left the source folder (one extra request per email)"),
+
+		concurrency: fs.Int("concurrency", 1, "Number of emails to process at once"),
+		delay:       fs.Duration("delay", 0, "Wait this long (e.g. 2s) before starting each email after the first, to go easy on the server (default: 0 = no delay)"),
+		delayJitter: fs.Int("delay-jitter", 0, "Vary each -delay at random by up to this percentage either way (0-100)"),
+		maxTabs:     fs.Int("max-tabs", 4, "Maximum tabs rendering screenshots at once in the shared Chrome, however high -concurrency is"),
+
+		configFile: fs.String("config", "", "YAML or TOML file of flag settings; flags given on the command line take precedence"),
+
+		showVersion: fs.Bool("version", false, "Print version information and exit"),
+
+		resetState: fs.Bool("reset-state", false, "With -state-file, forget the saved state for the source folder and scan it fully"),
+		stateFile:  fs.String("state-file", "", "Remember the JMAP sync state in this file and only consider emails changed since the last run"),
+
+		report:      fs.String("report", "", "Write a JSON report of each email's status and any error to this file"),
+		retryReport: fs.String("retry-report", "", "Process only the emails that failed in this -report file and are still in the source folder"),
+
+		embedMetadata: fs.Bool("embed-metadata", false, "Embed the subject, sender and date in each PNG screenshot as text chunks"),
+
+		chromePath:  fs.String("chrome-path", "", "Chrome or Chromium executable to run (default: found on the PATH)"),
+		chromeFlags: new(stringList),
+		imageProxy:  fs.String("image-proxy", "", "Proxy URL (e.g. http://proxy:3128) for Chrome's requests, such as remote images; a shortcut for -chrome-flag --proxy-server=URL"),
+
+		webhook:   fs.String("webhook", "", "URL to POST a JSON summary of the run to when it finishes"),
+		webhookOn: fs.String("webhook-on", WebhookOnAlways, "When to send -webhook: always or failures (only when emails failed)"),
+
+		checkpoint: fs.String("checkpoint", "", "Record progress in this file after each completed email, and resume after the last one recorded"),
+
+		exclusiveArchive: fs.Bool("exclusive-archive", false, "Remove archived emails from every other mailbox they are in (such as Inbox), not just the source folder"),
+
+		stripTrackers: fs.Bool("strip-trackers", false, "Remove tracking pixels (1x1, hidden or known tracker images) from the HTML before rendering"),
+
+		nameByHash: fs.Bool("name-by-hash", false, "Name screenshots after a hash of their HTML, so the same content always gets the same file and isn't rendered twice"),
+
+		interactive: fs.Bool("interactive", false, "List the emails to be processed and ask for confirmation before processing them"),
+		yes:         fs.Bool("yes", false, "With -interactive, proceed without asking (required when stdin isn't a terminal)"),
+
+		domainStats: fs.Bool("domain-stats", false, "Count processed emails by sender domain in the summary"),
+
+		account: fs.String("account", "", "Mail account ID or name to use when your login can access several (default: the primary account)"),
+
+		htmlFile:  fs.String("html-file", "", "Screenshot the HTML in this file instead of processing emails (no JMAP connection)"),
+		stdinHTML: fs.Bool("stdin-html", false, "Screenshot HTML read from standard input instead of processing emails (no JMAP connection)"),
+
+		preferAMP: fs.Bool("prefer-amp", false, "Render an email's AMP for Email (text/x-amp-html) part instead of its HTML when it has one"),
+
+		thread:     fs.Bool("thread", false, "Capture each email's whole conversation (every message of its thread) in one screenshot"),
+		threadMove: fs.String("thread-move", ThreadMoveAll, "With -thread, what to archive: thread (its messages in the source folder) or email (just the one processed)"),
+
+		maxHTMLSize: fs.Int("max-html-size", defaultMaxHTMLSize, "Fail emails whose HTML is larger than this many bytes instead of rendering them (0 = no limit)"),
+
+		trashOnFail: fs.Bool("trash-on-fail", false, "Move emails with no HTML or whose screenshot fails to the Trash folder instead of leaving them in the source folder"),
+
+		renderICS: fs.Bool("render-ics", false, "Show the event of a calendar invite (text/calendar part) as a card above the email"),
+
+		failTruncated: fs.Bool("fail-truncated", false, "Fail emails whose body the server returned only part of, instead of screenshotting what there is"),
+
+		archiveUnscreenshotted: fs.Bool("archive-unscreenshotted", false, "Archive emails with no HTML to render, without a screenshot, instead of failing them"),
+
+		renderAttachments: fs.Bool("render-attachments", false, "Also screenshot image and PDF attachments (a PDF's first page), each to a numbered file next to the email's"),
+
+		colorScheme: fs.String("color-scheme", ColorSchemeLight, "Emulated prefers-color-scheme: light or dark (renders the email's dark-mode styles)"),
+
+		matchBg: fs.Bool("match-bg", false, "Paint the page in the email's own background color, so margins and gaps around it match"),
+
+		pruneEmptyDirs: fs.Bool("prune-empty-dirs", false, "After the run, remove empty directories left in the output directory"),
+
+		timezone: fs.String("timezone", "", "IANA time zone the email's scripts see, e.g. Europe/London (default: the system's)"),
+		locale:   fs.String("locale", "", "Locale the email's scripts see, e.g. en-GB (default: the system's)"),
+
+		onlyWithScreenshotDiff: fs.Bool("only-with-screenshot-diff", false, "Leave an existing screenshot file as it is when the new capture is identical, instead of rewriting it"),
+		diffPixels:             fs.Bool("diff-pixels", false, "With -only-with-screenshot-diff, compare decoded pixels instead of file bytes"),
+
+		quarantine:       fs.String("quarantine", "", "Comma-separated sender address/domain patterns to screenshot but leave in the source folder for review"),
+		quarantineUnless: fs.String("quarantine-unless", "", "Comma-separated sender address/domain patterns; screenshot emails from any other sender but leave them in the source folder"),
+
+		widths: new(intList),
+
+		preserveKeywords: fs.Bool("preserve-keywords", false, "Never remove keywords, such as $flagged, in a move that changes them (moves that only change mailboxes keep every keyword anyway)"),
+
+		gallery: fs.Bool("gallery", false, "After the run, add the screenshots to an index.html gallery in the output directory"),
+
+		archiveOnScreenshotSkip: fs.Bool("archive-on-screenshot-skip", false, "With -incremental, archive emails that already have a screenshot instead of leaving them in the source folder"),
+
+		orderedOutput: fs.Bool("ordered-output", false, "With -concurrency, print each email's output in folder order instead of as it finishes"),
+
+		headers: fs.String("headers", "", "Comma-separated header fields to fetch and record in sidecars and embedded metadata, e.g. List-Unsubscribe,Message-ID"),
+	}
+	fs.Var(flags.capabilities, "capability", "Extra JMAP capability URN to declare in requests (repeatable)")
+	fs.Var(flags.chromeFlags, "chrome-flag", "Extra Chrome command-line switch, e.g. --no-sandbox (repeatable)")
+	fs.Var(flags.widths, "widths", "Comma-separated viewport widths to capture each email at, e.g. 375,768,1280, one file per width")
+	fs.Usage = func() { usage(fs) }
+	return fs, flags
+}
+
+// screenshotOptions returns the rendering options set by the flags
+func (flags *cliFlags) screenshotOptions() ScreenshotOptions {
+	format, extraFormats := splitFormats(*flags.format)
+	return ScreenshotOptions{
+		Width:           screenshotWidth,
+		Height:          screenshotHeight,
+		Capture:         *flags.capture,
+		Format:          format,
+		ExtraFormats:    extraFormats,
+		Quality:         *flags.quality,
+		PDFPageSize:     *flags.pdfPageSize,
+		PDFMargin:       *flags.pdfMargin,
+		PDFLandscape:    *flags.pdfLandscape,
+		BackgroundColor: *flags.bgColor,
+		FontFamily:      *flags.font,
+		MatchBackground: *flags.matchBg,
+		ColorScheme:     *flags.colorScheme,
+		Timezone:        *flags.timezone,
+		Locale:          *flags.locale,
+		SkipUnchanged:   *flags.onlyWithScreenshotDiff,
+		ComparePixels:   *flags.diffPixels,
+		Widths:          *flags.widths,
+		ThumbnailWidth:  *flags.thumbW,
+		ClipSelector:    *flags.clipSelector,
+		MaxHeight:       *flags.maxHeight,
+		Split:           *flags.split,
+		SaveHTML:        *flags.saveHTML,
+		Optimize:        *flags.optimize,
+		AutoWidth:       *flags.autoWidth,
+		MinWidth:        *flags.minWidth,
+		MaxWidth:        *flags.maxWidth,
+		MetaViewport:    *flags.metaViewport,
+		ChromePath:      *flags.chromePath,
+		ChromeFlags:     *flags.chromeFlags,
+		ImageProxy:      *flags.imageProxy,
+		StripTrackers:   *flags.stripTrackers,
+		NameByHash:      *flags.nameByHash,
+	}
+}
+
+// splitFormats splits a comma-separated -format list into the screenshot's
+// format and any extra formats
+func splitFormats(list string) (string, []string) {
+	var formats []string
+	for _, format := range strings.Split(list, ",") {
+		formats = append(formats, strings.ToLower(strings.TrimSpace(format)))
+	}
+	return formats[0], formats[1:]
+}
+
+// splitList splits a comma-separated flag value, such as a list of sender
+// patterns or header names, trimming each item and dropping empty ones
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// intList is a flag holding a comma-separated list of integers
+type intList []int
+
+func (l *intList) String() string {
+	values := make([]string, len(*l))
+	for i, n := range *l {
+		values[i] = strconv.Itoa(n)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *intList) Set(value string) error {
+	var values []int
+	for _, field := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return fmt.Errorf("invalid number %q", strings.TrimSpace(field))
+		}
+		values = append(values, n)
+	}
+	*l = append(*l, values...)
+	return nil
+}
+
+// screenshotRetryDelay is the initial backoff between screenshot attempts; it doubles after each failure
+var screenshotRetryDelay = time.Second
+
+// ProcessOptions configures how emails are processed
+type ProcessOptions struct {
+	Limit   int
+	DryRun  bool
+	Archive string // Archive mailbox name or role:<role>; defaults to archiveFolder
+
+	ScreenshotRetries int
+	Rules             []SenderRule // Sender-based archive routing; unmatched emails use Archive
+	HTMLParts         string       // HTMLPartsFirst (default), HTMLPartsConcat or HTMLPartsLargest
+
+	ExecHook          *ExecHook // Run after each successful screenshot
+	ExecIgnoreFailure bool      // Log hook failures without failing the email
+
+	ArchiveMode string // ArchiveMove (default), ArchiveCopy or ArchiveNone
+
+	Progress bool // Show an in-place progress line with ETA (for terminals)
+
+	// Dedupe skips the screenshot for emails whose normalized HTML matches one
+	// already screenshotted this run; duplicates are archived unless DedupeNoArchive
+	Dedupe          bool
+	DedupeNoArchive bool
+
+	// SenderFilter skips emails from non-matching senders; they are left in
+	// the source folder unless ArchiveFiltered
+	SenderFilter    SenderFilter
+	ArchiveFiltered bool
+
+	// Incremental sorts newest-first, skips emails that already have a
+	// screenshot, and stops after KnownThreshold consecutive such emails
+	Incremental    bool
+	KnownThreshold int
+
+	// ArchiveKnown archives emails Incremental skips for already having a
+	// screenshot, without capturing them again; by default they are left in
+	// the source folder untouched
+	ArchiveKnown bool
+
+	// StateFile, when set, stores the JMAP Email state between runs so only
+	// emails created or updated since the last successful run are considered.
+	// States are kept per account and source mailbox; ResetState clears the
+	// current one first to force a full scan.
+	StateFile  string
+	ResetState bool
+
+	// EstimateSamples, in dry-run mode, renders and deletes this many sample
+	// screenshots to estimate the total disk usage
+	EstimateSamples int
+
+	// Sidecar writes a <basename>.json metadata file next to each screenshot
+	Sidecar bool
+
+	// SenderDirs writes each screenshot to a subdirectory of the output
+	// directory named after the sender's domain ("unknown" if there is none)
+	SenderDirs bool
+
+	// EmbedMetadata writes the subject, sender and date into each screenshot
+	// as PNG text chunks; other formats are left as they are
+	EmbedMetadata bool
+
+	// Checkpoint is a file recording the last email of the unbroken run of
+	// completed emails from the start of the list; a later run with the same
+	// file skips the emails up to and including it
+	Checkpoint string
+
+	// Confirm, when set, lists the emails to be processed and reads a yes or
+	// no from it before processing any; no ends the run with errAborted
+	Confirm io.Reader
+
+	// PostProcessors run, in order, on each screenshot after Sidecar and
+	// EmbedMetadata and before ExecHook; one failing fails the email
+	PostProcessors []PostProcessor
+
+	// MaxFailures, when positive, stops the run once this many emails have
+	// failed, returning the partial result along with an error
+	MaxFailures int
+
+	// FailFast stops at the first failed email, returning the partial result
+	// along with an error
+	FailFast bool
+
+	// Banner renders the subject, sender and date above the email body
+	Banner bool
+
+	// UnreadOnly and HasAttachment narrow the source folder query
+	UnreadOnly    bool
+	HasAttachment bool
+
+	// PrintHTML writes the full HTML document each email would be rendered
+	// from to the output, without taking screenshots or moving anything
+	PrintHTML bool
+
+	// BatchMoves queues moves and applies them at the end of the run with
+	// as few Email/set calls as the server's limits allow
+	BatchMoves bool
+
+	// EmailID processes only this email, which must be in the source folder,
+	// instead of querying the folder; Limit and StateFile are ignored
+	EmailID string
+
+	// RetryIDs, when set, processes only these emails (the failures from an
+	// earlier report) that are still in the source folder, instead of
+	// querying the folder; Limit and StateFile are ignored
+	RetryIDs []string
+
+	// GuardedMove sends the Email state each email was read at with its
+	// move, so a concurrent change is detected rather than overwritten
+	GuardedMove bool
+
+	// VerifyMove re-fetches each moved email to confirm it left the source
+	// folder and reached the archive, failing it otherwise
+	VerifyMove bool
+
+	// MinAge leaves emails received less than this long ago in the source
+	// folder, counted as skipped, so a later run picks them up
+	MinAge time.Duration
+
+	// PreferAMP renders an email's AMP for Email part instead of its HTML
+	// body when it has one; the client must fetch every body value (FetchAllBodyValues)
+	PreferAMP bool
+
+	// MaxHTMLSize fails emails whose HTML to render is larger than this
+	// many bytes, without rendering them (0 = no limit)
+	MaxHTMLSize int
+
+	// RenderICS puts a card with the event's title, time and place above
+	// emails with a calendar (text/calendar) part; the client must fetch every
+	// body value (FetchAllBodyValues)
+	RenderICS bool
+
+	// FailTruncated fails emails with a body value the server cut short
+	// instead of screenshotting what was returned with a warning
+	FailTruncated bool
+
+	// RenderAttachments also screenshots each image and PDF attachment (a
+	// PDF's first page) to a numbered file next to the email's screenshot
+	RenderAttachments bool
+
+	// Quarantine screenshots emails from senders it doesn't allow as usual
+	// but leaves them in the source folder for review instead of archiving
+	// them, counting them as QuarantinedCount
+	Quarantine SenderFilter
+
+	// ArchiveUnscreenshotted archives emails with no HTML to render without
+	// a screenshot, counting them as ArchivedWithoutScreenshot, instead of
+	// failing them; this takes precedence over TrashOnFail for such emails
+	ArchiveUnscreenshotted bool
+
+	// TrashOnFail moves emails with no HTML content, or whose screenshot
+	// fails, to the account's Trash mailbox (by role) so later runs don't
+	// retry them. They are still counted as failed.
+	TrashOnFail bool
+
+	// Thread captures each email's whole conversation in one screenshot,
+	// oldest message first. ThreadMove is ThreadMoveAll (default) to archive
+	// every message of the thread in the source folder, or ThreadMoveEmail
+	// for just the email processed. Later emails of a captured thread count
+	// as duplicates.
+	Thread     bool
+	ThreadMove string
+
+	// DomainStats counts processed emails by the domain of their primary
+	// sender in ProcessResult.DomainCounts
+	DomainStats bool
+
+	// Concurrency is how many emails are processed at once (default 1);
+	// MaxTabs separately caps how many of them render in Chrome at a time
+	Concurrency int
+	MaxTabs     int
+
+	// OrderedOutput writes each email's output in list order rather than as
+	// it finishes, holding it back until the emails before it have finished
+	OrderedOutput bool
+
+	// Delay is how long to wait before starting each email after the first,
+	// varied by up to DelayJitter percent either way. It spaces whole
+	// emails, fetch to archive, on top of the JMAP rate limit.
+	Delay       time.Duration
+	DelayJitter int
+
+	// Context stops the run when it is done, as on an interrupt: no more
+	// emails are started and the summary covers those handled so far
+	// (default: never)
+	Context context.Context
+}
+
 // ProcessResult contains the results of processing emails
 type ProcessResult struct {
 	TotalCount     int
 	ProcessedCount int
 	FailedCount    int
+	SkippedCount   int
+	DuplicateCount int
+	StoppedEarly   bool // Incremental run stopped after a run of known emails
+
+	// MaxFailuresReached is set when the run stopped at MaxFailures
+	MaxFailuresReached bool
+
+	// ArchivedWithoutScreenshot counts emails without HTML archived anyway,
+	// with ArchiveUnscreenshotted
+	ArchivedWithoutScreenshot int
+
+	// QuarantinedCount counts emails screenshotted but left in the source
+	// folder, with Quarantine
+	QuarantinedCount int
+
+	// UnchangedCount counts screenshots captured identical to the files
+	// already there, which were left as they were, with SkipUnchanged
+	UnchangedCount int
+
+	// KnownCount counts the skipped emails that already had a screenshot,
+	// with Incremental; they were archived only with ArchiveKnown
+	KnownCount int
+
+	// Emails holds the result of each handled email in list order; it is
+	// empty for dry runs
+	Emails []emailResult
+
+	// DomainCounts is the number of processed emails per sender domain,
+	// with DomainStats
+	DomainCounts map[string]int
+}
+
+// TotalDuration returns the summed processing time of every handled email
+func (r *ProcessResult) TotalDuration() time.Duration {
+	var total time.Duration
+	for _, email := range r.Emails {
+		total += email.duration
+	}
+	return total
+}
+
+// AverageDuration returns the mean processing time per handled email
+func (r *ProcessResult) AverageDuration() time.Duration {
+	if len(r.Emails) == 0 {
+		return 0
+	}
+	return r.TotalDuration() / time.Duration(len(r.Emails))
+}
+
+// DomainCount is one sender domain's share of a run
+type DomainCount struct {
+	Domain string
+	Count  int
 }
 
+// DomainBreakdown returns DomainCounts with the busiest domains first, ties
+// broken by name
+func (r *ProcessResult) DomainBreakdown() []DomainCount {
+	breakdown := make([]DomainCount, 0, len(r.DomainCounts))
+	for domain, count := range r.DomainCounts {
+		breakdown = append(breakdown, DomainCount{Domain: domain, Count: count})
+	}
+	slices.SortFunc(breakdown, func(a, b DomainCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return breakdown
+}
+
+// formatDuration rounds d for display, e.g. 2.35s or 41ms
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(10 * time.Millisecond).String()
+}
+
+// Constructors used by run, replaced with fakes in tests
+var (
+	newEmailClient = func(opts ClientOptions) (EmailClient, error) {
+		client, err := NewJMAPClient(opts)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	newScreenshotService = func(dir string, opts ScreenshotOptions) (ScreenshotService, error) {
+		generator, err := NewScreenshotGenerator(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		return generator, nil
+	}
+)
+
 func main() {
-	flag.Parse()
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run does the work of main with the given arguments (excluding the program
+// name), reading -stdin-html input from stdin and writing progress to stdout
+// and errors to stderr. It returns the process exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs, flags := newFlagSet(os.Args[0])
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitConfig
+	}
+	logger := log.New(stderr, "", log.LstdFlags)
+
+	if *flags.showVersion {
+		fmt.Fprintln(stdout, versionString())
+		return exitOK
+	}
+
+	if *flags.configFile != "" {
+		if err := loadConfigFile(fs, *flags.configFile, stderr); err != nil {
+			logger.Print(err)
+			return exitConfig
+		}
+	}
+
+	// Rendering local HTML needs no credentials or server
+	if *flags.htmlFile != "" || *flags.stdinHTML {
+		return runHTMLInput(flags, stdin, stdout, logger)
+	}
+
+	// Get credentials from flags or environment
+	username, password := *flags.authUser, *flags.authPass
+	if username == "" {
+		username = os.Getenv("AAR_USERNAME")
+	}
+	if password == "" {
+		password = os.Getenv("AAR_PASSWORD")
+	}
+	auth, err := newAuthenticator(*flags.authMode, os.Getenv("FASTMAIL_AAR_KEY"), username, password)
+	if err != nil {
+		logger.Print(err)
+		return exitAuth
+	}
+
+	if *flags.noMove && *flags.copyMode {
+		logger.Print("-no-move and -copy are mutually exclusive")
+		return exitConfig
+	}
+	if *flags.exclusiveArchive && *flags.copyMode {
+		logger.Print("-exclusive-archive and -copy are mutually exclusive")
+		return exitConfig
+	}
+	// -incremental looks screenshots up by email ID before fetching the
+	// HTML a hash name comes from, so it would never find them
+	if *flags.nameByHash && *flags.incremental {
+		logger.Print("-name-by-hash can't be combined with -incremental")
+		return exitConfig
+	}
+	if *flags.archiveOnScreenshotSkip && !*flags.incremental {
+		logger.Print("-archive-on-screenshot-skip requires -incremental")
+		return exitConfig
+	}
+	archiveMode := ArchiveMove
+	if *flags.noMove {
+		archiveMode = ArchiveNone
+	} else if *flags.copyMode {
+		archiveMode = ArchiveCopy
+	}
+
+	if *flags.batchMoves && *flags.guardedMove {
+		logger.Print("-batch-moves and -guarded-move are mutually exclusive")
+		return exitConfig
+	}
+	// Batched moves happen after the checkpoint has recorded their emails
+	if *flags.batchMoves && *flags.checkpoint != "" {
+		logger.Print("-batch-moves and -checkpoint are mutually exclusive")
+		return exitConfig
+	}
+
+	if *flags.concurrency < 1 || *flags.maxTabs < 1 {
+		logger.Print("-concurrency and -max-tabs must be at least 1")
+		return exitConfig
+	}
 
-	// Get API key from environment
-	apiKey := os.Getenv("FASTMAIL_AAR_KEY")
-	if apiKey == "" {
-		log.Fatal("FASTMAIL_AAR_KEY environment variable is required")
+	if *flags.delay < 0 || *flags.delayJitter < 0 || *flags.delayJitter > 100 {
+		logger.Print("-delay must not be negative and -delay-jitter must be between 0 and 100")
+		return exitConfig
 	}
 
-	fmt.Println("Starting email screenshot generator...")
+	if *flags.maxFailures < 0 {
+		logger.Print("-max-failures must not be negative")
+		return exitConfig
+	}
+
+	if *flags.maxHTMLSize < 0 {
+		logger.Print("-max-html-size must not be negative")
+		return exitConfig
+	}
+
+	if *flags.resetState && *flags.stateFile == "" {
+		logger.Print("-reset-state requires -state-file")
+		return exitConfig
+	}
+
+	if *flags.emailID != "" && *flags.retryReport != "" {
+		logger.Print("-email-id and -retry-report are mutually exclusive")
+		return exitConfig
+	}
+
+	if *flags.estimate > 0 && !*flags.dryRun {
+		logger.Print("-estimate requires -dry-run")
+		return exitConfig
+	}
+
+	if *flags.threadMove != ThreadMoveAll && *flags.threadMove != ThreadMoveEmail {
+		logger.Printf("Invalid -thread-move %q: expected %s or %s", *flags.threadMove, ThreadMoveAll, ThreadMoveEmail)
+		return exitConfig
+	}
+
+	if *flags.webhookOn != WebhookOnAlways && *flags.webhookOn != WebhookOnFailures {
+		logger.Printf("Invalid -webhook-on %q: expected %s or %s", *flags.webhookOn, WebhookOnAlways, WebhookOnFailures)
+		return exitConfig
+	}
+	if *flags.webhook != "" {
+		if err := validateWebhookURL(*flags.webhook); err != nil {
+			logger.Print(err)
+			return exitConfig
+		}
+	}
+
+	// Confirming needs someone at a terminal to answer
+	var confirmInput io.Reader
+	if *flags.interactive && !*flags.yes {
+		if !isTerminal(stdin) {
+			logger.Print("-interactive needs a terminal to ask for confirmation; pass -yes to proceed without asking")
+			return exitConfig
+		}
+		confirmInput = stdin
+	}
+
+	switch *flags.htmlParts {
+	case HTMLPartsFirst, HTMLPartsConcat, HTMLPartsLargest:
+	default:
+		logger.Printf("Invalid -html-parts %q: expected %s, %s, or %s", *flags.htmlParts, HTMLPartsFirst, HTMLPartsConcat, HTMLPartsLargest)
+		return exitConfig
+	}
+
+	// Load the emails to retry before connecting, so a clean report needs
+	// no run at all
+	var retryIDs []string
+	if *flags.retryReport != "" {
+		retryIDs, err = loadFailedEmailIDs(*flags.retryReport)
+		if err != nil {
+			logger.Printf("Failed to load report: %v", err)
+			return exitConfig
+		}
+		if len(retryIDs) == 0 {
+			fmt.Fprintf(stdout, "No failed emails in %s, nothing to retry\n", *flags.retryReport)
+			return exitOK
+		}
+	}
+
+	if format, _ := splitFormats(*flags.format); *flags.embedMetadata && format != FormatPNG {
+		logger.Printf("Warning: -embed-metadata only supports PNG; -format %s screenshots won't have embedded metadata", format)
+	}
+
+	fmt.Fprintln(stdout, "Starting email screenshot generator...")
+	if *flags.insecure {
+		logger.Print("WARNING: -insecure disables TLS certificate verification; anyone on the network path can read your credentials and mail. Use it only for testing.")
+	}
+
+	// An interrupt stops the run once the emails in progress are done, and
+	// cancels requests waiting for the rate limit; a second one exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	context.AfterFunc(ctx, stop)
 
 	// Create JMAP client
-	client, err := NewJMAPClient(apiKey)
+	client, err := newEmailClient(ClientOptions{
+		Auth:              auth,
+		SessionURL:        *flags.sessionURL,
+		Capabilities:      *flags.capabilities,
+		RequestsPerSecond: *flags.rps,
+		TraceFile:         *flags.traceFile,
+		Context:           ctx,
+
+		CAFile:             *flags.caFile,
+		InsecureSkipVerify: *flags.insecure,
+
+		Account:            *flags.account,
+		FetchAllBodyValues: *flags.preferAMP || *flags.renderICS,
+		ExclusiveMoves:     *flags.exclusiveArchive,
+		PreserveKeywords:   *flags.preserveKeywords,
+		Headers:            splitList(*flags.headers),
+	})
 	if err != nil {
-		log.Fatalf("Failed to create JMAP client: %v", err)
+		logger.Printf("Failed to create JMAP client: %v", err)
+		return exitCode(err)
 	}
-	fmt.Println("✓ Connected to JMAP server")
+	if closer, ok := client.(io.Closer); ok {
+		defer closer.Close()
+	}
+	fmt.Fprintln(stdout, "✓ Connected to JMAP server")
 
-	// Create screenshot generator
-	generator, err := NewScreenshotGenerator(screenshotDir, screenshotWidth, screenshotHeight)
+	if *flags.listMailboxes {
+		fmt.Fprintln(stdout)
+		if err := listMailboxes(client, stdout); err != nil {
+			logger.Printf("Failed to list mailboxes: %v", err)
+			return exitCode(err)
+		}
+		return exitOK
+	}
+
+	// Create screenshot generator, with debug output alongside the errors
+	screenshotOpts := flags.screenshotOptions()
+	if *flags.debugLog {
+		screenshotOpts.DebugLog = newSyncWriter(stderr)
+	}
+	generator, err := newScreenshotService(*flags.outDir, screenshotOpts)
 	if err != nil {
-		log.Fatalf("Failed to create screenshot generator: %v", err)
+		logger.Printf("Failed to create screenshot generator: %v", err)
+		return exitConfig
+	}
+	if closer, ok := generator.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Load sender rules
+	var senderRules []SenderRule
+	if *flags.rules != "" {
+		senderRules, err = loadRules(*flags.rules)
+		if err != nil {
+			logger.Printf("Failed to load rules: %v", err)
+			return exitConfig
+		}
+	}
+
+	// Parse post-processing hook
+	var execHook *ExecHook
+	if *flags.execCmd != "" {
+		execHook, err = NewExecHook(*flags.execCmd, *flags.execTimeout)
+		if err != nil {
+			logger.Printf("Invalid -exec command: %v", err)
+			return exitConfig
+		}
 	}
 
 	// Process emails
-	result, err := processEmails(client, generator, *limit, *dryRun, os.Stdout)
+	opts := ProcessOptions{
+		Limit:   *flags.limit,
+		DryRun:  *flags.dryRun,
+		Archive: *flags.archive,
+
+		ScreenshotRetries: *flags.retries,
+		Rules:             senderRules,
+		HTMLParts:         *flags.htmlParts,
+
+		ExecHook:          execHook,
+		ExecIgnoreFailure: *flags.execIgnoreFail,
+
+		ArchiveMode: archiveMode,
+
+		Progress: isTerminal(stdout),
+
+		Dedupe:          *flags.dedupe,
+		DedupeNoArchive: *flags.dedupeNoArchive,
+
+		SenderFilter: SenderFilter{
+			Allow: splitList(*flags.fromAllow),
+			Deny:  splitList(*flags.fromDeny),
+		},
+		ArchiveFiltered: *flags.archiveFiltered,
+
+		Incremental:    *flags.incremental,
+		KnownThreshold: *flags.knownThreshold,
+		ArchiveKnown:   *flags.archiveOnScreenshotSkip,
+
+		StateFile:  *flags.stateFile,
+		ResetState: *flags.resetState,
+
+		EstimateSamples: *flags.estimate,
+
+		Sidecar:       *flags.sidecar,
+		SenderDirs:    *flags.senderDirs,
+		EmbedMetadata: *flags.embedMetadata,
+
+		FailFast:    *flags.failFast,
+		MaxFailures: *flags.maxFailures,
+		Banner:      *flags.banner,
+
+		GuardedMove: *flags.guardedMove,
+
+		EmailID:    *flags.emailID,
+		RetryIDs:   retryIDs,
+		BatchMoves: *flags.batchMoves,
+		PrintHTML:  *flags.printHTML,
+
+		UnreadOnly:    *flags.unreadOnly,
+		HasAttachment: *flags.hasAttachment,
+
+		Concurrency:   *flags.concurrency,
+		MaxTabs:       *flags.maxTabs,
+		OrderedOutput: *flags.orderedOutput,
+		Delay:         *flags.delay,
+		DelayJitter:   *flags.delayJitter,
+
+		VerifyMove: *flags.verifyMove,
+		MinAge:     *flags.minAge,
+
+		DomainStats: *flags.domainStats,
+		PreferAMP:   *flags.preferAMP,
+
+		Thread:     *flags.thread,
+		ThreadMove: *flags.threadMove,
+
+		MaxHTMLSize: *flags.maxHTMLSize,
+		TrashOnFail: *flags.trashOnFail,
+		RenderICS:   *flags.renderICS,
+		Checkpoint:  *flags.checkpoint,
+		Confirm:     confirmInput,
+
+		FailTruncated: *flags.failTruncated,
+
+		ArchiveUnscreenshotted: *flags.archiveUnscreenshotted,
+		RenderAttachments:      *flags.renderAttachments,
+
+		Quarantine: SenderFilter{
+			Allow: splitList(*flags.quarantineUnless),
+			Deny:  splitList(*flags.quarantine),
+		},
+
+		Context: ctx,
+	}
+	result, err := processEmails(client, generator, opts, stdout)
+	if errors.Is(err, errAborted) {
+		return exitOK
+	}
+	if err != nil && result == nil {
+		logger.Printf("Failed to process emails: %v", err)
+		return exitCode(err)
+	}
+
+	if *flags.report != "" {
+		if err := writeReport(*flags.report, result); err != nil {
+			logger.Printf("Failed to write report: %v", err)
+			return exitError
+		}
+	}
+
+	if *flags.gallery && !*flags.dryRun {
+		if err := writeGallery(*flags.outDir, result, stdout); err != nil {
+			logger.Printf("Failed to write gallery: %v", err)
+			return exitError
+		}
+	}
+
+	// Leftover empty directories are logged but don't fail the run
+	if *flags.pruneEmptyDirs && !*flags.dryRun {
+		if err := pruneOutputDir(*flags.outDir, stdout); err != nil {
+			logger.Printf("Failed to prune empty directories: %v", err)
+		}
+	}
+
+	// Print summary
+	fmt.Fprintf(stdout, "\n=== Summary ===\n")
+	fmt.Fprintf(stdout, "Total emails: %d\n", result.TotalCount)
+	fmt.Fprintf(stdout, "Successfully processed: %d\n", result.ProcessedCount)
+	fmt.Fprintf(stdout, "Failed: %d\n", result.FailedCount)
+	if result.SkippedCount > 0 {
+		fmt.Fprintf(stdout, "Skipped: %d\n", result.SkippedCount)
+	}
+	if result.DuplicateCount > 0 {
+		fmt.Fprintf(stdout, "Duplicates: %d\n", result.DuplicateCount)
+	}
+	if result.ArchivedWithoutScreenshot > 0 {
+		fmt.Fprintf(stdout, "Archived without screenshot: %d\n", result.ArchivedWithoutScreenshot)
+	}
+	if result.KnownCount > 0 {
+		if *flags.archiveOnScreenshotSkip {
+			fmt.Fprintf(stdout, "Already screenshotted (archived): %d\n", result.KnownCount)
+		} else {
+			fmt.Fprintf(stdout, "Already screenshotted (left in source folder): %d\n", result.KnownCount)
+		}
+	}
+	if result.QuarantinedCount > 0 {
+		fmt.Fprintf(stdout, "Quarantined (left in source folder): %d\n", result.QuarantinedCount)
+	}
+	if result.UnchangedCount > 0 {
+		fmt.Fprintf(stdout, "Unchanged screenshots, not rewritten: %d\n", result.UnchangedCount)
+	}
+	if result.MaxFailuresReached {
+		fmt.Fprintf(stdout, "Stopped after %d failures (-max-failures); the remaining emails were not attempted\n", result.FailedCount)
+	}
+	if len(result.Emails) > 0 {
+		fmt.Fprintf(stdout, "Time: %s total, %s average per email\n",
+			formatDuration(result.TotalDuration()), formatDuration(result.AverageDuration()))
+	}
+	if breakdown := result.DomainBreakdown(); len(breakdown) > 0 {
+		fmt.Fprintln(stdout, "Processed by sender domain:")
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		for _, dc := range breakdown {
+			fmt.Fprintf(tw, "  %s\t%d\n", dc.Domain, dc.Count)
+		}
+		tw.Flush()
+	}
+
+	// A webhook that can't be delivered is logged but doesn't fail the run
+	if *flags.webhook != "" && !*flags.dryRun && (*flags.webhookOn == WebhookOnAlways || result.FailedCount > 0) {
+		if err := sendWebhook(*flags.webhook, result); err != nil {
+			logger.Printf("Failed to send webhook: %v", err)
+		}
+	}
+
+	// A partial result with an error means the run stopped early, such as
+	// for -fail-fast or expired credentials
 	if err != nil {
-		log.Fatalf("Failed to process emails: %v", err)
+		logger.Printf("Stopped: %v", err)
+		if IsAuthError(err) {
+			return exitAuth
+		}
+		return exitEmailsFailed
+	}
+	if result.FailedCount > 0 {
+		return exitEmailsFailed
+	}
+	return exitOK
+}
+
+// Exit codes, so scripts can tell failure categories apart
+const (
+	exitOK           = 0 // Every email was handled
+	exitError        = 1 // Anything else, such as a network failure
+	exitAuth         = 2 // Missing or rejected credentials, or insufficient permissions
+	exitConfig       = 3 // Invalid flags or files, or a folder or account that doesn't exist
+	exitEmailsFailed = 4 // The run completed but some emails failed
+)
+
+// exitCode maps an error that ended the run to its exit code
+func exitCode(err error) int {
+	var notFound *MailboxNotFoundError
+	var noAccount *AccountNotFoundError
+	switch {
+	case err == nil:
+		return exitOK
+	case IsAuthError(err):
+		return exitAuth
+	case errors.As(err, &notFound), errors.As(err, &noAccount):
+		return exitConfig
+	default:
+		return exitError
 	}
+}
 
-	// Print summary
-	fmt.Printf("\n=== Summary ===\n")
-	fmt.Printf("Total emails: %d\n", result.TotalCount)
-	fmt.Printf("Successfully processed: %d\n", result.ProcessedCount)
-	fmt.Printf("Failed: %d\n", result.FailedCount)
+// usage prints the flag defaults followed by the exit codes
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", fs.Name())
+	fs.PrintDefaults()
+	fmt.Fprintf(out, `
+Exit codes:
+  %d  success
+  %d  error (e.g. network failure)
+  %d  authentication or permission failure
+  %d  invalid configuration, or folder or account not found
+  %d  some emails failed
+`, exitOK, exitError, exitAuth, exitConfig, exitEmailsFailed)
 }
 
-// processEmails processes emails from source to archive folder
-func processEmails(client EmailClient, generator ScreenshotService, limit int, dryRun bool, output io.Writer) (*ProcessResult, error) {
+// processEmails processes emails from source to archive folder. With
+// FailFast, the first failure ends the run and the partial result is
+// returned together with an error, as it is when MaxFailures is reached.
+func processEmails(client EmailClient, generator ScreenshotService, opts ProcessOptions, output io.Writer) (*ProcessResult, error) {
 	// Find source mailbox
 	sourceMailbox, err := client.FindMailboxByName(sourceFolder)
 	if err != nil {
@@ -74,104 +1271,977 @@ func processEmails(client EmailClient, generator ScreenshotService, limit int, d
 	}
 
 	// Find archive mailbox
-	archiveMailbox, err := client.FindMailboxByName(archiveFolder)
+	archiveSpec := opts.Archive
+	if archiveSpec == "" {
+		archiveSpec = archiveFolder
+	}
+	archiveMailbox, err := findMailbox(client, archiveSpec)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find archive folder '%s': %w", archiveFolder, err)
+		return nil, fmt.Errorf("failed to find archive folder '%s': %w", archiveSpec, err)
+	}
+
+	// Resolve archive mailboxes used by sender rules up front
+	ruleMailboxes := make(map[string]*Mailbox)
+	for _, rule := range opts.Rules {
+		if _, ok := ruleMailboxes[rule.Mailbox]; ok {
+			continue
+		}
+		mailbox, err := findMailbox(client, rule.Mailbox)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find rule folder '%s': %w", rule.Mailbox, err)
+		}
+		ruleMailboxes[rule.Mailbox] = mailbox
+	}
+
+	// Find the trash for emails that can't be rendered
+	var trashMailbox *Mailbox
+	if opts.TrashOnFail {
+		trashMailbox, err = client.FindMailboxByRole("trash")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find trash folder: %w", err)
+		}
 	}
 
 	// Get emails from source folder
-	emailIDs, err := client.GetEmailsInMailbox(sourceMailbox.ID, limit)
+	stateKey := syncStateKey(client.AccountID(), sourceMailbox.ID)
+	emailIDs, folderTotal, newState, err := listEmails(client, sourceMailbox, opts, output)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve emails: %w", err)
 	}
+	if opts.Checkpoint != "" {
+		lastID, err := loadCheckpoint(opts.Checkpoint, stateKey)
+		if err != nil {
+			return nil, err
+		}
+		emailIDs = resumeAfter(emailIDs, lastID, output)
+	}
 
 	emailCount := len(emailIDs)
 	if emailCount == 0 {
 		fmt.Fprintf(output, "No emails found in folder '%s'\n", sourceFolder)
+		if !opts.DryRun {
+			if err := saveState(opts.StateFile, stateKey, newState); err != nil {
+				return nil, err
+			}
+		}
 		return &ProcessResult{TotalCount: 0, ProcessedCount: 0, FailedCount: 0}, nil
 	}
 
-	fmt.Fprintf(output, "Found %d email(s) in folder '%s'\n", emailCount, sourceFolder)
+	if folderTotal > emailCount {
+		fmt.Fprintf(output, "Found %d of %d total email(s) in folder '%s'\n", emailCount, folderTotal, sourceFolder)
+	} else {
+		fmt.Fprintf(output, "Found %d email(s) in folder '%s'\n", emailCount, sourceFolder)
+	}
 
-	if dryRun {
+	if opts.DryRun {
 		fmt.Fprintln(output, "\nDRY RUN MODE - No changes will be made")
 		fmt.Fprintf(output, "Would process %d emails:\n", emailCount)
 		for i, id := range emailIDs {
 			fmt.Fprintf(output, "  %d. Email ID: %s\n", i+1, id)
 		}
+		if opts.EstimateSamples > 0 {
+			fmt.Fprintf(output, "\nRendering up to %d sample screenshot(s) to estimate disk usage...\n", opts.EstimateSamples)
+			estimate, err := estimateDiskUsage(client, generator, emailIDs, opts.EstimateSamples, opts.HTMLParts, output)
+			if err != nil {
+				fmt.Fprintf(output, "  ✗ Could not estimate disk usage: %v\n", err)
+			} else {
+				fmt.Fprintf(output, "Estimated disk usage: %s for %d emails (average %s over %d sample(s))\n",
+					formatBytes(estimate.TotalBytes), emailCount, formatBytes(estimate.AverageBytes), estimate.Samples)
+			}
+		}
 		return &ProcessResult{TotalCount: emailCount, ProcessedCount: 0, FailedCount: 0}, nil
 	}
 
-	// Process emails
-	var processedCount, failedCount int
-	for i, emailID := range emailIDs {
-		fmt.Fprintf(output, "\nProcessing email %d/%d (ID: %s)...\n", i+1, emailCount, emailID)
+	if opts.Confirm != nil {
+		if err := confirmRun(client, emailIDs, opts.Confirm, output); err != nil {
+			return nil, err
+		}
+	}
 
-		// Get email details
-		emails, err := client.GetEmails([]string{emailID})
+	// Sidecars record the mailboxes each email was in by name
+	var names map[string]string
+	if opts.Sidecar {
+		names, err = mailboxNames(client)
 		if err != nil {
-			fmt.Fprintf(output, "  ✗ Failed to fetch email: %v\n", err)
-			failedCount++
-			continue
+			fmt.Fprintf(output, "Warning: could not list mailboxes, sidecars will record mailbox IDs only: %v\n", err)
+		}
+	}
+
+	// The generator may have served earlier runs
+	unchangedBefore := unchangedCount(generator)
+
+	// Stopping the run cancels emails still waiting for a browser tab
+	parent := opts.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	p := &processor{
+		ctx:            ctx,
+		tabs:           newSemaphore(opts.MaxTabs),
+		client:         client,
+		emails:         newEmailPrefetcher(client, emailIDs, opts.GuardedMove),
+		generator:      generator,
+		opts:           opts,
+		sourceMailbox:  sourceMailbox,
+		archiveMailbox: archiveMailbox,
+		ruleMailboxes:  ruleMailboxes,
+		trashMailbox:   trashMailbox,
+		postProcessors: postProcessors(opts, names),
+		seenHashes:     make(map[string]string),
+		seenThreads:    make(map[string]string),
+	}
+
+	// Each email's lines are buffered and flushed as one block so they never
+	// interleave with another email's
+	out := newSyncWriter(output)
+	collector := newResultCollector(emailCount, newProgressReporter(out, emailCount, opts.Progress), opts.OrderedOutput)
+	checkpoint := newCheckpointer(opts.Checkpoint, stateKey, emailIDs)
+
+	work := func(i int) emailResult {
+		defer p.emails.done(i)
+		r := emailResult{index: i, id: emailIDs[i], buf: out.newEmailBuffer()}
+		fmt.Fprintf(r.buf, "\nProcessing email %d/%d (ID: %s)...\n", i+1, emailCount, r.id)
+
+		// Skip emails already screenshotted
+		start := time.Now()
+		if opts.Incremental && generator.HasScreenshot(r.id) {
+			fmt.Fprintln(r.buf, "  ↷ Screenshot already exists, skipping")
+			r.status, r.known = statusSkipped, true
+			if opts.ArchiveKnown {
+				if err := p.archiveKnown(i, r.buf); err != nil {
+					r.status, r.err = statusFailed, err
+				}
+			}
+			r.duration = time.Since(start)
+			return r
+		}
+
+		r.status, r.err = p.processEmail(&r, r.buf)
+		r.duration = time.Since(start)
+		if r.status == statusProcessed {
+			fmt.Fprintf(r.buf, "  ✓ Done in %s\n", formatDuration(r.duration))
+		}
+		return r
+	}
+
+	// Up to Concurrency workers run at once, each sending its result to this
+	// goroutine, which alone collects them and decides whether to stop. A new
+	// email starts only when a result has been collected, so stopping never
+	// starts another. With Delay, each start after the first waits here.
+	var consecutiveKnown, failures int
+	stoppedEarly, maxFailuresReached := false, false
+	var stopErr error
+	concurrency := max(opts.Concurrency, 1)
+	results := make(chan emailResult, concurrency)
+	next, inFlight := 0, 0
+	stopping := false
+	for next < emailCount || inFlight > 0 {
+		for !stopping && next < emailCount && inFlight < concurrency {
+			if ctx.Err() != nil || next > 0 && sleepContext(ctx, jitteredDelay(opts.Delay, opts.DelayJitter)) != nil {
+				break
+			}
+			go func(i int) { results <- work(i) }(next)
+			next++
+			inFlight++
+		}
+		if inFlight == 0 {
+			break
 		}
 
-		if len(emails) == 0 {
-			fmt.Fprintln(output, "  ✗ Email not found")
-			failedCount++
+		r := <-results
+		inFlight--
+		collector.add(r)
+		if err := checkpoint.complete(r); err != nil {
+			collector.progress.clear()
+			fmt.Fprintf(out, "Failed to save checkpoint: %v\n", err)
+		}
+		if stopping {
 			continue
 		}
 
-		email := emails[0]
-		fmt.Fprintf(output, "  Subject: %s\n", email.Subject)
+		// Stop after a run of already-screenshotted emails
+		if r.known {
+			consecutiveKnown++
+		} else {
+			consecutiveKnown = 0
+		}
+		if opts.Incremental && opts.KnownThreshold > 0 && consecutiveKnown >= opts.KnownThreshold {
+			collector.progress.clear()
+			fmt.Fprintf(out, "\nStopping early after %d consecutive already-processed emails\n", consecutiveKnown)
+			stoppedEarly = true
+			stopping = true
+			cancel()
+			continue
+		}
 
-		// Extract HTML content
-		htmlContent := extractHTMLContent(email)
-		if htmlContent == "" {
-			fmt.Fprintln(output, "  ✗ No HTML content found")
-			failedCount++
+		// Once the credentials are rejected, every other email would be too
+		if r.status == statusFailed && errors.Is(r.err, ErrAuthExpired) {
+			collector.progress.clear()
+			fmt.Fprintf(out, "\nStopping: authentication expired; %d email(s) not attempted\n", emailCount-next)
+			stopErr = r.err
+			stopping = true
+			cancel()
 			continue
 		}
 
-		// Generate screenshot
-		screenshotPath, err := generator.GenerateScreenshot(email.ReceivedAt, emailID, htmlContent)
-		if err != nil {
-			fmt.Fprintf(output, "  ✗ Failed to generate screenshot: %v\n", err)
-			failedCount++
+		if opts.FailFast && r.status == statusFailed {
+			collector.progress.clear()
+			fmt.Fprintf(out, "\nStopping at the first failure (-fail-fast); %d email(s) not attempted\n", emailCount-next)
+			stopErr = fmt.Errorf("email %s failed", r.id)
+			stopping = true
+			cancel()
 			continue
 		}
-		fmt.Fprintf(output, "  ✓ Screenshot generated: %s\n", screenshotPath)
 
-		// Move email to archive folder
-		if err := client.MoveEmail(emailID, sourceMailbox.ID, archiveMailbox.ID); err != nil {
-			fmt.Fprintf(output, "  ✗ Failed to move email to archive: %v\n", err)
-			failedCount++
+		// So many failures suggest something systemic, such as Chrome
+		// crashing or expired credentials, that the rest would fail too
+		if r.status == statusFailed {
+			failures++
+		}
+		if opts.MaxFailures > 0 && failures >= opts.MaxFailures {
+			collector.progress.clear()
+			fmt.Fprintf(out, "\nStopping after %d failures (-max-failures); %d email(s) not attempted\n", failures, emailCount-next)
+			stopErr = fmt.Errorf("%d emails failed", failures)
+			maxFailuresReached = true
+			stopping = true
+			cancel()
+		}
+	}
+	collector.flush()
+
+	// An interrupted run ends like a stopped one, with what it got to
+	interrupted := !stopping && parent.Err() != nil
+	if interrupted {
+		collector.progress.clear()
+		fmt.Fprintf(out, "\nStopping: interrupted; %d email(s) not attempted\n", emailCount-next)
+		stopErr = parent.Err()
+	}
+
+	// Apply queued batch moves; emails whose move failed count as failed
+	for emailID, err := range p.flushMoves(out) {
+		collector.fail(emailID, err)
+	}
+
+	result := collector.result(opts.DomainStats)
+	result.StoppedEarly = stoppedEarly
+	result.MaxFailuresReached = maxFailuresReached
+	result.UnchangedCount = unchangedCount(generator) - unchangedBefore
+
+	// Only advance the sync state once every email has been handled, so
+	// failures, emails beyond -limit and emails under -min-age are picked up
+	// again on the next run
+	limited := opts.Limit > 0 && emailCount >= opts.Limit
+	if result.FailedCount == 0 && !stoppedEarly && !interrupted && !limited && !opts.PrintHTML && collector.deferred() == 0 {
+		if err := saveState(opts.StateFile, stateKey, newState); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, stopErr
+}
+
+// listEmails returns the IDs of emails to process in the source mailbox and
+// the JMAP state to save once they are handled. With a saved state, only
+// emails created or updated since then are listed; otherwise, or if the
+// server can no longer calculate changes, the whole folder is queried. The
+// count is how many emails in the folder match, beyond any limit, when the
+// whole folder was queried and the server counted them, and 0 otherwise.
+func listEmails(client EmailClient, sourceMailbox *Mailbox, opts ProcessOptions, output io.Writer) ([]string, int, string, error) {
+	if opts.EmailID != "" {
+		emailIDs, newState, err := singleEmail(client, sourceMailbox, opts.EmailID)
+		return emailIDs, 0, newState, err
+	}
+	if opts.RetryIDs != nil {
+		emailIDs, err := retryEmails(client, sourceMailbox, opts.RetryIDs, output)
+		return emailIDs, 0, "", err
+	}
+
+	query := QueryOptions{
+		Limit:         opts.Limit,
+		NewestFirst:   opts.Incremental,
+		UnreadOnly:    opts.UnreadOnly,
+		HasAttachment: opts.HasAttachment,
+	}
+	if opts.StateFile == "" {
+		emailIDs, total, err := client.GetEmailsInMailbox(sourceMailbox.ID, query)
+		return emailIDs, total, "", err
+	}
+
+	key := syncStateKey(client.AccountID(), sourceMailbox.ID)
+	if opts.ResetState {
+		if err := saveSyncState(opts.StateFile, key, ""); err != nil {
+			return nil, 0, "", err
+		}
+		fmt.Fprintln(output, "Cleared the saved sync state, doing a full scan")
+	}
+
+	sinceState, err := loadSyncState(opts.StateFile, key)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	// Take the new state before listing so changes made during the run are
+	// seen next time
+	newState, err := client.GetEmailState()
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	if sinceState != "" {
+		emailIDs, err := changedEmails(client, sourceMailbox.ID, sinceState, opts.Limit)
+		if err == nil {
+			fmt.Fprintf(output, "Checking changes since state %s\n", sinceState)
+			return emailIDs, 0, newState, nil
+		}
+		if !isJMAPError(err, "cannotCalculateChanges") {
+			return nil, 0, "", err
+		}
+		fmt.Fprintln(output, "Saved sync state has expired, falling back to a full scan")
+	}
+
+	emailIDs, total, err := client.GetEmailsInMailbox(sourceMailbox.ID, query)
+	return emailIDs, total, newState, err
+}
+
+// singleEmail checks that emailID exists and is in the source mailbox, so
+// -email-id can't be used to move arbitrary mail
+func singleEmail(client EmailClient, sourceMailbox *Mailbox, emailID string) ([]string, string, error) {
+	result, err := client.GetEmails([]string{emailID})
+	if err != nil {
+		return nil, "", err
+	}
+	if result.IsNotFound(emailID) || len(result.List) == 0 {
+		return nil, "", fmt.Errorf("email %s not found", emailID)
+	}
+	if !result.List[0].MailboxIds[sourceMailbox.ID] {
+		return nil, "", fmt.Errorf("email %s is not in folder '%s'", emailID, sourceMailbox.Name)
+	}
+	return []string{emailID}, "", nil
+}
+
+// changedEmails returns the emails created or updated since sinceState that
+// are currently in mailboxID, up to limit (0 = no limit)
+func changedEmails(client EmailClient, mailboxID, sinceState string, limit int) ([]string, error) {
+	created, updated, _, _, err := client.GetEmailChanges(sinceState)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var candidates []string
+	for _, id := range append(created, updated...) {
+		if !seen[id] {
+			seen[id] = true
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	result, err := client.GetEmails(candidates)
+	if err != nil {
+		return nil, err
+	}
+	// Skipping emails that couldn't be checked would lose them for good
+	// once the new state is saved
+	if err := result.FailedErr(); err != nil {
+		return nil, err
+	}
+
+	var emailIDs []string
+	for _, email := range result.List {
+		if !email.MailboxIds[mailboxID] {
 			continue
 		}
-		fmt.Fprintln(output, "  ✓ Moved to archive folder")
+		emailIDs = append(emailIDs, email.ID)
+		if limit > 0 && len(emailIDs) >= limit {
+			break
+		}
+	}
+	return emailIDs, nil
+}
 
-		processedCount++
+// saveState records state under key in the state file at path; it does
+// nothing when either is empty
+func saveState(path, key, state string) error {
+	if path == "" || state == "" {
+		return nil
 	}
+	return saveSyncState(path, key, state)
+}
+
+// emailStatus is the outcome of processing a single email
+type emailStatus int
+
+const (
+	statusProcessed emailStatus = iota
+	statusFailed
+	statusSkipped
+	statusDuplicate
+	statusArchivedWithoutScreenshot // No HTML, archived anyway (ArchiveUnscreenshotted)
+	statusQuarantined               // Screenshotted but left in the source folder (Quarantine)
+)
 
-	return &ProcessResult{
-		TotalCount:     emailCount,
-		ProcessedCount: processedCount,
-		FailedCount:    failedCount,
-	}, nil
+// processor holds the state shared by every email in a run
+type processor struct {
+	ctx            context.Context // Cancelled when the run stops early
+	tabs           semaphore       // Bounds concurrent screenshots (browser tabs)
+	client         EmailClient
+	emails         *emailPrefetcher // Fetches the emails of the run in batches
+	generator      ScreenshotService
+	opts           ProcessOptions
+	sourceMailbox  *Mailbox
+	archiveMailbox *Mailbox
+	ruleMailboxes  map[string]*Mailbox
+	trashMailbox   *Mailbox // With TrashOnFail
+	postProcessors []PostProcessor
+	// mu guards seenHashes, seenThreads and the pending moves, which concurrent emails
+	// share; everything else about an email goes in its emailResult
+	mu          sync.Mutex
+	seenHashes  map[string]string // Content hash -> ID of the email first screenshotted with it
+	seenThreads map[string]string // Thread ID -> ID of the email that captured it, with Thread
+
+	// With BatchMoves, emails waiting to be moved to each archive mailbox
+	pendingMoves   map[*Mailbox][]string
+	pendingTargets []*Mailbox // Targets in the order first queued
 }
 
-// extractHTMLContent extracts HTML content from an email
-func extractHTMLContent(email Email) string {
-	if len(email.HTMLBody) == 0 {
-		return ""
+// processEmail fetches, screenshots and archives the email r.id, writing its
+// progress to output and filling in the rest of r as it goes. A failed
+// email's status comes with the reason.
+func (p *processor) processEmail(r *emailResult, output io.Writer) (emailStatus, error) {
+	opts := p.opts
+	emailID := r.id
+
+	// Get email details, fetched with the rest of its batch
+	email, state, err := p.emails.get(r.index)
+	if err != nil {
+		return statusFailed, failf(output, "%w", err)
+	}
+	fmt.Fprintf(output, "  Subject: %s\n", email.Subject)
+	r.subject, r.receivedAt = email.Subject, email.ReceivedAt
+	r.sender, _ = PrimarySender(email)
+	if opts.DomainStats {
+		_, sender := PrimarySender(email)
+		r.domain = senderDomain(sender)
+	}
+
+	// Leave emails that may still be changing for a later run
+	if opts.MinAge > 0 {
+		if received, err := time.Parse(time.RFC3339, email.ReceivedAt); err == nil {
+			if age := time.Since(received); age < opts.MinAge {
+				fmt.Fprintf(output, "  ↷ Received %s ago (under -min-age %s), leaving for a later run\n", formatDuration(age), opts.MinAge)
+				r.deferred = true
+				return statusSkipped, nil
+			}
+		}
+	}
+
+	// Apply sender allow/deny filters
+	if !opts.SenderFilter.IsZero() {
+		_, sender := PrimarySender(email)
+		if !opts.SenderFilter.Allows(sender) {
+			fmt.Fprintf(output, "  ↷ Sender %q filtered out, skipping\n", sender)
+			if opts.ArchiveFiltered {
+				if err := p.archive(email, state, output); err != nil {
+					return statusFailed, err
+				}
+			}
+			return statusSkipped, nil
+		}
+	}
+
+	// Extract HTML content
+	htmlContent := extractHTMLContent(email, opts.HTMLParts)
+	if partID, ok := email.AMPPart(); ok {
+		amp, fetched := email.BodyValues[partID]
+		switch {
+		case !opts.PreferAMP:
+			fmt.Fprintln(output, "  AMP part found; rendering the regular HTML (use -prefer-amp to render it)")
+		case !fetched:
+			fmt.Fprintln(output, "  AMP part found but the server didn't return its content; rendering the regular HTML")
+		default:
+			fmt.Fprintln(output, "  Rendering the AMP part (-prefer-amp)")
+			htmlContent = amp.Value
+		}
+	}
+
+	// Render the whole conversation instead, with a banner per message
+	archiveEmails, archiveState := []Email{email}, state
+	threaded := opts.Thread && email.ThreadID != ""
+	if threaded {
+		if firstID, claimed := p.claimThread(email.ThreadID, emailID); !claimed {
+			fmt.Fprintf(output, "  ↷ Thread already captured with %s, skipping\n", firstID)
+			if opts.ThreadMove != ThreadMoveEmail {
+				return statusDuplicate, nil
+			}
+			if err := p.archive(email, state, output); err != nil {
+				return statusFailed, err
+			}
+			return statusDuplicate, nil
+		}
+
+		thread, state, err := p.fetchThread(email)
+		if err != nil {
+			return statusFailed, failf(output, "Failed to fetch thread: %w", err)
+		}
+		fmt.Fprintf(output, "  Thread of %d message(s)\n", len(thread))
+		htmlContent = threadHTML(thread, opts.HTMLParts)
+		if opts.ThreadMove != ThreadMoveEmail {
+			archiveEmails, archiveState = p.threadInSource(thread, email), state
+		}
+	}
+
+	// Show a calendar invite's event above the email, which is all there is
+	// to render for invites without HTML
+	if opts.RenderICS {
+		htmlContent = calendarCard(email, output) + htmlContent
+	}
+
+	if htmlContent == "" && opts.ArchiveUnscreenshotted {
+		fmt.Fprintln(output, "  ↷ No HTML content found, archiving without a screenshot")
+		for _, e := range archiveEmails {
+			if err := p.archive(e, archiveState, output); err != nil {
+				return statusFailed, err
+			}
+		}
+		return statusArchivedWithoutScreenshot, nil
+	}
+	if htmlContent == "" {
+		err := failf(output, "No HTML content found")
+		p.trash(emailID, output)
+		return statusFailed, err
+	}
+
+	// A truncated body would be screenshotted as if it were the whole email
+	if email.TruncatedBody() {
+		if opts.FailTruncated {
+			return statusFailed, failf(output, "Email body was truncated by the server")
+		}
+		fmt.Fprintln(output, "  Warning: the server returned only part of this email's body; the screenshot may be incomplete")
+	}
+	if email.EncodingProblem() {
+		fmt.Fprintln(output, "  Warning: the server couldn't decode part of this email's body; some characters may be wrong")
+	}
+
+	// Refuse pathological bodies before they are wrapped, escaped and
+	// handed to Chrome, each of which copies them
+	if opts.MaxHTMLSize > 0 && len(htmlContent) > opts.MaxHTMLSize {
+		return statusFailed, failf(output, "HTML content is %s, over the -max-html-size limit of %s",
+			formatBytes(int64(len(htmlContent))), formatBytes(int64(opts.MaxHTMLSize)))
+	}
+
+	// Show the document that would be rendered instead of screenshotting
+	if opts.PrintHTML {
+		if opts.Banner && !threaded {
+			htmlContent = renderBanner(email) + htmlContent
+		}
+		fmt.Fprintln(output, p.generator.RenderHTML(htmlContent))
+		return statusSkipped, nil
+	}
+
+	// Skip screenshots of content already captured this run
+	var hash string
+	if opts.Dedupe {
+		hash = contentHash(htmlContent)
+		p.mu.Lock()
+		firstID, ok := p.seenHashes[hash]
+		p.mu.Unlock()
+		if ok {
+			fmt.Fprintf(output, "  ↷ Duplicate of %s, skipping screenshot\n", firstID)
+			if opts.DedupeNoArchive {
+				return statusDuplicate, nil
+			}
+			if err := p.archive(email, state, output); err != nil {
+				return statusFailed, err
+			}
+			return statusDuplicate, nil
+		}
+	}
+
+	// Generate screenshot
+	if opts.Banner && !threaded {
+		htmlContent = renderBanner(email) + htmlContent
+	}
+	if err := p.tabs.Acquire(p.ctx); err != nil {
+		fmt.Fprintln(output, "  ↷ Run stopped before a browser tab was free, skipping")
+		return statusSkipped, nil
+	}
+	var subdir string
+	if opts.SenderDirs {
+		_, sender := PrimarySender(email)
+		subdir = senderDir(sender)
+	}
+	screenshotPath, err := generateScreenshotWithRetry(p.ctx, p.generator, subdir, email, htmlContent, opts.ScreenshotRetries, output)
+	p.tabs.Release()
+	if err != nil && screenshotPath == "" {
+		for _, path := range writtenPaths(err) {
+			fmt.Fprintf(output, "  ✓ Written before the failure: %s\n", path)
+		}
+		err = failf(output, "Failed to generate screenshot: %w", err)
+		p.trash(emailID, output)
+		return statusFailed, err
+	}
+	fmt.Fprintf(output, "  ✓ Screenshot generated: %s\n", screenshotPath)
+	r.path = screenshotPath
+	paths := outputPaths(p.generator, screenshotPath)
+	if written := writtenPaths(err); written != nil {
+		// Only extra formats failed, so the email is still handled
+		paths = written
+	}
+	for _, path := range paths[1:] {
+		fmt.Fprintf(output, "  ✓ Also written: %s\n", path)
+	}
+	if err != nil {
+		fmt.Fprintf(output, "  Warning: not every format was written: %s\n", strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	if opts.RenderAttachments {
+		attachmentPaths, err := p.renderAttachments(email, subdir, output)
+		if err != nil {
+			return statusFailed, failf(output, "Rendering attachments failed: %w", err)
+		}
+		paths = append(paths, attachmentPaths...)
+	}
+	if len(paths) > 1 {
+		r.outputs = paths
+	}
+	if opts.Dedupe {
+		p.mu.Lock()
+		p.seenHashes[hash] = emailID
+		p.mu.Unlock()
+	}
+
+	// Post-process before the hook so it sees the finished files
+	for _, processor := range p.postProcessors {
+		if err := processor.Process(p.ctx, screenshotPath, email); err != nil {
+			return statusFailed, failf(output, "Post-processing failed: %w", err)
+		}
+	}
+
+	// Run post-processing hook
+	if opts.ExecHook != nil {
+		if err := opts.ExecHook.Run(screenshotPath, email); err != nil {
+			err = failf(output, "Exec hook failed: %w", err)
+			if !opts.ExecIgnoreFailure {
+				return statusFailed, err
+			}
+		} else {
+			fmt.Fprintln(output, "  ✓ Exec hook completed")
+		}
+	}
+
+	// Keep a record of suspicious emails but leave them to be reviewed
+	if !opts.Quarantine.IsZero() {
+		if _, sender := PrimarySender(email); !opts.Quarantine.Allows(sender) {
+			fmt.Fprintf(output, "  ↷ Left in source folder for review: sender %q quarantined\n", sender)
+			return statusQuarantined, nil
+		}
+	}
+
+	for _, e := range archiveEmails {
+		if err := p.archive(e, archiveState, output); err != nil {
+			return statusFailed, err
+		}
+	}
+
+	return statusProcessed, nil
+}
+
+// failf writes a failure line for the current email to output and returns
+// it as an error
+func failf(output io.Writer, format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	fmt.Fprintf(output, "  ✗ %v\n", err)
+	return err
+}
+
+// trash moves an email that failed to render to the trash, with TrashOnFail.
+// The email has already failed, so a refused move is only reported.
+func (p *processor) trash(emailID string, output io.Writer) {
+	if p.trashMailbox == nil {
+		return
+	}
+	if err := p.client.MoveEmail(emailID, p.sourceMailbox.ID, p.trashMailbox.ID); err != nil {
+		fmt.Fprintf(output, "  ✗ Failed to move email to trash: %v\n", err)
+		return
+	}
+	fmt.Fprintf(output, "  ✓ Moved to trash folder '%s'\n", p.trashMailbox.Name)
+}
+
+// archiveKnown archives the email at index, skipped for already having a
+// screenshot. It is fetched first, for the sender rules and the state guarded
+// moves need.
+func (p *processor) archiveKnown(index int, output io.Writer) error {
+	email, state, err := p.emails.get(index)
+	if err != nil {
+		return failf(output, "%w", err)
+	}
+	return p.archive(email, state, output)
+}
+
+// archive moves (or copies) an email to its archive folder according to the
+// archive mode and sender rules, returning why it failed if it did. state is the
+// Email state the email was read at, used to guard the move with GuardedMove.
+func (p *processor) archive(email Email, state string, output io.Writer) error {
+	client, opts := p.client, p.opts
+
+	// Choose the archive folder, honoring sender rules
+	target := p.archiveMailbox
+	if _, sender := PrimarySender(email); sender != "" {
+		if rule, ok := matchRule(opts.Rules, sender); ok {
+			target = p.ruleMailboxes[rule.Mailbox]
+		}
+	}
+
+	// Move (or copy) email to archive folder
+	switch opts.ArchiveMode {
+	case ArchiveNone:
+		fmt.Fprintln(output, "  ↷ Left in source folder (-no-move)")
+	case ArchiveCopy:
+		if err := client.CopyEmail(email.ID, target.ID); err != nil {
+			return failf(output, "Failed to copy email to archive: %w", err)
+		}
+		fmt.Fprintf(output, "  ✓ Copied to archive folder '%s'\n", target.Name)
+	default:
+		if opts.BatchMoves && !opts.GuardedMove {
+			p.queueMove(email.ID, target)
+			fmt.Fprintf(output, "  ✓ Queued for archive folder '%s'\n", target.Name)
+			break
+		}
+
+		var err error
+		if opts.GuardedMove {
+			err = p.guardedMove(email.ID, target.ID, state, output)
+		} else {
+			err = client.MoveEmail(email.ID, p.sourceMailbox.ID, target.ID)
+		}
+		if err != nil {
+			return failf(output, "Failed to move email to archive: %w", err)
+		}
+		if opts.VerifyMove {
+			if err := p.verifyMoves([]string{email.ID}, target.ID)[email.ID]; err != nil {
+				return failf(output, "Move could not be verified: %w", err)
+			}
+		}
+		if target == p.archiveMailbox {
+			fmt.Fprintln(output, "  ✓ Moved to archive folder")
+		} else {
+			fmt.Fprintf(output, "  ✓ Moved to archive folder '%s'\n", target.Name)
+		}
+	}
+
+	return nil
+}
+
+// queueMove records an email to be moved to target by flushMoves
+func (p *processor) queueMove(emailID string, target *Mailbox) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pendingMoves == nil {
+		p.pendingMoves = make(map[*Mailbox][]string)
+	}
+	if _, ok := p.pendingMoves[target]; !ok {
+		p.pendingTargets = append(p.pendingTargets, target)
+	}
+	p.pendingMoves[target] = append(p.pendingMoves[target], emailID)
+}
+
+// flushMoves moves every queued email with batched Email/set calls, one set
+// of batches per target, and returns why each email that could not be moved
+// failed
+func (p *processor) flushMoves(output io.Writer) map[string]error {
+	failures := make(map[string]error)
+	for _, target := range p.pendingTargets {
+		emailIDs := p.pendingMoves[target]
+		moved, failed := p.client.MoveEmails(emailIDs, p.sourceMailbox.ID, target.ID)
+		if p.opts.VerifyMove && len(moved) > 0 {
+			unverified := p.verifyMoves(moved, target.ID)
+			if len(unverified) > 0 && failed == nil {
+				failed = make(map[string]error)
+			}
+			for emailID, err := range unverified {
+				failed[emailID] = fmt.Errorf("move could not be verified: %w", err)
+			}
+			moved = slices.DeleteFunc(moved, func(emailID string) bool { return unverified[emailID] != nil })
+		}
+		fmt.Fprintf(output, "\nMoved %d/%d email(s) to archive folder '%s'\n", len(moved), len(emailIDs), target.Name)
+		for _, emailID := range emailIDs {
+			if err, ok := failed[emailID]; ok {
+				fmt.Fprintf(output, "  ✗ %s: %v\n", emailID, err)
+				failures[emailID] = err
+			}
+		}
+	}
+	p.pendingMoves, p.pendingTargets = nil, nil
+	return failures
+}
+
+// verifyMoves re-fetches emails after a move and returns an error for each
+// one that is still in the source folder or missing from the target
+func (p *processor) verifyMoves(emailIDs []string, targetMailboxID string) map[string]error {
+	unverified := make(map[string]error)
+	result, err := p.client.GetEmails(emailIDs)
+	if err != nil {
+		for _, emailID := range emailIDs {
+			unverified[emailID] = err
+		}
+		return unverified
+	}
+
+	found := result.ByID()
+	for _, emailID := range emailIDs {
+		email, ok := found[emailID]
+		switch {
+		case result.Failed[emailID] != nil:
+			unverified[emailID] = result.Failed[emailID]
+		case !ok:
+			unverified[emailID] = errors.New("email not found after the move")
+		case email.MailboxIds[p.sourceMailbox.ID]:
+			unverified[emailID] = errors.New("email is still in the source folder")
+		case !email.MailboxIds[targetMailboxID]:
+			unverified[emailID] = errors.New("email is not in the archive folder")
+		}
+	}
+	return unverified
+}
+
+// guardedMove moves an email only if the account hasn't changed since state
+// was read. On a state mismatch it re-fetches the email and, if it is still
+// in the source folder, retries once with the fresh state.
+func (p *processor) guardedMove(emailID, targetMailboxID, state string, output io.Writer) error {
+	_, err := p.client.MoveEmailIfInState(emailID, p.sourceMailbox.ID, targetMailboxID, state)
+	if !IsStateMismatch(err) {
+		return err
+	}
+
+	fmt.Fprintln(output, "  ↻ Mailbox changed since the email was read, re-fetching")
+	result, err := p.client.GetEmails([]string{emailID})
+	if err != nil {
+		return err
+	}
+	if len(result.List) == 0 || !result.List[0].MailboxIds[p.sourceMailbox.ID] {
+		return errors.New("email was moved or deleted by another client")
+	}
+
+	_, err = p.client.MoveEmailIfInState(emailID, p.sourceMailbox.ID, targetMailboxID, result.State)
+	return err
+}
+
+// generateScreenshotWithRetry generates a screenshot in subdir of the output
+// directory, retrying transient failures up to retries times with exponential
+// backoff. Permanent failures are returned immediately, and so is ctx's error
+// if it is cancelled while waiting to retry. A screenshot written with only
+// some of its extra formats is returned with their error, without retrying.
+func generateScreenshotWithRetry(ctx context.Context, generator ScreenshotService, subdir string, email Email, htmlContent string, retries int, output io.Writer) (string, error) {
+	delay := screenshotRetryDelay
+	for attempt := 0; ; attempt++ {
+		path, err := generator.GenerateScreenshot(subdir, email.ReceivedAt, email.ID, htmlContent)
+		if err == nil || path != "" || attempt >= retries || isPermanent(err) {
+			return path, err
+		}
+
+		fmt.Fprintf(output, "  ↻ Screenshot attempt %d failed: %v (retrying in %s)\n", attempt+1, err, delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return "", err
+		}
+		delay *= 2
+	}
+}
+
+// findMailbox resolves a mailbox by name, or by role when spec has the form role:<role>
+func findMailbox(client EmailClient, spec string) (*Mailbox, error) {
+	if role, ok := strings.CutPrefix(spec, "role:"); ok {
+		return client.FindMailboxByRole(role)
+	}
+	return client.FindMailboxByName(spec)
+}
+
+// listMailboxes prints a table of every mailbox's path, role, ID and email
+// counts, sorted by path, to help choose folder names and roles
+func listMailboxes(client EmailClient, output io.Writer) error {
+	mailboxes, err := client.ListMailboxes()
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[string]*Mailbox, len(mailboxes))
+	for i := range mailboxes {
+		byID[mailboxes[i].ID] = &mailboxes[i]
+	}
+	paths := make(map[string]string, len(mailboxes))
+	for i := range mailboxes {
+		paths[mailboxes[i].ID] = mailboxPath(&mailboxes[i], byID)
+	}
+	slices.SortFunc(mailboxes, func(a, b Mailbox) int {
+		return strings.Compare(paths[a.ID], paths[b.ID])
+	})
+
+	tw := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tROLE\tID\tUNREAD\tTOTAL")
+	for _, mailbox := range mailboxes {
+		role := mailbox.Role
+		if role == "" {
+			role = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", paths[mailbox.ID], role, mailbox.ID, mailbox.UnreadEmails, mailbox.TotalEmails)
+	}
+	return tw.Flush()
+}
+
+// Archive modes control what happens to an email after its screenshot
+const (
+	ArchiveMove = "move" // Remove from source, add to archive
+	ArchiveCopy = "copy" // Add to archive, keep in source
+	ArchiveNone = "none" // Leave the email untouched
+)
+
+// Strategies for emails with more than one HTML body part
+const (
+	HTMLPartsFirst   = "first"   // First part with a body value
+	HTMLPartsConcat  = "concat"  // All parts, in order
+	HTMLPartsLargest = "largest" // Part with the largest body value
+)
+
+// extractHTMLContent extracts HTML content from an email, combining multiple
+// HTML body parts according to mode. Parts whose body value is missing are skipped.
+// In the default mode a multipart email's root HTML part is preferred, so an
+// inline fragment listed first isn't mistaken for the body.
+func extractHTMLContent(email Email, mode string) string {
+	if mode != HTMLPartsConcat && mode != HTMLPartsLargest {
+		if partID, ok := email.RootHTMLPart(); ok {
+			if bodyValue, ok := email.BodyValues[partID]; ok {
+				return bodyValue.Value
+			}
+		}
 	}
 
-	// Get the first HTML body part
-	partID := email.HTMLBody[0].PartID
+	var parts []string
+	for _, part := range email.HTMLBody {
+		if bodyValue, ok := email.BodyValues[part.PartID]; ok {
+			parts = append(parts, bodyValue.Value)
+		}
+	}
 
-	// Get the body value
-	if bodyValue, ok := email.BodyValues[partID]; ok {
-		return bodyValue.Value
+	if len(parts) == 0 {
+		return ""
 	}
 
-	return ""
+	switch mode {
+	case HTMLPartsConcat:
+		return strings.Join(parts, "\n")
+	case HTMLPartsLargest:
+		largest := parts[0]
+		for _, part := range parts[1:] {
+			if len(part) > len(largest) {
+				largest = part
+			}
+		}
+		return largest
+	default:
+		return parts[0]
+	}
 }
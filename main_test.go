@@ -2,18 +2,73 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // MockEmailClient is a mock implementation of EmailClient
 type MockEmailClient struct {
+	accountID      string
 	mailboxes      map[string]*Mailbox
 	emails         map[string][]string
 	emailDetails   map[string]Email
 	moveEmailError error
 	getEmailsError error
+	fetchFailures  map[string]error // Email ID -> why its Email/get batch failed
+	moves          []moveCall
+	copies         []moveCall
+	lastQuery      QueryOptions
+
+	// Email/changes simulation
+	state        string
+	created      []string
+	updated      []string
+	changesError error
+	changesSince string
+
+	// Guarded moves: mismatchesRemaining moves are rejected with stateMismatch
+	mismatchesRemaining int
+	guardStates         []string
+
+	// Batched moves
+	batchMoves      [][]string
+	batchMoveErrors map[string]error
+
+	// silentMoveFailures reports moves as successful without applying them
+	silentMoveFailures bool
+
+	// Thread ID -> email IDs, oldest first
+	threads map[string][]string
+
+	// Blob ID -> content
+	blobs map[string][]byte
+
+	// The server's limits, and the IDs asked for by each Email/get
+	capabilities CoreCapabilities
+	getCalls     [][]string
+
+	// Email ID -> why an Email/get asking for it fails as a whole
+	getCallFailures map[string]error
+	// IDs left out of Email/get responses, neither returned nor not found
+	missingFromGet map[string]bool
+}
+
+// moveCall records the arguments of a MoveEmail call
+type moveCall struct {
+	emailID         string
+	sourceMailboxID string
+	targetMailboxID string
 }
 
 func NewMockEmailClient() *MockEmailClient {
@@ -24,59 +79,207 @@ func NewMockEmailClient() *MockEmailClient {
 	}
 }
 
+func (m *MockEmailClient) AccountID() string {
+	return m.accountID
+}
+
 func (m *MockEmailClient) FindMailboxByName(name string) (*Mailbox, error) {
 	if mailbox, ok := m.mailboxes[name]; ok {
 		return mailbox, nil
 	}
-	return nil, errors.New("mailbox not found")
+	return nil, &MailboxNotFoundError{Name: name}
+}
+
+func (m *MockEmailClient) ListMailboxes() ([]Mailbox, error) {
+	var mailboxes []Mailbox
+	for _, mailbox := range m.mailboxes {
+		mailboxes = append(mailboxes, *mailbox)
+	}
+	return mailboxes, nil
+}
+
+func (m *MockEmailClient) FindMailboxByRole(role string) (*Mailbox, error) {
+	for _, mailbox := range m.mailboxes {
+		if mailbox.Role == role {
+			return mailbox, nil
+		}
+	}
+	return nil, &MailboxNotFoundError{Role: role}
 }
 
-func (m *MockEmailClient) GetEmailsInMailbox(mailboxID string, limit int) ([]string, error) {
+func (m *MockEmailClient) GetEmailsInMailbox(mailboxID string, query QueryOptions) ([]string, int, error) {
+	m.lastQuery = query
 	if m.getEmailsError != nil {
-		return nil, m.getEmailsError
+		return nil, 0, m.getEmailsError
 	}
 	if emails, ok := m.emails[mailboxID]; ok {
-		if limit > 0 && len(emails) > limit {
-			return emails[:limit], nil
+		if query.Limit > 0 && len(emails) > query.Limit {
+			return emails[:query.Limit], len(emails), nil
 		}
-		return emails, nil
+		return emails, len(emails), nil
+	}
+	return []string{}, 0, nil
+}
+
+func (m *MockEmailClient) GetThread(threadID string) ([]string, error) {
+	if emailIDs, ok := m.threads[threadID]; ok {
+		return emailIDs, nil
+	}
+	return nil, fmt.Errorf("thread %s not found", threadID)
+}
+
+func (m *MockEmailClient) DownloadBlob(blobID, mimeType, name string) ([]byte, error) {
+	if data, ok := m.blobs[blobID]; ok {
+		return data, nil
 	}
-	return []string{}, nil
+	return nil, fmt.Errorf("blob %s not found", blobID)
+}
+
+func (m *MockEmailClient) Capabilities() CoreCapabilities {
+	return m.capabilities
 }
 
-func (m *MockEmailClient) GetEmails(emailIDs []string) ([]Email, error) {
-	var result []Email
+func (m *MockEmailClient) GetEmails(emailIDs []string) (*EmailGetResult, error) {
+	m.getCalls = append(m.getCalls, emailIDs)
+	for _, id := range emailIDs {
+		if err, ok := m.getCallFailures[id]; ok {
+			return nil, err
+		}
+	}
+	result := &EmailGetResult{State: "state-1"}
 	for _, id := range emailIDs {
-		if email, ok := m.emailDetails[id]; ok {
-			result = append(result, email)
+		if m.missingFromGet[id] {
+			continue
+		}
+		if err, ok := m.fetchFailures[id]; ok {
+			if result.Failed == nil {
+				result.Failed = make(map[string]error)
+			}
+			result.Failed[id] = err
+		} else if email, ok := m.emailDetails[id]; ok {
+			result.List = append(result.List, email)
+		} else {
+			result.NotFound = append(result.NotFound, id)
 		}
 	}
 	return result, nil
 }
 
 func (m *MockEmailClient) MoveEmail(emailID, sourceMailboxID, targetMailboxID string) error {
-	return m.moveEmailError
+	if m.moveEmailError != nil {
+		return m.moveEmailError
+	}
+	m.moves = append(m.moves, moveCall{emailID, sourceMailboxID, targetMailboxID})
+	m.applyMove(emailID, targetMailboxID)
+	return nil
+}
+
+// applyMove updates an email's mailboxes after a successful move, unless
+// silentMoveFailures simulates a server that reports moves it didn't make
+func (m *MockEmailClient) applyMove(emailID, targetMailboxID string) {
+	if email, ok := m.emailDetails[emailID]; ok && !m.silentMoveFailures {
+		email.MailboxIds = map[string]bool{targetMailboxID: true}
+		m.emailDetails[emailID] = email
+	}
+}
+
+func (m *MockEmailClient) MoveEmailIfInState(emailID, sourceMailboxID, targetMailboxID, ifInState string) (string, error) {
+	m.guardStates = append(m.guardStates, ifInState)
+	if m.mismatchesRemaining > 0 {
+		m.mismatchesRemaining--
+		return "", &JMAPError{Type: "stateMismatch"}
+	}
+	if err := m.MoveEmail(emailID, sourceMailboxID, targetMailboxID); err != nil {
+		return "", err
+	}
+	return "state-2", nil
+}
+
+func (m *MockEmailClient) MoveEmails(emailIDs []string, sourceMailboxID, targetMailboxID string) ([]string, map[string]error) {
+	m.batchMoves = append(m.batchMoves, emailIDs)
+	var moved []string
+	failed := make(map[string]error)
+	for _, id := range emailIDs {
+		if err, ok := m.batchMoveErrors[id]; ok {
+			failed[id] = err
+			continue
+		}
+		m.moves = append(m.moves, moveCall{id, sourceMailboxID, targetMailboxID})
+		m.applyMove(id, targetMailboxID)
+		moved = append(moved, id)
+	}
+	return moved, failed
+}
+
+func (m *MockEmailClient) CopyEmail(emailID, targetMailboxID string) error {
+	m.copies = append(m.copies, moveCall{emailID: emailID, targetMailboxID: targetMailboxID})
+	return nil
+}
+
+func (m *MockEmailClient) GetEmailState() (string, error) {
+	return m.state, nil
+}
+
+func (m *MockEmailClient) GetEmailChanges(sinceState string) (created, updated, destroyed []string, newState string, err error) {
+	m.changesSince = sinceState
+	if m.changesError != nil {
+		return nil, nil, nil, "", m.changesError
+	}
+	return m.created, m.updated, nil, m.state, nil
 }
 
 // MockScreenshotService is a mock implementation of ScreenshotService
 type MockScreenshotService struct {
 	generatedScreenshots map[string]string
 	generateError        error
+	failuresRemaining    int   // transient failures to return before succeeding
+	partialError         error // returned along with each screenshot's path
+	calls                int
+	existing             map[string]bool   // email IDs that already have a screenshot
+	rendered             map[string]string // email ID -> HTML passed to GenerateScreenshot
+
+	// When outputDir is set, screenshots are written there as real files
+	// whose sizes cycle through fileSizes
+	outputDir string
+	fileSizes []int
 }
 
 func NewMockScreenshotService() *MockScreenshotService {
 	return &MockScreenshotService{
 		generatedScreenshots: make(map[string]string),
+		existing:             make(map[string]bool),
+		rendered:             make(map[string]string),
 	}
 }
 
-func (m *MockScreenshotService) GenerateScreenshot(timestamp, emailID, htmlContent string) (string, error) {
+func (m *MockScreenshotService) HasScreenshot(emailID string) bool {
+	return m.existing[emailID]
+}
+
+func (m *MockScreenshotService) RenderHTML(htmlContent string) string {
+	return wrapHTML(htmlContent, WrapperStyle{})
+}
+
+func (m *MockScreenshotService) GenerateScreenshot(subdir, timestamp, emailID, htmlContent string) (string, error) {
+	m.calls++
+	m.rendered[emailID] = htmlContent
 	if m.generateError != nil {
 		return "", m.generateError
 	}
-	path := "screenshots/" + timestamp + "-" + emailID + ".png"
+	if m.failuresRemaining > 0 {
+		m.failuresRemaining--
+		return "", errors.New("tab crashed")
+	}
+	path := filepath.Join("screenshots", subdir, timestamp+"-"+emailID+".png")
+	if m.outputDir != "" {
+		path = filepath.Join(m.outputDir, emailID+".png")
+		size := m.fileSizes[(m.calls-1)%len(m.fileSizes)]
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			return "", err
+		}
+	}
 	m.generatedScreenshots[emailID] = path
-	return path, nil
+	return path, m.partialError
 }
 
 // Test successful processing of emails
@@ -108,7 +311,7 @@ func TestProcessEmails_Success(t *testing.T) {
 	}
 
 	var output bytes.Buffer
-	result, err := processEmails(client, generator, 0, false, &output)
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
@@ -145,7 +348,7 @@ func TestProcessEmails_DryRun(t *testing.T) {
 	client.emails["src-123"] = []string{"email1"}
 
 	var output bytes.Buffer
-	result, err := processEmails(client, generator, 0, true, &output)
+	result, err := processEmails(client, generator, ProcessOptions{DryRun: true}, &output)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
@@ -175,7 +378,7 @@ func TestProcessEmails_NoEmails(t *testing.T) {
 	client.emails["src-123"] = []string{}
 
 	var output bytes.Buffer
-	result, err := processEmails(client, generator, 0, false, &output)
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
@@ -199,7 +402,7 @@ func TestProcessEmails_SourceFolderNotFound(t *testing.T) {
 	client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
 
 	var output bytes.Buffer
-	_, err := processEmails(client, generator, 0, false, &output)
+	_, err := processEmails(client, generator, ProcessOptions{}, &output)
 
 	if err == nil {
 		t.Fatal("Expected error when source folder not found")
@@ -218,7 +421,7 @@ func TestProcessEmails_ArchiveFolderNotFound(t *testing.T) {
 	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
 
 	var output bytes.Buffer
-	_, err := processEmails(client, generator, 0, false, &output)
+	_, err := processEmails(client, generator, ProcessOptions{}, &output)
 
 	if err == nil {
 		t.Fatal("Expected error when archive folder not found")
@@ -249,7 +452,7 @@ func TestProcessEmails_ScreenshotError(t *testing.T) {
 	}
 
 	var output bytes.Buffer
-	result, err := processEmails(client, generator, 0, false, &output)
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
@@ -284,7 +487,7 @@ func TestProcessEmails_MoveEmailError(t *testing.T) {
 	}
 
 	var output bytes.Buffer
-	result, err := processEmails(client, generator, 0, false, &output)
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
@@ -316,7 +519,7 @@ func TestProcessEmails_NoHTMLContent(t *testing.T) {
 	}
 
 	var output bytes.Buffer
-	result, err := processEmails(client, generator, 0, false, &output)
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
@@ -355,7 +558,7 @@ func TestProcessEmails_WithLimit(t *testing.T) {
 	}
 
 	var output bytes.Buffer
-	result, err := processEmails(client, generator, 2, false, &output)
+	result, err := processEmails(client, generator, ProcessOptions{Limit: 2}, &output)
 
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
@@ -366,46 +569,1853 @@ func TestProcessEmails_WithLimit(t *testing.T) {
 	}
 }
 
-// Test extractHTMLContent function
-func TestExtractHTMLContent(t *testing.T) {
-	tests := []struct {
-		name     string
-		email    Email
-		expected string
-	}{
-		{
-			name: "Valid HTML content",
-			email: Email{
-				HTMLBody: []HTMLBodyPart{{PartID: "part1"}},
-				BodyValues: map[string]BodyValue{
-					"part1": {Value: "<html><body>Test</body></html>"},
-				},
-			},
-			expected: "<html><body>Test</body></html>",
+// Test archive folder resolved by role
+func TestProcessEmails_ArchiveByRole(t *testing.T) {
+	client := NewMockEmailClient()
+	generator := NewMockScreenshotService()
+
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+	client.mailboxes["Archiv"] = &Mailbox{ID: "arch-role", Name: "Archiv", Role: "archive"}
+	client.mailboxes["Papierkorb"] = &Mailbox{ID: "trash-role", Name: "Papierkorb", Role: "trash"}
+	client.emails["src-123"] = []string{"email1"}
+	client.emailDetails["email1"] = Email{
+		ID:         "email1",
+		Subject:    "Test Email",
+		ReceivedAt: "2025-10-24T14:30:00Z",
+		HTMLBody:   []HTMLBodyPart{{PartID: "part1", Type: "text/html"}},
+		BodyValues: map[string]BodyValue{
+			"part1": {Value: "<html><body>Test</body></html>"},
 		},
-		{
-			name: "No HTML body",
-			email: Email{
-				HTMLBody: []HTMLBodyPart{},
+	}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{Archive: "role:archive"}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 {
+		t.Errorf("Expected ProcessedCount=1, got %d", result.ProcessedCount)
+	}
+
+	if len(client.moves) != 1 || client.moves[0].targetMailboxID != "arch-role" {
+		t.Errorf("Expected email moved to arch-role, got %+v", client.moves)
+	}
+}
+
+// Test error when no mailbox has the requested role
+func TestProcessEmails_ArchiveRoleNotFound(t *testing.T) {
+	client := NewMockEmailClient()
+	generator := NewMockScreenshotService()
+
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+	client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
+
+	var output bytes.Buffer
+	_, err := processEmails(client, generator, ProcessOptions{Archive: "role:archive"}, &output)
+
+	if err == nil || !strings.Contains(err.Error(), "failed to find archive folder 'role:archive'") {
+		t.Errorf("Expected archive role error, got: %v", err)
+	}
+}
+
+// Test sender rules route emails to different archive folders
+func TestProcessEmails_SenderRules(t *testing.T) {
+	client := NewMockEmailClient()
+	generator := NewMockScreenshotService()
+
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+	client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
+	client.mailboxes["_aar_finance"] = &Mailbox{ID: "fin-789", Name: "_aar_finance"}
+	client.mailboxes["_aar_news"] = &Mailbox{ID: "news-012", Name: "_aar_news"}
+	client.emails["src-123"] = []string{"email1", "email2", "email3"}
+
+	senders := map[string]string{
+		"email1": "alerts@mybank.com",
+		"email2": "digest@news.example.org",
+		"email3": "friend@elsewhere.net",
+	}
+	for id, sender := range senders {
+		client.emailDetails[id] = Email{
+			ID:         id,
+			Subject:    "Email " + id,
+			ReceivedAt: "2025-10-24T14:30:00Z",
+			From:       []EmailAddress{{Email: sender}},
+			HTMLBody:   []HTMLBodyPart{{PartID: "part1", Type: "text/html"}},
+			BodyValues: map[string]BodyValue{
+				"part1": {Value: "<html><body>Test</body></html>"},
 			},
-			expected: "",
+		}
+	}
+
+	opts := ProcessOptions{
+		Rules: []SenderRule{
+			{Pattern: "*@mybank.com", Mailbox: "_aar_finance"},
+			{Pattern: "example.org", Mailbox: "_aar_news"},
 		},
-		{
-			name: "Missing body value",
-			email: Email{
-				HTMLBody:   []HTMLBodyPart{{PartID: "part1"}},
-				BodyValues: map[string]BodyValue{},
+	}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, opts, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 3 {
+		t.Errorf("Expected ProcessedCount=3, got %d", result.ProcessedCount)
+	}
+
+	expected := map[string]string{
+		"email1": "fin-789",
+		"email2": "news-012",
+		"email3": "arch-456",
+	}
+	for _, move := range client.moves {
+		if move.targetMailboxID != expected[move.emailID] {
+			t.Errorf("Expected %s moved to %s, got %s", move.emailID, expected[move.emailID], move.targetMailboxID)
+		}
+	}
+	if len(client.moves) != 3 {
+		t.Errorf("Expected 3 moves, got %d", len(client.moves))
+	}
+}
+
+// Test error when a rule references a missing mailbox
+func TestProcessEmails_SenderRuleFolderNotFound(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	opts := ProcessOptions{Rules: []SenderRule{{Pattern: "example.com", Mailbox: "_missing"}}}
+
+	var output bytes.Buffer
+	_, err := processEmails(client, generator, opts, &output)
+
+	if err == nil || !strings.Contains(err.Error(), "failed to find rule folder '_missing'") {
+		t.Errorf("Expected rule folder error, got: %v", err)
+	}
+}
+
+// Test an email deleted between query and get is reported as not found
+func TestProcessEmails_EmailNotFound(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+	client.emails["src-123"] = []string{"email1", "deleted"}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 || result.FailedCount != 1 {
+		t.Errorf("Expected 1 processed and 1 failed, got %d processed and %d failed", result.ProcessedCount, result.FailedCount)
+	}
+
+	if !strings.Contains(output.String(), "Email not found on server") {
+		t.Error("Output should report the email as not found on server")
+	}
+}
+
+// Test incremental mode stops after a run of already-screenshotted emails
+func TestProcessEmails_IncrementalStopsAfterKnown(t *testing.T) {
+	client := NewMockEmailClient()
+	generator := NewMockScreenshotService()
+
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+	client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
+	ids := []string{"new1", "new2", "known1", "new3", "known2", "known3", "new4"}
+	client.emails["src-123"] = ids
+	for _, id := range ids {
+		client.emailDetails[id] = Email{
+			ID:         id,
+			Subject:    "Email " + id,
+			ReceivedAt: "2025-10-24T14:30:00Z",
+			HTMLBody:   []HTMLBodyPart{{PartID: "part1", Type: "text/html"}},
+			BodyValues: map[string]BodyValue{
+				"part1": {Value: "<html><body>Test</body></html>"},
 			},
-			expected: "",
-		},
+		}
 	}
+	generator.existing["known1"] = true
+	generator.existing["known2"] = true
+	generator.existing["known3"] = true
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := extractHTMLContent(tt.email)
-			if result != tt.expected {
-				t.Errorf("Expected %q, got %q", tt.expected, result)
-			}
-		})
+	opts := ProcessOptions{Incremental: true, KnownThreshold: 2}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, opts, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !client.lastQuery.NewestFirst {
+		t.Error("Expected incremental query to sort newest first")
+	}
+
+	if result.ProcessedCount != 3 {
+		t.Errorf("Expected ProcessedCount=3, got %d", result.ProcessedCount)
+	}
+
+	if result.SkippedCount != 3 {
+		t.Errorf("Expected SkippedCount=3, got %d", result.SkippedCount)
+	}
+
+	if !result.StoppedEarly {
+		t.Error("Expected run to stop early")
+	}
+
+	if _, ok := generator.generatedScreenshots["new4"]; ok {
+		t.Error("Expected new4 not to be processed after stopping early")
+	}
+}
+
+// Test a failing exec hook fails the email and leaves it in the source folder
+func TestProcessEmails_ExecHookFailure(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+	hook, err := NewExecHook("false", time.Second)
+	if err != nil {
+		t.Fatalf("Failed to create hook: %v", err)
+	}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{ExecHook: hook}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.FailedCount != 1 {
+		t.Errorf("Expected FailedCount=1, got %d", result.FailedCount)
+	}
+
+	if len(client.moves) != 0 {
+		t.Error("Expected email not to be moved after hook failure")
+	}
+
+	// With failures ignored the email is archived
+	client = newSingleEmailClient()
+	output.Reset()
+	result, err = processEmails(client, generator, ProcessOptions{ExecHook: hook, ExecIgnoreFailure: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.ProcessedCount != 1 || len(client.moves) != 1 {
+		t.Errorf("Expected email processed and moved, got %d processed and %d moves", result.ProcessedCount, len(client.moves))
+	}
+}
+
+// Test -no-move screenshots without touching the email
+func TestProcessEmails_NoMove(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{ArchiveMode: ArchiveNone}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 {
+		t.Errorf("Expected ProcessedCount=1, got %d", result.ProcessedCount)
+	}
+	if len(generator.generatedScreenshots) != 1 {
+		t.Error("Expected a screenshot to be generated")
+	}
+	if len(client.moves) != 0 || len(client.copies) != 0 {
+		t.Errorf("Expected no moves or copies, got %d moves and %d copies", len(client.moves), len(client.copies))
+	}
+}
+
+// Test -copy adds the email to the archive without moving it
+func TestProcessEmails_Copy(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{ArchiveMode: ArchiveCopy}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 {
+		t.Errorf("Expected ProcessedCount=1, got %d", result.ProcessedCount)
+	}
+	if len(client.moves) != 0 {
+		t.Errorf("Expected no moves, got %d", len(client.moves))
+	}
+	if len(client.copies) != 1 || client.copies[0].targetMailboxID != "arch-456" {
+		t.Errorf("Expected a copy to arch-456, got %+v", client.copies)
+	}
+}
+
+// Test emails that already have a screenshot are left in the source folder
+// by default, and archived without a new screenshot with ArchiveKnown
+func TestProcessEmails_ArchiveKnown(t *testing.T) {
+	for _, archiveKnown := range []bool{false, true} {
+		client := newSingleEmailClient()
+		generator := NewMockScreenshotService()
+		generator.existing["email1"] = true
+
+		var output bytes.Buffer
+		result, err := processEmails(client, generator, ProcessOptions{Incremental: true, ArchiveKnown: archiveKnown}, &output)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if _, ok := generator.generatedScreenshots["email1"]; ok {
+			t.Errorf("ArchiveKnown=%v: expected no new screenshot", archiveKnown)
+		}
+		if result.SkippedCount != 1 || result.KnownCount != 1 {
+			t.Errorf("ArchiveKnown=%v: expected 1 skipped, already screenshotted email, got %d and %d", archiveKnown, result.SkippedCount, result.KnownCount)
+		}
+		if !archiveKnown && len(client.moves) != 0 {
+			t.Errorf("Expected the email to stay in the source folder, got moves %+v", client.moves)
+		}
+		if archiveKnown && (len(client.moves) != 1 || client.moves[0].targetMailboxID != "arch-456") {
+			t.Errorf("Expected a move to arch-456, got %+v", client.moves)
+		}
+	}
+}
+
+// addHTMLEmail adds an email with the given HTML body to the mock's source folder
+func addHTMLEmail(client *MockEmailClient, id, html string) {
+	client.emails["src-123"] = append(client.emails["src-123"], id)
+	client.emailDetails[id] = Email{
+		ID:         id,
+		Subject:    "Email " + id,
+		ReceivedAt: "2025-10-24T14:30:00Z",
+		HTMLBody:   []HTMLBodyPart{{PartID: "part1", Type: "text/html"}},
+		BodyValues: map[string]BodyValue{
+			"part1": {Value: html},
+		},
+	}
+}
+
+// Test -dedupe screenshots identical content only once
+func TestProcessEmails_Dedupe(t *testing.T) {
+	client := NewMockEmailClient()
+	generator := NewMockScreenshotService()
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+	client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
+	addHTMLEmail(client, "email1", "<p>Weekly digest</p>")
+	addHTMLEmail(client, "email2", "<p>Weekly\n   digest</p>")
+	addHTMLEmail(client, "email3", "<p>Something else</p>")
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{Dedupe: true}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if generator.calls != 2 {
+		t.Errorf("Expected 2 screenshots, got %d", generator.calls)
+	}
+	if _, ok := generator.generatedScreenshots["email2"]; ok {
+		t.Error("Expected no screenshot for duplicate email2")
+	}
+	if result.DuplicateCount != 1 || result.ProcessedCount != 2 {
+		t.Errorf("Expected 2 processed and 1 duplicate, got %d processed and %d duplicates", result.ProcessedCount, result.DuplicateCount)
+	}
+	if len(client.moves) != 3 {
+		t.Errorf("Expected duplicates to be archived (3 moves), got %d", len(client.moves))
+	}
+
+	// With -dedupe-no-archive the duplicate stays in the source folder
+	client.moves = nil
+	generator = NewMockScreenshotService()
+	result, err = processEmails(client, generator, ProcessOptions{Dedupe: true, DedupeNoArchive: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for _, move := range client.moves {
+		if move.emailID == "email2" {
+			t.Error("Expected duplicate email2 not to be moved")
+		}
+	}
+	if result.DuplicateCount != 1 {
+		t.Errorf("Expected DuplicateCount=1, got %d", result.DuplicateCount)
+	}
+}
+
+// Test sender filters skip non-matching emails
+func TestProcessEmails_SenderFilter(t *testing.T) {
+	newClient := func() *MockEmailClient {
+		client := NewMockEmailClient()
+		client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+		client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
+		for id, sender := range map[string]string{
+			"email1": "news@substack.com",
+			"email2": "promo@substack.com",
+			"email3": "alerts@bank.com",
+		} {
+			addHTMLEmail(client, id, "<p>Hello</p>")
+			email := client.emailDetails[id]
+			email.From = []EmailAddress{{Email: sender}}
+			client.emailDetails[id] = email
+		}
+		return client
+	}
+
+	tests := []struct {
+		name      string
+		filter    SenderFilter
+		processed []string
+	}{
+		{"allow only", SenderFilter{Allow: []string{"substack.com"}}, []string{"email1", "email2"}},
+		{"deny only", SenderFilter{Deny: []string{"substack.com"}}, []string{"email3"}},
+		{"allow and deny", SenderFilter{Allow: []string{"substack.com"}, Deny: []string{"promo@*"}}, []string{"email1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newClient()
+			generator := NewMockScreenshotService()
+
+			var output bytes.Buffer
+			result, err := processEmails(client, generator, ProcessOptions{SenderFilter: tt.filter}, &output)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			if result.ProcessedCount != len(tt.processed) || result.SkippedCount != 3-len(tt.processed) {
+				t.Errorf("Expected %d processed and %d skipped, got %d and %d",
+					len(tt.processed), 3-len(tt.processed), result.ProcessedCount, result.SkippedCount)
+			}
+			for _, id := range tt.processed {
+				if _, ok := generator.generatedScreenshots[id]; !ok {
+					t.Errorf("Expected %s to be screenshotted", id)
+				}
+			}
+			if len(client.moves) != len(tt.processed) {
+				t.Errorf("Expected filtered emails to stay in source, got %d moves", len(client.moves))
+			}
+		})
+	}
+}
+
+// newSingleEmailClient returns a mock client with one HTML email in the source folder
+func newSingleEmailClient() *MockEmailClient {
+	client := NewMockEmailClient()
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+	client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
+	client.emails["src-123"] = []string{"email1"}
+	client.emailDetails["email1"] = Email{
+		ID:         "email1",
+		Subject:    "Test Email",
+		ReceivedAt: "2025-10-24T14:30:00Z",
+		HTMLBody:   []HTMLBodyPart{{PartID: "part1", Type: "text/html"}},
+		BodyValues: map[string]BodyValue{
+			"part1": {Value: "<html><body>Test</body></html>"},
+		},
+	}
+	return client
+}
+
+// Test that a transient screenshot failure is retried and the email processed
+func TestProcessEmails_ScreenshotRetrySucceeds(t *testing.T) {
+	saved := screenshotRetryDelay
+	screenshotRetryDelay = 0
+	t.Cleanup(func() { screenshotRetryDelay = saved })
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+	generator.failuresRemaining = 1
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{ScreenshotRetries: 2}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 || result.FailedCount != 0 {
+		t.Errorf("Expected 1 processed and 0 failed, got %d processed and %d failed", result.ProcessedCount, result.FailedCount)
+	}
+
+	if generator.calls != 2 {
+		t.Errorf("Expected 2 screenshot attempts, got %d", generator.calls)
+	}
+
+	if len(client.moves) != 1 {
+		t.Errorf("Expected email to be moved after retry, got %d moves", len(client.moves))
+	}
+}
+
+// Test a screenshot written with a failed extra format is a warning: the
+// email is archived without retrying
+func TestProcessEmails_ExtraFormatFails(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+	generator.partialError = &partialError{
+		written: []string{"screenshots/email1.png"},
+		errs:    []error{errors.New("webp output: encoder crashed")},
+	}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{ScreenshotRetries: 2}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.ProcessedCount != 1 || result.FailedCount != 0 {
+		t.Errorf("Expected 1 processed and 0 failed, got %d processed and %d failed", result.ProcessedCount, result.FailedCount)
+	}
+	if generator.calls != 1 {
+		t.Errorf("Expected 1 screenshot attempt, got %d", generator.calls)
+	}
+	if len(client.moves) != 1 {
+		t.Errorf("Expected email to be moved, got %d moves", len(client.moves))
+	}
+	if !strings.Contains(output.String(), "Warning: not every format was written: webp output: encoder crashed") {
+		t.Errorf("Expected a warning about the webp output, got:\n%s", output.String())
+	}
+}
+
+// Test cancelling the run stops the backoff between retries instead of
+// waiting it out
+func TestGenerateScreenshotWithRetry_Cancelled(t *testing.T) {
+	saved := screenshotRetryDelay
+	screenshotRetryDelay = time.Hour
+	t.Cleanup(func() { screenshotRetryDelay = saved })
+	generator := NewMockScreenshotService()
+	generator.failuresRemaining = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	email := Email{ID: "email1", ReceivedAt: "2025-10-24T14:30:00Z"}
+	_, err := generateScreenshotWithRetry(ctx, generator, "", email, "<p>Test</p>", 5, io.Discard)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation error, got: %v", err)
+	}
+	if generator.calls != 1 {
+		t.Errorf("Expected no attempt after cancelling, got %d", generator.calls)
+	}
+}
+
+// Test that permanent screenshot failures are not retried
+func TestProcessEmails_ScreenshotPermanentErrorNotRetried(t *testing.T) {
+	saved := screenshotRetryDelay
+	screenshotRetryDelay = 0
+	t.Cleanup(func() { screenshotRetryDelay = saved })
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+	generator.generateError = &permanentError{errors.New("empty HTML content")}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{ScreenshotRetries: 3}, &output)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.FailedCount != 1 {
+		t.Errorf("Expected FailedCount=1, got %d", result.FailedCount)
+	}
+
+	if generator.calls != 1 {
+		t.Errorf("Expected a single attempt for a permanent error, got %d", generator.calls)
+	}
+}
+
+// Test extractHTMLContent function
+func TestExtractHTMLContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    Email
+		expected string
+	}{
+		{
+			name: "Valid HTML content",
+			email: Email{
+				HTMLBody: []HTMLBodyPart{{PartID: "part1"}},
+				BodyValues: map[string]BodyValue{
+					"part1": {Value: "<html><body>Test</body></html>"},
+				},
+			},
+			expected: "<html><body>Test</body></html>",
+		},
+		{
+			name: "No HTML body",
+			email: Email{
+				HTMLBody: []HTMLBodyPart{},
+			},
+			expected: "",
+		},
+		{
+			name: "Missing body value",
+			email: Email{
+				HTMLBody:   []HTMLBodyPart{{PartID: "part1"}},
+				BodyValues: map[string]BodyValue{},
+			},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := extractHTMLContent(tt.email, HTMLPartsFirst)
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// Test extractHTMLContent with multiple HTML body parts
+func TestExtractHTMLContent_MultipleParts(t *testing.T) {
+	email := Email{
+		HTMLBody: []HTMLBodyPart{{PartID: "1"}, {PartID: "missing"}, {PartID: "2"}, {PartID: "3"}},
+		BodyValues: map[string]BodyValue{
+			"1": {Value: "<p>header</p>"},
+			"2": {Value: "<div>the main newsletter body</div>"},
+			"3": {Value: "<p>footer</p>"},
+		},
+	}
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{HTMLPartsFirst, "<p>header</p>"},
+		{HTMLPartsConcat, "<p>header</p>\n<div>the main newsletter body</div>\n<p>footer</p>"},
+		{HTMLPartsLargest, "<div>the main newsletter body</div>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			result := extractHTMLContent(email, tt.mode)
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+// Test a missing first part falls back to the next available part
+func TestExtractHTMLContent_SkipsMissingPart(t *testing.T) {
+	email := Email{
+		HTMLBody:   []HTMLBodyPart{{PartID: "missing"}, {PartID: "2"}},
+		BodyValues: map[string]BodyValue{"2": {Value: "<p>body</p>"}},
+	}
+
+	if result := extractHTMLContent(email, HTMLPartsFirst); result != "<p>body</p>" {
+		t.Errorf("Expected %q, got %q", "<p>body</p>", result)
+	}
+}
+
+// Test a multipart/related email's root HTML part, named by its start
+// parameter, is chosen over an inline HTML fragment listed before it
+func TestExtractHTMLContent_RelatedRoot(t *testing.T) {
+	email := Email{
+		HTMLBody: []HTMLBodyPart{{PartID: "2"}, {PartID: "3"}},
+		BodyValues: map[string]BodyValue{
+			"1": {Value: "plain text"},
+			"2": {Value: "<p>inline fragment</p>"},
+			"3": {Value: "<div>the main newsletter body</div>"},
+		},
+		BodyStructure: &BodyPart{Type: "multipart/alternative", SubParts: []BodyPart{
+			{PartID: "1", Type: "text/plain"},
+			{Type: "multipart/related", ContentType: ` multipart/related; type="text/html"; start="<root@example.com>"`, SubParts: []BodyPart{
+				{PartID: "2", Type: "text/html", CID: "fragment@example.com"},
+				{PartID: "3", Type: "text/html", CID: "root@example.com"},
+				{PartID: "4", Type: "image/png", CID: "logo@example.com"},
+			}},
+		}},
+	}
+
+	if result := extractHTMLContent(email, HTMLPartsFirst); result != "<div>the main newsletter body</div>" {
+		t.Errorf("Expected the root part, got %q", result)
+	}
+
+	// Without a start parameter the first related part is the root
+	email.BodyStructure.SubParts[1].ContentType = ""
+	if result := extractHTMLContent(email, HTMLPartsFirst); result != "<p>inline fragment</p>" {
+		t.Errorf("Expected the first related part, got %q", result)
+	}
+}
+
+// newStateClient returns a client whose source folder holds email1 and email2,
+// with only email2 changed since the saved state "s1"
+func newStateClient(t *testing.T) (*MockEmailClient, string) {
+	t.Helper()
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	for _, id := range []string{"email1", "email2"} {
+		email := client.emailDetails[id]
+		email.MailboxIds = map[string]bool{"src-123": true}
+		client.emailDetails[id] = email
+	}
+	client.emailDetails["elsewhere"] = Email{ID: "elsewhere", MailboxIds: map[string]bool{"inbox": true}}
+	client.accountID = "acc1"
+	client.state = "s2"
+	client.created = []string{"email2", "elsewhere"}
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	if err := saveSyncState(stateFile, "acc1:src-123", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	return client, stateFile
+}
+
+// Test that a saved state limits processing to changed emails in the source folder
+func TestProcessEmails_StateFileUsesChanges(t *testing.T) {
+	client, stateFile := newStateClient(t)
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{StateFile: stateFile}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if client.changesSince != "s1" {
+		t.Errorf("Expected changes since s1, got %q", client.changesSince)
+	}
+	if result.TotalCount != 1 || len(client.moves) != 1 || client.moves[0].emailID != "email2" {
+		t.Errorf("Expected only email2 processed, got total %d, moves %+v", result.TotalCount, client.moves)
+	}
+
+	if saved, _ := loadSyncState(stateFile, "acc1:src-123"); saved != "s2" {
+		t.Errorf("Expected state s2 saved, got %q", saved)
+	}
+}
+
+// Test that an expired state falls back to a full scan of the source folder
+func TestProcessEmails_StateFileFallsBackToQuery(t *testing.T) {
+	client, stateFile := newStateClient(t)
+	client.changesError = &JMAPError{Type: "cannotCalculateChanges"}
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{StateFile: stateFile}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.TotalCount != 2 {
+		t.Errorf("Expected full scan of 2 emails, got %d", result.TotalCount)
+	}
+	if !strings.Contains(output.String(), "falling back to a full scan") {
+		t.Errorf("Expected fallback message, got: %s", output.String())
+	}
+}
+
+// Test that the state is not advanced when an email fails
+func TestProcessEmails_StateFileNotSavedOnFailure(t *testing.T) {
+	client, stateFile := newStateClient(t)
+	generator := NewMockScreenshotService()
+	generator.generateError = errors.New("render failed")
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, generator, ProcessOptions{StateFile: stateFile}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if saved, _ := loadSyncState(stateFile, "acc1:src-123"); saved != "s1" {
+		t.Errorf("Expected state to stay s1, got %q", saved)
+	}
+}
+
+// Test -reset-state ignores and clears the saved state for a full scan
+func TestProcessEmails_ResetState(t *testing.T) {
+	client, stateFile := newStateClient(t)
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{StateFile: stateFile, ResetState: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if client.changesSince != "" || result.TotalCount != 2 {
+		t.Errorf("Expected a full scan of 2 emails, got changes since %q and %d emails", client.changesSince, result.TotalCount)
+	}
+	if saved, _ := loadSyncState(stateFile, "acc1:src-123"); saved != "s2" {
+		t.Errorf("Expected state s2 saved after the full scan, got %q", saved)
+	}
+}
+
+// Test -fail-fast stops at the first failed email and returns the partial result
+func TestProcessEmails_FailFast(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "")
+	addHTMLEmail(client, "email3", "<p>Three</p>")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{FailFast: true}, &output)
+	if err == nil || !strings.Contains(err.Error(), "email2") {
+		t.Fatalf("Expected error naming email2, got: %v", err)
+	}
+	if result == nil {
+		t.Fatal("Expected a partial result")
+	}
+
+	if result.ProcessedCount != 1 || result.FailedCount != 1 {
+		t.Errorf("Expected 1 processed and 1 failed, got %+v", result)
+	}
+	if _, ok := generator.generatedScreenshots["email3"]; ok {
+		t.Error("Expected email3 not to be attempted")
+	}
+	if !strings.Contains(output.String(), "1 email(s) not attempted") {
+		t.Errorf("Expected stop message, got: %s", output.String())
+	}
+}
+
+// Test an interrupted run starts no more emails and returns the partial
+// result with the interruption
+func TestProcessEmails_Interrupted(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	generator := NewMockScreenshotService()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{Context: ctx}, &output)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the cancellation error, got: %v", err)
+	}
+	if result == nil {
+		t.Fatal("Expected a partial result")
+	}
+
+	if result.ProcessedCount != 0 || len(generator.generatedScreenshots) != 0 {
+		t.Errorf("Expected no email attempted, got %+v", result)
+	}
+	if !strings.Contains(output.String(), "interrupted; 2 email(s) not attempted") {
+		t.Errorf("Expected stop message, got: %s", output.String())
+	}
+}
+
+// Test -render-attachments screenshots an image attachment to a numbered
+// file of its own, leaving other attachments alone
+func TestProcessEmails_RenderAttachments(t *testing.T) {
+	client := newSingleEmailClient()
+	email := client.emailDetails["email1"]
+	email.Attachments = []BodyPart{
+		{PartID: "2", Type: "image/png", Name: "receipt.png", BlobID: "blob-png", Size: 4},
+		{PartID: "3", Type: "application/zip", Name: "archive.zip", BlobID: "blob-zip", Size: 4},
+	}
+	client.emailDetails["email1"] = email
+	client.blobs = map[string][]byte{"blob-png": []byte("\x89PNG")}
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{RenderAttachments: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 {
+		t.Errorf("Expected the email processed, got %+v", result)
+	}
+	if len(generator.generatedScreenshots) != 2 {
+		t.Errorf("Expected the email and one attachment screenshotted, got %v", generator.generatedScreenshots)
+	}
+	path, ok := generator.generatedScreenshots["email1.attachment-1"]
+	if !ok {
+		t.Fatalf("Expected a screenshot for the attachment, got %v", generator.generatedScreenshots)
+	}
+	if want := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("\x89PNG")); !strings.Contains(generator.rendered["email1.attachment-1"], want) {
+		t.Errorf("Expected the image inline, got: %s", generator.rendered["email1.attachment-1"])
+	}
+	if outputs := newReport(result).Emails[0].Outputs; len(outputs) != 2 || outputs[1] != path {
+		t.Errorf("Expected the attachment in the report's outputs, got %v", outputs)
+	}
+}
+
+// Test -max-failures stops the run, with the partial result, once that many
+// emails have failed
+func TestProcessEmails_MaxFailures(t *testing.T) {
+	client := newSingleEmailClient()
+	for i := 2; i <= 5; i++ {
+		addHTMLEmail(client, fmt.Sprintf("email%d", i), fmt.Sprintf("<p>%d</p>", i))
+	}
+	generator := NewMockScreenshotService()
+	generator.generateError = errors.New("chrome is gone")
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{MaxFailures: 3}, &output)
+	if err == nil {
+		t.Fatal("Expected an error for the stopped run")
+	}
+	if result == nil {
+		t.Fatal("Expected a partial result")
+	}
+
+	if result.FailedCount != 3 || !result.MaxFailuresReached {
+		t.Errorf("Expected the run stopped at 3 failures, got %+v", result)
+	}
+	if generator.calls != 3 {
+		t.Errorf("Expected 3 screenshot attempts, got %d", generator.calls)
+	}
+	if !strings.Contains(output.String(), "Stopping after 3 failures (-max-failures); 2 email(s) not attempted") {
+		t.Errorf("Expected stop message, got: %s", output.String())
+	}
+}
+
+// Test emails missing from a fetch, or whose batch failed, fail on their own
+// while the rest are processed
+func TestProcessEmails_PartialFetch(t *testing.T) {
+	client := newSingleEmailClient()
+	client.emails["src-123"] = append(client.emails["src-123"], "deleted", "unfetched")
+	client.fetchFailures = map[string]error{"unfetched": errors.New("backend unavailable")}
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 || result.FailedCount != 2 {
+		t.Errorf("Expected 1 processed and 2 failed, got %+v", result)
+	}
+	expected := []moveCall{{"email1", "src-123", "arch-456"}}
+	if !slices.Equal(client.moves, expected) {
+		t.Errorf("Expected only email1 moved, got %v", client.moves)
+	}
+	for _, message := range []string{
+		"✗ Email not found on server",
+		"✗ Failed to fetch email: backend unavailable",
+	} {
+		if !strings.Contains(output.String(), message) {
+			t.Errorf("Expected %q in the output, got: %s", message, output.String())
+		}
+	}
+}
+
+// Test the emails of a run are fetched in batches of the server's
+// maxObjectsInGet rather than one Email/get each
+func TestProcessEmails_FetchesInBatches(t *testing.T) {
+	client := newSingleEmailClient()
+	for i := 2; i <= 5; i++ {
+		addHTMLEmail(client, fmt.Sprintf("email%d", i), fmt.Sprintf("<p>%d</p>", i))
+	}
+	client.capabilities.MaxObjectsInGet = 2
+
+	var output bytes.Buffer
+	result, err := processEmails(client, NewMockScreenshotService(), ProcessOptions{}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 5 {
+		t.Errorf("Expected 5 processed, got %+v", result)
+	}
+	expected := [][]string{{"email1", "email2"}, {"email3", "email4"}, {"email5"}}
+	if !reflect.DeepEqual(client.getCalls, expected) {
+		t.Errorf("Expected Email/get calls %v, got %v", expected, client.getCalls)
+	}
+}
+
+// Test an email left out of its batch's response fails with its own reason
+// while the one returned with it is processed
+func TestProcessEmails_MissingFromBatch(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	client.missingFromGet = map[string]bool{"email2": true}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, NewMockScreenshotService(), ProcessOptions{}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(client.getCalls) != 1 {
+		t.Errorf("Expected both emails fetched in one Email/get, got %v", client.getCalls)
+	}
+	if result.ProcessedCount != 1 || result.FailedCount != 1 {
+		t.Errorf("Expected 1 processed and 1 failed, got %+v", result)
+	}
+	if result.Emails[0].status != statusProcessed || result.Emails[1].status != statusFailed {
+		t.Errorf("Expected email1 processed and email2 failed, got %+v", result.Emails)
+	}
+	if !errors.Is(result.Emails[1].err, errEmailMissingInBatch) {
+		t.Errorf("Expected email2 to fail as missing from its batch, got: %v", result.Emails[1].err)
+	}
+	expected := []moveCall{{"email1", "src-123", "arch-456"}}
+	if !slices.Equal(client.moves, expected) {
+		t.Errorf("Expected only email1 moved, got %v", client.moves)
+	}
+}
+
+// Test an Email/get that fails as a whole fails only its batch's emails, and
+// the next batch is still fetched and processed
+func TestProcessEmails_FailedBatch(t *testing.T) {
+	client := newSingleEmailClient()
+	for i := 2; i <= 3; i++ {
+		addHTMLEmail(client, fmt.Sprintf("email%d", i), fmt.Sprintf("<p>%d</p>", i))
+	}
+	client.capabilities.MaxObjectsInGet = 2
+	client.getCallFailures = map[string]error{"email2": errors.New("backend unavailable")}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, NewMockScreenshotService(), ProcessOptions{}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 || result.FailedCount != 2 {
+		t.Errorf("Expected 1 processed and 2 failed, got %+v", result)
+	}
+	expected := []moveCall{{"email3", "src-123", "arch-456"}}
+	if !slices.Equal(client.moves, expected) {
+		t.Errorf("Expected only email3 moved, got %v", client.moves)
+	}
+	if strings.Count(output.String(), "✗ Failed to fetch email: backend unavailable") != 2 {
+		t.Errorf("Expected both emails of the first batch to fail, got: %s", output.String())
+	}
+}
+
+// Test a limited run reports how many emails the folder holds in all
+func TestProcessEmails_FolderTotal(t *testing.T) {
+	client := newSingleEmailClient()
+	for i := 2; i <= 3; i++ {
+		addHTMLEmail(client, fmt.Sprintf("email%d", i), fmt.Sprintf("<p>%d</p>", i))
+	}
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, NewMockScreenshotService(), ProcessOptions{Limit: 1}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !strings.Contains(output.String(), "Found 1 of 3 total email(s) in folder '_aar'") {
+		t.Errorf("Expected the folder total, got: %s", output.String())
+	}
+}
+
+// Test expired credentials stop the run instead of failing every email
+func TestProcessEmails_AuthExpired(t *testing.T) {
+	client := newSingleEmailClient()
+	for i := 2; i <= 4; i++ {
+		addHTMLEmail(client, fmt.Sprintf("email%d", i), fmt.Sprintf("<p>%d</p>", i))
+	}
+	client.moveEmailError = fmt.Errorf("%w: request failed with %w", ErrAuthExpired, &StatusError{StatusCode: 401})
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
+	if !errors.Is(err, ErrAuthExpired) || exitCode(err) != exitAuth {
+		t.Fatalf("Expected ErrAuthExpired, got: %v", err)
+	}
+	if result == nil || result.FailedCount != 1 {
+		t.Fatalf("Expected a partial result with one failure, got %+v", result)
+	}
+	if generator.calls != 1 {
+		t.Errorf("Expected no emails attempted after the first, got %d screenshots", generator.calls)
+	}
+	if !strings.Contains(output.String(), "Stopping: authentication expired; 3 email(s) not attempted") {
+		t.Errorf("Expected stop message, got: %s", output.String())
+	}
+}
+
+// Test failures don't stop the run without -fail-fast
+func TestProcessEmails_ContinuesPastFailure(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "")
+	addHTMLEmail(client, "email3", "<p>Three</p>")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.ProcessedCount != 2 || result.FailedCount != 1 {
+		t.Errorf("Expected 2 processed and 1 failed, got %+v", result)
+	}
+}
+
+// Test -banner prepends the email metadata to the rendered HTML
+func TestProcessEmails_Banner(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, generator, ProcessOptions{Banner: true}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	rendered := generator.rendered["email1"]
+	if !strings.HasPrefix(rendered, `<div class="aar-banner"`) || !strings.Contains(rendered, "Test Email") {
+		t.Errorf("Expected banner with subject before the body, got: %s", rendered)
+	}
+}
+
+// Test a guarded move sends the read state and retries after a state mismatch
+func TestProcessEmails_GuardedMoveRetriesOnMismatch(t *testing.T) {
+	client := newSingleEmailClient()
+	email := client.emailDetails["email1"]
+	email.MailboxIds = map[string]bool{"src-123": true}
+	client.emailDetails["email1"] = email
+	client.mismatchesRemaining = 1
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{GuardedMove: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 || len(client.moves) != 1 {
+		t.Errorf("Expected the retried move to succeed, got %+v with moves %v", result, client.moves)
+	}
+	if len(client.guardStates) != 2 || client.guardStates[0] != "state-1" {
+		t.Errorf("Expected two guarded attempts starting from state-1, got %v", client.guardStates)
+	}
+	if !strings.Contains(output.String(), "re-fetching") {
+		t.Errorf("Expected re-fetch message, got: %s", output.String())
+	}
+}
+
+// Test a guarded move gives up if the email left the source folder concurrently
+func TestProcessEmails_GuardedMoveEmailMovedElsewhere(t *testing.T) {
+	client := newSingleEmailClient()
+	email := client.emailDetails["email1"]
+	email.MailboxIds = map[string]bool{"other": true}
+	client.emailDetails["email1"] = email
+	client.mismatchesRemaining = 1
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{GuardedMove: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.FailedCount != 1 || len(client.moves) != 0 {
+		t.Errorf("Expected the move to fail without retrying, got %+v", result)
+	}
+}
+
+// Test -email-id processes only that email, ignoring the limit
+func TestProcessEmails_SingleEmailID(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	addHTMLEmail(client, "email3", "<p>Three</p>")
+	email := client.emailDetails["email3"]
+	email.MailboxIds = map[string]bool{"src-123": true}
+	client.emailDetails["email3"] = email
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{EmailID: "email3", Limit: 1}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.TotalCount != 1 || len(generator.generatedScreenshots) != 1 {
+		t.Errorf("Expected exactly one email processed, got %+v", result)
+	}
+	if _, ok := generator.generatedScreenshots["email3"]; !ok {
+		t.Error("Expected email3 to be screenshotted")
+	}
+	if len(client.moves) != 1 || client.moves[0].emailID != "email3" {
+		t.Errorf("Expected only email3 moved, got %v", client.moves)
+	}
+}
+
+// Test -email-id refuses unknown emails and emails outside the source folder
+func TestProcessEmails_SingleEmailIDValidation(t *testing.T) {
+	client := newSingleEmailClient()
+	client.emailDetails["inbox1"] = Email{ID: "inbox1", MailboxIds: map[string]bool{"inbox": true}}
+	generator := NewMockScreenshotService()
+
+	tests := map[string]string{
+		"missing": "not found",
+		"inbox1":  "not in folder '_aar'",
+	}
+	for id, expected := range tests {
+		var output bytes.Buffer
+		_, err := processEmails(client, generator, ProcessOptions{EmailID: id}, &output)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing %q, got: %v", id, expected, err)
+		}
+	}
+	if len(client.moves) != 0 {
+		t.Errorf("Expected no moves, got %v", client.moves)
+	}
+}
+
+// Test -batch-moves applies all moves in one call at the end, counting refused ones as failed
+func TestProcessEmails_BatchMoves(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	addHTMLEmail(client, "email3", "<p>Three</p>")
+	client.batchMoveErrors = map[string]error{"email2": errors.New("not updated")}
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{BatchMoves: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(client.batchMoves) != 1 || len(client.batchMoves[0]) != 3 {
+		t.Errorf("Expected one batch of 3 emails, got %v", client.batchMoves)
+	}
+	if result.ProcessedCount != 2 || result.FailedCount != 1 {
+		t.Errorf("Expected 2 processed and 1 failed, got %+v", result)
+	}
+	if !strings.Contains(output.String(), "Moved 2/3 email(s)") {
+		t.Errorf("Expected batch summary, got: %s", output.String())
+	}
+}
+
+// Test -print-html prints the wrapped document without screenshotting or moving
+func TestProcessEmails_PrintHTML(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{PrintHTML: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !strings.Contains(output.String(), "<!DOCTYPE html>") || !strings.Contains(output.String(), "<html><body>Test</body></html>") {
+		t.Errorf("Expected the wrapped email HTML in output, got: %s", output.String())
+	}
+	if generator.calls != 0 {
+		t.Errorf("Expected no screenshots, got %d", generator.calls)
+	}
+	if len(client.moves) != 0 || len(client.copies) != 0 {
+		t.Errorf("Expected no moves, got %v", client.moves)
+	}
+	if result.ProcessedCount != 0 || result.SkippedCount != 1 {
+		t.Errorf("Expected the email counted as skipped, got %+v", result)
+	}
+}
+
+// countingScreenshotService records the most screenshots in progress at once
+type countingScreenshotService struct {
+	MockScreenshotService
+	active, peak, calls atomic.Int32
+}
+
+func (c *countingScreenshotService) GenerateScreenshot(subdir, timestamp, emailID, htmlContent string) (string, error) {
+	n := c.active.Add(1)
+	defer c.active.Add(-1)
+	c.calls.Add(1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return "screenshots/" + emailID + ".png", nil
+}
+
+func (c *countingScreenshotService) HasScreenshot(emailID string) bool { return false }
+
+// Test -max-tabs caps concurrent screenshots below -concurrency
+func TestProcessEmails_MaxTabs(t *testing.T) {
+	client := newSingleEmailClient()
+	for i := 2; i <= 12; i++ {
+		addHTMLEmail(client, fmt.Sprintf("email%d", i), fmt.Sprintf("<p>%d</p>", i))
+	}
+	generator := &countingScreenshotService{}
+
+	var output bytes.Buffer
+	opts := ProcessOptions{ArchiveMode: ArchiveNone, Concurrency: 8, MaxTabs: 2}
+	result, err := processEmails(client, generator, opts, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 12 || generator.calls.Load() != 12 {
+		t.Errorf("Expected 12 screenshots, got %d (%+v)", generator.calls.Load(), result)
+	}
+	if peak := generator.peak.Load(); peak > 2 {
+		t.Errorf("Expected at most 2 concurrent screenshots, got %d", peak)
+	}
+}
+
+// Test -fail-fast with -concurrency stops starting new emails
+func TestProcessEmails_FailFastConcurrent(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "")
+	for i := 3; i <= 6; i++ {
+		addHTMLEmail(client, fmt.Sprintf("email%d", i), fmt.Sprintf("<p>%d</p>", i))
+	}
+	generator := &countingScreenshotService{}
+
+	var output bytes.Buffer
+	opts := ProcessOptions{ArchiveMode: ArchiveNone, FailFast: true, Concurrency: 3, MaxTabs: 1}
+	result, err := processEmails(client, generator, opts, &output)
+	if err == nil {
+		t.Fatal("Expected a fail-fast error")
+	}
+
+	if result.FailedCount != 1 {
+		t.Errorf("Expected 1 failure, got %+v", result)
+	}
+	if attempted := result.ProcessedCount + result.FailedCount + result.SkippedCount; attempted >= 6 {
+		t.Errorf("Expected emails after the failure not to be started, got %+v", result)
+	}
+}
+
+// Test -verify-move passes when the email reached the archive
+func TestProcessEmails_VerifyMove(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{VerifyMove: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.ProcessedCount != 1 || result.FailedCount != 0 {
+		t.Errorf("Expected the verified email to be processed, got %+v\n%s", result, output.String())
+	}
+}
+
+// Test -verify-move fails an email the server claims to have moved but left in the source folder
+func TestProcessEmails_VerifyMoveDetectsSilentFailure(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		client := newSingleEmailClient()
+		email := client.emailDetails["email1"]
+		email.MailboxIds = map[string]bool{"src-123": true}
+		client.emailDetails["email1"] = email
+		client.silentMoveFailures = true
+		generator := NewMockScreenshotService()
+
+		var output bytes.Buffer
+		result, err := processEmails(client, generator, ProcessOptions{VerifyMove: true, BatchMoves: batch}, &output)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if result.ProcessedCount != 0 || result.FailedCount != 1 {
+			t.Errorf("batch=%v: expected 1 failure, got %+v", batch, result)
+		}
+		if !strings.Contains(output.String(), "still in the source folder") {
+			t.Errorf("batch=%v: expected verification failure, got: %s", batch, output.String())
+		}
+	}
+}
+
+// Test each handled email's processing time is reported and returned
+func TestProcessEmails_Durations(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(result.Emails) != 2 || result.Emails[0].id != "email1" || result.Emails[1].id != "email2" {
+		t.Fatalf("Expected results for both emails in order, got %+v", result.Emails)
+	}
+	for _, email := range result.Emails {
+		if email.duration <= 0 {
+			t.Errorf("Expected a duration for %s", email.id)
+		}
+	}
+	if result.AverageDuration() != result.TotalDuration()/2 {
+		t.Errorf("Expected average of total %s over 2 emails, got %s", result.TotalDuration(), result.AverageDuration())
+	}
+	if strings.Count(output.String(), "✓ Done in ") != 1 {
+		t.Errorf("Expected a done line for the processed email only, got: %s", output.String())
+	}
+}
+
+// Test dry runs don't report timings
+func TestProcessEmails_DryRunHasNoDurations(t *testing.T) {
+	result, err := processEmails(newSingleEmailClient(), NewMockScreenshotService(), ProcessOptions{DryRun: true}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(result.Emails) != 0 {
+		t.Errorf("Expected no email results, got %+v", result.Emails)
+	}
+}
+
+// Test -min-age leaves a just-received email for a later run
+func TestProcessEmails_MinAge(t *testing.T) {
+	client, stateFile := newStateClient(t)
+	fresh := client.emailDetails["email2"]
+	fresh.ReceivedAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	client.emailDetails["email2"] = fresh
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	opts := ProcessOptions{MinAge: 10 * time.Minute, StateFile: stateFile, ResetState: true}
+	result, err := processEmails(client, generator, opts, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 || result.SkippedCount != 1 {
+		t.Errorf("Expected 1 processed and 1 skipped, got %+v", result)
+	}
+	if len(client.moves) != 1 || client.moves[0].emailID != "email1" {
+		t.Errorf("Expected only the old email moved, got %+v", client.moves)
+	}
+	if !strings.Contains(output.String(), "leaving for a later run") {
+		t.Errorf("Expected min-age message, got: %s", output.String())
+	}
+	if saved, _ := loadSyncState(stateFile, "acc1:src-123"); saved != "" {
+		t.Errorf("Expected the state not to advance past the skipped email, got %q", saved)
+	}
+}
+
+// Test listMailboxes prints every mailbox with its path, role, ID and counts
+func TestListMailboxes(t *testing.T) {
+	client := NewMockEmailClient()
+	client.mailboxes["Inbox"] = &Mailbox{ID: "mb1", Name: "Inbox", Role: "inbox", UnreadEmails: 3, TotalEmails: 120}
+	client.mailboxes["Archive"] = &Mailbox{ID: "mb2", Name: "Archive", Role: "archive", TotalEmails: 5000}
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "mb3", Name: sourceFolder, TotalEmails: 7}
+	client.mailboxes["2024"] = &Mailbox{ID: "mb4", Name: "2024", ParentID: "mb2", TotalEmails: 42}
+
+	var output bytes.Buffer
+	if err := listMailboxes(client, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected a header and 4 mailboxes, got:\n%s", output.String())
+	}
+	expected := [][]string{
+		{"NAME", "ROLE", "ID", "UNREAD", "TOTAL"},
+		{"Archive", "archive", "mb2", "0", "5000"},
+		{"Archive/2024", "-", "mb4", "0", "42"},
+		{"Inbox", "inbox", "mb1", "3", "120"},
+		{sourceFolder, "-", "mb3", "0", "7"},
+	}
+	for i, fields := range expected {
+		if got := strings.Fields(lines[i]); strings.Join(got, " ") != strings.Join(fields, " ") {
+			t.Errorf("Line %d: expected %v, got %v", i, fields, got)
+		}
+	}
+}
+
+// Test -domain-stats counts processed emails by sender domain, busiest first
+func TestProcessEmails_DomainStats(t *testing.T) {
+	client := NewMockEmailClient()
+	client.mailboxes[sourceFolder] = &Mailbox{ID: "src-123", Name: sourceFolder}
+	client.mailboxes[archiveFolder] = &Mailbox{ID: "arch-456", Name: archiveFolder}
+	senders := map[string]string{
+		"email1": "news@shop.example",
+		"email2": "Deals@Shop.Example",
+		"email3": "alerts@bank.example",
+	}
+	for id, sender := range senders {
+		addHTMLEmail(client, id, "<p>"+id+"</p>")
+		email := client.emailDetails[id]
+		email.From = []EmailAddress{{Email: sender}}
+		client.emailDetails[id] = email
+	}
+	client.emails["src-123"] = append(client.emails["src-123"], "email4")
+	client.emailDetails["email4"] = Email{ID: "email4", From: []EmailAddress{{Email: "x@bank.example"}}}
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{DomainStats: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// email4 has no HTML, so it fails and isn't counted
+	expected := []DomainCount{{"shop.example", 2}, {"bank.example", 1}}
+	if breakdown := result.DomainBreakdown(); !slices.Equal(breakdown, expected) {
+		t.Errorf("Expected %v, got %v", expected, breakdown)
+	}
+}
+
+// Test -prefer-amp renders an email's AMP part, and that without it the
+// regular HTML is rendered and the AMP part only noted
+func TestProcessEmails_PreferAMP(t *testing.T) {
+	for _, preferAMP := range []bool{true, false} {
+		client := newSingleEmailClient()
+		email := client.emailDetails["email1"]
+		email.BodyStructure = &BodyPart{Type: "multipart/alternative", SubParts: []BodyPart{
+			{PartID: "part0", Type: "text/plain"},
+			{PartID: "amp", Type: "text/x-amp-html"},
+			{PartID: "part1", Type: "text/html"},
+		}}
+		email.BodyValues["amp"] = BodyValue{Value: "<html ⚡4email><body>AMP</body></html>"}
+		client.emailDetails["email1"] = email
+		generator := NewMockScreenshotService()
+
+		var output bytes.Buffer
+		if _, err := processEmails(client, generator, ProcessOptions{PreferAMP: preferAMP}, &output); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		expected := "<html><body>Test</body></html>"
+		if preferAMP {
+			expected = "<html ⚡4email><body>AMP</body></html>"
+		}
+		if generator.rendered["email1"] != expected {
+			t.Errorf("prefer-amp %v: expected %q rendered, got %q", preferAMP, expected, generator.rendered["email1"])
+		}
+		if !strings.Contains(output.String(), "AMP part") {
+			t.Errorf("prefer-amp %v: expected the AMP part to be logged, got:\n%s", preferAMP, output.String())
+		}
+	}
+}
+
+// newThreadClient returns a client whose source folder holds both messages
+// of a two-message thread
+func newThreadClient() *MockEmailClient {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Reply body</p>")
+	for _, id := range []string{"email1", "email2"} {
+		email := client.emailDetails[id]
+		email.ThreadID = "T1"
+		email.MailboxIds = map[string]bool{"src-123": true}
+		client.emailDetails[id] = email
+	}
+	client.threads = map[string][]string{"T1": {"email1", "email2"}}
+	return client
+}
+
+// Test -thread renders both messages of a thread in one screenshot, archives
+// the whole thread, and treats the thread's second email as a duplicate
+func TestProcessEmails_Thread(t *testing.T) {
+	client := newThreadClient()
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{Thread: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(generator.rendered) != 1 {
+		t.Fatalf("Expected one combined screenshot, got %d", len(generator.rendered))
+	}
+	rendered := generator.rendered["email1"]
+	first, second := strings.Index(rendered, "<body>Test</body>"), strings.Index(rendered, "Reply body")
+	if first < 0 || second < first || strings.Count(rendered, "aar-banner") != 2 {
+		t.Errorf("Expected both bodies under their own banners, oldest first, got:\n%s", rendered)
+	}
+	if result.ProcessedCount != 1 || result.DuplicateCount != 1 {
+		t.Errorf("Expected 1 processed and 1 duplicate, got %+v", result)
+	}
+	if len(client.moves) != 2 {
+		t.Errorf("Expected both thread messages moved, got %v", client.moves)
+	}
+}
+
+// Test -thread-move email archives only the email processed
+func TestProcessEmails_ThreadMoveEmail(t *testing.T) {
+	client := newThreadClient()
+	client.emails["src-123"] = []string{"email1"}
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, NewMockScreenshotService(), ProcessOptions{Thread: true, ThreadMove: ThreadMoveEmail}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(client.moves) != 1 || client.moves[0].emailID != "email1" {
+		t.Errorf("Expected only email1 moved, got %v", client.moves)
+	}
+}
+
+// Test -max-html-size fails an oversized email without rendering it, and
+// still renders the others
+func TestProcessEmails_MaxHTMLSize(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "huge", "<p>"+strings.Repeat("x", 2048)+"</p>")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{MaxHTMLSize: 1024}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.FailedCount != 1 || result.ProcessedCount != 1 {
+		t.Errorf("Expected the huge email failed and the other processed, got %+v", result)
+	}
+	if _, ok := generator.rendered["huge"]; ok || generator.calls != 1 {
+		t.Errorf("Expected the huge email not to be rendered, got %d render(s)", generator.calls)
+	}
+	if !strings.Contains(output.String(), "over the -max-html-size limit of 1.0 KB") {
+		t.Errorf("Expected the size limit in the output, got:\n%s", output.String())
+	}
+	if len(client.moves) != 1 || client.moves[0].emailID != "email1" {
+		t.Errorf("Expected only email1 moved, got %v", client.moves)
+	}
+}
+
+// Test -trash-on-fail moves an email with no HTML to the trash and archives
+// the others as usual
+func TestProcessEmails_TrashOnFail(t *testing.T) {
+	client := newSingleEmailClient()
+	client.mailboxes["Trash"] = &Mailbox{ID: "trash-789", Name: "Trash", Role: "trash"}
+	addHTMLEmail(client, "image-only", "")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{TrashOnFail: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.FailedCount != 1 || result.ProcessedCount != 1 {
+		t.Errorf("Expected one failed and one processed, got %+v", result)
+	}
+	expected := []moveCall{
+		{"email1", "src-123", "arch-456"},
+		{"image-only", "src-123", "trash-789"},
+	}
+	if !slices.Equal(client.moves, expected) {
+		t.Errorf("Expected moves %v, got %v", expected, client.moves)
+	}
+	if !strings.Contains(output.String(), "Moved to trash folder 'Trash'") {
+		t.Errorf("Expected the trash move in the output, got:\n%s", output.String())
+	}
+}
+
+// Test -archive-unscreenshotted archives an email without HTML, counting it
+// separately rather than as failed
+func TestProcessEmails_ArchiveUnscreenshotted(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "plain-text", "")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{ArchiveUnscreenshotted: true}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ArchivedWithoutScreenshot != 1 || result.ProcessedCount != 1 || result.FailedCount != 0 {
+		t.Errorf("Expected one processed and one archived without a screenshot, got %+v", result)
+	}
+	expected := []moveCall{
+		{"email1", "src-123", "arch-456"},
+		{"plain-text", "src-123", "arch-456"},
+	}
+	if !slices.Equal(client.moves, expected) {
+		t.Errorf("Expected moves %v, got %v", expected, client.moves)
+	}
+	if _, ok := generator.generatedScreenshots["plain-text"]; ok {
+		t.Error("Expected no screenshot for the email without HTML")
+	}
+	if report := newReport(result); report.ArchivedWithoutScreenshot != 1 || report.Emails[1].Status != "archived-without-screenshot" {
+		t.Errorf("Expected the email reported as archived without a screenshot, got %+v", report)
+	}
+}
+
+// Test a quarantined email is screenshotted but not moved, while other
+// emails are archived as usual
+func TestProcessEmails_Quarantine(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "suspicious", "<p>Verify your account</p>")
+	email := client.emailDetails["suspicious"]
+	email.From = []EmailAddress{{Name: "Support", Email: "support@bank-login.example"}}
+	client.emailDetails["suspicious"] = email
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	opts := ProcessOptions{Quarantine: SenderFilter{Deny: []string{"bank-login.example"}}}
+	result, err := processEmails(client, generator, opts, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.QuarantinedCount != 1 || result.ProcessedCount != 1 || result.FailedCount != 0 {
+		t.Errorf("Expected one processed and one quarantined, got %+v", result)
+	}
+	if _, ok := generator.generatedScreenshots["suspicious"]; !ok {
+		t.Error("Expected a screenshot of the quarantined email")
+	}
+	expected := []moveCall{{"email1", "src-123", "arch-456"}}
+	if !slices.Equal(client.moves, expected) {
+		t.Errorf("Expected only email1 moved, got %v", client.moves)
+	}
+	if !strings.Contains(output.String(), `sender "support@bank-login.example" quarantined`) {
+		t.Errorf("Expected the quarantine in the output, got: %s", output.String())
+	}
+	if report := newReport(result); report.Quarantined != 1 || report.Emails[1].Status != "quarantined" {
+		t.Errorf("Expected the email reported as quarantined, got %+v", report)
+	}
+}
+
+// Test -trash-on-fail fails the run up front when there is no trash mailbox
+func TestProcessEmails_TrashOnFailNoTrash(t *testing.T) {
+	client := newSingleEmailClient()
+
+	var output bytes.Buffer
+	_, err := processEmails(client, NewMockScreenshotService(), ProcessOptions{TrashOnFail: true}, &output)
+	var notFound *MailboxNotFoundError
+	if !errors.As(err, &notFound) || notFound.Role != "trash" {
+		t.Errorf("Expected a missing trash mailbox error, got: %v", err)
+	}
+	if len(client.moves) != 0 {
+		t.Errorf("Expected no moves, got %v", client.moves)
+	}
+}
+
+// Test -render-ics puts an invite's event above its HTML, and leaves emails
+// without a calendar part alone
+func TestProcessEmails_RenderICS(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "plain", "<p>No invite</p>")
+	email := client.emailDetails["email1"]
+	email.BodyStructure = &BodyPart{Type: "multipart/alternative", SubParts: []BodyPart{
+		{PartID: "part1", Type: "text/html"},
+		{PartID: "ics", Type: "text/calendar"},
+	}}
+	email.BodyValues["ics"] = BodyValue{Value: testInvite}
+	client.emailDetails["email1"] = email
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, generator, ProcessOptions{RenderICS: true}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	rendered := generator.rendered["email1"]
+	for _, field := range []string{
+		"Quarterly planning, Q4 review with the whole team",
+		"Fri, 24 Oct 2025 10:30 – 11:30 EDT",
+		"Room 4B; &#34;Main&#34; building",
+	} {
+		if !strings.Contains(rendered, field) {
+			t.Errorf("Expected %q in the rendered HTML, got:\n%s", field, rendered)
+		}
+	}
+	if !strings.HasSuffix(rendered, "<html><body>Test</body></html>") {
+		t.Errorf("Expected the email's HTML after the card, got:\n%s", rendered)
+	}
+	if generator.rendered["plain"] != "<p>No invite</p>" {
+		t.Errorf("Expected the email without an invite unchanged, got %q", generator.rendered["plain"])
+	}
+}
+
+// Test -delay spaces the start of each email after the first
+func TestProcessEmails_Delay(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	start := time.Now()
+	result, err := processEmails(client, generator, ProcessOptions{Delay: 100 * time.Millisecond}, &output)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 2 {
+		t.Errorf("Expected both emails processed, got %+v", result)
+	}
+	if elapsed < 100*time.Millisecond {
+		t.Errorf("Expected two emails to take at least the delay, took %s", elapsed)
+	}
+}
+
+// Test a truncated body is screenshotted with a warning, or failed and left
+// in the source folder with -fail-truncated
+func TestProcessEmails_TruncatedBody(t *testing.T) {
+	for _, failTruncated := range []bool{false, true} {
+		client := newSingleEmailClient()
+		email := client.emailDetails["email1"]
+		email.BodyValues["part1"] = BodyValue{Value: "<html><body>Test", IsTruncated: true}
+		client.emailDetails["email1"] = email
+		generator := NewMockScreenshotService()
+
+		var output bytes.Buffer
+		result, err := processEmails(client, generator, ProcessOptions{FailTruncated: failTruncated}, &output)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if !failTruncated {
+			if result.ProcessedCount != 1 {
+				t.Errorf("Expected the email processed, got %+v", result)
+			}
+			if !strings.Contains(output.String(), "Warning: the server returned only part") {
+				t.Errorf("Expected a truncation warning, got: %s", output.String())
+			}
+			continue
+		}
+		if result.FailedCount != 1 || len(client.moves) != 0 || len(generator.generatedScreenshots) != 0 {
+			t.Errorf("Expected the email failed without a screenshot or move, got %+v", result)
+		}
+		if !strings.Contains(output.String(), "Email body was truncated by the server") {
+			t.Errorf("Expected the truncation reported, got: %s", output.String())
+		}
+	}
+}
+
+// Test -interactive lists the emails and processes them only when the
+// answer is yes
+func TestProcessEmails_Confirm(t *testing.T) {
+	for _, tt := range []struct {
+		answer  string
+		proceed bool
+	}{
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+		{"y\n", true},
+		{"YES\n", true},
+	} {
+		t.Run(strings.TrimSpace(tt.answer), func(t *testing.T) {
+			client := newSingleEmailClient()
+			generator := NewMockScreenshotService()
+
+			var output bytes.Buffer
+			result, err := processEmails(client, generator, ProcessOptions{Confirm: strings.NewReader(tt.answer)}, &output)
+			if !strings.Contains(output.String(), `1. email1  "Test Email" from unknown`) {
+				t.Errorf("Expected the email listed, got: %s", output.String())
+			}
+
+			if !tt.proceed {
+				if !errors.Is(err, errAborted) {
+					t.Errorf("Expected errAborted, got: %v", err)
+				}
+				if len(generator.generatedScreenshots) != 0 || len(client.moves) != 0 {
+					t.Errorf("Expected nothing processed, got screenshots %v and moves %v", generator.generatedScreenshots, client.moves)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if result.ProcessedCount != 1 || len(client.moves) != 1 {
+				t.Errorf("Expected the email processed and moved, got %+v and moves %v", result, client.moves)
+			}
+		})
+	}
+}
+
+// Test -sender-dirs puts each screenshot under its sender's domain, with
+// senders without an address under unknown
+func TestProcessEmails_SenderDirs(t *testing.T) {
+	client := newSingleEmailClient()
+	email := client.emailDetails["email1"]
+	email.From = []EmailAddress{{Name: "Newsletter", Email: "news@substack.com"}}
+	client.emailDetails["email1"] = email
+	addHTMLEmail(client, "anonymous", "<p>Who sent this?</p>")
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, generator, ProcessOptions{SenderDirs: true}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for id, dir := range map[string]string{"email1": "substack.com", "anonymous": "unknown"} {
+		if path := generator.generatedScreenshots[id]; filepath.Base(filepath.Dir(path)) != dir {
+			t.Errorf("Expected %s in a %s directory, got %q", id, dir, path)
+		}
 	}
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errMetadataUnsupported is returned by embedMetadata for image formats it
+// can't write metadata into
+var errMetadataUnsupported = errors.New("embedded metadata is only supported for PNG screenshots")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// metadataText is one keyword/value pair embedded in an image
+type metadataText struct {
+	keyword string
+	text    string
+}
+
+// emailMetadata returns the PNG text entries describing email, followed by
+// any header fields fetched for it, by name
+func emailMetadata(email Email) []metadataText {
+	author, address := PrimarySender(email)
+	if address != "" && author != address {
+		author = fmt.Sprintf("%s <%s>", author, address)
+	}
+	created := email.ReceivedAt
+	if received, err := time.Parse(time.RFC3339, email.ReceivedAt); err == nil {
+		created = received.Format(time.RFC1123Z)
+	}
+
+	texts := []metadataText{
+		{"Subject", email.Subject},
+		{"Author", author},
+		{"Creation Time", created},
+	}
+	// PNG keywords are at most 79 bytes, far longer than any real header name
+	for _, name := range slices.Sorted(maps.Keys(email.Headers)) {
+		if len(name) <= 79 {
+			texts = append(texts, metadataText{name, email.Headers[name]})
+		}
+	}
+	return texts
+}
+
+// embedMetadata writes the email's subject, sender and date into the
+// screenshot at screenshotPath and any further slices of it, as PNG text
+// chunks. Other formats return errMetadataUnsupported.
+func embedMetadata(screenshotPath string, email Email) error {
+	if !strings.EqualFold(filepath.Ext(screenshotPath), ".png") {
+		return errMetadataUnsupported
+	}
+
+	texts := emailMetadata(email)
+	for i := 0; ; i++ {
+		path := slicePath(screenshotPath, i)
+		data, err := os.ReadFile(path)
+		if i > 0 && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		tagged, err := addPNGText(data, texts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if err := writeFileAtomic(path, tagged); err != nil {
+			return err
+		}
+	}
+}
+
+// addPNGText inserts text chunks after a PNG's IHDR chunk, leaving the image
+// data untouched. Latin-1 text uses tEXt as the PNG spec requires; anything
+// else uses the UTF-8 iTXt chunk.
+func addPNGText(pngData []byte, texts []metadataText) ([]byte, error) {
+	// Signature, then IHDR: length, type, 13 bytes of data, CRC
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	if len(pngData) < ihdrEnd || !bytes.HasPrefix(pngData, pngSignature) || string(pngData[12:16]) != "IHDR" {
+		return nil, errors.New("not a PNG image")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(pngData[:ihdrEnd])
+	for _, t := range texts {
+		if t.text == "" {
+			continue
+		}
+		if latin1, ok := toLatin1(t.text); ok {
+			writePNGChunk(&buf, "tEXt", append([]byte(t.keyword+"\x00"), latin1...))
+		} else {
+			// Keyword, then no compression, no language and no translated keyword
+			writePNGChunk(&buf, "iTXt", []byte(t.keyword+"\x00\x00\x00\x00\x00"+t.text))
+		}
+	}
+	buf.Write(pngData[ihdrEnd:])
+	return buf.Bytes(), nil
+}
+
+// writePNGChunk appends a chunk with its length and CRC
+func writePNGChunk(buf *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	buf.WriteString(chunkType)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// toLatin1 encodes s as ISO 8859-1, reporting false if it has characters
+// outside that set or control characters other than newline
+func toLatin1(s string) ([]byte, bool) {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff || (r < 0x20 && r != '\n') || (r >= 0x7f && r < 0xa0) {
+			return nil, false
+		}
+		out = append(out, byte(r))
+	}
+	return out, true
+}
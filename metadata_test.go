@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pngTextChunks returns the keyword/text pairs of a PNG's tEXt and iTXt chunks
+func pngTextChunks(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	texts := make(map[string]string)
+	for pos := len(pngSignature); pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		chunk := data[pos+8 : pos+8+length]
+		switch chunkType {
+		case "tEXt":
+			keyword, text, _ := strings.Cut(string(chunk), "\x00")
+			var utf8 []rune
+			for _, b := range []byte(text) {
+				utf8 = append(utf8, rune(b))
+			}
+			texts[keyword] = string(utf8)
+		case "iTXt":
+			keyword, rest, _ := strings.Cut(string(chunk), "\x00")
+			// Skip the compression flag and method, language and translated keyword
+			parts := strings.SplitN(rest[2:], "\x00", 3)
+			texts[keyword] = parts[2]
+		}
+		pos += 8 + length + 4
+	}
+	return texts
+}
+
+func writeTestPNG(t *testing.T, path string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write PNG: %v", err)
+	}
+}
+
+// Test the subject, sender and date are embedded in every slice as PNG text
+// chunks, and the images still decode
+func TestEmbedMetadata(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shot.png")
+	writeTestPNG(t, path)
+	writeTestPNG(t, slicePath(path, 1))
+
+	email := Email{
+		Subject:    "Café receipt ✓",
+		From:       []EmailAddress{{Name: "Shop", Email: "shop@example.com"}},
+		ReceivedAt: "2025-10-24T14:30:00Z",
+	}
+	if err := embedMetadata(path, email); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := map[string]string{
+		"Subject":       "Café receipt ✓",
+		"Author":        "Shop <shop@example.com>",
+		"Creation Time": "Fri, 24 Oct 2025 14:30:00 +0000",
+	}
+	for i := range 2 {
+		data, err := os.ReadFile(slicePath(path, i))
+		if err != nil {
+			t.Fatalf("Failed to read slice %d: %v", i, err)
+		}
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("Slice %d no longer decodes: %v", i, err)
+		}
+		texts := pngTextChunks(t, data)
+		for keyword, text := range expected {
+			if texts[keyword] != text {
+				t.Errorf("Slice %d: expected %s %q, got %q", i, keyword, text, texts[keyword])
+			}
+		}
+	}
+}
+
+// Test formats without metadata support are reported rather than modified
+func TestEmbedMetadata_Unsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shot.webp")
+	webp := []byte("RIFF\x00\x00\x00\x00WEBP")
+	if err := os.WriteFile(path, webp, 0644); err != nil {
+		t.Fatalf("Failed to write WebP: %v", err)
+	}
+
+	if err := embedMetadata(path, Email{Subject: "Hi"}); !errors.Is(err, errMetadataUnsupported) {
+		t.Errorf("Expected errMetadataUnsupported, got: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, webp) {
+		t.Error("Expected the WebP file to be left unchanged")
+	}
+}
+
+// Test data that isn't a PNG is rejected
+func TestAddPNGText_NotPNG(t *testing.T) {
+	if _, err := addPNGText([]byte("not an image, but long enough to look"), nil); err == nil {
+		t.Error("Expected error for non-PNG data")
+	}
+}
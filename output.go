@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// syncWriter serializes writes to an underlying writer so it can be shared by
+// emails processed concurrently
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newSyncWriter wraps w for shared use
+func newSyncWriter(w io.Writer) *syncWriter {
+	return &syncWriter{w: w}
+}
+
+// Write writes p to the underlying writer while holding the lock
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// emailBuffer collects the multi-line output for one email in memory so it
+// reaches the shared writer as a single, uninterrupted block
+type emailBuffer struct {
+	bytes.Buffer
+	out *syncWriter
+}
+
+// newEmailBuffer returns an empty buffer that flushes to s
+func (s *syncWriter) newEmailBuffer() *emailBuffer {
+	return &emailBuffer{out: s}
+}
+
+// Flush writes everything buffered so far to the shared writer in one write
+// and empties the buffer
+func (b *emailBuffer) Flush() error {
+	if b.Len() == 0 {
+		return nil
+	}
+	_, err := b.out.Write(b.Bytes())
+	b.Reset()
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test that two emails writing concurrently never interleave their lines
+func TestEmailBuffer_NoInterleaving(t *testing.T) {
+	var output bytes.Buffer
+	out := newSyncWriter(&output)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, id := range []string{"A", "B"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			buf := out.newEmailBuffer()
+			<-start
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(buf, "%s line %d\n", id, i)
+			}
+			buf.Flush()
+		}(id)
+	}
+	close(start)
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 200 {
+		t.Fatalf("Expected 200 lines, got %d", len(lines))
+	}
+
+	// All of one email's lines must come before all of the other's
+	first := lines[0][:1]
+	for i, line := range lines {
+		expected := first
+		if i >= 100 {
+			expected = map[string]string{"A": "B", "B": "A"}[first]
+		}
+		if !strings.HasPrefix(line, expected+" ") {
+			t.Fatalf("Line %d from the wrong email: %q", i, line)
+		}
+	}
+}
+
+// Test a flushed buffer is emptied so later output isn't repeated
+func TestEmailBuffer_FlushResets(t *testing.T) {
+	var output bytes.Buffer
+	buf := newSyncWriter(&output).newEmailBuffer()
+
+	fmt.Fprintln(buf, "first")
+	buf.Flush()
+	fmt.Fprintln(buf, "second")
+	buf.Flush()
+	buf.Flush()
+
+	if output.String() != "first\nsecond\n" {
+		t.Errorf("Expected each line once, got %q", output.String())
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PostProcessor works on a screenshot once it has been written, before the
+// exec hook runs and the email is archived. path is the screenshot's first
+// (or only) slice. An error fails the email, leaving it in the source folder.
+type PostProcessor interface {
+	Process(ctx context.Context, path string, email Email) error
+}
+
+// PostProcessorFunc adapts an ordinary function to a PostProcessor
+type PostProcessorFunc func(ctx context.Context, path string, email Email) error
+
+// Process calls f(ctx, path, email)
+func (f PostProcessorFunc) Process(ctx context.Context, path string, email Email) error {
+	return f(ctx, path, email)
+}
+
+// sidecarPostProcessor returns a post-processor writing the email's metadata
+// next to the screenshot, naming its mailboxes from mailboxNames
+func sidecarPostProcessor(mailboxNames map[string]string) PostProcessor {
+	return PostProcessorFunc(func(_ context.Context, path string, email Email) error {
+		if err := writeSidecar(path, email, mailboxNames); err != nil {
+			return fmt.Errorf("write sidecar: %w", err)
+		}
+		return nil
+	})
+}
+
+// metadataPostProcessor embeds the email's metadata in the screenshot,
+// leaving formats without metadata support as they are
+var metadataPostProcessor = PostProcessorFunc(func(_ context.Context, path string, email Email) error {
+	if err := embedMetadata(path, email); err != nil && !errors.Is(err, errMetadataUnsupported) {
+		return fmt.Errorf("embed metadata: %w", err)
+	}
+	return nil
+})
+
+// postProcessors returns the built-in post-processors opts enables, followed
+// by opts.PostProcessors in order. Sidecars name mailboxes from mailboxNames.
+func postProcessors(opts ProcessOptions, mailboxNames map[string]string) []PostProcessor {
+	var processors []PostProcessor
+	if opts.Sidecar {
+		processors = append(processors, sidecarPostProcessor(mailboxNames))
+	}
+	if opts.EmbedMetadata {
+		processors = append(processors, metadataPostProcessor)
+	}
+	return append(processors, opts.PostProcessors...)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// recordingPostProcessor records each screenshot it is given
+type recordingPostProcessor struct {
+	paths  []string
+	emails []Email
+}
+
+func (r *recordingPostProcessor) Process(_ context.Context, path string, email Email) error {
+	r.paths = append(r.paths, path)
+	r.emails = append(r.emails, email)
+	return nil
+}
+
+// Test a registered post-processor gets each screenshot's path and email
+func TestProcessEmails_PostProcessor(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+	recorder := &recordingPostProcessor{}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{PostProcessors: []PostProcessor{recorder}}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.ProcessedCount != 1 {
+		t.Errorf("Expected the email processed, got %+v", result)
+	}
+	if len(recorder.paths) != 1 || recorder.paths[0] != generator.generatedScreenshots["email1"] {
+		t.Errorf("Expected path %q, got %v", generator.generatedScreenshots["email1"], recorder.paths)
+	}
+	if len(recorder.emails) != 1 || recorder.emails[0].ID != "email1" || recorder.emails[0].Subject != "Test Email" {
+		t.Errorf("Expected email1, got %+v", recorder.emails)
+	}
+}
+
+// Test a failing post-processor fails the email, which stays in the source
+// folder, and stops later post-processors
+func TestProcessEmails_PostProcessorFails(t *testing.T) {
+	client := newSingleEmailClient()
+	recorder := &recordingPostProcessor{}
+	failing := PostProcessorFunc(func(context.Context, string, Email) error {
+		return errors.New("upload refused")
+	})
+
+	var output bytes.Buffer
+	result, err := processEmails(client, NewMockScreenshotService(), ProcessOptions{PostProcessors: []PostProcessor{failing, recorder}}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.FailedCount != 1 {
+		t.Errorf("Expected the email failed, got %+v", result)
+	}
+	if len(client.moves) != 0 || len(recorder.paths) != 0 {
+		t.Errorf("Expected no moves or later post-processing, got %v, %v", client.moves, recorder.paths)
+	}
+	if !strings.Contains(output.String(), "Post-processing failed: upload refused") {
+		t.Errorf("Expected the failure in the output, got:\n%s", output.String())
+	}
+}
+
+// Test built-in post-processors run first, in a fixed order
+func TestPostProcessors(t *testing.T) {
+	custom := &recordingPostProcessor{}
+	processors := postProcessors(ProcessOptions{Sidecar: true, EmbedMetadata: true, PostProcessors: []PostProcessor{custom}}, nil)
+	if len(processors) != 3 || processors[2] != custom {
+		t.Errorf("Expected sidecar, metadata and the custom post-processor, got %v", processors)
+	}
+	if processors := postProcessors(ProcessOptions{}, nil); len(processors) != 0 {
+		t.Errorf("Expected no post-processors by default, got %v", processors)
+	}
+}
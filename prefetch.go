@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// maxPrefetchBatch caps how many emails are fetched together even when the
+// server allows more in one Email/get, since their bodies come with them and
+// a batch stays in memory until each of its emails has been handled
+const maxPrefetchBatch = 50
+
+// Reasons an email fails to be fetched although the rest of its batch was
+var (
+	errEmailNotFound       = errors.New("Email not found on server (it may have been deleted or moved since the query)")
+	errEmailMissingInBatch = errors.New("Email missing from its batch's Email/get response, though the server didn't report it as not found")
+)
+
+// emailPrefetcher fetches the emails of a run in batches, one Email/get per
+// batch rather than per email. A batch is fetched when the first of its
+// emails is needed and dropped once all of them have been handled. It is
+// safe for concurrent use.
+type emailPrefetcher struct {
+	client    EmailClient
+	emailIDs  []string
+	batchSize int
+
+	mu      sync.Mutex
+	batches map[int]*emailBatch // By batch number
+}
+
+// emailBatch is the fetched result of one batch of emails
+type emailBatch struct {
+	once    sync.Once
+	result  *EmailGetResult
+	byID    map[string]Email
+	err     error // The whole batch failed
+	pending int   // Emails of the batch not yet handled
+}
+
+// newEmailPrefetcher returns a prefetcher for emailIDs in batches of the
+// server's maxObjectsInGet, up to maxPrefetchBatch. With guarded moves every
+// email is fetched on its own, since each move is guarded by the state its
+// email was read at, which a batch read earlier would rarely still match.
+func newEmailPrefetcher(client EmailClient, emailIDs []string, guarded bool) *emailPrefetcher {
+	batchSize := maxPrefetchBatch
+	if limit := clientCapabilities(client).MaxObjectsInGet; limit > 0 {
+		batchSize = min(batchSize, limit)
+	}
+	if guarded {
+		batchSize = 1
+	}
+	return &emailPrefetcher{
+		client:    client,
+		emailIDs:  emailIDs,
+		batchSize: batchSize,
+		batches:   make(map[int]*emailBatch),
+	}
+}
+
+// batch returns batch number n, creating it if needed. f.mu must be held.
+func (f *emailPrefetcher) batch(n int) *emailBatch {
+	b, ok := f.batches[n]
+	if !ok {
+		start := n * f.batchSize
+		b = &emailBatch{pending: min(start+f.batchSize, len(f.emailIDs)) - start}
+		f.batches[n] = b
+	}
+	return b
+}
+
+// get returns the email at index i and the Email state it was read at,
+// fetching its batch first if no other email of it has. An error means only
+// this email couldn't be fetched.
+func (f *emailPrefetcher) get(i int) (Email, string, error) {
+	n := i / f.batchSize
+	f.mu.Lock()
+	b := f.batch(n)
+	f.mu.Unlock()
+	b.once.Do(func() {
+		start := n * f.batchSize
+		end := min(start+f.batchSize, len(f.emailIDs))
+		b.result, b.err = f.client.GetEmails(f.emailIDs[start:end])
+		if b.err == nil {
+			b.byID = b.result.ByID()
+		}
+	})
+
+	emailID := f.emailIDs[i]
+	if b.err != nil {
+		return Email{}, "", fmt.Errorf("Failed to fetch email: %w", b.err)
+	}
+	if b.result.IsNotFound(emailID) {
+		return Email{}, "", errEmailNotFound
+	}
+	if err, ok := b.result.Failed[emailID]; ok {
+		return Email{}, "", fmt.Errorf("Failed to fetch email: %w", err)
+	}
+	email, ok := b.byID[emailID]
+	if !ok {
+		return Email{}, "", errEmailMissingInBatch
+	}
+	return email, b.result.State, nil
+}
+
+// done records that the email at index i has been handled, whether or not it
+// was fetched, dropping its batch once every email of it has been
+func (f *emailPrefetcher) done(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := i / f.batchSize
+	b := f.batch(n)
+	b.pending--
+	if b.pending == 0 {
+		delete(f.batches, n)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// clearLine returns the cursor to the start of the line and erases it
+const clearLine = "\r\033[K"
+
+// progressReporter draws a single, in-place updating progress line with an
+// ETA. A disabled reporter writes nothing.
+type progressReporter struct {
+	w       io.Writer
+	total   int
+	enabled bool
+	start   time.Time
+	now     func() time.Time
+	shown   bool
+}
+
+// newProgressReporter returns a reporter for total emails
+func newProgressReporter(w io.Writer, total int, enabled bool) *progressReporter {
+	return &progressReporter{
+		w:       w,
+		total:   total,
+		enabled: enabled,
+		start:   time.Now(),
+		now:     time.Now,
+	}
+}
+
+// update redraws the progress line after done emails have finished
+func (p *progressReporter) update(done int) {
+	if !p.enabled || p.total == 0 {
+		return
+	}
+
+	percent := done * 100 / p.total
+	line := fmt.Sprintf("[%d/%d] %d%%", done, p.total, percent)
+	if done > 0 && done < p.total {
+		elapsed := p.now().Sub(p.start)
+		remaining := elapsed / time.Duration(done) * time.Duration(p.total-done)
+		line += fmt.Sprintf(" ETA %s", remaining.Round(time.Second))
+	}
+
+	fmt.Fprint(p.w, clearLine+line)
+	p.shown = true
+}
+
+// clear erases the progress line so regular output can be written
+func (p *progressReporter) clear() {
+	if !p.shown {
+		return
+	}
+	fmt.Fprint(p.w, clearLine)
+	p.shown = false
+}
+
+// isTerminal reports whether v, a reader or writer, is a file connected to a
+// terminal
+func isTerminal(v any) bool {
+	f, ok := v.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
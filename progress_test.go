@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test non-terminal output contains no carriage-return progress sequences
+func TestProcessEmails_NoProgressWhenNotTerminal(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, generator, ProcessOptions{}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if strings.Contains(output.String(), "\r") {
+		t.Errorf("Expected no carriage returns in non-TTY output, got %q", output.String())
+	}
+}
+
+// Test the progress line shows counts, percentage and ETA
+func TestProgressReporter_Update(t *testing.T) {
+	var output bytes.Buffer
+	progress := newProgressReporter(&output, 4, true)
+	start := progress.start
+	progress.now = func() time.Time { return start.Add(10 * time.Second) }
+
+	progress.update(1)
+	if !strings.Contains(output.String(), "\r") || !strings.Contains(output.String(), "[1/4] 25% ETA 30s") {
+		t.Errorf("Expected in-place progress with ETA, got %q", output.String())
+	}
+
+	output.Reset()
+	progress.clear()
+	if output.String() != clearLine {
+		t.Errorf("Expected clear sequence, got %q", output.String())
+	}
+
+	output.Reset()
+	progress.clear()
+	if output.Len() != 0 {
+		t.Error("Expected clear to be a no-op when nothing is shown")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// pruneEmptyDirs removes the directories under root that are empty,
+// including those emptied by removing their own empty subdirectories, and
+// returns how many it removed. root itself is kept, files are never touched,
+// and symlinked directories aren't followed.
+func pruneEmptyDirs(root string) (int, error) {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// WalkDir lists a directory before its contents, so going backwards
+	// empties subdirectories before their parents are checked
+	removed := 0
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return removed, err
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := os.Remove(dirs[i]); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// pruneOutputDir removes the empty directories left in the output directory,
+// reporting how many there were
+func pruneOutputDir(outputDir string, output io.Writer) error {
+	dir, err := resolveOutputDir(outputDir)
+	if err != nil {
+		return err
+	}
+	removed, err := pruneEmptyDirs(dir)
+	if removed > 0 {
+		fmt.Fprintf(output, "Removed empty directories from %s: %d\n", dir, removed)
+	}
+	return err
+}
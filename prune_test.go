@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test empty nested directories are removed while directories with files survive
+func TestPruneEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"2025/10/24", "2025/11", "example.com", "empty"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := filepath.Join(root, "example.com", "M1.png")
+	if err := os.WriteFile(kept, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := pruneEmptyDirs(root)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if removed != 5 {
+		t.Errorf("Expected 5 directories removed, got %d", removed)
+	}
+
+	for _, dir := range []string{"2025", "empty"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("Expected the screenshot to survive, got: %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("Expected the output directory itself to be kept, got: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces events evenly so that no more than a fixed number occur
+// per second. It is safe for concurrent use; a nil limiter never blocks.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter allowing rps events per second, or nil
+// (unlimited) when rps is not positive
+func newRateLimiter(rps float64) *rateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+// Wait blocks until the next event is allowed or ctx is done
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	return sleepContext(ctx, wait)
+}
+
+// jitteredDelay returns delay varied at random by up to jitterPercent
+// percent either way, so a fixed cadence doesn't look mechanical
+func jitteredDelay(delay time.Duration, jitterPercent int) time.Duration {
+	if delay <= 0 || jitterPercent <= 0 {
+		return delay
+	}
+	spread := float64(delay) * float64(jitterPercent) / 100
+	return delay + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// sleepContext sleeps for d, returning early with ctx's error if it is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
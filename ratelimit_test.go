@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that requests under a low RPS are spaced out
+func TestRateLimiter_ThrottlesRequests(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Email/query",{"ids":[]},"0"]]}`))
+	})
+	client.limiter = newRateLimiter(20) // one request every 50ms
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, _, err := client.GetEmailsInMailbox("mb1", QueryOptions{}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	if minimum := 4 * 50 * time.Millisecond; elapsed < minimum {
+		t.Errorf("Expected 5 requests to take at least %s, took %s", minimum, elapsed)
+	}
+}
+
+// Test that cancelling the client's context stops a request waiting for the
+// rate limiter without sending it
+func TestRateLimiter_CancelsWaitingRequest(t *testing.T) {
+	var requests atomic.Int32
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"methodResponses":[["Email/query",{"ids":[]},"0"]]}`))
+	})
+	client.limiter = newRateLimiter(0.1) // one request every 10s
+	ctx, cancel := context.WithCancel(context.Background())
+	client.ctx = ctx
+
+	if _, _, err := client.GetEmailsInMailbox("mb1", QueryOptions{}); err != nil {
+		t.Fatalf("Expected the first request to succeed, got: %v", err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err := client.GetEmailsInMailbox("mb1", QueryOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation error, got: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected the request to return promptly after cancellation")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected only the first request sent, got %d", n)
+	}
+}
+
+// Test that Wait returns when the context is cancelled
+func TestRateLimiter_RespectsCancellation(t *testing.T) {
+	limiter := newRateLimiter(0.1) // one event every 10s
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Expected first wait to succeed, got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := limiter.Wait(ctx); err == nil {
+		t.Error("Expected error when context is cancelled")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected Wait to return promptly after cancellation")
+	}
+}
+
+// Test that a zero RPS limiter never blocks
+func TestRateLimiter_Unlimited(t *testing.T) {
+	limiter := newRateLimiter(0)
+	if limiter != nil {
+		t.Fatal("Expected nil limiter for zero RPS")
+	}
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Errorf("Expected nil limiter to never block, got: %v", err)
+	}
+}
+
+// Test jittered delays stay within the jitter either side of the delay
+func TestJitteredDelay(t *testing.T) {
+	if d := jitteredDelay(time.Second, 0); d != time.Second {
+		t.Errorf("Expected no jitter, got %s", d)
+	}
+	for range 100 {
+		if d := jitteredDelay(time.Second, 20); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("Expected a delay within 20%% of 1s, got %s", d)
+		}
+	}
+}
+
+// Test sleepContext returns early when the context is cancelled
+func TestSleepContext_RespectsCancellation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := sleepContext(ctx, 10*time.Second); err == nil {
+		t.Error("Expected an error when the context is cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected sleep to return promptly, took %s", elapsed)
+	}
+}
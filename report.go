@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Report is the machine-readable record of a run written by -report
+type Report struct {
+	Total     int           `json:"total"`
+	Processed int           `json:"processed"`
+	Failed    int           `json:"failed"`
+	Skipped   int           `json:"skipped"`
+	Duplicate int           `json:"duplicate"`
+	Emails    []ReportEmail `json:"emails"`
+
+	// Emails without HTML archived anyway with -archive-unscreenshotted
+	ArchivedWithoutScreenshot int `json:"archivedWithoutScreenshot"`
+	// Emails screenshotted but left in the source folder with -quarantine
+	Quarantined int `json:"quarantined"`
+	// Screenshots identical to the files already there, with -only-with-screenshot-diff
+	Unchanged int `json:"unchanged"`
+	// Emails skipped for already having a screenshot, with -incremental
+	AlreadyScreenshotted int `json:"alreadyScreenshotted"`
+}
+
+// ReportEmail is the outcome of one email in a Report
+type ReportEmail struct {
+	ID         string   `json:"id"`
+	Status     string   `json:"status"`
+	Error      string   `json:"error,omitempty"`      // Why the email failed
+	Screenshot string   `json:"screenshot,omitempty"` // Path of the screenshot written
+	Outputs    []string `json:"outputs,omitempty"`    // Every file written, with extra formats
+	DurationMs int64    `json:"durationMs"`
+}
+
+// String returns the name of the status used in reports
+func (s emailStatus) String() string {
+	switch s {
+	case statusProcessed:
+		return "processed"
+	case statusFailed:
+		return "failed"
+	case statusSkipped:
+		return "skipped"
+	case statusDuplicate:
+		return "duplicate"
+	case statusArchivedWithoutScreenshot:
+		return "archived-without-screenshot"
+	case statusQuarantined:
+		return "quarantined"
+	default:
+		return "unknown"
+	}
+}
+
+// newReport builds the report for result, listing emails in the order they
+// were found
+func newReport(result *ProcessResult) Report {
+	report := Report{
+		Total:     result.TotalCount,
+		Processed: result.ProcessedCount,
+		Failed:    result.FailedCount,
+		Skipped:   result.SkippedCount,
+		Duplicate: result.DuplicateCount,
+		Emails:    []ReportEmail{},
+
+		ArchivedWithoutScreenshot: result.ArchivedWithoutScreenshot,
+		Quarantined:               result.QuarantinedCount,
+		Unchanged:                 result.UnchangedCount,
+		AlreadyScreenshotted:      result.KnownCount,
+	}
+	for _, r := range result.Emails {
+		email := ReportEmail{
+			ID:         r.id,
+			Status:     r.status.String(),
+			Screenshot: r.path,
+			Outputs:    r.outputs,
+			DurationMs: r.duration.Milliseconds(),
+		}
+		if r.err != nil {
+			email.Error = r.err.Error()
+		}
+		report.Emails = append(report.Emails, email)
+	}
+	return report
+}
+
+// writeReport writes the JSON report for result to path
+func writeReport(path string, result *ProcessResult) error {
+	report := newReport(result)
+	return writeAtomic(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	})
+}
+
+// loadFailedEmailIDs reads a report written by -report and returns the IDs
+// of the emails that failed, in report order
+func loadFailedEmailIDs(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report: %w", err)
+	}
+
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("invalid report %s: %w", path, err)
+	}
+
+	var emailIDs []string
+	for _, email := range report.Emails {
+		if email.Error != "" {
+			emailIDs = append(emailIDs, email.ID)
+		}
+	}
+	return emailIDs, nil
+}
+
+// retryEmails keeps the emails from a previous report that are still in the
+// source mailbox, noting on output any that have gone
+func retryEmails(client EmailClient, sourceMailbox *Mailbox, emailIDs []string, output io.Writer) ([]string, error) {
+	fmt.Fprintf(output, "Retrying %d failed email(s) from the report\n", len(emailIDs))
+	if len(emailIDs) == 0 {
+		return nil, nil
+	}
+
+	result, err := client.GetEmails(emailIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	inSource := make(map[string]bool, len(result.List))
+	for _, email := range result.List {
+		inSource[email.ID] = email.MailboxIds[sourceMailbox.ID]
+	}
+
+	// Emails that couldn't be checked are retried anyway; processing
+	// fetches each again
+	var retryIDs []string
+	for _, emailID := range emailIDs {
+		if !inSource[emailID] && result.Failed[emailID] == nil {
+			fmt.Fprintf(output, "  ↷ %s is no longer in folder '%s', skipping\n", emailID, sourceMailbox.Name)
+			continue
+		}
+		retryIDs = append(retryIDs, emailID)
+	}
+	return retryIDs, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the report lists each email's status and error, and the failed IDs
+// can be read back from it
+func TestWriteReport(t *testing.T) {
+	result := &ProcessResult{
+		TotalCount:     2,
+		ProcessedCount: 1,
+		FailedCount:    1,
+		Emails: []emailResult{
+			{id: "a", status: statusFailed, err: errors.New("No HTML content found"), duration: 5 * time.Millisecond},
+			{id: "b", status: statusProcessed, path: "shots/b.png", duration: 1500 * time.Millisecond},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := writeReport(path, result); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Invalid report JSON: %v", err)
+	}
+	expected := []ReportEmail{
+		{ID: "a", Status: "failed", Error: "No HTML content found", DurationMs: 5},
+		{ID: "b", Status: "processed", Screenshot: "shots/b.png", DurationMs: 1500},
+	}
+	if report.Total != 2 || report.Failed != 1 || len(report.Emails) != 2 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	for i, email := range expected {
+		if !reflect.DeepEqual(report.Emails[i], email) {
+			t.Errorf("Expected email %+v, got %+v", email, report.Emails[i])
+		}
+	}
+
+	failed, err := loadFailedEmailIDs(path)
+	if err != nil || len(failed) != 1 || failed[0] != "a" {
+		t.Errorf("Expected failed IDs [a], got %v, %v", failed, err)
+	}
+}
+
+// Test retrying a report reprocesses only the failed email, skipping failures
+// no longer in the source folder
+func TestProcessEmails_RetryReport(t *testing.T) {
+	client := newSingleEmailClient()
+	addHTMLEmail(client, "email2", "<p>Two</p>")
+	addHTMLEmail(client, "email3", "<p>Three</p>")
+	for _, id := range []string{"email1", "email2"} {
+		email := client.emailDetails[id]
+		email.MailboxIds = map[string]bool{"src-123": true}
+		client.emailDetails[id] = email
+	}
+	email3 := client.emailDetails["email3"]
+	email3.MailboxIds = map[string]bool{"inbox": true}
+	client.emailDetails["email3"] = email3
+	generator := NewMockScreenshotService()
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	report := `{"emails": [
+		{"id": "email1", "status": "failed", "error": "Failed to generate screenshot: timeout"},
+		{"id": "email2", "status": "processed"},
+		{"id": "email3", "status": "failed", "error": "Failed to move email to archive: forbidden"}
+	]}`
+	if err := os.WriteFile(path, []byte(report), 0644); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	retryIDs, err := loadFailedEmailIDs(path)
+	if err != nil {
+		t.Fatalf("Failed to load report: %v", err)
+	}
+
+	var output bytes.Buffer
+	result, err := processEmails(client, generator, ProcessOptions{RetryIDs: retryIDs}, &output)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if result.TotalCount != 1 || result.ProcessedCount != 1 {
+		t.Errorf("Expected only email1 processed, got %+v", result)
+	}
+	if _, ok := generator.generatedScreenshots["email1"]; !ok || len(generator.generatedScreenshots) != 1 {
+		t.Errorf("Expected only email1 screenshotted, got %v", generator.generatedScreenshots)
+	}
+	if len(client.moves) != 1 || client.moves[0].emailID != "email1" {
+		t.Errorf("Expected only email1 moved, got %v", client.moves)
+	}
+	if !strings.Contains(output.String(), "email3 is no longer in folder '_aar'") {
+		t.Errorf("Expected email3 to be skipped, got:\n%s", output.String())
+	}
+}
+
+// Test an unreadable report is rejected
+func TestLoadFailedEmailIDs_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	if _, err := loadFailedEmailIDs(path); err == nil {
+		t.Error("Expected error for a missing report")
+	}
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	if _, err := loadFailedEmailIDs(path); err == nil {
+		t.Error("Expected error for an invalid report")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// SenderRule routes emails from senders matching Pattern to the Mailbox archive
+type SenderRule struct {
+	Pattern string
+	Mailbox string // Mailbox name or role:<role>
+}
+
+// loadRules reads sender rules from a file
+func loadRules(filename string) ([]SenderRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %w", err)
+	}
+	defer f.Close()
+
+	return parseRules(f)
+}
+
+// parseRules parses sender rules, one per line in the form "<pattern> <mailbox>".
+// Blank lines and lines starting with # are ignored. The mailbox may contain spaces.
+func parseRules(r io.Reader) ([]SenderRule, error) {
+	var rules []SenderRule
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i < 0 || strings.TrimSpace(line[i:]) == "" {
+			return nil, fmt.Errorf("invalid rule on line %d: expected '<pattern> <mailbox>'", lineNum)
+		}
+		pattern, mailbox := line[:i], strings.TrimSpace(line[i:])
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern on line %d: %w", lineNum, err)
+		}
+
+		rules = append(rules, SenderRule{Pattern: pattern, Mailbox: mailbox})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// matchSender reports whether a sender address matches pattern. Patterns
+// containing @ are matched against the full address (with * and ? globs);
+// other patterns are matched against the domain, including subdomains, so
+// "example.com" matches both news@example.com and news@mail.example.com.
+func matchSender(pattern, address string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	address = strings.ToLower(strings.TrimSpace(address))
+	if pattern == "" || address == "" {
+		return false
+	}
+
+	if strings.Contains(pattern, "@") {
+		matched, _ := path.Match(pattern, address)
+		return matched
+	}
+
+	_, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return false
+	}
+	if matched, _ := path.Match(pattern, domain); matched {
+		return true
+	}
+	return strings.HasSuffix(domain, "."+pattern)
+}
+
+// senderDomain returns the lowercased domain of a sender address, or
+// "unknown" if it has none
+func senderDomain(address string) string {
+	_, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(address)), "@")
+	if !ok || domain == "" {
+		return "unknown"
+	}
+	return domain
+}
+
+// senderDir returns the directory name for a sender's domain with -sender-dirs:
+// the domain reduced to letters, digits, dots and hyphens, or "unknown"
+func senderDir(address string) string {
+	dir := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, senderDomain(address))
+	// Dots at either end could make "." or ".."
+	dir = strings.Trim(dir, ".-")
+	if dir == "" {
+		return "unknown"
+	}
+	return dir
+}
+
+// matchRule returns the first rule whose pattern matches address
+func matchRule(rules []SenderRule, address string) (SenderRule, bool) {
+	for _, rule := range rules {
+		if matchSender(rule.Pattern, address) {
+			return rule, true
+		}
+	}
+	return SenderRule{}, false
+}
+
+// SenderFilter selects which senders are processed. When Allow is non-empty
+// only matching senders pass; senders matching Deny are then excluded.
+type SenderFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// IsZero reports whether the filter has no patterns and so allows everything
+func (f SenderFilter) IsZero() bool {
+	return len(f.Allow) == 0 && len(f.Deny) == 0
+}
+
+// Allows reports whether a sender address passes the filter
+func (f SenderFilter) Allows(address string) bool {
+	if len(f.Allow) > 0 && !matchAny(f.Allow, address) {
+		return false
+	}
+	return !matchAny(f.Deny, address)
+}
+
+// matchAny reports whether address matches any of patterns
+func matchAny(patterns []string, address string) bool {
+	for _, pattern := range patterns {
+		if matchSender(pattern, address) {
+			return true
+		}
+	}
+	return false
+}
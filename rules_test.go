@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test parsing of a rules file
+func TestParseRules(t *testing.T) {
+	input := `# finance senders
+*@mybank.com   _aar_finance
+
+example.org	Newsletters Archive
+`
+	rules, err := parseRules(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := []SenderRule{
+		{Pattern: "*@mybank.com", Mailbox: "_aar_finance"},
+		{Pattern: "example.org", Mailbox: "Newsletters Archive"},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("Expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("Rule %d: expected %+v, got %+v", i, expected[i], rules[i])
+		}
+	}
+
+	if _, err := parseRules(strings.NewReader("lonely-pattern\n")); err == nil {
+		t.Error("Expected error for rule without mailbox")
+	}
+}
+
+// Test sender pattern matching
+func TestMatchSender(t *testing.T) {
+	tests := []struct {
+		pattern string
+		address string
+		want    bool
+	}{
+		{"news@example.com", "News@Example.com", true},
+		{"*@example.com", "anyone@example.com", true},
+		{"*@example.com", "anyone@mail.example.com", false},
+		{"example.com", "anyone@example.com", true},
+		{"example.com", "anyone@mail.example.com", true},
+		{"example.com", "anyone@notexample.com", false},
+		{"*.example.com", "anyone@mail.example.com", true},
+		{"example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchSender(tt.pattern, tt.address); got != tt.want {
+			t.Errorf("matchSender(%q, %q) = %v, want %v", tt.pattern, tt.address, got, tt.want)
+		}
+	}
+}
+
+// Test sender allow/deny filtering
+func TestSenderFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  SenderFilter
+		allowed []string
+		denied  []string
+	}{
+		{
+			name:    "allow only",
+			filter:  SenderFilter{Allow: splitList("substack.com, news@example.com")},
+			allowed: []string{"writer@substack.com", "news@example.com"},
+			denied:  []string{"other@example.com", "spam@elsewhere.net", ""},
+		},
+		{
+			name:    "deny only",
+			filter:  SenderFilter{Deny: splitList("*@marketing.example.com")},
+			allowed: []string{"news@example.com", ""},
+			denied:  []string{"promo@marketing.example.com"},
+		},
+		{
+			name: "allow then deny",
+			filter: SenderFilter{
+				Allow: splitList("example.com"),
+				Deny:  splitList("promo@example.com"),
+			},
+			allowed: []string{"news@example.com", "news@mail.example.com"},
+			denied:  []string{"promo@example.com", "news@other.org"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, address := range tt.allowed {
+				if !tt.filter.Allows(address) {
+					t.Errorf("Expected %q to be allowed", address)
+				}
+			}
+			for _, address := range tt.denied {
+				if tt.filter.Allows(address) {
+					t.Errorf("Expected %q to be denied", address)
+				}
+			}
+		})
+	}
+}
+
+// Test sender domains become safe directory names
+func TestSenderDir(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"news@Substack.com", "substack.com"},
+		{"", "unknown"},
+		{"no-at-sign", "unknown"},
+		{"x@..", "unknown"},
+		{"x@../../etc", "etc"},
+		{"x@mail_server.example.com", "mail-server.example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := senderDir(tt.address); got != tt.want {
+			t.Errorf("senderDir(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeJMAPServer serves a JMAP session and the methods a run uses, with the
+// given mailboxes (name -> ID) and the emails in the source folder
+func fakeJMAPServer(t *testing.T, mailboxes map[string]string, emails []Email) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"apiUrl":          server.URL + "/api",
+				"primaryAccounts": map[string]string{"urn:ietf:params:jmap:mail": "acc1"},
+			})
+			return
+		}
+
+		var request struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Invalid request: %v", err)
+			return
+		}
+
+		var responses []interface{}
+		for _, call := range request.MethodCalls {
+			var method, callID string
+			var args struct {
+				Filter struct {
+					Name string `json:"name"`
+				} `json:"filter"`
+			}
+			json.Unmarshal(call[0], &method)
+			json.Unmarshal(call[1], &args)
+			json.Unmarshal(call[2], &callID)
+
+			var result interface{}
+			switch method {
+			case "Mailbox/query":
+				ids := []string{}
+				if id, ok := mailboxes[args.Filter.Name]; ok {
+					ids = append(ids, id)
+				}
+				result = map[string]interface{}{"ids": ids}
+			case "Mailbox/get":
+				// Answers the preceding Mailbox/query by back-reference
+				var list []Mailbox
+				for _, previous := range responses {
+					for _, id := range previous.([]interface{})[1].(map[string]interface{})["ids"].([]string) {
+						for name, mailboxID := range mailboxes {
+							if mailboxID == id {
+								list = append(list, Mailbox{ID: id, Name: name})
+							}
+						}
+					}
+				}
+				result = map[string]interface{}{"list": list}
+			case "Email/query":
+				ids := []string{}
+				for _, email := range emails {
+					ids = append(ids, email.ID)
+				}
+				result = map[string]interface{}{"ids": ids}
+			case "Email/get":
+				result = map[string]interface{}{"state": "s1", "list": emails}
+			case "Email/set":
+				result = map[string]interface{}{"updated": map[string]interface{}{}}
+			default:
+				t.Errorf("Unexpected method %s", method)
+			}
+			responses = append(responses, []interface{}{method, result, callID})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"methodResponses": responses})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Test run returns a distinct exit code for each category of failure
+func TestRun_ExitCodes(t *testing.T) {
+	folders := map[string]string{sourceFolder: "src", archiveFolder: "arch"}
+	noHTML := []Email{{ID: "M1", Subject: "Plain text only"}}
+
+	tests := []struct {
+		name     string
+		args     []string
+		server   func(t *testing.T) *httptest.Server
+		expected int
+	}{
+		{
+			name:     "invalid flags",
+			args:     []string{"-no-move", "-copy"},
+			expected: exitConfig,
+		},
+		{
+			name:     "name by hash with incremental",
+			args:     []string{"-name-by-hash", "-incremental"},
+			expected: exitConfig,
+		},
+		{
+			name:     "interactive without a terminal",
+			args:     []string{"-interactive"},
+			expected: exitConfig,
+		},
+		{
+			name: "rejected credentials",
+			server: func(t *testing.T) *httptest.Server {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "invalid token", http.StatusUnauthorized)
+				}))
+				t.Cleanup(server.Close)
+				return server
+			},
+			expected: exitAuth,
+		},
+		{
+			name: "missing folder",
+			server: func(t *testing.T) *httptest.Server {
+				return fakeJMAPServer(t, map[string]string{archiveFolder: "arch"}, nil)
+			},
+			expected: exitConfig,
+		},
+		{
+			name: "email failed",
+			server: func(t *testing.T) *httptest.Server {
+				return fakeJMAPServer(t, folders, noHTML)
+			},
+			expected: exitEmailsFailed,
+		},
+		{
+			name: "success",
+			server: func(t *testing.T) *httptest.Server {
+				return fakeJMAPServer(t, folders, noHTML)
+			},
+			args:     []string{"-dry-run"},
+			expected: exitOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FASTMAIL_AAR_KEY", "test-key")
+			args := append([]string{"-output-dir", t.TempDir()}, tt.args...)
+			if tt.server != nil {
+				args = append(args, "-session-url", tt.server(t).URL)
+			}
+
+			var stdout, stderr bytes.Buffer
+			if code := run(args, nil, &stdout, &stderr); code != tt.expected {
+				t.Errorf("Expected exit code %d, got %d\n%s", tt.expected, code, stderr.String())
+			}
+		})
+	}
+}
+
+// Test run wires flags into the client, generator and processing options,
+// using fakes in place of the JMAP client and Chrome
+func TestRun_WithFakes(t *testing.T) {
+	client := newSingleEmailClient()
+	generator := NewMockScreenshotService()
+
+	var clientOpts ClientOptions
+	var outputDir string
+	oldClient, oldGenerator := newEmailClient, newScreenshotService
+	t.Cleanup(func() { newEmailClient, newScreenshotService = oldClient, oldGenerator })
+	newEmailClient = func(opts ClientOptions) (EmailClient, error) {
+		clientOpts = opts
+		return client, nil
+	}
+	newScreenshotService = func(dir string, opts ScreenshotOptions) (ScreenshotService, error) {
+		outputDir = dir
+		return generator, nil
+	}
+
+	t.Setenv("FASTMAIL_AAR_KEY", "test-key")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-output-dir", "shots", "-capability", "urn:x", "-no-move"}, nil, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d\n%s", exitOK, code, stderr.String())
+	}
+
+	if outputDir != "shots" || len(clientOpts.Capabilities) != 1 || clientOpts.Capabilities[0] != "urn:x" {
+		t.Errorf("Expected flags passed to constructors, got dir %q and %+v", outputDir, clientOpts)
+	}
+	if len(client.moves) != 0 {
+		t.Errorf("Expected -no-move to leave the email, got moves %v", client.moves)
+	}
+	for _, line := range []string{"Total emails: 1", "Successfully processed: 1", "Failed: 0", "average per email"} {
+		if !strings.Contains(stdout.String(), line) {
+			t.Errorf("Expected summary line %q, got:\n%s", line, stdout.String())
+		}
+	}
+}
+
+// Test an unknown flag is a configuration error reported on stderr
+func TestRun_UnknownFlag(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-no-such-flag"}, nil, &stdout, &stderr); code != exitConfig {
+		t.Errorf("Expected exit code %d, got %d", exitConfig, code)
+	}
+	if !strings.Contains(stderr.String(), "no-such-flag") || !strings.Contains(stderr.String(), "Exit codes:") {
+		t.Errorf("Expected the error and usage on stderr, got: %s", stderr.String())
+	}
+}
+
+// Test JMAP errors map to exit codes
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{nil, exitOK},
+		{&StatusError{StatusCode: http.StatusForbidden}, exitAuth},
+		{&JMAPError{Type: "accountReadOnly"}, exitAuth},
+		{&MailboxNotFoundError{Role: "archive"}, exitConfig},
+		{fmt.Errorf("authentication failed: %w", &AccountNotFoundError{Account: "work"}), exitConfig},
+		{&StatusError{StatusCode: http.StatusBadGateway}, exitError},
+	}
+
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.expected {
+			t.Errorf("exitCode(%v) = %d, expected %d", tt.err, got, tt.expected)
+		}
+	}
+}
@@ -2,42 +2,407 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 )
 
+// Capture modes
+const (
+	CaptureFull     = "full"     // Entire scrollable page
+	CaptureViewport = "viewport" // Only the emulated viewport ("above the fold")
+)
+
+// Color schemes, the prefers-color-scheme media feature emulated in Chrome
+const (
+	ColorSchemeLight = "light" // Chrome's default; the email's regular styles
+	ColorSchemeDark  = "dark"  // Triggers the email's dark-mode styles, if any
+)
+
+// Image formats
+const (
+	FormatPNG  = "png"
+	FormatWebP = "webp" // Encoded by Chrome; lossy, with Quality
+	FormatPDF  = "pdf"  // Printed by Chrome, paginated, with the PDF options
+)
+
+// pdfPageSizes are the paper sizes for -pdf-page-size, in inches (portrait)
+var pdfPageSizes = map[string][2]float64{
+	"letter": {8.5, 11},
+	"legal":  {8.5, 14},
+	"a4":     {8.27, 11.69},
+	"a3":     {11.69, 16.54},
+}
+
+// localePattern matches a BCP 47 language tag such as "en", "en-GB" or
+// "zh-Hant-TW", loosely: Chrome falls back for subtags it doesn't know
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// Defaults for PDF output
+const (
+	defaultPDFPageSize = "letter"
+	defaultPDFMargin   = 0.4 // Inches; Chrome's own default of about 1cm
+)
+
+// defaultWebPQuality is used when Quality is not set
+const defaultWebPQuality = 90
+
+// ScreenshotOptions configures screenshot rendering
+type ScreenshotOptions struct {
+	Width   int
+	Height  int
+	Capture string // CaptureFull (default) or CaptureViewport
+
+	// Format is FormatPNG (default), FormatWebP or FormatPDF; Quality
+	// (1-100) applies to WebP
+	Format  string
+	Quality int
+
+	// ExtraFormats are further formats written from the same page load,
+	// next to the screenshot under its name with their own extension.
+	// Thumbnails, optimization and post-processing apply to Format only.
+	ExtraFormats []string
+
+	// With FormatPDF, the paper size (a key of pdfPageSizes, default
+	// letter), the margin on every side in inches, and the orientation.
+	// Other formats ignore them.
+	PDFPageSize  string
+	PDFMargin    float64
+	PDFLandscape bool
+
+	// BackgroundColor is a CSS color for the page background. "transparent"
+	// removes the browser's default white so the email's own background shows.
+	BackgroundColor string
+	FontFamily      string
+
+	// MatchBackground paints the page in the computed background color of
+	// the email's outer element, once loaded, so margins and transparent
+	// regions match it; BackgroundColor applies when it has none
+	MatchBackground bool
+
+	// ColorScheme is ColorSchemeLight (default) or ColorSchemeDark, which
+	// emulates prefers-color-scheme: dark and darkens the page's default
+	// background and text to match
+	ColorScheme string
+
+	// Timezone is an IANA time zone, such as "Europe/London", and Locale a
+	// language tag, such as "en-GB", that the page's scripts see in place of
+	// the system's; empty leaves the system setting
+	Timezone string
+	Locale   string
+
+	// ThumbnailWidth, when positive, also writes a <basename>.thumb.png
+	// scaled down to this width
+	ThumbnailWidth int
+
+	// ClipSelector, when set, captures only the bounding box of the first
+	// element matching this CSS selector, falling back to Capture if none does
+	ClipSelector string
+
+	// MaxHeight, when positive, limits the height of a single image. Taller
+	// content is cut off at MaxHeight, or with Split, captured as successive
+	// slices written as <basename>.png, <basename>.2.png, <basename>.3.png...
+	MaxHeight int
+	Split     bool
+
+	// AutoWidth resizes the viewport to the email's natural content width,
+	// bounded by MinWidth and MaxWidth, before capturing
+	AutoWidth bool
+	MinWidth  int
+	MaxWidth  int
+
+	// MetaViewport sets each email's viewport to the width its
+	// <meta name="viewport"> declares, bounded by MinWidth and MaxWidth,
+	// keeping Width for emails that don't declare one
+	MetaViewport bool
+
+	// Widths, when set, captures the page at each of these viewport widths
+	// in turn from one page load, instead of at Width, writing each under
+	// the screenshot's name suffixed with the width, e.g. <basename>-375.png
+	Widths []int
+
+	// SaveHTML also writes the wrapped HTML document rendered by Chrome to
+	// <basename>.html, for debugging rendering problems
+	SaveHTML bool
+
+	// Optimize re-encodes each PNG at the best compression level, trading
+	// some CPU for smaller files
+	Optimize bool
+
+	// ChromePath runs this Chrome executable instead of the one found on
+	// the PATH, and ChromeFlags adds command-line switches such as
+	// --no-sandbox to chromedp's defaults
+	ChromePath  string
+	ChromeFlags []string
+
+	// NameByHash names each screenshot after a hash of its HTML instead of
+	// its time and email ID, and doesn't render HTML already captured under
+	// that name
+	NameByHash bool
+
+	// StripTrackers removes tracking pixels and hidden beacon images from
+	// the HTML before it is rendered
+	StripTrackers bool
+
+	// ImageProxy routes the browser's requests, such as remote images,
+	// through this proxy (http, https, socks4 or socks5 URL) by adding
+	// --proxy-server to ChromeFlags
+	ImageProxy string
+
+	// SkipUnchanged leaves a file already at an output path as it is when
+	// the new capture is identical, so reprocessing an email doesn't rewrite
+	// it. ComparePixels compares decoded images rather than their bytes.
+	SkipUnchanged bool
+	ComparePixels bool
+
+	// DebugLog receives measurement details such as the clip region, one
+	// line each, when set
+	DebugLog io.Writer
+}
+
 // ScreenshotGenerator handles screenshot generation
 type ScreenshotGenerator struct {
 	outputDir string
-	width     int
-	height    int
+	opts      ScreenshotOptions
+
+	// capture loads a full HTML document once and renders it at each of
+	// widths() in each of formats() in turn; replaced in tests. The error is
+	// for the page itself, which fails every rendering.
+	capture func(fullHTML string) ([]rendering, error)
+
+	browser   *chromeBrowser // Shared by every capture, each in its own tab
+	unchanged *atomic.Int64  // Screenshots left as they were, with SkipUnchanged
+}
+
+// rendering is a page rendered in one format: one image per slice (just one
+// unless MaxHeight and Split are set, and always one for a PDF), or why the
+// format failed
+type rendering struct {
+	images [][]byte
+	err    error
+}
+
+// permanentError marks a screenshot failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// isPermanent reports whether err is a screenshot failure that should not be retried
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
 }
 
 // NewScreenshotGenerator creates a new screenshot generator
-func NewScreenshotGenerator(outputDir string, width, height int) (*ScreenshotGenerator, error) {
-	// Create output directory if it doesn't exist
+func NewScreenshotGenerator(outputDir string, opts ScreenshotOptions) (*ScreenshotGenerator, error) {
+	if opts.BackgroundColor != "" {
+		if err := validateCSSColor(opts.BackgroundColor); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FontFamily != "" {
+		if err := validateFontFamily(opts.FontFamily); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Split && opts.MaxHeight <= 0 {
+		return nil, errors.New("splitting requires a positive maximum height")
+	}
+	if (opts.AutoWidth || opts.MetaViewport) && (opts.MinWidth <= 0 || opts.MaxWidth < opts.MinWidth) {
+		return nil, fmt.Errorf("invalid auto-width bounds %d-%d", opts.MinWidth, opts.MaxWidth)
+	}
+	if len(opts.Widths) > 0 && opts.AutoWidth {
+		return nil, errors.New("a list of widths can't be combined with auto-width")
+	}
+	if opts.MetaViewport && (opts.AutoWidth || len(opts.Widths) > 0) {
+		return nil, errors.New("the meta viewport width can't be combined with auto-width or a list of widths")
+	}
+	for i, width := range opts.Widths {
+		if width <= 0 {
+			return nil, fmt.Errorf("invalid width %d", width)
+		}
+		if slices.Contains(opts.Widths[:i], width) {
+			return nil, fmt.Errorf("width %d is listed twice", width)
+		}
+	}
+
+	if opts.Format == "" {
+		opts.Format = FormatPNG
+	}
+	seenFormats := make(map[string]bool)
+	for _, format := range append([]string{opts.Format}, opts.ExtraFormats...) {
+		if seenFormats[format] {
+			return nil, fmt.Errorf("format %s is listed more than once", format)
+		}
+		seenFormats[format] = true
+
+		switch format {
+		case FormatPNG:
+		case FormatWebP:
+			if opts.Quality == 0 {
+				opts.Quality = defaultWebPQuality
+			}
+			if opts.Quality < 1 || opts.Quality > 100 {
+				return nil, fmt.Errorf("invalid quality %d (expected 1-100)", opts.Quality)
+			}
+		case FormatPDF:
+			if opts.PDFPageSize == "" {
+				opts.PDFPageSize = defaultPDFPageSize
+			}
+			opts.PDFPageSize = strings.ToLower(opts.PDFPageSize)
+			size, ok := pdfPageSizes[opts.PDFPageSize]
+			if !ok {
+				return nil, fmt.Errorf("invalid PDF page size %q (expected letter, legal, a4 or a3)", opts.PDFPageSize)
+			}
+			if opts.PDFMargin < 0 || opts.PDFMargin*2 >= min(size[0], size[1]) {
+				return nil, fmt.Errorf("invalid PDF margin %g (expected 0 to under half the page width)", opts.PDFMargin)
+			}
+			// A PDF is paginated rather than clipped to a region
+			if opts.Capture == CaptureViewport || opts.ClipSelector != "" || opts.MaxHeight > 0 {
+				return nil, errors.New("viewport capture, clip selectors and maximum heights don't apply to pdf format")
+			}
+		default:
+			return nil, fmt.Errorf("invalid format %q (expected %s, %s or %s)", format, FormatPNG, FormatWebP, FormatPDF)
+		}
+	}
+	// Thumbnails and optimization re-encode the image, which needs a PNG
+	if opts.Format != FormatPNG && (opts.ThumbnailWidth > 0 || opts.Optimize) {
+		return nil, errors.New("thumbnails and optimization require png format")
+	}
+
+	if opts.ImageProxy != "" {
+		proxyFlag, err := proxyServerFlag(opts.ImageProxy)
+		if err != nil {
+			return nil, err
+		}
+		opts.ChromeFlags = append(slices.Clone(opts.ChromeFlags), proxyFlag)
+	}
+	for _, chromeFlag := range opts.ChromeFlags {
+		if _, _, err := parseChromeFlag(chromeFlag); err != nil {
+			return nil, err
+		}
+	}
+
+	switch opts.ColorScheme {
+	case "":
+		opts.ColorScheme = ColorSchemeLight
+	case ColorSchemeLight, ColorSchemeDark:
+	default:
+		return nil, fmt.Errorf("invalid color scheme %q (expected %s or %s)", opts.ColorScheme, ColorSchemeLight, ColorSchemeDark)
+	}
+	if opts.Timezone != "" {
+		// "Local" would load, but means nothing to Chrome
+		if _, err := time.LoadLocation(opts.Timezone); err != nil || opts.Timezone == "Local" {
+			return nil, fmt.Errorf("invalid timezone %q (expected an IANA time zone such as Europe/London)", opts.Timezone)
+		}
+	}
+	if opts.Locale != "" && !localePattern.MatchString(opts.Locale) {
+		return nil, fmt.Errorf("invalid locale %q (expected a language tag such as en-GB)", opts.Locale)
+	}
+
+	switch opts.Capture {
+	case "":
+		opts.Capture = CaptureFull
+	case CaptureFull, CaptureViewport:
+	default:
+		return nil, fmt.Errorf("invalid capture mode %q (expected %s or %s)", opts.Capture, CaptureFull, CaptureViewport)
+	}
+
+	outputDir, err := resolveOutputDir(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create output directory (and any parents) if it doesn't exist
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	return &ScreenshotGenerator{
+	generator := &ScreenshotGenerator{
 		outputDir: outputDir,
-		width:     width,
-		height:    height,
-	}, nil
+		opts:      opts,
+		browser:   new(chromeBrowser),
+		unchanged: new(atomic.Int64),
+	}
+	generator.capture = generator.chromeCapture
+	return generator, nil
+}
+
+// resolveOutputDir expands a leading ~ to the user's home directory and makes dir absolute
+func resolveOutputDir(dir string) (string, error) {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to expand home directory: %w", err)
+		}
+		dir = filepath.Join(home, dir[1:])
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+	return absDir, nil
+}
+
+// hashNameLength is how many hex digits of the content hash name a
+// screenshot with NameByHash: 64 bits, so a collision between different
+// content needs billions of screenshots to become likely
+const hashNameLength = 16
+
+// outputDirFor returns the directory screenshots go in: subdir of the output
+// directory (created if need be) when it is set
+func (s *ScreenshotGenerator) outputDirFor(subdir string) (string, error) {
+	if subdir == "" {
+		return s.outputDir, nil
+	}
+	if !filepath.IsLocal(subdir) {
+		return "", &permanentError{fmt.Errorf("invalid screenshot subdirectory %q", subdir)}
+	}
+	dir := filepath.Join(s.outputDir, subdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create screenshot subdirectory: %w", err)
+	}
+	return dir, nil
+}
+
+// hashedPath returns the screenshot path named after htmlContent's hash,
+// in subdir of the output directory when it is set
+func (s *ScreenshotGenerator) hashedPath(subdir, htmlContent string) (string, error) {
+	dir, err := s.outputDirFor(subdir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, contentHash(htmlContent)[:hashNameLength]+s.extension()), nil
 }
 
-// GenerateScreenshot creates a screenshot from HTML content
-func (s *ScreenshotGenerator) GenerateScreenshot(timestamp, emailID, htmlContent string) (string, error) {
+// outputPath returns the screenshot path for an email received at timestamp,
+// in subdir of the output directory (created if need be) when it is set
+func (s *ScreenshotGenerator) outputPath(subdir, timestamp, emailID string) (string, error) {
 	// Parse the timestamp (in UTC)
 	t, err := time.Parse(time.RFC3339, timestamp)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse timestamp: %w", err)
+		return "", &permanentError{fmt.Errorf("failed to parse timestamp: %w", err)}
 	}
 
 	// Convert to New York timezone
@@ -50,59 +415,886 @@ func (s *ScreenshotGenerator) GenerateScreenshot(timestamp, emailID, htmlContent
 	// Format timestamp as yyyy-mm-dd-hh-mm-ss in New York time
 	formattedTime := nyTime.Format("2006-01-02-15-04-05")
 
+	dir, err := s.outputDirFor(subdir)
+	if err != nil {
+		return "", err
+	}
+
 	// Create output filename with timestamp and email ID
-	outputPath := filepath.Join(s.outputDir, fmt.Sprintf("%s-%s.png", formattedTime, emailID))
+	return filepath.Join(dir, fmt.Sprintf("%s-%s%s", formattedTime, emailID, s.extension())), nil
+}
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// formats returns every format rendered, Format first
+func (s *ScreenshotGenerator) formats() []string {
+	return append([]string{s.opts.Format}, s.opts.ExtraFormats...)
+}
+
+// OutputPaths returns every file written for the screenshot at
+// screenshotPath: the screenshot itself, then one per extra format, and with
+// Widths the same again for each further width
+func (s *ScreenshotGenerator) OutputPaths(screenshotPath string) []string {
+	base := screenshotPath
+	if len(s.opts.Widths) > 0 {
+		suffix := fmt.Sprintf("-%d", s.opts.Widths[0])
+		base = strings.TrimSuffix(trimExtension(screenshotPath), suffix) + filepath.Ext(screenshotPath)
+	}
+
+	var paths []string
+	for _, path := range s.widthPaths(base) {
+		paths = append(paths, path)
+		for _, format := range s.opts.ExtraFormats {
+			paths = append(paths, trimExtension(path)+formatExtension(format))
+		}
+	}
+	return paths
+}
+
+// extension returns the file extension for the configured image format
+func (s *ScreenshotGenerator) extension() string {
+	return formatExtension(s.opts.Format)
+}
 
-	// Create chromedp context
-	allocCtx, allocCancel := chromedp.NewContext(ctx)
-	defer allocCancel()
+// formatExtension returns the file extension for an output format
+func formatExtension(format string) string {
+	switch format {
+	case FormatWebP:
+		return ".webp"
+	case FormatPDF:
+		return ".pdf"
+	default:
+		return ".png"
+	}
+}
+
+// HasScreenshot reports whether a screenshot for emailID already exists in
+// the output directory or one of its subdirectories (such as -sender-dirs)
+func (s *ScreenshotGenerator) HasScreenshot(emailID string) bool {
+	name := filepath.Base(s.widthPaths("*-" + emailID + s.extension())[0])
+	for _, pattern := range []string{filepath.Join(s.outputDir, name), filepath.Join(s.outputDir, "*", name)} {
+		if matches, err := filepath.Glob(pattern); err == nil && len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ExistingScreenshot returns the screenshot already captured for htmlContent
+// in subdir, if there is one. Only hash names tie a file to content, so
+// without NameByHash there never is.
+func (s *ScreenshotGenerator) ExistingScreenshot(subdir, htmlContent string) (string, bool) {
+	if !s.opts.NameByHash {
+		return "", false
+	}
+	path, err := s.hashedPath(subdir, htmlContent)
+	if err != nil {
+		return "", false
+	}
+	existing := s.widthPaths(path)[0]
+	if _, err := os.Stat(existing); err != nil {
+		return "", false
+	}
+	return existing, true
+}
+
+// RenderHTML returns the full HTML document that GenerateScreenshot would
+// render for htmlContent
+func (s *ScreenshotGenerator) RenderHTML(htmlContent string) string {
+	if s.opts.StripTrackers {
+		var removed int
+		htmlContent, removed = stripTrackers(htmlContent)
+		s.debugf("removed %d tracking image(s)", removed)
+	}
+	return wrapHTML(htmlContent, s.wrapperStyle())
+}
+
+// wrapperStyle returns the page styling derived from the generator options
+func (s *ScreenshotGenerator) wrapperStyle() WrapperStyle {
+	return WrapperStyle{
+		BackgroundColor: s.opts.BackgroundColor,
+		FontFamily:      s.opts.FontFamily,
+		Dark:            s.opts.ColorScheme == ColorSchemeDark,
+	}
+}
+
+// setupActions returns the emulation actions run before navigating to the email
+func (s *ScreenshotGenerator) setupActions() chromedp.Tasks {
+	tasks := chromedp.Tasks{
+		chromedp.EmulateViewport(int64(s.opts.Width), int64(s.opts.Height)),
+	}
+	if strings.EqualFold(s.opts.BackgroundColor, "transparent") {
+		tasks = append(tasks, emulation.SetDefaultBackgroundColorOverride().
+			WithColor(&cdp.RGBA{R: 0, G: 0, B: 0, A: 0}))
+	}
+	if s.opts.ColorScheme == ColorSchemeDark {
+		tasks = append(tasks, emulation.SetEmulatedMedia().WithFeatures([]*emulation.MediaFeature{
+			{Name: "prefers-color-scheme", Value: ColorSchemeDark},
+		}))
+	}
+	if s.opts.Timezone != "" {
+		tasks = append(tasks, emulation.SetTimezoneOverride(s.opts.Timezone))
+	}
+	if s.opts.Locale != "" {
+		tasks = append(tasks, emulation.SetLocaleOverride().WithLocale(s.opts.Locale))
+	}
+	return tasks
+}
+
+// captureParams returns the PNG capture parameters for the configured capture
+// mode, or for exactly the clip region when clip is non-nil
+func (s *ScreenshotGenerator) captureParams(clip *page.Viewport) *page.CaptureScreenshotParams {
+	params := page.CaptureScreenshot().
+		WithFormat(page.CaptureScreenshotFormatPng).
+		WithFromSurface(true)
+	if s.opts.Format == FormatWebP {
+		params = params.WithFormat(page.CaptureScreenshotFormatWebp).WithQuality(int64(s.opts.Quality))
+	}
+
+	if clip != nil {
+		return params.WithClip(clip).WithCaptureBeyondViewport(true)
+	}
+	if s.opts.Capture == CaptureViewport {
+		return params.WithClip(&page.Viewport{
+			Width:  float64(s.opts.Width),
+			Height: float64(s.opts.Height),
+			Scale:  1,
+		})
+	}
+	return params.WithCaptureBeyondViewport(true)
+}
+
+// pdfParams returns the print parameters for FormatPDF: the paper size in
+// the requested orientation, the same margin on every side, and the
+// email's backgrounds
+func (s *ScreenshotGenerator) pdfParams() *page.PrintToPDFParams {
+	size := pdfPageSizes[s.opts.PDFPageSize]
+	margin := s.opts.PDFMargin
+	return page.PrintToPDF().
+		WithPaperWidth(size[0]).
+		WithPaperHeight(size[1]).
+		WithLandscape(s.opts.PDFLandscape).
+		WithMarginTop(margin).
+		WithMarginBottom(margin).
+		WithMarginLeft(margin).
+		WithMarginRight(margin).
+		WithPrintBackground(true)
+}
+
+// GenerateScreenshot creates a screenshot from HTML content, in subdir of the
+// output directory if it is set
+func (s *ScreenshotGenerator) GenerateScreenshot(subdir, timestamp, emailID, htmlContent string) (string, error) {
+	if strings.TrimSpace(htmlContent) == "" {
+		return "", &permanentError{errors.New("empty HTML content")}
+	}
+
+	var outputPath string
+	var err error
+	if s.opts.NameByHash {
+		// The same content was already captured under this name
+		if existing, ok := s.ExistingScreenshot(subdir, htmlContent); ok {
+			s.debugf("%s already exists, not rendering again", filepath.Base(existing))
+			return existing, nil
+		}
+		outputPath, err = s.hashedPath(subdir, htmlContent)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		outputPath, err = s.outputPath(subdir, timestamp, emailID)
+		if err != nil {
+			return "", err
+		}
+	}
 
 	// Prepare HTML with base structure
-	fullHTML := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <style>
-        body {
-            margin: 20px;
-            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif;
-            font-size: 14px;
-            line-height: 1.5;
-        }
-        img {
-            max-width: 100%%;
-            height: auto;
-        }
-    </style>
-</head>
-<body>
-%s
-</body>
-</html>`, htmlContent)
-
-	// Create a data URL from the HTML
-	dataURL := "data:text/html;charset=utf-8," + url.PathEscape(fullHTML)
+	fullHTML := s.RenderHTML(htmlContent)
+
+	renderings, err := s.capture(fullHTML)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate screenshot: %w", err)
+	}
+
+	// Renderings come width by width, each in every format. Each extra
+	// format is written whatever became of the others.
+	paths := s.widthPaths(outputPath)
+	formats := len(s.formats())
+	var extras []string
+	var extraErrs []error
+	for w, path := range paths {
+		for i, format := range s.opts.ExtraFormats {
+			extraPath := trimExtension(path) + formatExtension(format)
+			if err := s.writeRendering(extraPath, renderings[w*formats+i+1]); err != nil {
+				extraErrs = append(extraErrs, fmt.Errorf("%s output%s: %w", format, s.widthLabel(w), err))
+				continue
+			}
+			extras = append(extras, extraPath)
+		}
+	}
+
+	changed := false
+	var primaries []string
+	for w, path := range paths {
+		r := renderings[w*formats]
+		var err error
+		if r.err != nil {
+			err = fmt.Errorf("failed to generate screenshot%s: %w", s.widthLabel(w), r.err)
+		} else {
+			var wrote bool
+			wrote, err = s.writeScreenshot(path, r.images)
+			changed = changed || wrote
+		}
+		if err != nil {
+			if len(primaries)+len(extras) == 0 {
+				return "", errors.Join(append([]error{err}, extraErrs...)...)
+			}
+			// Report the files that were written all the same
+			return "", &partialError{written: append(primaries, extras...), errs: append([]error{err}, extraErrs...)}
+		}
+		primaries = append(primaries, path)
+	}
+	if !changed {
+		s.unchanged.Add(1)
+	}
+
+	if s.opts.SaveHTML {
+		if _, err := s.writeIfChanged(htmlPath(outputPath), []byte(fullHTML)); err != nil {
+			return "", fmt.Errorf("failed to write HTML: %w", err)
+		}
+	}
+
+	if s.opts.ThumbnailWidth > 0 {
+		// The thumbnail of an unchanged screenshot is unchanged too
+		thumbnail := thumbnailPath(paths[0])
+		if _, err := os.Stat(thumbnail); changed || err != nil {
+			if err := writeThumbnail(thumbnail, renderings[0].images[0], s.opts.ThumbnailWidth); err != nil {
+				return "", fmt.Errorf("failed to write thumbnail: %w", err)
+			}
+		}
+	}
+
+	if len(extraErrs) > 0 {
+		return paths[0], &partialError{written: append(primaries, extras...), errs: extraErrs}
+	}
+	return paths[0], nil
+}
+
+// partialError reports the formats of a screenshot that failed while others
+// were written. GenerateScreenshot returns it along with the screenshot's
+// path when only extra formats failed, and with no path when the screenshot
+// itself failed after other files were written.
+type partialError struct {
+	written []string // Every file written
+	errs    []error  // One per failed format
+}
+
+func (e *partialError) Error() string   { return errors.Join(e.errs...).Error() }
+func (e *partialError) Unwrap() []error { return e.errs }
+
+// writtenPaths returns the files a failed screenshot wrote all the same
+func writtenPaths(err error) []string {
+	var p *partialError
+	if errors.As(err, &p) {
+		return p.written
+	}
+	return nil
+}
+
+// writeScreenshot writes a screenshot's slices, optimized with Optimize, to
+// path and the slice paths after it, reporting whether any file was written
+func (s *ScreenshotGenerator) writeScreenshot(path string, parts [][]byte) (bool, error) {
+	if len(parts) == 0 {
+		return false, errors.New("failed to generate screenshot: no image captured")
+	}
+
+	if s.opts.Optimize {
+		for i, buf := range parts {
+			optimized, err := optimizePNG(buf)
+			if err != nil {
+				return false, fmt.Errorf("failed to optimize screenshot: %w", err)
+			}
+			s.debugf("optimized %s from %s to %s", filepath.Base(slicePath(path, i)), formatBytes(int64(len(buf))), formatBytes(int64(len(optimized))))
+			parts[i] = optimized
+		}
+	}
+
+	changed := false
+	for i, buf := range parts {
+		written, err := s.writeIfChanged(slicePath(path, i), buf)
+		if err != nil {
+			return false, fmt.Errorf("failed to write screenshot: %w", err)
+		}
+		changed = changed || written
+	}
+	return changed, nil
+}
+
+// widths returns every viewport width captured: Widths, or just Width
+func (s *ScreenshotGenerator) widths() []int {
+	if len(s.opts.Widths) > 0 {
+		return s.opts.Widths
+	}
+	return []int{s.opts.Width}
+}
+
+// widthPaths returns the screenshot path for each of Widths, suffixed with
+// the width, or just path without Widths
+func (s *ScreenshotGenerator) widthPaths(path string) []string {
+	if len(s.opts.Widths) == 0 {
+		return []string{path}
+	}
+	var paths []string
+	for _, width := range s.opts.Widths {
+		paths = append(paths, fmt.Sprintf("%s-%d%s", trimExtension(path), width, filepath.Ext(path)))
+	}
+	return paths
+}
+
+// widthLabel names the width at index w of Widths for errors, if there are any
+func (s *ScreenshotGenerator) widthLabel(w int) string {
+	if len(s.opts.Widths) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" at %dpx", s.opts.Widths[w])
+}
+
+// writeRendering writes an extra format's single file to path
+func (s *ScreenshotGenerator) writeRendering(path string, r rendering) error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.images) == 0 {
+		return errors.New("nothing rendered")
+	}
+	_, err := s.writeIfChanged(path, r.images[0])
+	return err
+}
+
+// writeIfChanged writes data to path, unless SkipUnchanged is set and the
+// file there already has the same content. It reports whether it wrote.
+func (s *ScreenshotGenerator) writeIfChanged(path string, data []byte) (bool, error) {
+	if s.opts.SkipUnchanged && sameContent(path, data, s.opts.ComparePixels) {
+		s.debugf("%s is unchanged, not rewriting it", filepath.Base(path))
+		return false, nil
+	}
+	return true, writeFileAtomic(path, data)
+}
+
+// UnchangedCount returns how many screenshots were captured identical to the
+// files already written for them, and so left as they were
+func (s *ScreenshotGenerator) UnchangedCount() int {
+	return int(s.unchanged.Load())
+}
+
+// htmlPath returns the path of the saved HTML for a screenshot
+func htmlPath(screenshotPath string) string {
+	return trimExtension(screenshotPath) + ".html"
+}
+
+// slicePath returns the path of the index'th (0-based) slice of a split
+// screenshot; the first slice uses the screenshot path itself
+func slicePath(screenshotPath string, index int) string {
+	if index == 0 {
+		return screenshotPath
+	}
+	return fmt.Sprintf("%s.%d%s", trimExtension(screenshotPath), index+1, filepath.Ext(screenshotPath))
+}
+
+// trimExtension returns a screenshot path without its image extension
+func trimExtension(screenshotPath string) string {
+	return strings.TrimSuffix(screenshotPath, filepath.Ext(screenshotPath))
+}
+
+// chromeBrowser is the headless Chrome that every capture opens a tab in. It
+// is started by the first capture, and again by the next one if it exits.
+type chromeBrowser struct {
+	mu     sync.Mutex
+	ctx    context.Context // The browser's chromedp context; nil until started
+	cancel context.CancelFunc
+}
+
+// tab opens a new tab, starting the browser with allocOpts first if it isn't
+// running. Canceling the tab's context closes the tab but not the browser.
+func (b *chromeBrowser) tab(allocOpts []chromedp.ExecAllocatorOption) (context.Context, context.CancelFunc, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The browser's context is canceled when Chrome exits or crashes
+	if b.ctx == nil || b.ctx.Err() != nil {
+		if b.cancel != nil {
+			b.cancel()
+		}
+		ctx, allocCancel := context.Background(), context.CancelFunc(func() {})
+		if allocOpts != nil {
+			ctx, allocCancel = chromedp.NewExecAllocator(ctx, allocOpts...)
+		}
+		browserCtx, browserCancel := chromedp.NewContext(ctx)
+		// Running no actions starts the browser, so a failed launch is reported here
+		if err := chromedp.Run(browserCtx); err != nil {
+			browserCancel()
+			allocCancel()
+			return nil, nil, err
+		}
+		b.ctx = browserCtx
+		b.cancel = func() {
+			browserCancel()
+			allocCancel()
+		}
+	}
+	tabCtx, tabCancel := chromedp.NewContext(b.ctx)
+	return tabCtx, tabCancel, nil
+}
+
+// close shuts the browser down, if it was started
+func (b *chromeBrowser) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		b.cancel()
+		b.ctx, b.cancel = nil, nil
+	}
+}
+
+// Close shuts down the Chrome that screenshots were rendered in
+func (s *ScreenshotGenerator) Close() error {
+	s.browser.close()
+	return nil
+}
+
+// chromeCapture loads a full HTML document in a new tab of the shared
+// headless Chrome and renders it in each format
+func (s *ScreenshotGenerator) chromeCapture(fullHTML string) ([]rendering, error) {
+	s = s.forDocument(fullHTML)
+
+	// Open a fresh tab so each attempt starts from a clean page
+	tabCtx, closeTab, err := s.browser.tab(s.allocatorOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer closeTab()
+
+	// Limit the time in the tab, not the browser's lifetime
+	ctx, cancel := context.WithTimeout(tabCtx, 30*time.Second)
+	defer cancel()
+
+	// Load the HTML from a data URL, or a temporary file when it's too large
+	docURL, cleanup, err := documentURL(fullHTML)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
 
 	// Run chromedp tasks
-	var buf []byte
-	if err := chromedp.Run(allocCtx,
-		chromedp.EmulateViewport(int64(s.width), int64(s.height)),
-		chromedp.Navigate(dataURL),
+	var renderings []rendering
+	if err := chromedp.Run(ctx,
+		s.setupActions(),
+		chromedp.Navigate(docURL),
 		chromedp.WaitReady("body"),
 		chromedp.Sleep(500*time.Millisecond), // Give time for rendering
-		chromedp.FullScreenshot(&buf, 90),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			// Work on a copy so an auto-fitted width doesn't leak into other captures
+			g := *s
+			if s.opts.AutoWidth {
+				width, err := s.fitViewport(ctx)
+				if err != nil {
+					return err
+				}
+				g.opts.Width = width
+			}
+			if s.opts.MatchBackground {
+				if err := g.matchBackground(ctx); err != nil {
+					return err
+				}
+			}
+
+			// Every width and format comes from this one page load
+			for _, width := range g.widths() {
+				w := g
+				if len(s.opts.Widths) > 0 {
+					if err := chromedp.EmulateViewport(int64(width), int64(s.opts.Height)).Do(ctx); err != nil {
+						return err
+					}
+					w.opts.Width = width
+				}
+				for _, format := range w.formats() {
+					f := w
+					f.opts.Format = format
+					images, err := f.renderFormat(ctx)
+					renderings = append(renderings, rendering{images: images, err: err})
+				}
+			}
+			return nil
+		}),
 	); err != nil {
-		return "", fmt.Errorf("failed to generate screenshot: %w", err)
+		return nil, err
+	}
+
+	return renderings, nil
+}
+
+// renderFormat renders the loaded page in the configured format: printed
+// for FormatPDF, otherwise captured slice by slice
+func (s *ScreenshotGenerator) renderFormat(ctx context.Context) ([][]byte, error) {
+	if s.opts.Format == FormatPDF {
+		pdf, _, err := s.pdfParams().Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{pdf}, nil
+	}
+
+	clip, err := s.measureClip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	regions, err := s.captureRegions(ctx, clip)
+	if err != nil {
+		return nil, err
+	}
+	var images [][]byte
+	for _, region := range regions {
+		buf, err := s.captureParams(region).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, buf)
+	}
+	return images, nil
+}
+
+// maxDataURLLength is the longest data: URL documentURL hands to Chrome.
+// Chrome rejects URLs over 2 MiB (kMaxURLChars), and navigating to one fails
+// without an error or loads a truncated page, so larger documents are
+// written to a file instead, leaving headroom below the limit.
+const maxDataURLLength = 1 << 20
+
+// documentURL returns a URL Chrome can load fullHTML from, and a function
+// to call once it has been loaded. Small documents are inlined as a data:
+// URL; larger ones are written to a temporary file and loaded as file://.
+func documentURL(fullHTML string) (string, func(), error) {
+	dataURL := "data:text/html;charset=utf-8," + url.PathEscape(fullHTML)
+	if len(dataURL) <= maxDataURLLength {
+		return dataURL, func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "aar-*.html")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary HTML file: %w", err)
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	_, err = f.WriteString(fullHTML)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write temporary HTML file: %w", err)
+	}
+
+	fileURL := url.URL{Scheme: "file", Path: filepath.ToSlash(f.Name())}
+	return fileURL.String(), cleanup, nil
+}
+
+// allocatorOptions returns chromedp's default launch options with ChromePath
+// and ChromeFlags applied, or nil when neither is set so the default
+// allocator is used unchanged
+func (s *ScreenshotGenerator) allocatorOptions() []chromedp.ExecAllocatorOption {
+	if s.opts.ChromePath == "" && len(s.opts.ChromeFlags) == 0 {
+		return nil
+	}
+
+	opts := append([]chromedp.ExecAllocatorOption{}, chromedp.DefaultExecAllocatorOptions[:]...)
+	if s.opts.ChromePath != "" {
+		opts = append(opts, chromedp.ExecPath(s.opts.ChromePath))
+	}
+	for _, chromeFlag := range s.opts.ChromeFlags {
+		name, value, _ := parseChromeFlag(chromeFlag)
+		opts = append(opts, chromedp.Flag(name, value))
+	}
+	return opts
+}
+
+// parseChromeFlag splits a switch like --no-sandbox or --proxy-server=host:3128
+// into its name and value (true for a switch without one)
+func parseChromeFlag(chromeFlag string) (string, any, error) {
+	name, value, hasValue := strings.Cut(strings.TrimLeft(chromeFlag, "-"), "=")
+	if name == "" {
+		return "", nil, fmt.Errorf("invalid Chrome flag %q", chromeFlag)
+	}
+	if !hasValue {
+		return name, true, nil
+	}
+	return name, value, nil
+}
+
+// proxyServerFlag returns the --proxy-server switch for a proxy URL. Chrome
+// has no switch for proxy credentials, so a URL carrying them is rejected
+// rather than silently ignored.
+func proxyServerFlag(proxy string) (string, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "", fmt.Errorf("invalid image proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks4", "socks5":
+	default:
+		return "", fmt.Errorf("invalid image proxy %q (expected an http, https, socks4 or socks5 URL)", proxy)
+	}
+	if u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return "", fmt.Errorf("invalid image proxy %q (expected scheme://host:port)", proxy)
+	}
+	if u.User != nil {
+		return "", errors.New("image proxy credentials aren't supported by Chrome; use a proxy that adds them itself")
+	}
+	return "--proxy-server=" + u.Scheme + "://" + u.Host, nil
+}
+
+// fitViewport lays the page out at MinWidth to measure the width its content
+// needs, then re-emulates the viewport at that width within the configured
+// bounds, returning the new width
+func (s *ScreenshotGenerator) fitViewport(ctx context.Context) (int, error) {
+	if err := chromedp.EmulateViewport(int64(s.opts.MinWidth), int64(s.opts.Height)).Do(ctx); err != nil {
+		return 0, fmt.Errorf("failed to set measuring viewport: %w", err)
+	}
+
+	var contentWidth float64
+	if err := chromedp.Evaluate(`document.documentElement.scrollWidth`, &contentWidth).Do(ctx); err != nil {
+		return 0, fmt.Errorf("failed to measure content width: %w", err)
 	}
 
-	// Write screenshot to file
-	if err := os.WriteFile(outputPath, buf, 0644); err != nil {
-		return "", fmt.Errorf("failed to write screenshot: %w", err)
+	width := fitWidth(int(contentWidth), s.opts.MinWidth, s.opts.MaxWidth)
+	s.debugf("content width %.0f, viewport width %d", contentWidth, width)
+	if err := chromedp.EmulateViewport(int64(width), int64(s.opts.Height)).Do(ctx); err != nil {
+		return 0, fmt.Errorf("failed to resize viewport: %w", err)
+	}
+	return width, nil
+}
+
+// fitWidth clamps a measured content width to [minWidth, maxWidth]
+func fitWidth(contentWidth, minWidth, maxWidth int) int {
+	return max(minWidth, min(contentWidth, maxWidth))
+}
+
+// metaTagPattern matches a <meta> tag, with the same heuristic as imgTagPattern
+var metaTagPattern = regexp.MustCompile(`(?is)<meta\b[^>]*>`)
+
+// metaViewportWidth returns the width in CSS pixels an HTML document's
+// <meta name="viewport"> declares, if it declares a number of pixels rather
+// than device-width
+func metaViewportWidth(htmlContent string) (int, bool) {
+	for _, tag := range metaTagPattern.FindAllString(htmlContent, -1) {
+		attrs := imgAttributes(tag)
+		if !strings.EqualFold(attrs["name"], "viewport") {
+			continue
+		}
+		for _, property := range strings.FieldsFunc(attrs["content"], func(r rune) bool { return r == ',' || r == ';' }) {
+			key, value, _ := strings.Cut(property, "=")
+			if !strings.EqualFold(strings.TrimSpace(key), "width") {
+				continue
+			}
+			width, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "px"), 64)
+			if err != nil || width < 1 {
+				return 0, false
+			}
+			return int(math.Round(width)), true
+		}
+	}
+	return 0, false
+}
+
+// forDocument returns the generator to capture fullHTML with: with
+// MetaViewport, a copy whose Width is the document's meta viewport width
+// within the bounds, otherwise s itself
+func (s *ScreenshotGenerator) forDocument(fullHTML string) *ScreenshotGenerator {
+	if !s.opts.MetaViewport {
+		return s
+	}
+	width, ok := metaViewportWidth(fullHTML)
+	if !ok {
+		s.debugf("no meta viewport width, viewport width %d", s.opts.Width)
+		return s
+	}
+	g := *s
+	g.opts.Width = fitWidth(width, s.opts.MinWidth, s.opts.MaxWidth)
+	g.debugf("meta viewport width %d, viewport width %d", width, g.opts.Width)
+	return &g
+}
+
+// outerBackgroundsScript returns the computed background colors of the
+// email's outer element and its first descendants, outermost first. Blocks
+// added above the email, such as the banner, are passed over.
+const outerBackgroundsScript = `(() => {
+	const colors = [];
+	let el = Array.from(document.body.children).find(e => !/\baar-/.test(e.className));
+	for (let depth = 0; el && depth < 5; depth++, el = el.firstElementChild) {
+		colors.push(getComputedStyle(el).backgroundColor);
+	}
+	return colors;
+})()`
+
+// matchBackground paints the page behind the email in the background color
+// of its outer element, leaving the configured background when it has none
+func (s *ScreenshotGenerator) matchBackground(ctx context.Context) error {
+	var colors []string
+	if err := chromedp.Evaluate(outerBackgroundsScript, &colors).Do(ctx); err != nil {
+		return fmt.Errorf("failed to read the email's background: %w", err)
+	}
+
+	color, ok := opaqueBackground(colors)
+	if !ok {
+		s.debugf("no email background among %v, keeping the page background", colors)
+		return nil
+	}
+	s.debugf("matching the email background %s", color)
+	if err := chromedp.Evaluate(backgroundScript(color), nil).Do(ctx); err != nil {
+		return fmt.Errorf("failed to set the page background: %w", err)
+	}
+	return nil
+}
+
+// opaqueBackground returns the first of the computed background colors that
+// isn't fully transparent
+func opaqueBackground(colors []string) (string, bool) {
+	for _, color := range colors {
+		color = strings.TrimSpace(color)
+		if color == "" || color == "transparent" || strings.HasSuffix(strings.ReplaceAll(color, " ", ""), ",0)") {
+			continue
+		}
+		return color, true
+	}
+	return "", false
+}
+
+// backgroundScript returns the script setting the page's background to color
+func backgroundScript(color string) string {
+	quoted, _ := json.Marshal(color)
+	return fmt.Sprintf(`document.documentElement.style.background = %s; document.body.style.background = %[1]s;`, quoted)
+}
+
+// captureRegions returns the clip region of each image to capture. Without
+// MaxHeight this is just clip, which may be nil for the default capture.
+func (s *ScreenshotGenerator) captureRegions(ctx context.Context, clip *page.Viewport) ([]*page.Viewport, error) {
+	if s.opts.MaxHeight <= 0 {
+		return []*page.Viewport{clip}, nil
+	}
+
+	region := clip
+	switch {
+	case region != nil:
+	case s.opts.Capture == CaptureViewport:
+		region = &page.Viewport{Width: float64(s.opts.Width), Height: float64(s.opts.Height), Scale: 1}
+	default:
+		var height float64
+		script := `Math.max(document.documentElement.scrollHeight, document.body.scrollHeight)`
+		if err := chromedp.Evaluate(script, &height).Do(ctx); err != nil {
+			return nil, fmt.Errorf("failed to measure content height: %w", err)
+		}
+		s.debugf("content height %.0f (max %d)", height, s.opts.MaxHeight)
+		region = &page.Viewport{Width: float64(s.opts.Width), Height: height, Scale: 1}
+	}
+
+	return splitRegion(*region, float64(s.opts.MaxHeight), s.opts.Split), nil
+}
+
+// splitRegion limits region to maxHeight: either by cutting it off, or with
+// split, by dividing it into successive slices no taller than maxHeight
+func splitRegion(region page.Viewport, maxHeight float64, split bool) []*page.Viewport {
+	if region.Height <= maxHeight {
+		return []*page.Viewport{&region}
+	}
+	if !split {
+		region.Height = maxHeight
+		return []*page.Viewport{&region}
+	}
+
+	var parts []*page.Viewport
+	for top := 0.0; top < region.Height; top += maxHeight {
+		slice := region
+		slice.Y = region.Y + top
+		slice.Height = min(maxHeight, region.Height-top)
+		parts = append(parts, &slice)
+	}
+	return parts
+}
+
+// clipScript returns JavaScript that evaluates to the page coordinates of the
+// first element matching selector, or null if there is none
+func clipScript(selector string) string {
+	quoted, _ := json.Marshal(selector)
+	return fmt.Sprintf(`(() => {
+	const el = document.querySelector(%s);
+	if (!el) return null;
+	const r = el.getBoundingClientRect();
+	return {x: r.left + window.scrollX, y: r.top + window.scrollY, width: r.width, height: r.height};
+})()`, quoted)
+}
+
+// measureClip returns the clip region for ClipSelector, or nil when no
+// selector is configured or no non-empty element matches it
+func (s *ScreenshotGenerator) measureClip(ctx context.Context) (*page.Viewport, error) {
+	if s.opts.ClipSelector == "" {
+		return nil, nil
+	}
+
+	var rect *struct {
+		X      float64 `json:"x"`
+		Y      float64 `json:"y"`
+		Width  float64 `json:"width"`
+		Height float64 `json:"height"`
+	}
+	if err := chromedp.Evaluate(clipScript(s.opts.ClipSelector), &rect).Do(ctx); err != nil {
+		return nil, fmt.Errorf("failed to measure %q: %w", s.opts.ClipSelector, err)
+	}
+	if rect == nil || rect.Width <= 0 || rect.Height <= 0 {
+		s.debugf("clip selector %q not found, using %s capture", s.opts.ClipSelector, s.opts.Capture)
+		return nil, nil
+	}
+
+	s.debugf("clip selector %q measured at %.0fx%.0f+%.0f+%.0f", s.opts.ClipSelector, rect.Width, rect.Height, rect.X, rect.Y)
+	return &page.Viewport{X: rect.X, Y: rect.Y, Width: rect.Width, Height: rect.Height, Scale: 1}, nil
+}
+
+// debugf writes a message to DebugLog when debug output is enabled
+func (s *ScreenshotGenerator) debugf(format string, args ...interface{}) {
+	if s.opts.DebugLog != nil {
+		fmt.Fprintf(s.opts.DebugLog, "debug: "+format+"\n", args...)
+	}
+}
+
+// writeFileAtomic writes data to path so that readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	return writeAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeAtomic streams content into a temporary file in the same directory as
+// path and renames it into place only once write has fully succeeded. The
+// temporary file is removed on any error.
+func writeAtomic(path string, write func(w io.Writer) error) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err = os.Chmod(tmpPath, 0644); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
 
-	return outputPath, nil
+	return nil
 }
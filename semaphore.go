@@ -0,0 +1,37 @@
+package main
+
+import "context"
+
+// semaphore bounds how many holders run at once. A nil semaphore never
+// blocks.
+type semaphore chan struct{}
+
+// newSemaphore returns a semaphore admitting n holders, or nil (unlimited)
+// when n is not positive
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// Acquire waits for a free slot, giving up with the context's error if it is
+// cancelled first
+func (s semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return ctx.Err()
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (s semaphore) Release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// Sidecar is the metadata written next to a screenshot as <basename>.json
+type Sidecar struct {
+	ID         string         `json:"id"`
+	Subject    string         `json:"subject"`
+	From       []EmailAddress `json:"from"`
+	ReceivedAt string         `json:"receivedAt"`
+	Preview    string         `json:"preview"`
+	Screenshot string         `json:"screenshot"` // File name of the screenshot, relative to the sidecar
+	// Mailboxes the email was in when it was processed, before it was moved
+	Mailboxes []SidecarMailbox `json:"mailboxes"`
+	// Header fields requested with -headers that the email has
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// SidecarMailbox is one mailbox an email was in. Name is empty when the ID
+// doesn't match a mailbox the account listed.
+type SidecarMailbox struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// mailboxNames returns the names of the account's mailboxes by ID
+func mailboxNames(client EmailClient) (map[string]string, error) {
+	mailboxes, err := client.ListMailboxes()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		names[mailbox.ID] = mailbox.Name
+	}
+	return names, nil
+}
+
+// sidecarMailboxes returns the mailboxes email is in, resolved against
+// names and sorted by name, with unknown IDs last
+func sidecarMailboxes(email Email, names map[string]string) []SidecarMailbox {
+	mailboxes := []SidecarMailbox{}
+	for id, in := range email.MailboxIds {
+		if in {
+			mailboxes = append(mailboxes, SidecarMailbox{ID: id, Name: names[id]})
+		}
+	}
+	sort.Slice(mailboxes, func(i, j int) bool {
+		a, b := mailboxes[i], mailboxes[j]
+		if (a.Name == "") != (b.Name == "") {
+			return b.Name == ""
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	return mailboxes
+}
+
+// sidecarPath returns the metadata file path for a screenshot
+func sidecarPath(screenshotPath string) string {
+	return trimExtension(screenshotPath) + ".json"
+}
+
+// writeSidecar writes the metadata for email next to its screenshot, naming
+// its mailboxes from mailboxNames
+func writeSidecar(screenshotPath string, email Email, mailboxNames map[string]string) error {
+	sidecar := Sidecar{
+		ID:         email.ID,
+		Subject:    email.Subject,
+		From:       email.From,
+		ReceivedAt: email.ReceivedAt,
+		Preview:    email.Preview,
+		Screenshot: filepath.Base(screenshotPath),
+		Mailboxes:  sidecarMailboxes(email, mailboxNames),
+		Headers:    email.Headers,
+	}
+
+	return writeAtomic(sidecarPath(screenshotPath), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(sidecar)
+	})
+}
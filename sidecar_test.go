@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Test the sidecar records the email metadata, including the preview
+func TestWriteSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "2025-10-24-10-30-00-M1.png")
+	email := Email{
+		ID:         "M1",
+		Subject:    "Weekly digest",
+		ReceivedAt: "2025-10-24T14:30:00Z",
+		From:       []EmailAddress{{Name: "News", Email: "news@example.com"}},
+		Preview:    "This week in review...",
+	}
+
+	if err := writeSidecar(path, email, nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	data, err := os.ReadFile(sidecarPath(path))
+	if err != nil {
+		t.Fatalf("Failed to read sidecar: %v", err)
+	}
+	var sidecar Sidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatalf("Expected valid JSON, got: %v", err)
+	}
+
+	if sidecar.Preview != email.Preview || sidecar.Subject != email.Subject || sidecar.ID != "M1" {
+		t.Errorf("Expected email metadata, got %+v", sidecar)
+	}
+	if len(sidecar.From) != 1 || sidecar.From[0].Email != "news@example.com" {
+		t.Errorf("Expected sender news@example.com, got %+v", sidecar.From)
+	}
+	if sidecar.Screenshot != "2025-10-24-10-30-00-M1.png" {
+		t.Errorf("Expected screenshot file name, got %q", sidecar.Screenshot)
+	}
+}
+
+// Test processing writes a sidecar only when enabled
+func TestProcessEmails_Sidecar(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		client := newSingleEmailClient()
+		email := client.emailDetails["email1"]
+		email.Preview = "Snippet"
+		client.emailDetails["email1"] = email
+		generator := NewMockScreenshotService()
+		generator.outputDir = t.TempDir()
+		generator.fileSizes = []int{10}
+
+		var output bytes.Buffer
+		if _, err := processEmails(client, generator, ProcessOptions{Sidecar: enabled}, &output); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		_, err := os.Stat(sidecarPath(generator.generatedScreenshots["email1"]))
+		if enabled && err != nil {
+			t.Errorf("Expected sidecar to be written, got: %v", err)
+		}
+		if !enabled && err == nil {
+			t.Error("Expected no sidecar without -sidecar")
+		}
+	}
+}
+
+// Test the sidecar names every mailbox the email was in before it was moved
+func TestProcessEmails_SidecarMailboxes(t *testing.T) {
+	client := newSingleEmailClient()
+	client.mailboxes["Inbox"] = &Mailbox{ID: "inbox-1", Name: "Inbox", Role: "inbox"}
+	email := client.emailDetails["email1"]
+	email.MailboxIds = map[string]bool{"src-123": true, "inbox-1": true, "gone-9": true}
+	client.emailDetails["email1"] = email
+	generator := NewMockScreenshotService()
+	generator.outputDir = t.TempDir()
+	generator.fileSizes = []int{10}
+
+	var output bytes.Buffer
+	if _, err := processEmails(client, generator, ProcessOptions{Sidecar: true}, &output); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	data, err := os.ReadFile(sidecarPath(generator.generatedScreenshots["email1"]))
+	if err != nil {
+		t.Fatalf("Failed to read sidecar: %v", err)
+	}
+	var sidecar Sidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatalf("Expected valid JSON, got: %v", err)
+	}
+
+	expected := []SidecarMailbox{
+		{ID: "inbox-1", Name: "Inbox"},
+		{ID: "src-123", Name: sourceFolder},
+		{ID: "gone-9"},
+	}
+	if !reflect.DeepEqual(sidecar.Mailboxes, expected) {
+		t.Errorf("Expected mailboxes %+v, got %+v", expected, sidecar.Mailboxes)
+	}
+}
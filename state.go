@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// syncStateKey identifies the saved state of one source mailbox in one
+// account, so switching folders or accounts never reuses another's state
+func syncStateKey(accountID, mailboxID string) string {
+	return accountID + ":" + mailboxID
+}
+
+// loadSyncStates reads the JMAP Email states saved by previous runs, keyed
+// by syncStateKey. A missing file, or one written before states were kept
+// per mailbox, yields no states so the caller does a full sync.
+func loadSyncStates(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	states := map[string]string{}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return map[string]string{}, nil
+	}
+	return states, nil
+}
+
+// loadSyncState returns the state saved for key, or "" if there is none
+func loadSyncState(path, key string) (string, error) {
+	states, err := loadSyncStates(path)
+	if err != nil {
+		return "", err
+	}
+	return states[key], nil
+}
+
+// saveSyncState records state under key for the next run's Email/changes
+// call, keeping the states of other mailboxes. An empty state removes key.
+func saveSyncState(path, key, state string) error {
+	states, err := loadSyncStates(path)
+	if err != nil {
+		return err
+	}
+	if state == "" {
+		delete(states, key)
+	} else {
+		states[key] = state
+	}
+
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test states for different mailboxes and accounts are stored independently
+func TestSyncState_PerMailbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	inbox, receipts := syncStateKey("acc1", "mb-inbox"), syncStateKey("acc1", "mb-receipts")
+	other := syncStateKey("acc2", "mb-inbox")
+
+	for key, state := range map[string]string{inbox: "s1", receipts: "r7", other: "x3"} {
+		if err := saveSyncState(path, key, state); err != nil {
+			t.Fatalf("Failed to save %s: %v", key, err)
+		}
+	}
+	if err := saveSyncState(path, inbox, "s2"); err != nil {
+		t.Fatalf("Failed to update %s: %v", inbox, err)
+	}
+
+	for key, expected := range map[string]string{inbox: "s2", receipts: "r7", other: "x3", "acc1:unknown": ""} {
+		if state, err := loadSyncState(path, key); err != nil || state != expected {
+			t.Errorf("Expected %s state %q, got %q (err %v)", key, expected, state, err)
+		}
+	}
+
+	// An empty state clears only its own key
+	if err := saveSyncState(path, receipts, ""); err != nil {
+		t.Fatalf("Failed to clear %s: %v", receipts, err)
+	}
+	if state, _ := loadSyncState(path, receipts); state != "" {
+		t.Errorf("Expected %s cleared, got %q", receipts, state)
+	}
+	if state, _ := loadSyncState(path, inbox); state != "s2" {
+		t.Errorf("Expected %s kept, got %q", inbox, state)
+	}
+}
+
+// Test a missing file or one from before per-mailbox states means a full sync
+func TestLoadSyncState_MissingOrLegacy(t *testing.T) {
+	dir := t.TempDir()
+	if state, err := loadSyncState(filepath.Join(dir, "missing"), "acc1:mb"); err != nil || state != "" {
+		t.Errorf("Expected no state for a missing file, got %q (err %v)", state, err)
+	}
+
+	legacy := filepath.Join(dir, "legacy")
+	if err := os.WriteFile(legacy, []byte("s1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := loadSyncState(legacy, "acc1:mb"); err != nil || state != "" {
+		t.Errorf("Expected no state for a legacy file, got %q (err %v)", state, err)
+	}
+}
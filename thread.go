@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Thread archive modes
+const (
+	ThreadMoveAll   = "thread" // Archive every message of the thread in the source folder
+	ThreadMoveEmail = "email"  // Archive only the email that was processed
+)
+
+// threadSeparator goes between messages in a thread render
+const threadSeparator = `<hr class="aar-thread-separator" style="margin: 40px -20px 20px; border: 0; border-top: 4px solid #d1d5db;">
+`
+
+// claimThread records that emailID is capturing threadID, returning false and
+// the email that got there first if the thread is already claimed this run
+func (p *processor) claimThread(threadID, emailID string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if firstID, ok := p.seenThreads[threadID]; ok {
+		return firstID, false
+	}
+	p.seenThreads[threadID] = emailID
+	return emailID, true
+}
+
+// fetchThread returns every email in email's thread, oldest first, and the
+// Email state they were read at
+func (p *processor) fetchThread(email Email) ([]Email, string, error) {
+	emailIDs, err := p.client.GetThread(email.ThreadID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := p.client.GetEmails(emailIDs)
+	if err != nil {
+		return nil, "", err
+	}
+	// A thread missing some of its emails would be captured incomplete
+	if err := result.FailedErr(); err != nil {
+		return nil, "", err
+	}
+	byID := result.ByID()
+
+	var thread []Email
+	for _, emailID := range emailIDs {
+		if e, ok := byID[emailID]; ok {
+			thread = append(thread, e)
+		}
+	}
+	if len(thread) == 0 {
+		return nil, "", fmt.Errorf("thread %s has no emails", email.ThreadID)
+	}
+	return thread, result.State, nil
+}
+
+// threadInSource returns the emails of a thread that are in the source
+// folder, always including the email being processed
+func (p *processor) threadInSource(thread []Email, email Email) []Email {
+	var inSource []Email
+	for _, e := range thread {
+		if e.ID == email.ID || e.MailboxIds[p.sourceMailbox.ID] {
+			inSource = append(inSource, e)
+		}
+	}
+	return inSource
+}
+
+// threadHTML concatenates the messages of a thread into one document, each
+// under its own banner. Messages without HTML show their plain-text preview.
+func threadHTML(thread []Email, mode string) string {
+	parts := make([]string, 0, len(thread))
+	for _, email := range thread {
+		body := extractHTMLContent(email, mode)
+		if body == "" {
+			body = "<p>" + html.EscapeString(email.Preview) + "</p>"
+		}
+		parts = append(parts, renderBanner(email)+body)
+	}
+	return strings.Join(parts, threadSeparator)
+}
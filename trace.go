@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces credential values in traced headers
+const redacted = "[REDACTED]"
+
+// traceEntry is one line of a JMAP trace file
+type traceEntry struct {
+	Time      time.Time         `json:"time"`
+	Direction string            `json:"direction"` // "request" or "response"
+	Method    string            `json:"method,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      json.RawMessage   `json:"body"`
+}
+
+// tracer appends JMAP requests and responses to a writer as JSON Lines. It
+// is safe for concurrent use; a nil tracer records nothing.
+type tracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// traceRequest records an outgoing request with its credentials redacted
+func (t *tracer) traceRequest(req *http.Request, body []byte) {
+	if t == nil {
+		return
+	}
+
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		value := strings.Join(values, ", ")
+		if name == "Authorization" {
+			scheme, _, _ := strings.Cut(value, " ")
+			value = scheme + " " + redacted
+		}
+		headers[name] = value
+	}
+
+	t.write(traceEntry{
+		Direction: "request",
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Headers:   headers,
+		Body:      traceBody(body),
+	})
+}
+
+// traceResponse records a response status and raw body
+func (t *tracer) traceResponse(status int, body []byte) {
+	if t == nil {
+		return
+	}
+
+	t.write(traceEntry{
+		Direction: "response",
+		Status:    status,
+		Body:      traceBody(body),
+	})
+}
+
+func (t *tracer) write(entry traceEntry) {
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w.Write(append(line, '\n'))
+}
+
+// traceBody embeds a JSON body as-is, or as a JSON string when it isn't valid JSON
+func traceBody(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
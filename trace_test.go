@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test a single call writes a request and a response line with the token redacted
+func TestTraceFile_RecordsRequestAndResponse(t *testing.T) {
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"methodResponses":[["Email/query",{"ids":["M1"]},"0"]]}`))
+	})
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create trace file: %v", err)
+	}
+	client.tracer = &tracer{w: f}
+
+	if _, _, err := client.GetEmailsInMailbox("mb1", QueryOptions{}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read trace file: %v", err)
+	}
+	if strings.Contains(string(data), "test-key") {
+		t.Error("Trace file must not contain the API key")
+	}
+
+	var entries []traceEntry
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		var entry traceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid trace line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 trace lines, got %d", len(entries))
+	}
+
+	request, response := entries[0], entries[1]
+	if request.Direction != "request" || !strings.Contains(string(request.Body), "Email/query") {
+		t.Errorf("Expected request entry with the method call, got %+v", request)
+	}
+	if request.Headers["Authorization"] != "Bearer "+redacted {
+		t.Errorf("Expected redacted Authorization header, got %q", request.Headers["Authorization"])
+	}
+	if response.Direction != "response" || response.Status != http.StatusOK || !strings.Contains(string(response.Body), `"M1"`) {
+		t.Errorf("Expected response entry with the raw body, got %+v", response)
+	}
+}
+
+// Test non-JSON bodies are stored as strings
+func TestTraceBody_NonJSON(t *testing.T) {
+	if body := traceBody([]byte("Unauthorized")); string(body) != `"Unauthorized"` {
+		t.Errorf("Expected quoted string, got %s", body)
+	}
+}
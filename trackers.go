@@ -0,0 +1,69 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// imgTagPattern matches an <img> tag. Like the rest of this file it is a
+	// heuristic, not an HTML parser: a ">" inside a quoted attribute ends it.
+	imgTagPattern = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	// attrPattern matches one attribute of a tag, quoted or not
+	attrPattern = regexp.MustCompile(`(?is)\s([a-z][a-z0-9-]*)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	// trackerURLPattern matches the open-tracking endpoints of common mailing
+	// services and analytics
+	trackerURLPattern = regexp.MustCompile(`(?i)(/track/open|/wf/open|/o\.gif|/open\.gif|/pixel\.gif|/beacon\.gif|google-analytics\.com/collect)`)
+	// tinySizePattern matches a width or height of at most one pixel
+	tinySizePattern = regexp.MustCompile(`^0*[01](\.0*)?(px)?$`)
+)
+
+// stripTrackers removes tracking pixels from an email's HTML: images one
+// pixel or smaller in both dimensions, images hidden with display:none or
+// visibility:hidden, and images from known open-tracking URLs. It returns the
+// HTML and how many images were removed.
+func stripTrackers(htmlContent string) (string, int) {
+	removed := 0
+	stripped := imgTagPattern.ReplaceAllStringFunc(htmlContent, func(tag string) string {
+		if isTrackerImage(imgAttributes(tag)) {
+			removed++
+			return ""
+		}
+		return tag
+	})
+	return stripped, removed
+}
+
+// imgAttributes returns a tag's attributes by lowercased name
+func imgAttributes(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrPattern.FindAllStringSubmatch(tag, -1) {
+		attrs[strings.ToLower(m[1])] = strings.TrimSpace(m[2] + m[3] + m[4])
+	}
+	return attrs
+}
+
+// isTrackerImage reports whether an image's attributes look like a tracker
+func isTrackerImage(attrs map[string]string) bool {
+	if trackerURLPattern.MatchString(attrs["src"]) {
+		return true
+	}
+
+	// Declarations later in the style override the attributes, as in CSS
+	width, height := attrs["width"], attrs["height"]
+	for _, declaration := range strings.Split(attrs["style"], ";") {
+		property, value, _ := strings.Cut(declaration, ":")
+		property = strings.ToLower(strings.TrimSpace(property))
+		value = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important")))
+		switch {
+		case property == "display" && value == "none",
+			property == "visibility" && value == "hidden":
+			return true
+		case property == "width":
+			width = value
+		case property == "height":
+			height = value
+		}
+	}
+	return tinySizePattern.MatchString(width) && tinySizePattern.MatchString(height)
+}
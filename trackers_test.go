@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+// Test which images are taken for trackers
+func TestStripTrackers(t *testing.T) {
+	tests := []struct {
+		name    string
+		html    string
+		want    string
+		removed int
+	}{
+		{"1x1 pixel", `<p>Hi</p><img src="https://t.example.com/x" width="1" height="1" alt="">`, `<p>Hi</p>`, 1},
+		{"0x0 pixel", `<IMG SRC=https://t.example.com/x WIDTH=0 HEIGHT=0>`, ``, 1},
+		{"sized by style", `<img src="/x.png" style="width: 1px; height: 1px">`, ``, 1},
+		{"hidden", `<img src="/x.png" width="600" style="display:none !important">`, ``, 1},
+		{"invisible", `<img src='/x.png' style='visibility: hidden'>`, ``, 1},
+		{"tracker URL", `<img src="https://us1.list-manage.com/track/open.php?u=1" width="600">`, ``, 1},
+		{"content image", `<img src="/hero.png" width="600" height="1">`, `<img src="/hero.png" width="600" height="1">`, 0},
+		{"style overrides size", `<img src="/logo.png" width="1" height="1" style="width:120px;height:40px">`, `<img src="/logo.png" width="1" height="1" style="width:120px;height:40px">`, 0},
+		{"unsized", `<img src="/logo.png">`, `<img src="/logo.png">`, 0},
+	}
+
+	for _, tt := range tests {
+		got, removed := stripTrackers(tt.html)
+		if got != tt.want || removed != tt.removed {
+			t.Errorf("%s: expected %q (%d removed), got %q (%d removed)", tt.name, tt.want, tt.removed, got, removed)
+		}
+	}
+}
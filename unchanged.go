@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // Registers the JPEG decoder for pixel comparison
+	"os"
+)
+
+// sameContent reports whether the file at path holds the same content as
+// data. By default the two are compared by hash; with pixels, images are
+// decoded and compared pixel by pixel, so the same picture encoded
+// differently counts as the same. Content that can't be decoded, such as
+// a PDF, is compared by hash. A missing or unreadable file isn't the same.
+func sameContent(path string, data []byte, pixels bool) bool {
+	existing, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if sha256.Sum256(existing) == sha256.Sum256(data) {
+		return true
+	}
+	if !pixels {
+		return false
+	}
+
+	a, _, errA := image.Decode(bytes.NewReader(existing))
+	b, _, errB := image.Decode(bytes.NewReader(data))
+	if errA != nil || errB != nil {
+		return false
+	}
+	return samePixels(a, b)
+}
+
+// samePixels reports whether two images are the same size with the same
+// colors at every pixel
+func samePixels(a, b image.Image) bool {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return false
+	}
+	return bytes.Equal(toRGBA(a).Pix, toRGBA(b).Pix)
+}
+
+// toRGBA returns a copy of img's pixels as RGBA, anchored at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	rgba := image.NewRGBA(image.Rectangle{Max: img.Bounds().Size()})
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build metadata, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// buildVersion returns the version, commit and build date, falling back to
+// the module and VCS information recorded by the Go toolchain when the
+// ldflags weren't set
+func buildVersion() (v, c, d string) {
+	v, c, d = version, commit, date
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v, c, d
+	}
+	if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && c == "none":
+			c = setting.Value
+		case setting.Key == "vcs.time" && d == "unknown":
+			d = setting.Value
+		}
+	}
+	return v, c, d
+}
+
+// versionString returns the -version output
+func versionString() string {
+	v, c, d := buildVersion()
+	return fmt.Sprintf("aar %s (commit %s, built %s)", v, c, d)
+}
+
+// userAgent returns the User-Agent header sent with JMAP requests
+func userAgent() string {
+	v, _, _ := buildVersion()
+	return "aar/" + v
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Test the version string reports ldflags metadata when it is set
+func TestVersionString(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version, commit, date
+	defer func() { version, commit, date = oldVersion, oldCommit, oldDate }()
+	version, commit, date = "v1.2.3", "abc1234", "2025-10-24T14:30:00Z"
+
+	expected := "aar v1.2.3 (commit abc1234, built 2025-10-24T14:30:00Z)"
+	if got := versionString(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if got := userAgent(); got != "aar/v1.2.3" {
+		t.Errorf("Expected User-Agent aar/v1.2.3, got %q", got)
+	}
+}
+
+// Test -version prints the version and exits 0 before requiring an API key
+func TestMain_VersionFlagExitsEarly(t *testing.T) {
+	if os.Getenv("AAR_TEST_RUN_MAIN") == "1" {
+		os.Args = []string{"aar", "-version"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMain_VersionFlagExitsEarly$")
+	cmd.Env = append(os.Environ(), "AAR_TEST_RUN_MAIN=1", "FASTMAIL_AAR_KEY=")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Expected exit 0, got: %v", err)
+	}
+
+	if !regexp.MustCompile(`(?m)^aar \S+ \(commit \S+, built \S+\)$`).Match(out) {
+		t.Errorf("Expected version line, got: %q", out)
+	}
+	if strings.Contains(string(out), "Starting") {
+		t.Errorf("Expected exit before processing, got: %q", out)
+	}
+}
+
+// Test JMAP requests identify the tool in the User-Agent header
+func TestMakeRequest_UserAgent(t *testing.T) {
+	var agent string
+	client := newTestJMAPClient(t, func(w http.ResponseWriter, r *http.Request) {
+		agent = r.Header.Get("User-Agent")
+		w.Write([]byte(`{"methodResponses":[]}`))
+	})
+
+	client.makeRequest(nil)
+	if agent != userAgent() {
+		t.Errorf("Expected User-Agent %q, got %q", userAgent(), agent)
+	}
+}
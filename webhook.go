@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// When -webhook fires
+const (
+	WebhookOnAlways   = "always"   // After every run
+	WebhookOnFailures = "failures" // Only after runs with failed emails
+)
+
+// Webhook delivery: each attempt has webhookTimeout, and failed attempts are
+// retried up to webhookAttempts in all, webhookRetryDelay apart
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+)
+
+var webhookRetryDelay = 2 * time.Second
+
+// validateWebhookURL checks -webhook is an absolute http or https URL
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q (expected an http or https URL)", rawURL)
+	}
+	return nil
+}
+
+// webhookPayload is the report for result with only its failed emails, so
+// the payload stays small however many emails were processed
+func webhookPayload(result *ProcessResult) Report {
+	report := newReport(result)
+	failed := []ReportEmail{}
+	for _, email := range report.Emails {
+		if email.Status == statusFailed.String() {
+			failed = append(failed, email)
+		}
+	}
+	report.Emails = failed
+	return report
+}
+
+// sendWebhook POSTs the run's summary as JSON to webhookURL, retrying
+// network errors and server errors. Client errors (4xx) aren't retried.
+func sendWebhook(webhookURL string, result *ProcessResult) error {
+	body, err := json.Marshal(webhookPayload(result))
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(client, webhookURL, body)
+		if err == nil {
+			return nil
+		}
+		var rejected webhookRejectedError
+		if errors.As(err, &rejected) || attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(webhookRetryDelay)
+	}
+}
+
+// webhookRejectedError is a 4xx response, which retrying won't change
+type webhookRejectedError struct {
+	status string
+}
+
+func (e webhookRejectedError) Error() string {
+	return fmt.Sprintf("webhook rejected the request: %s", e.status)
+}
+
+// postWebhook makes one delivery attempt
+func postWebhook(client *http.Client, webhookURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return webhookRejectedError{status: resp.Status}
+	default:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
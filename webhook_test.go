@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// webhookServer answers each request with the next status in statuses
+// (repeating the last), recording each request body
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, *[][]byte) {
+	t.Helper()
+	old := webhookRetryDelay
+	webhookRetryDelay = 0
+	t.Cleanup(func() { webhookRetryDelay = old })
+
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected %s request with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		bodies = append(bodies, body.Bytes())
+		w.WriteHeader(statuses[min(len(bodies), len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+// Test the webhook receives the run's counts and failed emails, after a
+// retried server error
+func TestSendWebhook(t *testing.T) {
+	server, bodies := webhookServer(t, http.StatusServiceUnavailable, http.StatusOK)
+	result := &ProcessResult{
+		TotalCount:     2,
+		ProcessedCount: 1,
+		FailedCount:    1,
+		Emails: []emailResult{
+			{id: "a", status: statusProcessed, path: "shots/a.png"},
+			{id: "b", status: statusFailed, err: errors.New("No HTML content found")},
+		},
+	}
+
+	if err := sendWebhook(server.URL, result); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(*bodies) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(*bodies))
+	}
+	var payload Report
+	if err := json.Unmarshal((*bodies)[1], &payload); err != nil {
+		t.Fatalf("Invalid payload JSON: %v", err)
+	}
+	if payload.Total != 2 || payload.Processed != 1 || payload.Failed != 1 {
+		t.Errorf("Unexpected counts in %+v", payload)
+	}
+	expected := ReportEmail{ID: "b", Status: "failed", Error: "No HTML content found"}
+	if len(payload.Emails) != 1 || !reflect.DeepEqual(payload.Emails[0], expected) {
+		t.Errorf("Expected only the failed email %+v, got %+v", expected, payload.Emails)
+	}
+}
+
+// Test a client error isn't retried and a persistent server error gives up
+// after the last attempt
+func TestSendWebhook_Errors(t *testing.T) {
+	server, bodies := webhookServer(t, http.StatusNotFound)
+	if err := sendWebhook(server.URL, &ProcessResult{}); err == nil || len(*bodies) != 1 {
+		t.Errorf("Expected one rejected attempt, got %d attempt(s), %v", len(*bodies), err)
+	}
+
+	server, bodies = webhookServer(t, http.StatusBadGateway)
+	if err := sendWebhook(server.URL, &ProcessResult{}); err == nil || len(*bodies) != webhookAttempts {
+		t.Errorf("Expected %d failed attempts, got %d, %v", webhookAttempts, len(*bodies), err)
+	}
+}
+
+// Test -webhook-on failures fires after a failed email, and an undeliverable
+// webhook is logged without changing the exit code
+func TestRun_Webhook(t *testing.T) {
+	folders := map[string]string{sourceFolder: "src", archiveFolder: "arch"}
+	noHTML := []Email{{ID: "M1", Subject: "Plain text only"}}
+	var calls atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(hook.Close)
+
+	for _, tt := range []struct {
+		emails   []Email
+		expected int
+		calls    int32
+	}{
+		{nil, exitOK, 0},
+		{noHTML, exitEmailsFailed, 1},
+	} {
+		calls.Store(0)
+		t.Setenv("FASTMAIL_AAR_KEY", "test-key")
+		args := []string{
+			"-output-dir", t.TempDir(),
+			"-session-url", fakeJMAPServer(t, folders, tt.emails).URL,
+			"-webhook", hook.URL, "-webhook-on", WebhookOnFailures,
+		}
+
+		var stdout, stderr bytes.Buffer
+		if code := run(args, nil, &stdout, &stderr); code != tt.expected {
+			t.Errorf("Expected exit code %d, got %d\n%s", tt.expected, code, stderr.String())
+		}
+		if calls.Load() != tt.calls {
+			t.Errorf("Expected %d webhook call(s), got %d", tt.calls, calls.Load())
+		}
+		if tt.calls > 0 && !strings.Contains(stderr.String(), "Failed to send webhook") {
+			t.Errorf("Expected the webhook failure logged, got:\n%s", stderr.String())
+		}
+	}
+}
+
+// Test -webhook and -webhook-on are validated before the run
+func TestRun_WebhookInvalid(t *testing.T) {
+	t.Setenv("FASTMAIL_AAR_KEY", "test-key")
+	for _, args := range [][]string{
+		{"-webhook", "ftp://example.com/hook"},
+		{"-webhook", "http://example.com/hook", "-webhook-on", "sometimes"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(args, nil, &stdout, &stderr); code != exitConfig {
+			t.Errorf("%v: expected exit code %d, got %d", args, exitConfig, code)
+		}
+	}
+}